@@ -11,7 +11,9 @@ package api
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/url"
+	"strings"
 )
 
 // ConfigureAuthRealmRequest is a request to /configureAuthRealm
@@ -52,6 +54,16 @@ type ConfigureServiceRequest struct {
 	Config json.RawMessage
 }
 
+// MoveServiceRequest is a request to /moveService
+type MoveServiceRequest struct {
+	// The ID of the service to move.
+	ID string
+	// The user ID of the configured client to move the service to.
+	UserID string
+	// True to make the old client leave the rooms which the service refers to.
+	LeaveOldRooms bool
+}
+
 // A ClientConfig contains the configuration information for a matrix client so that
 // Go-NEB can drive it. It forms the HTTP body to /configureClient requests.
 type ClientConfig struct {
@@ -85,12 +97,52 @@ type Session struct {
 	Config    json.RawMessage
 }
 
+// A RoomGroup is a named set of rooms. It forms the HTTP body to /configureRoomGroup requests.
+//
+// Service configs can refer to a room group as "group:<Name>" in place of a room ID. When used as a key,
+// e.g. in the "Rooms" map of a service, each room in the group gets a copy of the value. When used in a list
+// of rooms, the reference is replaced by each room in the group. If the group changes, every service which
+// refers to it is registered again with the new rooms.
+type RoomGroup struct {
+	// The name of the room group, e.g. "ops".
+	Name string
+	// The room IDs in the group.
+	Rooms []string
+}
+
+// A Tenant is a team which shares the Go-NEB deployment with other teams. It forms the HTTP body to
+// /configureTenant requests.
+//
+// Admin API requests made with a tenant's access token can only see and change the services, clients
+// and realms which the tenant owns. Resources are owned by the tenant which created them.
+type Tenant struct {
+	// An arbitrary unique identifier for this tenant, e.g. "ops".
+	ID string
+	// The access token the tenant uses for admin API requests, sent as "Authorization: Bearer <token>".
+	// Only a hash of the token is stored, so it is never returned.
+	AccessToken string `json:",omitempty"`
+	// The limits on what the tenant can configure.
+	Quotas TenantQuotas
+}
+
+// TenantQuotas are the limits on what a tenant can configure. Zero means no limit.
+type TenantQuotas struct {
+	// The maximum number of services the tenant can own.
+	MaxServices int
+	// The maximum number of feeds which the services of the tenant can read, e.g. RSS feeds.
+	MaxFeeds int
+	// The maximum number of incoming webhook requests per minute across all services of the tenant.
+	// Requests over the limit are rejected with HTTP 429.
+	MaxWebhooksPerMinute int
+}
+
 // ConfigFile represents config.sample.yaml
 type ConfigFile struct {
-	Clients  []ClientConfig
-	Realms   []ConfigureAuthRealmRequest
-	Services []ConfigureServiceRequest
-	Sessions []Session
+	Clients    []ClientConfig
+	Realms     []ConfigureAuthRealmRequest
+	Services   []ConfigureServiceRequest
+	Sessions   []Session
+	RoomGroups []RoomGroup `json:"room_groups"`
 }
 
 // Check validates the /configureService request
@@ -101,6 +153,14 @@ func (c *ConfigureServiceRequest) Check() error {
 	return nil
 }
 
+// Check validates the /moveService request
+func (c *MoveServiceRequest) Check() error {
+	if c.ID == "" || c.UserID == "" {
+		return errors.New(`Must supply an "ID" and a "UserID"`)
+	}
+	return nil
+}
+
 // Check validates the /configureAuthRealm request
 func (c *ConfigureAuthRealmRequest) Check() error {
 	if c.ID == "" || c.Type == "" || c.Config == nil {
@@ -135,3 +195,30 @@ func (r *RequestAuthSessionRequest) Check() error {
 	}
 	return nil
 }
+
+// Check that the room group is valid.
+func (g *RoomGroup) Check() error {
+	if g.Name == "" || strings.ContainsAny(g.Name, " \t\n") {
+		return errors.New(`Must supply a "Name" without whitespace`)
+	}
+	for _, roomID := range g.Rooms {
+		if !strings.HasPrefix(roomID, "!") {
+			return fmt.Errorf(`"Rooms" must only contain room IDs, got %q`, roomID)
+		}
+	}
+	return nil
+}
+
+// Check that the tenant is valid.
+func (t *Tenant) Check() error {
+	if t.ID == "" || strings.ContainsAny(t.ID, " \t\n") {
+		return errors.New(`Must supply an "ID" without whitespace`)
+	}
+	if t.AccessToken == "" {
+		return errors.New(`Must supply an "AccessToken"`)
+	}
+	if t.Quotas.MaxServices < 0 || t.Quotas.MaxFeeds < 0 || t.Quotas.MaxWebhooksPerMinute < 0 {
+		return errors.New(`"Quotas" must not be negative`)
+	}
+	return nil
+}
@@ -64,6 +64,12 @@ func (h *RequestAuthSession) OnIncomingRequest(req *http.Request) util.JSONRespo
 		logger.WithError(err).Info("Failed to LoadAuthRealm")
 		return util.MessageResponse(400, "Unknown RealmID")
 	}
+	if ok, err := canAccess(h.Db, req, database.ResourceRealm, body.RealmID); err != nil {
+		logger.WithError(err).Error("Failed to LoadResourceOwner")
+		return util.MessageResponse(500, "Failed to load realm")
+	} else if !ok {
+		return util.MessageResponse(400, "Unknown RealmID")
+	}
 
 	response := realm.RequestAuthSession(body.UserID, body.Config)
 	if response == nil {
@@ -122,6 +128,12 @@ func (h *RemoveAuthSession) OnIncomingRequest(req *http.Request) util.JSONRespon
 	if err != nil {
 		return util.MessageResponse(400, "Unknown RealmID")
 	}
+	if ok, err := canAccess(h.Db, req, database.ResourceRealm, body.RealmID); err != nil {
+		logger.WithError(err).Error("Failed to LoadResourceOwner")
+		return util.MessageResponse(500, "Failed to remove auth session")
+	} else if !ok {
+		return util.MessageResponse(400, "Unknown RealmID")
+	}
 
 	if err := h.Db.RemoveAuthSession(body.RealmID, body.UserID); err != nil {
 		logger.WithError(err).Error("Failed to RemoveAuthSession")
@@ -217,15 +229,25 @@ func (h *ConfigureAuthRealm) OnIncomingRequest(req *http.Request) util.JSONRespo
 		return util.MessageResponse(400, "Error parsing config JSON")
 	}
 
+	if res := h.checkOwner(req, body.ID); res != nil {
+		return *res
+	}
+
 	if err = realm.Register(); err != nil {
 		return util.MessageResponse(400, "Error registering auth realm")
 	}
 
 	oldRealm, err := h.Db.StoreAuthRealm(realm)
-	if err != nil {
+	if _, ok := err.(*database.DependencyError); ok {
+		return util.MessageResponse(400, err.Error())
+	} else if err != nil {
 		logger.WithError(err).Error("Failed to StoreAuthRealm")
 		return util.MessageResponse(500, "Error storing realm")
 	}
+	if err := claim(h.Db, req, database.ResourceRealm, body.ID); err != nil {
+		logger.WithError(err).Error("Failed to StoreResourceOwner")
+		return util.MessageResponse(500, "Error storing realm")
+	}
 
 	return util.JSONResponse{
 		Code: 200,
@@ -238,6 +260,86 @@ func (h *ConfigureAuthRealm) OnIncomingRequest(req *http.Request) util.JSONRespo
 	}
 }
 
+// checkOwner returns an error response if the realm exists and is owned by a tenant other than the one
+// making the request.
+func (h *ConfigureAuthRealm) checkOwner(req *http.Request, realmID string) *util.JSONResponse {
+	logger := util.GetLogger(req.Context())
+	_, err := h.Db.LoadAuthRealm(realmID)
+	if err != nil && err != sql.ErrNoRows {
+		logger.WithError(err).Error("Failed to LoadAuthRealm")
+		res := util.MessageResponse(500, "Error loading old realm")
+		return &res
+	}
+	if ok, err := canConfigure(h.Db, req, database.ResourceRealm, realmID, err == nil); err != nil {
+		logger.WithError(err).Error("Failed to LoadResourceOwner")
+		res := util.MessageResponse(500, "Error loading old realm")
+		return &res
+	} else if !ok {
+		res := util.MessageResponse(403, "Realm is owned by another tenant")
+		return &res
+	}
+	return nil
+}
+
+// RemoveAuthRealm represents an HTTP handler capable of processing /admin/removeAuthRealm requests.
+type RemoveAuthRealm struct {
+	Db *database.ServiceDB
+}
+
+// OnIncomingRequest handles POST requests to /admin/removeAuthRealm.
+//
+// The JSON object MUST contain the key "ID" to identify the realm to remove. This will
+// return HTTP 400 if any auth sessions or services still use the realm.
+//
+// Request:
+//  POST /admin/removeAuthRealm
+//  {
+//      "ID": "my-realm-id"
+//  }
+// Response:
+//  HTTP/1.1 200 OK
+//  {}
+func (h *RemoveAuthRealm) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	logger := util.GetLogger(req.Context())
+	if req.Method != "POST" {
+		return util.MessageResponse(405, "Unsupported Method")
+	}
+	var body struct {
+		ID string
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return util.MessageResponse(400, "Error parsing request JSON")
+	}
+	logger.WithField("realm_id", body.ID).Print("Incoming remove auth realm request")
+
+	if body.ID == "" {
+		return util.MessageResponse(400, `Must supply an "ID"`)
+	}
+
+	if _, err := h.Db.LoadAuthRealm(body.ID); err != nil {
+		return util.MessageResponse(400, "Unknown realm ID")
+	}
+	if ok, err := canAccess(h.Db, req, database.ResourceRealm, body.ID); err != nil {
+		logger.WithError(err).Error("Failed to LoadResourceOwner")
+		return util.MessageResponse(500, "Failed to remove auth realm")
+	} else if !ok {
+		return util.MessageResponse(400, "Unknown realm ID")
+	}
+
+	err := h.Db.DeleteAuthRealm(body.ID)
+	if _, ok := err.(*database.DependencyError); ok {
+		return util.MessageResponse(400, err.Error())
+	} else if err != nil {
+		logger.WithError(err).Error("Failed to DeleteAuthRealm")
+		return util.MessageResponse(500, "Failed to remove auth realm")
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct{}{},
+	}
+}
+
 // GetSession represents an HTTP handler capable of processing /admin/getSession requests.
 type GetSession struct {
 	Db *database.ServiceDB
@@ -285,6 +387,12 @@ func (h *GetSession) OnIncomingRequest(req *http.Request) util.JSONResponse {
 	if body.RealmID == "" || body.UserID == "" {
 		return util.MessageResponse(400, `Must supply a "RealmID" and "UserID"`)
 	}
+	if ok, err := canAccess(h.Db, req, database.ResourceRealm, body.RealmID); err != nil {
+		logger.WithError(err).Error("Failed to LoadResourceOwner")
+		return util.MessageResponse(500, `Failed to load session`)
+	} else if !ok {
+		return util.MessageResponse(400, "Unknown RealmID")
+	}
 
 	session, err := h.Db.LoadAuthSessionByUser(body.RealmID, body.UserID)
 	if err != nil && err != sql.ErrNoRows {
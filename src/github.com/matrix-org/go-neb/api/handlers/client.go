@@ -1,16 +1,19 @@
 package handlers
 
 import (
+	"database/sql"
 	"encoding/json"
 	"net/http"
 
 	"github.com/matrix-org/go-neb/api"
 	"github.com/matrix-org/go-neb/clients"
+	"github.com/matrix-org/go-neb/database"
 	"github.com/matrix-org/util"
 )
 
 // ConfigureClient represents an HTTP handler capable of processing /admin/configureClient requests.
 type ConfigureClient struct {
+	Db      *database.ServiceDB
 	Clients *clients.Clients
 }
 
@@ -53,11 +56,27 @@ func (s *ConfigureClient) OnIncomingRequest(req *http.Request) util.JSONResponse
 		return util.MessageResponse(400, "Error parsing client config")
 	}
 
+	_, err := s.Db.LoadMatrixClientConfig(body.UserID)
+	if err != nil && err != sql.ErrNoRows {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to LoadMatrixClientConfig")
+		return util.MessageResponse(500, "Error loading old client")
+	}
+	if ok, err := canConfigure(s.Db, req, database.ResourceClient, body.UserID, err == nil); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to LoadResourceOwner")
+		return util.MessageResponse(500, "Error loading old client")
+	} else if !ok {
+		return util.MessageResponse(403, "Client is owned by another tenant")
+	}
+
 	oldClient, err := s.Clients.Update(body)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).WithField("body", body).Error("Failed to Clients.Update")
 		return util.MessageResponse(500, "Error storing token")
 	}
+	if err := claim(s.Db, req, database.ResourceClient, body.UserID); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to StoreResourceOwner")
+		return util.MessageResponse(500, "Error storing token")
+	}
 
 	return util.JSONResponse{
 		Code: 200,
@@ -67,3 +86,56 @@ func (s *ConfigureClient) OnIncomingRequest(req *http.Request) util.JSONResponse
 		}{oldClient, body},
 	}
 }
+
+// RemoveClient represents an HTTP handler capable of processing /admin/removeClient requests.
+type RemoveClient struct {
+	Db      *database.ServiceDB
+	Clients *clients.Clients
+}
+
+// OnIncomingRequest handles POST requests to /admin/removeClient.
+//
+// The JSON object MUST contain the key "UserID" to identify the client to remove. This will
+// return HTTP 400 if any services still use the client: they must be removed first.
+//
+// Request:
+//  POST /admin/removeClient
+//  {
+//      "UserID": "@my_bot:localhost"
+//  }
+// Response:
+//  HTTP/1.1 200 OK
+//  {}
+func (s *RemoveClient) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	if req.Method != "POST" {
+		return util.MessageResponse(405, "Unsupported Method")
+	}
+	var body struct {
+		UserID string
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return util.MessageResponse(400, "Error parsing request JSON")
+	}
+	if body.UserID == "" {
+		return util.MessageResponse(400, `Must supply a "UserID"`)
+	}
+	if ok, err := canAccess(s.Db, req, database.ResourceClient, body.UserID); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to LoadResourceOwner")
+		return util.MessageResponse(500, "Error removing client")
+	} else if !ok {
+		return util.MessageResponse(404, "Client not found")
+	}
+
+	if err := s.Clients.Remove(body.UserID); err != nil {
+		if _, ok := err.(*database.DependencyError); ok {
+			return util.MessageResponse(400, err.Error())
+		}
+		util.GetLogger(req.Context()).WithError(err).WithField("body", body).Error("Failed to Clients.Remove")
+		return util.MessageResponse(500, "Error removing client")
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct{}{},
+	}
+}
@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/matrix-org/go-neb/clients"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/util"
+)
+
+// Doctor represents an HTTP handler capable of processing /admin/doctor requests.
+type Doctor struct {
+	Db      *database.ServiceDB
+	Clients *clients.Clients
+}
+
+// OnIncomingRequest handles POST requests to /admin/doctor.
+//
+// This reports stored entries which refer to clients or auth realms that no longer exist.
+// If "Cleanup" is true, services without a client, sessions without a realm and bot
+// options without a client are removed. Services which refer to missing realms or which
+// cannot be loaded are only reported, as they need to be reconfigured or removed by hand.
+// The response is always the report of what was found before any cleanup. This covers every
+// tenant, so it requires the admin token.
+//
+// Request:
+//  POST /admin/doctor
+//  {
+//      "Cleanup": false
+//  }
+// Response:
+//  HTTP/1.1 200 OK
+//  {
+//      "ServicesWithoutClient": [
+//          {
+//              "ServiceID": "github_service",
+//              "ServiceType": "github",
+//              "ServiceUserID": "@removed_bot:localhost"
+//          }
+//      ],
+//      "ServicesWithoutRealm": null,
+//      "UnloadableServices": null,
+//      "SessionsWithoutRealm": null,
+//      "BotOptionsWithoutClient": null
+//  }
+func (h *Doctor) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	if req.Method != "POST" {
+		return util.MessageResponse(405, "Unsupported Method")
+	}
+	if res := requireAdmin(req); res != nil {
+		return *res
+	}
+	var body struct {
+		Cleanup bool
+	}
+	if req.ContentLength != 0 {
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			return util.MessageResponse(400, "Error parsing request JSON")
+		}
+	}
+
+	var report database.OrphanReport
+	var err error
+	if body.Cleanup {
+		report, err = h.Db.RemoveOrphans()
+		if err == nil {
+			for _, srv := range report.ServicesWithoutClient {
+				h.Clients.ServiceDeleted(srv.ServiceID)
+			}
+		}
+	} else {
+		report, err = h.Db.FindOrphans()
+	}
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to check for orphans")
+		return util.MessageResponse(500, "Failed to check storage")
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: report,
+	}
+}
@@ -0,0 +1,231 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/api"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+	"github.com/matrix-org/util"
+)
+
+// MoveService represents an HTTP handler which can process /admin/moveService requests.
+type MoveService struct {
+	ConfigureService *ConfigureService
+}
+
+// OnIncomingRequest handles POST requests to /admin/moveService.
+//
+// The service with the given "ID" is moved to the client with the given "UserID", which
+// must already be configured. The service keeps its config and any state it has stored,
+// and its webhook URL does not change. Any room groups and spaces which its config refers
+// to are expanded again, with spaces as seen by the new client. The service is registered
+// again with the new client, which then joins every room which the service refers to. If
+// "LeaveOldRooms" is true, the old client leaves those rooms, except any which the new
+// client failed to join and any which the old client's other services still refer to.
+//
+// Request:
+//  POST /admin/moveService
+//  {
+//      "ID": "my_service_id",
+//      "UserID": "@my_new_bot:localhost",
+//      "LeaveOldRooms": true
+//  }
+// Response:
+//  HTTP/1.1 200 OK
+//  {
+//      "ID": "my_service_id",
+//      "Type": "rssbot",
+//      "OldUserID": "@my_bot:localhost",
+//      "NewUserID": "@my_new_bot:localhost",
+//      "JoinedRooms": ["!qmElAGdFYCHoCJuaNt:localhost"],
+//      "LeftRooms": ["!qmElAGdFYCHoCJuaNt:localhost"],
+//      "FailedRooms": {
+//          "!ewfug483gsfe:localhost": "Failed to join: HTTP 403"
+//      }
+//  }
+func (h *MoveService) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	logger := util.GetLogger(req.Context())
+	if req.Method != "POST" {
+		return util.MessageResponse(405, "Unsupported Method")
+	}
+	var body api.MoveServiceRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return util.MessageResponse(400, "Error parsing request JSON")
+	}
+	if err := body.Check(); err != nil {
+		return util.MessageResponse(400, err.Error())
+	}
+
+	s := h.ConfigureService
+	mut := s.getMutexForServiceID(body.ID)
+	mut.Lock()
+	defer mut.Unlock()
+
+	old, code, err := s.loadAccessibleService(req, body.ID, logger)
+	if err != nil {
+		return util.MessageResponse(code, err.Error())
+	}
+	if old.ServiceUserID() == body.UserID {
+		return util.MessageResponse(400, "Service already uses this client")
+	}
+	logger = logger.WithFields(log.Fields{
+		"service_id":          old.ServiceID(),
+		"service_type":        old.ServiceType(),
+		"old_service_user_id": old.ServiceUserID(),
+		"new_service_user_id": body.UserID,
+	})
+	logger.Print("Incoming move service request")
+
+	// Create the stored service again for the new client, so that it keeps its state. If its config
+	// referred to room groups or spaces, they are expanded again so that spaces are seen by the new client.
+	config, err := s.db.LoadServiceConfig(body.ID)
+	if err != nil && err != sql.ErrNoRows {
+		logger.WithError(err).Error("Failed to LoadServiceConfig")
+		return util.MessageResponse(500, "Failed to load service")
+	}
+	service, spaces, err := s.rebuildService(old, body.UserID, config)
+	if err != nil {
+		return util.MessageResponse(400, err.Error())
+	}
+
+	if code, err := s.checkTenant(req, service, true); err != nil {
+		return util.MessageResponse(code, err.Error())
+	}
+	if _, code, err := s.registerService(service, old, config, spaces, logger); err != nil {
+		return util.MessageResponse(code, err.Error())
+	}
+
+	serviceJSON, err := json.Marshal(service)
+	if err != nil {
+		logger.WithError(err).Error("Failed to marshal service")
+		return util.MessageResponse(500, "Failed to move service")
+	}
+	joined, left, failed := s.moveRooms(old.ServiceUserID(), body.UserID, types.RoomIDs(service.ServiceType(), serviceJSON), body.LeaveOldRooms, logger)
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct {
+			ID          string
+			Type        string
+			OldUserID   string
+			NewUserID   string
+			JoinedRooms []string
+			LeftRooms   []string
+			FailedRooms map[string]string
+		}{service.ServiceID(), service.ServiceType(), old.ServiceUserID(), body.UserID, joined, left, failed},
+	}
+}
+
+// loadAccessibleService loads the service with the ID, if the request can access it. Returns an HTTP
+// status code and an error if it can't be loaded.
+func (s *ConfigureService) loadAccessibleService(req *http.Request, serviceID string, logger *log.Entry) (types.Service, int, error) {
+	service, err := s.db.LoadService(serviceID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, 404, errors.New("Service not found")
+		}
+		logger.WithError(err).Error("Failed to LoadService")
+		return nil, 500, errors.New("Failed to load service")
+	}
+	if ok, err := canAccess(s.db, req, database.ResourceService, serviceID); err != nil {
+		logger.WithError(err).Error("Failed to LoadResourceOwner")
+		return nil, 500, errors.New("Failed to load service")
+	} else if !ok {
+		return nil, 404, errors.New("Service not found")
+	}
+	return service, 200, nil
+}
+
+// moveRooms makes the client with the new user ID join the rooms, and if leave is true, makes the client
+// with the old user ID leave those which the new client joined and none of its services refer to.
+// Returns the rooms joined and left, and the rooms which could not be joined or left mapped to the reason.
+func (s *ConfigureService) moveRooms(oldUserID, newUserID string, roomIDs []string, leave bool, logger *log.Entry) (joined, left []string, failed map[string]string) {
+	joined = []string{}
+	left = []string{}
+	failed = make(map[string]string)
+	newClient, err := s.clients.Client(newUserID)
+	if err != nil {
+		// registerService has just used the client, so this should never happen.
+		for _, roomID := range roomIDs {
+			failed[roomID] = fmt.Sprintf("Failed to join: %s", err)
+		}
+		return
+	}
+	joined = joinRooms(newClient, roomIDs, failed, logger)
+	if !leave || len(joined) == 0 {
+		return
+	}
+	left = s.leaveUnusedRooms(oldUserID, joined, failed, logger)
+	return
+}
+
+// joinRooms makes the client join the rooms. Returns the rooms joined, and adds those which could not be
+// joined to failed, mapped to the reason.
+func joinRooms(cli *gomatrix.Client, roomIDs []string, failed map[string]string, logger *log.Entry) []string {
+	joined := []string{}
+	for _, roomID := range roomIDs {
+		if _, err := cli.JoinRoom(roomID, "", nil); err != nil {
+			logger.WithError(err).WithField("room_id", roomID).Warn("Failed to join room")
+			failed[roomID] = fmt.Sprintf("Failed to join: %s", err)
+			continue
+		}
+		joined = append(joined, roomID)
+	}
+	return joined
+}
+
+// leaveUnusedRooms makes the client with the user ID leave the rooms which none of its services refer to.
+// Returns the rooms left, and adds those which could not be left to failed, mapped to the reason.
+func (s *ConfigureService) leaveUnusedRooms(userID string, roomIDs []string, failed map[string]string, logger *log.Entry) []string {
+	left := []string{}
+	cli, err := s.clients.Client(userID)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to load old client to leave rooms")
+		for _, roomID := range roomIDs {
+			failed[roomID] = fmt.Sprintf("Failed to leave: %s", err)
+		}
+		return left
+	}
+	services, err := s.db.LoadServicesForUser(userID)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to LoadServicesForUser")
+		for _, roomID := range roomIDs {
+			failed[roomID] = "Failed to leave: Error loading the old client's services"
+		}
+		return left
+	}
+	inUse := serviceRooms(services)
+	for _, roomID := range roomIDs {
+		if inUse[roomID] {
+			continue
+		}
+		if _, err := cli.SendJSON("POST", cli.BuildURL("rooms", roomID, "leave"), struct{}{}); err != nil {
+			logger.WithError(err).WithField("room_id", roomID).Warn("Failed to leave room")
+			failed[roomID] = fmt.Sprintf("Failed to leave: %s", err)
+			continue
+		}
+		left = append(left, roomID)
+	}
+	return left
+}
+
+// serviceRooms returns the set of rooms which the services refer to.
+func serviceRooms(services []types.Service) map[string]bool {
+	inUse := make(map[string]bool)
+	for _, srv := range services {
+		b, err := json.Marshal(srv)
+		if err != nil {
+			continue
+		}
+		for _, roomID := range types.RoomIDs(srv.ServiceType(), b) {
+			inUse[roomID] = true
+		}
+	}
+	return inUse
+}
@@ -0,0 +1,219 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/api"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/util"
+)
+
+// ConfigureRoomGroup represents an HTTP handler which can process /admin/configureRoomGroup requests.
+type ConfigureRoomGroup struct {
+	Db               *database.ServiceDB
+	ConfigureService *ConfigureService
+}
+
+// OnIncomingRequest handles POST requests to /admin/configureRoomGroup. The JSON object
+// provided is of type "api.RoomGroup".
+//
+// Every service whose config refers to the room group is registered again with the new
+// rooms, as if its config had been sent to /admin/configureService again. Services which
+// fail to register keep their old config and are listed in "Failed". Room groups are shared
+// by every tenant, so this requires the admin token.
+//
+// Request:
+//  POST /admin/configureRoomGroup
+//  {
+//      "Name": "ops",
+//      "Rooms": ["!qmElAGdFYCHoCJuaNt:localhost", "!ewfug483gsfe:localhost"]
+//  }
+// Response:
+//  HTTP/1.1 200 OK
+//  {
+//      "Name": "ops",
+//      "OldRooms": ["!qmElAGdFYCHoCJuaNt:localhost"],
+//      "NewRooms": ["!qmElAGdFYCHoCJuaNt:localhost", "!ewfug483gsfe:localhost"],
+//      "Registered": ["alertmanager_service"],
+//      "Failed": {
+//          "travis_service": "Failed to register service: ..."
+//      }
+//  }
+func (h *ConfigureRoomGroup) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	logger := util.GetLogger(req.Context())
+	if req.Method != "POST" {
+		return util.MessageResponse(405, "Unsupported Method")
+	}
+	if res := requireAdmin(req); res != nil {
+		return *res
+	}
+	var body api.RoomGroup
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return util.MessageResponse(400, "Error parsing request JSON")
+	}
+	if err := body.Check(); err != nil {
+		return util.MessageResponse(400, err.Error())
+	}
+	logger.WithFields(log.Fields{
+		"group": body.Name,
+		"rooms": body.Rooms,
+	}).Print("Incoming configure room group request")
+
+	old, err := h.Db.StoreRoomGroup(body)
+	if err != nil {
+		logger.WithError(err).Error("Failed to StoreRoomGroup")
+		return util.MessageResponse(500, "Error storing room group")
+	}
+
+	serviceIDs, err := h.Db.LoadServiceIDsForRoomGroup(body.Name)
+	if err != nil {
+		logger.WithError(err).Error("Failed to LoadServiceIDsForRoomGroup")
+		return util.MessageResponse(500, "Error loading services for room group")
+	}
+	registered := []string{}
+	failed := make(map[string]string)
+	for _, serviceID := range serviceIDs {
+		serviceLogger := logger.WithField("service_id", serviceID)
+		if err := h.ConfigureService.reregisterService(serviceID, serviceLogger); err != nil {
+			serviceLogger.WithError(err).Warn("Failed to register service for changed room group")
+			failed[serviceID] = err.Error()
+			continue
+		}
+		registered = append(registered, serviceID)
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct {
+			Name       string
+			OldRooms   []string
+			NewRooms   []string
+			Registered []string
+			Failed     map[string]string
+		}{body.Name, old.Rooms, body.Rooms, registered, failed},
+	}
+}
+
+// GetRoomGroup represents an HTTP handler which can process /admin/getRoomGroup requests.
+type GetRoomGroup struct {
+	Db *database.ServiceDB
+}
+
+// OnIncomingRequest handles POST requests to /admin/getRoomGroup.
+//
+// The request body MUST be a JSON body which has a "Name" key which represents
+// the room group to get. The response lists the services which refer to the group, or only
+// those which the tenant owns if the request was made by a tenant.
+//
+// Request:
+//  POST /admin/getRoomGroup
+//  {
+//      "Name": "ops"
+//  }
+// Response:
+//  HTTP/1.1 200 OK
+//  {
+//      "Name": "ops",
+//      "Rooms": ["!qmElAGdFYCHoCJuaNt:localhost"],
+//      "Services": ["alertmanager_service"]
+//  }
+func (h *GetRoomGroup) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	if req.Method != "POST" {
+		return util.MessageResponse(405, "Unsupported Method")
+	}
+	var body struct {
+		Name string
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return util.MessageResponse(400, "Error parsing request JSON")
+	}
+	if body.Name == "" {
+		return util.MessageResponse(400, `Must supply a "Name"`)
+	}
+
+	group, err := h.Db.LoadRoomGroup(body.Name)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return util.MessageResponse(404, `Room group not found`)
+		}
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to LoadRoomGroup")
+		return util.MessageResponse(500, `Failed to load room group`)
+	}
+	serviceIDs, err := h.Db.LoadServiceIDsForRoomGroup(body.Name)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to LoadServiceIDsForRoomGroup")
+		return util.MessageResponse(500, `Failed to load room group`)
+	}
+	visible := []string{}
+	for _, serviceID := range serviceIDs {
+		ok, err := canAccess(h.Db, req, database.ResourceService, serviceID)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("Failed to LoadResourceOwner")
+			return util.MessageResponse(500, `Failed to load room group`)
+		}
+		if ok {
+			visible = append(visible, serviceID)
+		}
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct {
+			Name     string
+			Rooms    []string
+			Services []string
+		}{group.Name, group.Rooms, visible},
+	}
+}
+
+// RemoveRoomGroup represents an HTTP handler which can process /admin/removeRoomGroup requests.
+type RemoveRoomGroup struct {
+	Db *database.ServiceDB
+}
+
+// OnIncomingRequest handles POST requests to /admin/removeRoomGroup.
+//
+// The JSON object MUST contain the key "Name" to identify the room group to remove. This will
+// return HTTP 400 if any services still refer to the group. This requires the admin token.
+//
+// Request:
+//  POST /admin/removeRoomGroup
+//  {
+//      "Name": "ops"
+//  }
+// Response:
+//  HTTP/1.1 200 OK
+//  {}
+func (h *RemoveRoomGroup) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	if req.Method != "POST" {
+		return util.MessageResponse(405, "Unsupported Method")
+	}
+	if res := requireAdmin(req); res != nil {
+		return *res
+	}
+	var body struct {
+		Name string
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return util.MessageResponse(400, "Error parsing request JSON")
+	}
+	if body.Name == "" {
+		return util.MessageResponse(400, `Must supply a "Name"`)
+	}
+
+	err := h.Db.DeleteRoomGroup(body.Name)
+	if _, ok := err.(*database.DependencyError); ok {
+		return util.MessageResponse(400, err.Error())
+	} else if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to DeleteRoomGroup")
+		return util.MessageResponse(500, "Failed to remove room group")
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct{}{},
+	}
+}
@@ -81,7 +81,7 @@ func (s *ConfigureService) OnIncomingRequest(req *http.Request) util.JSONRespons
 		return util.MessageResponse(405, "Unsupported Method")
 	}
 
-	service, httpErr := s.createService(req)
+	service, config, spaces, httpErr := s.createService(req)
 	if httpErr != nil {
 		return *httpErr
 	}
@@ -103,25 +103,125 @@ func (s *ConfigureService) OnIncomingRequest(req *http.Request) util.JSONRespons
 		return util.MessageResponse(500, "Error loading old service")
 	}
 
+	if code, err := s.checkTenant(req, service, old != nil); err != nil {
+		return util.MessageResponse(code, err.Error())
+	}
+
+	oldService, code, err := s.registerService(service, old, config, spaces, logger)
+	if err != nil {
+		return util.MessageResponse(code, err.Error())
+	}
+	if err := claim(s.db, req, database.ResourceService, service.ServiceID()); err != nil {
+		logger.WithError(err).Error("Failed to StoreResourceOwner")
+		return util.MessageResponse(500, "Error storing service")
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct {
+			ID        string
+			Type      string
+			OldConfig types.Service
+			NewConfig types.Service
+		}{service.ServiceID(), service.ServiceType(), withoutSecrets(oldService), withoutSecrets(service)},
+	}
+}
+
+// checkTenant checks that the tenant which made the request, if any, owns the service if it exists
+// along with the client and realms it uses, and that the tenant's quotas allow it. Returns an error
+// along with the HTTP status code to respond with.
+func (s *ConfigureService) checkTenant(req *http.Request, service types.Service, exists bool) (int, error) {
+	tenant := requestTenant(req)
+	if tenant == nil {
+		return 200, nil
+	}
+	ok, err := canConfigure(s.db, req, database.ResourceService, service.ServiceID(), exists)
+	if err != nil {
+		return 500, fmt.Errorf("Error loading service owner")
+	} else if !ok {
+		return 403, fmt.Errorf("Service is owned by another tenant")
+	}
+	if ok, err = canAccess(s.db, req, database.ResourceClient, service.ServiceUserID()); err != nil {
+		return 500, fmt.Errorf("Error loading client owner")
+	} else if !ok {
+		return 403, fmt.Errorf("Matrix client is not owned by this tenant")
+	}
+	if code, err := s.checkDependencies(req, service); err != nil {
+		return code, err
+	}
+	return checkServiceQuotas(s.db, tenant, service)
+}
+
+// checkDependencies returns an error if the service uses other clients or realms which are not owned by
+// the tenant making the request.
+func (s *ConfigureService) checkDependencies(req *http.Request, service types.Service) (int, error) {
+	var userIDs []string
+	if dependent, isDependent := service.(types.ClientDependent); isDependent {
+		userIDs = append(userIDs, dependent.ClientUserIDs()...)
+	}
+	if sender, isSender := service.(types.FailoverSender); isSender {
+		userIDs = append(userIDs, sender.FailoverUsers()...)
+	}
+	for _, userID := range userIDs {
+		if ok, err := canAccess(s.db, req, database.ResourceClient, userID); err != nil {
+			return 500, fmt.Errorf("Error loading client owner")
+		} else if !ok {
+			return 403, fmt.Errorf("Matrix client %s is not owned by this tenant", userID)
+		}
+	}
+	if dependent, isDependent := service.(types.RealmDependent); isDependent {
+		for _, realmID := range dependent.RealmIDs() {
+			if ok, err := canAccess(s.db, req, database.ResourceRealm, realmID); err != nil {
+				return 500, fmt.Errorf("Error loading realm owner")
+			} else if !ok {
+				return 403, fmt.Errorf("Realm %s is not owned by this tenant", realmID)
+			}
+		}
+	}
+	return 200, nil
+}
+
+// registerService registers and stores the service, replacing the old service if there is one. The
+// config the service was created from is stored if it refers to room groups or spaces, so that it can
+// be registered again when they change, along with the rooms each space contained. The caller must hold
+// the mutex for the service ID. Returns the previous service, or an error along with the HTTP status
+// code to respond with.
+func (s *ConfigureService) registerService(service, old types.Service, config json.RawMessage, spaces map[string][]string, logger *log.Entry) (types.Service, int, error) {
 	client, err := s.clients.Client(service.ServiceUserID())
 	if err != nil {
-		return util.MessageResponse(400, "Unknown matrix client")
+		return nil, 400, fmt.Errorf("Unknown matrix client")
 	}
 
 	if err := checkClientForService(service, client); err != nil {
-		return util.MessageResponse(400, err.Error())
+		return nil, 400, err
+	}
+	failoverClients, err := s.failoverClients(service)
+	if err != nil {
+		return nil, 400, err
 	}
 
 	if err = service.Register(old, client); err != nil {
-		return util.MessageResponse(500, "Failed to register service: "+err.Error())
+		return nil, 500, fmt.Errorf("Failed to register service: %s", err)
 	}
 
 	oldService, err := s.db.StoreService(service)
 	if err != nil {
 		logger.WithError(err).Error("Failed to StoreService")
-		return util.MessageResponse(500, "Error storing service")
+		return nil, 500, fmt.Errorf("Error storing service")
+	}
+	if err := s.db.StoreServiceConfig(service.ServiceID(), service.ServiceType(), config); err != nil {
+		logger.WithError(err).Error("Failed to StoreServiceConfig")
+		return nil, 500, fmt.Errorf("Error storing service")
+	}
+	for space, rooms := range spaces {
+		if _, err := s.db.StoreSpaceRooms(service.ServiceUserID(), space, rooms); err != nil {
+			logger.WithError(err).Error("Failed to StoreSpaceRooms")
+			return nil, 500, fmt.Errorf("Error storing service")
+		}
 	}
 
+	s.clients.ServiceRegistered(service)
+
 	// Start any polling NOW because they may decide to stop it in PostRegister, and we want to make
 	// sure we'll actually stop.
 	if _, ok := service.(types.Poller); ok {
@@ -135,36 +235,145 @@ func (s *ConfigureService) OnIncomingRequest(req *http.Request) util.JSONRespons
 
 	service.PostRegister(old)
 	metrics.IncrementConfigureService(service.ServiceType())
+	joinFailoverClients(service, failoverClients, logger)
+	return oldService, 200, nil
+}
 
-	return util.JSONResponse{
-		Code: 200,
-		JSON: struct {
-			ID        string
-			Type      string
-			OldConfig types.Service
-			NewConfig types.Service
-		}{service.ServiceID(), service.ServiceType(), oldService, service},
+// failoverClients returns the clients named in the "failover_user_ids" of the service config, or an
+// error if any of them is not configured or is the service user.
+func (s *ConfigureService) failoverClients(service types.Service) ([]*gomatrix.Client, error) {
+	sender, ok := service.(types.FailoverSender)
+	if !ok {
+		return nil, nil
 	}
+	var clients []*gomatrix.Client
+	for _, userID := range sender.FailoverUsers() {
+		if userID == service.ServiceUserID() {
+			return nil, fmt.Errorf("The service user cannot be a failover client")
+		}
+		client, err := s.clients.Client(userID)
+		if err != nil {
+			return nil, fmt.Errorf("Unknown failover matrix client: %s", userID)
+		}
+		clients = append(clients, client)
+	}
+	return clients, nil
 }
 
-func (s *ConfigureService) createService(req *http.Request) (types.Service, *util.JSONResponse) {
+// joinFailoverClients makes the failover clients join the rooms in the service config, so that they can
+// send there when the service user can't. Rooms which they fail to join are only logged, as the service
+// user may still be able to send there.
+func joinFailoverClients(service types.Service, clients []*gomatrix.Client, logger *log.Entry) {
+	if len(clients) == 0 {
+		return
+	}
+	config, err := json.Marshal(service)
+	if err != nil {
+		return
+	}
+	for _, roomID := range types.RoomIDs(service.ServiceType(), config) {
+		for _, client := range clients {
+			if _, err := client.JoinRoom(roomID, "", nil); err != nil {
+				logger.WithError(err).WithFields(log.Fields{
+					"room_id": roomID,
+					"user_id": client.UserID,
+				}).Warn("Failover client failed to join room")
+			}
+		}
+	}
+}
+
+// reregisterService creates the service again with the room groups and spaces in its stored config
+// expanded again, and registers it. This is used when a room group or space which the service refers
+// to changes.
+func (s *ConfigureService) reregisterService(serviceID string, logger *log.Entry) error {
+	mut := s.getMutexForServiceID(serviceID)
+	mut.Lock()
+	defer mut.Unlock()
+
+	old, err := s.db.LoadService(serviceID)
+	if err != nil {
+		return err
+	}
+	config, err := s.db.LoadServiceConfig(serviceID)
+	if err != nil {
+		return err
+	}
+	service, spaces, err := s.rebuildService(old, old.ServiceUserID(), config)
+	if err != nil {
+		return err
+	}
+	_, _, err = s.registerService(service, old, config, spaces, logger)
+	return err
+}
+
+// rebuildService creates the stored service again for the client with the given user ID. The room
+// group and space references in config, the config which the service was created from, are expanded
+// again, and everything else is kept as it was stored, including any state which the service keeps
+// about itself. config is nil if the service doesn't refer to room groups or spaces. Returns the new
+// service along with the rooms of each space which was referenced.
+func (s *ConfigureService) rebuildService(old types.Service, userID string, config json.RawMessage) (types.Service, map[string][]string, error) {
+	serviceJSON, err := json.Marshal(old)
+	if err != nil {
+		return nil, nil, err
+	}
+	var spaces map[string][]string
+	if config != nil {
+		var expanded json.RawMessage
+		if expanded, spaces, err = s.expandConfig(userID, old.ServiceType(), config); err != nil {
+			return nil, nil, err
+		}
+		if serviceJSON, err = types.MergeExpanded(old.ServiceType(), serviceJSON, config, expanded); err != nil {
+			return nil, nil, err
+		}
+	}
+	service, err := types.CreateService(old.ServiceID(), old.ServiceType(), userID, serviceJSON)
+	if err != nil {
+		return nil, nil, err
+	}
+	return service, spaces, nil
+}
+
+// expandConfig replaces the room group and space references in the config of a service of the given
+// type with room IDs. Spaces are expanded as seen by the client with the given user ID. Returns the
+// expanded config along with the rooms of each space which was referenced.
+func (s *ConfigureService) expandConfig(userID, serviceType string, config json.RawMessage) (json.RawMessage, map[string][]string, error) {
+	expanded, _, err := s.db.ExpandRoomGroups(serviceType, config)
+	if err != nil {
+		return nil, nil, err
+	}
+	return s.clients.ExpandSpaces(userID, serviceType, expanded)
+}
+
+func (s *ConfigureService) createService(req *http.Request) (types.Service, json.RawMessage, map[string][]string, *util.JSONResponse) {
 	var body api.ConfigureServiceRequest
 	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
 		res := util.MessageResponse(400, "Error parsing request JSON")
-		return nil, &res
+		return nil, nil, nil, &res
 	}
 
 	if err := body.Check(); err != nil {
 		res := util.MessageResponse(400, err.Error())
-		return nil, &res
+		return nil, nil, nil, &res
 	}
 
-	service, err := types.CreateService(body.ID, body.Type, body.UserID, body.Config)
+	if types.ServiceTypeRegistered(body.Type) && !types.ServiceTypeEnabled(body.Type) {
+		res := util.MessageResponse(400, fmt.Sprintf("Service type '%s' is disabled", body.Type))
+		return nil, nil, nil, &res
+	}
+
+	config, spaces, err := s.expandConfig(body.UserID, body.Type, body.Config)
+	if err != nil {
+		res := util.MessageResponse(400, err.Error())
+		return nil, nil, nil, &res
+	}
+
+	service, err := types.CreateService(body.ID, body.Type, body.UserID, config)
 	if err != nil {
 		res := util.MessageResponse(400, "Error parsing config JSON")
-		return nil, &res
+		return nil, nil, nil, &res
 	}
-	return service, nil
+	return service, body.Config, spaces, nil
 }
 
 // GetService represents an HTTP handler which can process /admin/getService requests.
@@ -189,6 +398,14 @@ type GetService struct {
 //      "Type": "github",
 //      "Config": {
 //          // service-specific config information
+//      },
+//      "SendFailovers": {
+//          // rooms which the service user couldn't send to the last time it tried
+//          "!qmElAGdFYCHoCJuaNt:localhost": {
+//              "Time": "2017-01-01T12:00:00Z",
+//              "UserID": "@my_backup_bot:localhost",
+//              "Reason": "HTTP 429"
+//          }
 //      }
 //  }
 func (h *GetService) OnIncomingRequest(req *http.Request) util.JSONResponse {
@@ -214,15 +431,31 @@ func (h *GetService) OnIncomingRequest(req *http.Request) util.JSONResponse {
 		util.GetLogger(req.Context()).WithError(err).Error("Failed to LoadService")
 		return util.MessageResponse(500, `Failed to load service`)
 	}
+	if ok, err := canAccess(h.Db, req, database.ResourceService, body.ID); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to LoadResourceOwner")
+		return util.MessageResponse(500, `Failed to load service`)
+	} else if !ok {
+		return util.MessageResponse(404, `Service not found`)
+	}
 
 	return util.JSONResponse{
 		Code: 200,
 		JSON: struct {
-			ID     string
-			Type   string
-			Config types.Service
-		}{srv.ServiceID(), srv.ServiceType(), srv},
+			ID            string
+			Type          string
+			Config        types.Service
+			SendFailovers map[string]metrics.SendFailover
+		}{srv.ServiceID(), srv.ServiceType(), withoutSecrets(srv), metrics.SendFailovers(srv.ServiceID())},
+	}
+}
+
+// withoutSecrets returns the service to include in an admin API response, without any secrets which
+// Go-NEB generated for it.
+func withoutSecrets(service types.Service) types.Service {
+	if hider, ok := service.(types.SecretHider); ok {
+		return hider.WithoutSecrets()
 	}
+	return service
 }
 
 func checkClientForService(service types.Service, client *gomatrix.Client) error {
@@ -240,3 +473,78 @@ func checkClientForService(service types.Service, client *gomatrix.Client) error
 	}
 	return nil
 }
+
+// TestService represents an HTTP handler which can process /admin/testService requests.
+type TestService struct {
+	Db      *database.ServiceDB
+	Clients *clients.Clients
+}
+
+// OnIncomingRequest handles POST requests to /admin/testService.
+//
+// The request body MUST be a JSON body which has an "ID" key which represents
+// the service ID to test. Representative sample webhook requests are run through the
+// service as if they were received from upstream, and any notifications sent as a
+// result are labelled as a test. This will return HTTP 400 if the service does not
+// support test events. Supported service types are "github-webhook", "travis-ci",
+// "alertmanager" and "slackapi".
+//
+// Request:
+//  POST /admin/testService
+//  {
+//      "ID": "my_service_id"
+//  }
+// Response:
+//  HTTP/1.1 200 OK
+//  {
+//      "ServiceID": "my_service_id",
+//      "ServiceType": "travis-ci",
+//      "StatusCodes": [200],
+//      "Rooms": ["!qmElAGdFYCHoCJuaNt:localhost"],
+//      "FailedRooms": {
+//          "!ewfug483gsfe:localhost": "HTTP 403"
+//      }
+//  }
+func (h *TestService) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	if req.Method != "POST" {
+		return util.MessageResponse(405, "Unsupported Method")
+	}
+	var body struct {
+		ID string
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return util.MessageResponse(400, "Error parsing request JSON")
+	}
+
+	if body.ID == "" {
+		return util.MessageResponse(400, `Must supply a "ID"`)
+	}
+
+	srv, err := h.Db.LoadService(body.ID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return util.MessageResponse(404, `Service not found`)
+		}
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to LoadService")
+		return util.MessageResponse(500, `Failed to load service`)
+	}
+	if ok, err := canAccess(h.Db, req, database.ResourceService, body.ID); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to LoadResourceOwner")
+		return util.MessageResponse(500, `Failed to load service`)
+	} else if !ok {
+		return util.MessageResponse(404, `Service not found`)
+	}
+
+	result, err := h.Clients.SendTestEvents(srv)
+	if err == clients.ErrTestEventsUnsupported {
+		return util.MessageResponse(400, fmt.Sprintf("Service type '%s' does not support test events", srv.ServiceType()))
+	} else if err != nil {
+		util.GetLogger(req.Context()).WithError(err).WithField("service_id", body.ID).Error("Failed to SendTestEvents")
+		return util.MessageResponse(500, `Failed to send test events`)
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: result,
+	}
+}
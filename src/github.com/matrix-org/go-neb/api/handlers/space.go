@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/util"
+)
+
+// RefreshSpaces registers again every service whose config refers to a space which has gained or lost
+// rooms since the service was last registered. Only the services of the client with the given user ID are
+// checked, unless it is "". Returns the IDs of the services which were registered again, and the IDs of
+// those which could not be checked or registered mapped to the reason why.
+func (s *ConfigureService) RefreshSpaces(userID string, logger *log.Entry) (registered []string, failed map[string]string, err error) {
+	configs, err := s.db.LoadServiceConfigs()
+	if err != nil {
+		return nil, nil, err
+	}
+	var serviceIDs []string
+	for serviceID := range configs {
+		serviceIDs = append(serviceIDs, serviceID)
+	}
+	sort.Strings(serviceIDs)
+
+	registered = []string{}
+	failed = make(map[string]string)
+	// user ID => space => whether the rooms of the space have changed
+	changed := make(map[string]map[string]bool)
+	for _, serviceID := range serviceIDs {
+		spaces := types.SpaceReferences(configs[serviceID].ServiceType, configs[serviceID].Config)
+		if len(spaces) == 0 {
+			continue
+		}
+		service, err := s.db.LoadService(serviceID)
+		if err != nil {
+			failed[serviceID] = err.Error()
+			continue
+		}
+		serviceUserID := service.ServiceUserID()
+		if userID != "" && serviceUserID != userID {
+			continue
+		}
+		if changed[serviceUserID] == nil {
+			changed[serviceUserID] = make(map[string]bool)
+		}
+
+		needsRegister, err := s.anySpaceChanged(serviceUserID, spaces, changed[serviceUserID])
+		if err != nil {
+			failed[serviceID] = err.Error()
+			continue
+		}
+		if !needsRegister {
+			continue
+		}
+
+		serviceLogger := logger.WithField("service_id", serviceID)
+		if err := s.reregisterService(serviceID, serviceLogger); err != nil {
+			serviceLogger.WithError(err).Warn("Failed to register service for changed space")
+			failed[serviceID] = err.Error()
+			continue
+		}
+		serviceLogger.Info("Registered service for changed space")
+		registered = append(registered, serviceID)
+	}
+	return
+}
+
+// anySpaceChanged returns true if the rooms of any of the spaces, as seen by the client with the given
+// user ID, have changed. Whether each space has changed is cached in changed, so that spaces which are
+// referenced by several services are only checked once.
+func (s *ConfigureService) anySpaceChanged(userID string, spaces []string, changed map[string]bool) (bool, error) {
+	anyChanged := false
+	for _, space := range spaces {
+		spaceChanged, checked := changed[space]
+		if !checked {
+			var err error
+			if spaceChanged, err = s.spaceChanged(userID, space); err != nil {
+				return false, err
+			}
+			changed[space] = spaceChanged
+		}
+		anyChanged = anyChanged || spaceChanged
+	}
+	return anyChanged, nil
+}
+
+// spaceChanged returns true if the rooms of the space, as seen by the client with the given user ID,
+// differ from those stored when it was last expanded.
+func (s *ConfigureService) spaceChanged(userID, space string) (bool, error) {
+	rooms, err := s.clients.SpaceRooms(userID, space)
+	if err != nil {
+		return false, err
+	}
+	oldRooms, err := s.db.LoadSpaceRooms(userID, space)
+	if err == sql.ErrNoRows {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	return !reflect.DeepEqual(rooms, oldRooms), nil
+}
+
+// RefreshSpaces represents an HTTP handler which can process /admin/refreshSpaces requests.
+type RefreshSpaces struct {
+	ConfigureService *ConfigureService
+}
+
+// OnIncomingRequest handles POST requests to /admin/refreshSpaces.
+//
+// Every service whose config refers to a space which has gained or lost rooms since the
+// service was last registered is registered again with the new rooms, as if its config
+// had been sent to /admin/configureService again. Spaces are refreshed automatically when
+// a syncing client sees an "m.space.child" event, so this is only needed for spaces which
+// the client is not joined to. If a "UserID" is supplied, only the services of that client
+// are checked. Tenants must supply the "UserID" of a client which they own.
+//
+// Request:
+//  POST /admin/refreshSpaces
+//  {
+//      "UserID": "@my_bot:localhost"
+//  }
+// Response:
+//  HTTP/1.1 200 OK
+//  {
+//      "Registered": ["alertmanager_service"],
+//      "Failed": {
+//          "travis_service": "Failed to register service: ..."
+//      }
+//  }
+func (h *RefreshSpaces) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	logger := util.GetLogger(req.Context())
+	if req.Method != "POST" {
+		return util.MessageResponse(405, "Unsupported Method")
+	}
+	var body struct {
+		UserID string
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return util.MessageResponse(400, "Error parsing request JSON")
+	}
+	if requestTenant(req) != nil {
+		if body.UserID == "" {
+			return util.MessageResponse(400, `Must supply a "UserID"`)
+		}
+		if ok, err := canAccess(h.ConfigureService.db, req, database.ResourceClient, body.UserID); err != nil {
+			logger.WithError(err).Error("Failed to LoadResourceOwner")
+			return util.MessageResponse(500, "Error refreshing spaces")
+		} else if !ok {
+			return util.MessageResponse(404, "Client not found")
+		}
+	}
+
+	registered, failed, err := h.ConfigureService.RefreshSpaces(body.UserID, logger)
+	if err != nil {
+		logger.WithError(err).Error("Failed to RefreshSpaces")
+		return util.MessageResponse(500, "Error refreshing spaces")
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct {
+			Registered []string
+			Failed     map[string]string
+		}{registered, failed},
+	}
+}
@@ -0,0 +1,335 @@
+package handlers
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/api"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/util"
+)
+
+// tenantContextKey is the context key of the tenant which made an admin API request.
+type tenantContextKey struct{}
+
+// AdminAuth authenticates admin API requests. Requests made with the admin token can see and change
+// everything. Requests made with the access token of a tenant can only see and change what the tenant
+// owns. If there is no admin token, requests without an access token are treated as if they were made
+// with the admin token, so that deployments without tenants don't need to change. Tenants can only be
+// configured when there is an admin token, and Go-NEB won't start without one once tenants exist.
+type AdminAuth struct {
+	Db         *database.ServiceDB
+	AdminToken string
+}
+
+// Protect returns a handler which authenticates requests before passing them to the given handler.
+func (a *AdminAuth) Protect(handler util.JSONRequestHandler) util.JSONRequestHandler {
+	return &protectedHandler{a, handler}
+}
+
+type protectedHandler struct {
+	auth    *AdminAuth
+	handler util.JSONRequestHandler
+}
+
+func (p *protectedHandler) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	tenant, resErr := p.auth.authenticate(req)
+	if resErr != nil {
+		return *resErr
+	}
+	if tenant != nil {
+		req = req.WithContext(context.WithValue(req.Context(), tenantContextKey{}, tenant))
+	}
+	return p.handler.OnIncomingRequest(req)
+}
+
+// authenticate returns the tenant which made the request, or nil if the request was made with the
+// admin token.
+func (a *AdminAuth) authenticate(req *http.Request) (*api.Tenant, *util.JSONResponse) {
+	token := bearerToken(req)
+	if token == "" {
+		if a.AdminToken == "" {
+			return nil, nil
+		}
+		res := util.MessageResponse(401, "Missing access token")
+		return nil, &res
+	}
+	if a.AdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(a.AdminToken)) == 1 {
+		return nil, nil
+	}
+	tenant, err := a.Db.LoadTenantByToken(token)
+	if err == sql.ErrNoRows {
+		res := util.MessageResponse(401, "Unknown access token")
+		return nil, &res
+	} else if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to LoadTenantByToken")
+		res := util.MessageResponse(500, "Failed to load tenant")
+		return nil, &res
+	}
+	return &tenant, nil
+}
+
+// bearerToken returns the access token in the Authorization header of the request, if any.
+func bearerToken(req *http.Request) string {
+	if header := req.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimPrefix(header, "Bearer ")
+	}
+	return ""
+}
+
+// requestTenant returns the tenant which made the admin API request, or nil if it was made with the
+// admin token.
+func requestTenant(req *http.Request) *api.Tenant {
+	tenant, _ := req.Context().Value(tenantContextKey{}).(*api.Tenant)
+	return tenant
+}
+
+// requireAdmin returns an error response if the request was not made with the admin token.
+func requireAdmin(req *http.Request) *util.JSONResponse {
+	if requestTenant(req) == nil {
+		return nil
+	}
+	res := util.MessageResponse(403, "Requires the admin token")
+	return &res
+}
+
+// canAccess returns true if the request can see and change the resource: that is, if the request was
+// made with the admin token or by the tenant which owns the resource.
+func canAccess(db *database.ServiceDB, req *http.Request, resourceType, resourceID string) (bool, error) {
+	tenant := requestTenant(req)
+	if tenant == nil {
+		return true, nil
+	}
+	owner, err := db.LoadResourceOwner(resourceType, resourceID)
+	return owner == tenant.ID, err
+}
+
+// canConfigure returns true if the request can create or replace the resource. Tenants can create
+// resources which don't exist yet and replace resources which they own.
+func canConfigure(db *database.ServiceDB, req *http.Request, resourceType, resourceID string, exists bool) (bool, error) {
+	tenant := requestTenant(req)
+	if tenant == nil {
+		return true, nil
+	}
+	owner, err := db.LoadResourceOwner(resourceType, resourceID)
+	return owner == tenant.ID || (owner == "" && !exists), err
+}
+
+// claim records that the resource is owned by the tenant which made the request. Resources configured
+// with the admin token keep the owner they had.
+func claim(db *database.ServiceDB, req *http.Request, resourceType, resourceID string) error {
+	if tenant := requestTenant(req); tenant != nil {
+		return db.StoreResourceOwner(resourceType, resourceID, tenant.ID)
+	}
+	return nil
+}
+
+// checkServiceQuotas checks that the tenant would not go over its quotas by storing the service.
+// Returns an error along with the HTTP status code to respond with.
+func checkServiceQuotas(db *database.ServiceDB, tenant *api.Tenant, service types.Service) (int, error) {
+	if tenant.Quotas.MaxServices == 0 && tenant.Quotas.MaxFeeds == 0 {
+		return 200, nil
+	}
+	services, feeds, err := tenantUsage(db, tenant, service)
+	if err != nil {
+		return 500, fmt.Errorf("Error loading services")
+	}
+	if tenant.Quotas.MaxServices > 0 && services > tenant.Quotas.MaxServices {
+		return 403, fmt.Errorf("Quota of %d services exceeded", tenant.Quotas.MaxServices)
+	}
+	if tenant.Quotas.MaxFeeds > 0 && feeds > tenant.Quotas.MaxFeeds {
+		return 403, fmt.Errorf("Quota of %d feeds exceeded", tenant.Quotas.MaxFeeds)
+	}
+	return 200, nil
+}
+
+// tenantUsage returns the number of services and feeds the tenant would have if the service was stored.
+// Feeds are only counted if the tenant has a feed quota, as every service of the tenant must be loaded.
+func tenantUsage(db *database.ServiceDB, tenant *api.Tenant, service types.Service) (services, feeds int, err error) {
+	resources, err := db.LoadOwnedResources(database.ResourceService)
+	if err != nil {
+		return
+	}
+	services = 1
+	feeds = numFeeds(service)
+	for _, r := range resources {
+		if r.TenantID != tenant.ID || r.ID == service.ServiceID() {
+			continue
+		}
+		services++
+		if tenant.Quotas.MaxFeeds > 0 {
+			srv, err := db.LoadService(r.ID)
+			if err != nil {
+				return 0, 0, err
+			}
+			feeds += numFeeds(srv)
+		}
+	}
+	return
+}
+
+func numFeeds(service types.Service) int {
+	if reader, ok := service.(types.FeedReader); ok {
+		return len(reader.FeedURLs())
+	}
+	return 0
+}
+
+// webhookLimiter counts the incoming webhook requests of each tenant in the current minute.
+type webhookLimiter struct {
+	mu     sync.Mutex
+	minute time.Time
+	counts map[string]int // tenant_id => number of requests
+}
+
+// allow returns true and counts the request if the tenant has made fewer than max requests this minute.
+func (l *webhookLimiter) allow(tenantID string, max int, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	minute := now.Truncate(time.Minute)
+	if !minute.Equal(l.minute) {
+		l.minute = minute
+		l.counts = make(map[string]int)
+	}
+	if l.counts[tenantID] >= max {
+		return false
+	}
+	l.counts[tenantID]++
+	return true
+}
+
+// ConfigureTenant represents an HTTP handler capable of processing /admin/configureTenant requests.
+type ConfigureTenant struct {
+	Db   *database.ServiceDB
+	Auth *AdminAuth
+}
+
+// OnIncomingRequest handles POST requests to /admin/configureTenant. The JSON object provided
+// is of type "api.Tenant". This requires the admin token, so tenants can't be configured if
+// Go-NEB was started without one.
+//
+// Using an existing ID replaces the access token and quotas of the tenant. Lowering a quota
+// does not remove anything the tenant already owns, but the tenant won't be able to add more.
+//
+// Request:
+//  POST /admin/configureTenant
+//  {
+//      "ID": "ops",
+//      "AccessToken": "a_long_random_string",
+//      "Quotas": {
+//          "MaxServices": 10,
+//          "MaxFeeds": 50,
+//          "MaxWebhooksPerMinute": 120
+//      }
+//  }
+// Response:
+//  HTTP/1.1 200 OK
+//  {
+//      "OldTenant": {
+//          "ID": "ops",
+//          "Quotas": { ... }
+//      },
+//      "NewTenant": {
+//          "ID": "ops",
+//          "Quotas": { ... }
+//      }
+//  }
+func (h *ConfigureTenant) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	if req.Method != "POST" {
+		return util.MessageResponse(405, "Unsupported Method")
+	}
+	if res := requireAdmin(req); res != nil {
+		return *res
+	}
+	if h.Auth.AdminToken == "" {
+		return util.MessageResponse(403, "Tenants can only be configured when ADMIN_TOKEN is set")
+	}
+	var body api.Tenant
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return util.MessageResponse(400, "Error parsing request JSON")
+	}
+	if err := body.Check(); err != nil {
+		return util.MessageResponse(400, err.Error())
+	}
+	util.GetLogger(req.Context()).WithFields(log.Fields{
+		"tenant_id": body.ID,
+		"quotas":    body.Quotas,
+	}).Print("Incoming configure tenant request")
+
+	old, err := h.Db.StoreTenant(body)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to StoreTenant")
+		return util.MessageResponse(500, "Error storing tenant")
+	}
+
+	body.AccessToken = ""
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct {
+			OldTenant api.Tenant
+			NewTenant api.Tenant
+		}{old, body},
+	}
+}
+
+// ListResources represents an HTTP handler capable of processing /admin/listServices,
+// /admin/listClients and /admin/listAuthRealms requests.
+type ListResources struct {
+	Db *database.ServiceDB
+	// The type of resource to list, e.g. database.ResourceService.
+	ResourceType string
+}
+
+// OnIncomingRequest handles POST requests to /admin/listServices, /admin/listClients and
+// /admin/listAuthRealms.
+//
+// Requests made with the admin token list every service, client or realm. Requests made
+// by a tenant only list those which the tenant owns. "Type" is the service or realm type
+// and is empty for clients. "TenantID" is empty for things which are not owned by a tenant.
+//
+// Request:
+//  POST /admin/listServices
+//  {}
+// Response:
+//  HTTP/1.1 200 OK
+//  {
+//      "Resources": [
+//          {
+//              "ID": "github_service",
+//              "Type": "github",
+//              "TenantID": "ops"
+//          }
+//      ]
+//  }
+func (h *ListResources) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	if req.Method != "POST" {
+		return util.MessageResponse(405, "Unsupported Method")
+	}
+	resources, err := h.Db.LoadOwnedResources(h.ResourceType)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to LoadOwnedResources")
+		return util.MessageResponse(500, "Failed to list resources")
+	}
+	visible := []database.OwnedResource{}
+	tenant := requestTenant(req)
+	for _, r := range resources {
+		if tenant == nil || r.TenantID == tenant.ID {
+			visible = append(visible, r)
+		}
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct {
+			Resources []database.OwnedResource
+		}{visible},
+	}
+}
@@ -1,39 +1,55 @@
 package handlers
 
 import (
+	"crypto/subtle"
 	"encoding/base64"
 	"net/http"
 	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/matrix-org/go-neb/clients"
 	"github.com/matrix-org/go-neb/database"
 	"github.com/matrix-org/go-neb/metrics"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
 )
 
 // Webhook represents an HTTP handler capable of accepting webhook requests on behalf of services.
 type Webhook struct {
-	db      *database.ServiceDB
-	clients *clients.Clients
+	db         *database.ServiceDB
+	clients    *clients.Clients
+	limiter    *webhookLimiter
+	adminToken string
 }
 
-// NewWebhook returns a new webhook HTTP handler
-func NewWebhook(db *database.ServiceDB, cli *clients.Clients) *Webhook {
-	return &Webhook{db, cli}
+// NewWebhook returns a new webhook HTTP handler. The admin token authorises requests to service routes
+// which require it.
+func NewWebhook(db *database.ServiceDB, cli *clients.Clients, adminToken string) *Webhook {
+	return &Webhook{db, cli, &webhookLimiter{}, adminToken}
 }
 
 // Handle an incoming webhook HTTP request.
 //
-// The webhook MUST have a known base64 encoded service ID as the last path segment
-// in order for this request to be passed to the correct service, or else this will return
-// HTTP 400. If the base64 encoded service ID is unknown, this will return HTTP 404.
-// Beyond this, the exact response is determined by the specific Service implementation.
+// The webhook MUST have a known base64 encoded service ID as the path segment after
+// "/services/hooks/" in order for this request to be passed to the correct service, or else this
+// will return HTTP 400. If the base64 encoded service ID is unknown, this will return HTTP 404. If the
+// service is owned by a tenant which has used up its webhook quota for this minute, this will return
+// HTTP 429. Requests with more path segments after the service ID are passed to the matching
+// route of the service (see types.WebhookRouter), or get HTTP 404 if there isn't one. Beyond this,
+// the exact response is determined by the specific Service implementation.
 func (wh *Webhook) Handle(w http.ResponseWriter, req *http.Request) {
 	log.WithField("path", req.URL.Path).Print("Incoming webhook request")
-	segments := strings.Split(req.URL.Path, "/")
-	// last path segment is the service ID which we will pass the incoming request to,
-	// but we've base64d it.
-	base64srvID := segments[len(segments)-1]
+	// The service ID which we will pass the incoming request to is base64d, and may be followed by
+	// the path of one of the service's routes.
+	path := req.URL.Path
+	if i := strings.Index(path, "/services/hooks/"); i >= 0 {
+		path = path[i+len("/services/hooks/"):]
+	}
+	base64srvID, routePath := path, ""
+	if i := strings.Index(path, "/"); i >= 0 {
+		base64srvID, routePath = path[:i], strings.Trim(path[i+1:], "/")
+	}
 	bytesSrvID, err := base64.RawURLEncoding.DecodeString(base64srvID)
 	if err != nil {
 		log.WithError(err).WithField("base64_service_id", base64srvID).Print(
@@ -50,17 +66,123 @@ func (wh *Webhook) Handle(w http.ResponseWriter, req *http.Request) {
 		w.WriteHeader(404)
 		return
 	}
-	cli, err := wh.clients.Client(service.ServiceUserID())
+	if !wh.allow(service.ServiceID()) {
+		log.WithField("service_id", service.ServiceID()).Print("Webhook quota exceeded")
+		metrics.RecordWebhookDelivery(service.ServiceID(), 429)
+		w.WriteHeader(429)
+		return
+	}
+	cli, err := wh.clients.SendingClient(service)
 	if err != nil {
 		log.WithError(err).WithField("user_id", service.ServiceUserID()).Print(
 			"Failed to retrieve matrix client instance")
 		w.WriteHeader(500)
 		return
 	}
+	if routePath != "" {
+		wh.serveRoute(w, req, service, routePath, cli)
+		return
+	}
 	log.WithFields(log.Fields{
 		"service_id":   service.ServiceID(),
 		"service_type": service.ServiceType(),
 	}).Print("Incoming webhook for service")
 	metrics.IncrementWebhook(service.ServiceType())
-	service.OnReceiveWebhook(w, req, cli)
+	sw := &statusResponseWriter{ResponseWriter: w, statusCode: 200}
+	service.OnReceiveWebhook(sw, req, cli)
+	metrics.RecordWebhookDelivery(service.ServiceID(), sw.statusCode)
+}
+
+// serveRoute passes the request to the route of the service with the given path.
+func (wh *Webhook) serveRoute(w http.ResponseWriter, req *http.Request, service types.Service, routePath string, cli *gomatrix.Client) {
+	logger := log.WithFields(log.Fields{
+		"service_id":   service.ServiceID(),
+		"service_type": service.ServiceType(),
+		"route":        routePath,
+	})
+	router, ok := service.(types.WebhookRouter)
+	if !ok {
+		w.WriteHeader(404)
+		return
+	}
+	var methods []string
+	for _, route := range router.WebhookRoutes() {
+		if route.Path != routePath {
+			continue
+		}
+		if route.Method != req.Method {
+			methods = append(methods, route.Method)
+			continue
+		}
+		if !wh.authorized(route.Auth, req, service.ServiceID()) {
+			logger.Print("Unauthorised request for service route")
+			w.WriteHeader(401)
+			return
+		}
+		logger.Print("Incoming request for service route")
+		route.Handler(w, req, cli)
+		return
+	}
+	if len(methods) > 0 {
+		w.Header().Set("Allow", strings.Join(methods, ", "))
+		w.WriteHeader(405)
+		return
+	}
+	w.WriteHeader(404)
+}
+
+// authorized returns true if the request meets the auth policy of a route of the service.
+func (wh *Webhook) authorized(auth types.RouteAuth, req *http.Request, serviceID string) bool {
+	if auth == types.RouteAuthNone {
+		return true
+	}
+	// Unlike the admin API, a route which requires the admin token always requires a token, as
+	// webhooks are exposed to the internet.
+	token := bearerToken(req)
+	if token == "" {
+		return false
+	}
+	if wh.adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(wh.adminToken)) == 1 {
+		return true
+	}
+	tenant, err := wh.db.LoadTenantByToken(token)
+	if err != nil {
+		return false
+	}
+	owner, err := wh.db.LoadResourceOwner(database.ResourceService, serviceID)
+	return err == nil && owner == tenant.ID
+}
+
+// allow returns true if the tenant which owns the service, if any, is within its webhook quota.
+func (wh *Webhook) allow(serviceID string) bool {
+	tenantID, err := wh.db.LoadResourceOwner(database.ResourceService, serviceID)
+	if err != nil {
+		log.WithError(err).WithField("service_id", serviceID).Error("Failed to load service owner")
+		return true
+	} else if tenantID == "" {
+		return true
+	}
+	tenant, err := wh.db.LoadTenant(tenantID)
+	if err != nil {
+		log.WithError(err).WithField("tenant_id", tenantID).Error("Failed to load tenant")
+		return true
+	} else if tenant.Quotas.MaxWebhooksPerMinute == 0 {
+		return true
+	}
+	return wh.limiter.allow(tenantID, tenant.Quotas.MaxWebhooksPerMinute, time.Now())
+}
+
+// statusResponseWriter records the status code written to a response.
+type statusResponseWriter struct {
+	http.ResponseWriter
+	statusCode  int
+	wroteHeader bool
+}
+
+func (w *statusResponseWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.statusCode = code
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(code)
 }
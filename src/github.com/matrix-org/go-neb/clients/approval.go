@@ -0,0 +1,289 @@
+package clients
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/metrics"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+)
+
+// approvalReactions are the reactions which approve a parked command.
+var approvalReactions = map[string]bool{
+	"👍":  true,
+	"👍️": true,
+	"✅":  true,
+}
+
+// A parkedCommand is a command which is waiting to be approved.
+type parkedCommand struct {
+	id          int
+	command     types.Command
+	args        []string
+	roomID      string
+	requesterID string
+	// The client which parked the command, and the event it asked for approval with.
+	client        *gomatrix.Client
+	requestEvent  string
+	expires       time.Time
+	expiryTimer   *time.Timer
+	commandString string
+}
+
+// approvals holds the commands which are waiting to be approved.
+type approvals struct {
+	mu     sync.Mutex
+	lastID int
+	parked map[int]*parkedCommand // id => command
+}
+
+// parkCommand asks for approval of the command in the room instead of running it. The command is
+// discarded if it isn't approved before the timeout of its policy.
+func (c *Clients) parkCommand(client *gomatrix.Client, command types.Command, event *gomatrix.Event, args []string) {
+	timeout := command.Approval.Timeout
+	if timeout == 0 {
+		timeout = types.DefaultApprovalTimeout
+	}
+
+	c.approvals.mu.Lock()
+	c.approvals.lastID++
+	p := &parkedCommand{
+		id:            c.approvals.lastID,
+		command:       command,
+		args:          args,
+		roomID:        event.RoomID,
+		requesterID:   event.Sender,
+		client:        client,
+		expires:       time.Now().Add(timeout),
+		commandString: "!" + strings.Join(append(append([]string{}, command.Path...), args...), " "),
+	}
+	if c.approvals.parked == nil {
+		c.approvals.parked = make(map[int]*parkedCommand)
+	}
+	c.approvals.parked[p.id] = p
+	p.expiryTimer = time.AfterFunc(timeout, func() { c.expireCommand(p.id) })
+	c.approvals.mu.Unlock()
+
+	who := "Another user"
+	if level := command.Approval.RequiredPowerLevel(); level > 0 {
+		who = fmt.Sprintf("Another user with power level %d or more", level)
+	}
+	body := fmt.Sprintf(
+		"%s needs approval to run %s. %s can approve it within %s with \"!neb approve %d\" or by reacting with 👍.",
+		event.Sender, p.commandString, who, timeout, p.id,
+	)
+	res, err := client.SendMessageEvent(event.RoomID, "m.room.message", gomatrix.TextMessage{MsgType: "m.notice", Body: body})
+	if err != nil {
+		log.WithFields(log.Fields{
+			log.ErrorKey: err,
+			"room_id":    event.RoomID,
+			"user_id":    event.Sender,
+			"command":    command.Path,
+		}).Warn("Failed to ask for approval of command")
+		return
+	}
+	c.approvals.mu.Lock()
+	p.requestEvent = res.EventID
+	c.approvals.mu.Unlock()
+}
+
+// approveCommand runs the parked command with the given ID if the user can approve it. Returns an
+// error saying why the user can't approve it otherwise.
+func (c *Clients) approveCommand(client *gomatrix.Client, roomID, approverID string, id int) error {
+	c.approvals.mu.Lock()
+	p, ok := c.approvals.parked[id]
+	c.approvals.mu.Unlock()
+	if !ok || p.roomID != roomID || p.client.UserID != client.UserID || time.Now().After(p.expires) {
+		return fmt.Errorf("There is no command #%d waiting to be approved in this room", id)
+	}
+	if err := checkApprover(client, p, approverID); err != nil {
+		return err
+	}
+
+	// Only the first approval runs the command.
+	c.approvals.mu.Lock()
+	_, ok = c.approvals.parked[id]
+	delete(c.approvals.parked, id)
+	c.approvals.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("Command #%d has already been approved", id)
+	}
+	p.expiryTimer.Stop()
+	runApproved(client, p, approverID)
+	return nil
+}
+
+// checkApprover returns an error if the user can't approve the parked command.
+func checkApprover(client *gomatrix.Client, p *parkedCommand, approverID string) error {
+	if p.requesterID == approverID {
+		return errors.New("Another user must approve your command")
+	}
+	if level := p.command.Approval.RequiredPowerLevel(); level > 0 {
+		pl, err := matrix.LoadPowerLevels(client, p.roomID)
+		if err != nil {
+			return fmt.Errorf("Failed to check power levels: %s", err)
+		}
+		if pl.UserLevel(approverID) < level {
+			return fmt.Errorf("You need power level %d to approve this command", level)
+		}
+	}
+	return nil
+}
+
+// runApproved runs the parked command which the user approved, and sends the approval and the response
+// of the command to the room.
+func runApproved(client *gomatrix.Client, p *parkedCommand, approverID string) {
+	roomID := p.roomID
+	log.WithFields(log.Fields{
+		"room_id":     roomID,
+		"user_id":     p.requesterID,
+		"approved_by": approverID,
+		"command":     p.command.Path,
+		"args":        p.args,
+	}).Info("Command approved")
+	notice := fmt.Sprintf("%s approved %s for %s", approverID, p.commandString, p.requesterID)
+	responses := []interface{}{gomatrix.TextMessage{MsgType: "m.notice", Body: notice}}
+	if content := runCommand(p.command, roomID, p.requesterID, p.args); content != nil {
+		responses = append(responses, content)
+	}
+	for _, content := range responses {
+		if err := sendResponse(client, roomID, p.requesterID, content); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+				"user_id":    approverID,
+				"content":    content,
+			}).Print("Failed to send command response")
+		}
+	}
+}
+
+// parkedByOtherClient returns true if the command with the given ID is waiting to be approved in the room,
+// but was parked by another client. Every client in the room sees "!neb approve" and "!neb cancel", but
+// only the client which parked the command should respond to them.
+func (c *Clients) parkedByOtherClient(client *gomatrix.Client, roomID string, id int) bool {
+	c.approvals.mu.Lock()
+	defer c.approvals.mu.Unlock()
+	p, ok := c.approvals.parked[id]
+	return ok && p.roomID == roomID && p.client.UserID != client.UserID
+}
+
+// cancelCommand discards the parked command with the given ID. Only the user who invoked it can
+// cancel it.
+func (c *Clients) cancelCommand(client *gomatrix.Client, roomID, userID string, id int) error {
+	c.approvals.mu.Lock()
+	defer c.approvals.mu.Unlock()
+	p, ok := c.approvals.parked[id]
+	if !ok || p.roomID != roomID || p.client.UserID != client.UserID {
+		return fmt.Errorf("There is no command #%d waiting to be approved in this room", id)
+	}
+	if p.requesterID != userID {
+		return errors.New("Only the user who ran the command can cancel it")
+	}
+	p.expiryTimer.Stop()
+	delete(c.approvals.parked, id)
+	return nil
+}
+
+// expireCommand discards the parked command with the given ID, if it is still waiting to be approved.
+func (c *Clients) expireCommand(id int) {
+	c.approvals.mu.Lock()
+	p, ok := c.approvals.parked[id]
+	delete(c.approvals.parked, id)
+	c.approvals.mu.Unlock()
+	if !ok {
+		return
+	}
+	metrics.IncrementCommand(p.command.Path[0], metrics.StatusFailure)
+	body := fmt.Sprintf("%s was not approved in time, so it will not run", p.commandString)
+	if _, err := p.client.SendMessageEvent(p.roomID, "m.room.message", gomatrix.TextMessage{MsgType: "m.notice", Body: body}); err != nil {
+		log.WithError(err).WithField("room_id", p.roomID).Warn("Failed to send command expiry notice")
+	}
+}
+
+// onReactionEvent approves the parked command which asked for approval with the event which was
+// reacted to, if the reaction is an approval.
+func (c *Clients) onReactionEvent(client *gomatrix.Client, event *gomatrix.Event) {
+	relation, ok := event.Content["m.relates_to"].(map[string]interface{})
+	if !ok || relation["rel_type"] != "m.annotation" {
+		return
+	}
+	key, _ := relation["key"].(string)
+	eventID, _ := relation["event_id"].(string)
+	if !approvalReactions[key] || eventID == "" {
+		return
+	}
+	id := 0
+	c.approvals.mu.Lock()
+	for _, p := range c.approvals.parked {
+		if p.requestEvent == eventID && p.client.UserID == client.UserID {
+			id = p.id
+		}
+	}
+	c.approvals.mu.Unlock()
+	if id == 0 {
+		return
+	}
+	if err := c.approveCommand(client, event.RoomID, event.Sender, id); err != nil {
+		if _, err := client.SendMessageEvent(event.RoomID, "m.room.message", gomatrix.TextMessage{MsgType: "m.notice", Body: err.Error()}); err != nil {
+			log.WithError(err).WithField("room_id", event.RoomID).Warn("Failed to send approval error")
+		}
+	}
+}
+
+// approvalCommands returns the "!neb approve" and "!neb cancel" commands.
+func (c *Clients) approvalCommands(client *gomatrix.Client) []types.Command {
+	parseID := func(args []string, usage string) (int, error) {
+		if len(args) != 1 {
+			return 0, errors.New(usage)
+		}
+		id, err := strconv.Atoi(strings.TrimPrefix(args[0], "#"))
+		if err != nil {
+			return 0, errors.New(usage)
+		}
+		return id, nil
+	}
+	return []types.Command{
+		types.Command{
+			Path:      []string{"neb", "approve"},
+			Arguments: []string{"id"},
+			Help:      "Approve a command which is waiting for a second user.",
+			Command: func(roomID, userID string, args []string) (interface{}, error) {
+				id, err := parseID(args, "Usage: !neb approve <id>")
+				if err != nil {
+					return nil, err
+				}
+				if c.parkedByOtherClient(client, roomID, id) {
+					return nil, nil
+				}
+				// The approval and the command's response are sent by approveCommand.
+				return nil, c.approveCommand(client, roomID, userID, id)
+			},
+		},
+		types.Command{
+			Path:      []string{"neb", "cancel"},
+			Arguments: []string{"id"},
+			Help:      "Cancel a command of yours which is waiting for approval.",
+			Command: func(roomID, userID string, args []string) (interface{}, error) {
+				id, err := parseID(args, "Usage: !neb cancel <id>")
+				if err != nil {
+					return nil, err
+				}
+				if c.parkedByOtherClient(client, roomID, id) {
+					return nil, nil
+				}
+				if err := c.cancelCommand(client, roomID, userID, id); err != nil {
+					return nil, err
+				}
+				return &gomatrix.TextMessage{MsgType: "m.notice", Body: fmt.Sprintf("Cancelled command #%d", id)}, nil
+			},
+		},
+	}
+}
@@ -25,6 +25,15 @@ type Clients struct {
 	dbMutex    sync.Mutex
 	mapMutex   sync.Mutex
 	clients    map[string]clientEntry
+
+	// The services which use the clients of other users, by service ID.
+	observersMutex    sync.Mutex
+	dependentServices map[string]types.Service
+
+	spaceChangeHandler func(userID string)
+	spaceChangePending map[string]bool
+
+	approvals approvals
 }
 
 // New makes a new collection of matrix clients
@@ -33,6 +42,10 @@ func New(db database.Storer, cli *http.Client) *Clients {
 		db:         db,
 		httpClient: cli,
 		clients:    make(map[string]clientEntry), // user_id => clientEntry
+
+		dependentServices: make(map[string]types.Service),
+
+		spaceChangePending: make(map[string]bool),
 	}
 	return clients
 }
@@ -53,8 +66,30 @@ func (c *Clients) Update(config api.ClientConfig) (api.ClientConfig, error) {
 	return old.config, err
 }
 
+// Remove deletes the config for a matrix client and stops it syncing. Returns a
+// *database.DependencyError if any services still use the client.
+func (c *Clients) Remove(userID string) error {
+	c.dbMutex.Lock()
+	defer c.dbMutex.Unlock()
+
+	if err := c.db.DeleteMatrixClientConfig(userID); err != nil {
+		return err
+	}
+
+	c.mapMutex.Lock()
+	defer c.mapMutex.Unlock()
+	if entry, ok := c.clients[userID]; ok {
+		entry.client.StopSync()
+		delete(c.clients, userID)
+	}
+	return nil
+}
+
 // Start listening on client /sync streams
 func (c *Clients) Start() error {
+	if err := c.loadDependentServices(); err != nil {
+		return err
+	}
 	configs, err := c.db.LoadMatrixClientConfigs()
 	if err != nil {
 		return err
@@ -163,6 +198,12 @@ func (c *Clients) onMessageEvent(client *gomatrix.Client, event *gomatrix.Event)
 		}).Warn("Error loading services")
 	}
 
+	for _, service := range c.observingServices(client, services) {
+		if observer, ok := service.(types.MessageObserver); ok {
+			observer.OnMessageEvent(client, event)
+		}
+	}
+
 	body, ok := event.Body()
 	if !ok || body == "" {
 		return
@@ -173,6 +214,21 @@ func (c *Clients) onMessageEvent(client *gomatrix.Client, event *gomatrix.Event)
 		return
 	}
 
+	for _, content := range c.responsesTo(client, services, event, body) {
+		if err := sendResponse(client, event.RoomID, event.Sender, content); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    event.RoomID,
+				"user_id":    event.Sender,
+				"content":    content,
+			}).Print("Failed to send command response")
+		}
+	}
+}
+
+// responsesTo runs the commands or expansions of the services for the body of the message event,
+// and returns their responses.
+func (c *Clients) responsesTo(client *gomatrix.Client, services []types.Service, event *gomatrix.Event, body string) []interface{} {
 	// replace all smart quotes with their normal counterparts so shellwords can parse it
 	body = strings.Replace(body, `‘`, `'`, -1)
 	body = strings.Replace(body, `’`, `'`, -1)
@@ -181,14 +237,23 @@ func (c *Clients) onMessageEvent(client *gomatrix.Client, event *gomatrix.Event)
 
 	var responses []interface{}
 
+	var args []string
+	if body[0] == '!' { // message is a command
+		var err error
+		if args, err = shellwords.Parse(body[1:]); err != nil {
+			args = strings.Split(body[1:], " ")
+		}
+		if response := c.runCommandForService(client, c.nebCommands(client, services), event, args); response != nil {
+			responses = append(responses, response)
+		}
+	}
+
 	for _, service := range services {
+		if scoper, ok := service.(types.CommandScoper); ok && !scoper.InCommandScope(event.RoomID) {
+			continue
+		}
 		if body[0] == '!' { // message is a command
-			args, err := shellwords.Parse(body[1:])
-			if err != nil {
-				args = strings.Split(body[1:], " ")
-			}
-
-			if response := runCommandForService(service.Commands(client), event, args); response != nil {
+			if response := c.runCommandForService(client, service.Commands(client), event, args); response != nil {
 				responses = append(responses, response)
 			}
 		} else { // message isn't a command, it might need expanding
@@ -196,24 +261,129 @@ func (c *Clients) onMessageEvent(client *gomatrix.Client, event *gomatrix.Event)
 			responses = append(responses, expansions...)
 		}
 	}
+	return responses
+}
 
-	for _, content := range responses {
-		if _, err := client.SendMessageEvent(event.RoomID, "m.room.message", content); err != nil {
-			log.WithFields(log.Fields{
-				log.ErrorKey: err,
-				"room_id":    event.RoomID,
-				"user_id":    event.Sender,
-				"content":    content,
-			}).Print("Failed to send command response")
+// sendResponse sends the response to a command or expansion which the user invoked in the room. Private
+// responses are sent to the user in a direct message instead, and acknowledged in the room unless it is
+// the direct message room.
+func sendResponse(client *gomatrix.Client, roomID, userID string, content interface{}) error {
+	res, ok := content.(types.Response)
+	if !ok {
+		_, err := client.SendMessageEvent(roomID, "m.room.message", content)
+		return err
+	}
+	if res.Content == nil {
+		return nil
+	}
+	if !res.Private {
+		_, err := client.SendMessageEvent(roomID, "m.room.message", res.Content)
+		return err
+	}
+
+	directRoomID, err := matrix.DirectRoom(client, userID)
+	if err == nil {
+		_, err = client.SendMessageEvent(directRoomID, "m.room.message", res.Content)
+	}
+	if err == nil && directRoomID == roomID {
+		return nil
+	}
+	ack := userID + ": I've sent you the response in a direct message."
+	if err != nil {
+		// Don't fall back to sending the response to the room, as it is private.
+		ack = userID + ": I couldn't send you the response in a direct message."
+	}
+	if _, ackErr := client.SendMessageEvent(roomID, "m.room.message", gomatrix.TextMessage{MsgType: "m.notice", Body: ack}); err == nil {
+		err = ackErr
+	}
+	return err
+}
+
+func (c *Clients) onRedactionEvent(client *gomatrix.Client, event *gomatrix.Event) {
+	services, err := c.db.LoadServicesForUser(client.UserID)
+	if err != nil {
+		log.WithFields(log.Fields{
+			log.ErrorKey:      err,
+			"room_id":         event.RoomID,
+			"service_user_id": client.UserID,
+		}).Warn("Error loading services")
+	}
+	for _, service := range c.observingServices(client, services) {
+		if observer, ok := service.(types.RedactionObserver); ok {
+			observer.OnRedactionEvent(client, event)
+		}
+	}
+}
+
+// observingServices returns the services which are told about the events received by the client: the
+// given services of its user, along with the services of other users which also use the client.
+func (c *Clients) observingServices(client *gomatrix.Client, services []types.Service) []types.Service {
+	observers := append([]types.Service{}, services...)
+	c.observersMutex.Lock()
+	defer c.observersMutex.Unlock()
+	for _, service := range c.dependentServices {
+		if service.ServiceUserID() != client.UserID && types.UsesClient(service, client.UserID) {
+			observers = append(observers, service)
+		}
+	}
+	return observers
+}
+
+// loadDependentServices loads the services which use the clients of other users, so that they can be told
+// about the events those clients receive without loading them for every event.
+func (c *Clients) loadDependentServices() error {
+	dependents := make(map[string]types.Service)
+	for _, serviceType := range types.ClientDependentServiceTypes() {
+		srvs, err := c.db.LoadServicesByType(serviceType)
+		if err != nil {
+			return err
+		}
+		for _, service := range srvs {
+			dependents[service.ServiceID()] = service
 		}
 	}
+	c.observersMutex.Lock()
+	defer c.observersMutex.Unlock()
+	c.dependentServices = dependents
+	return nil
+}
+
+// ServiceRegistered updates the services which are told about the events received by other clients. It
+// must be called whenever a service is registered.
+func (c *Clients) ServiceRegistered(service types.Service) {
+	c.observersMutex.Lock()
+	defer c.observersMutex.Unlock()
+	if _, ok := service.(types.ClientDependent); ok {
+		c.dependentServices[service.ServiceID()] = service
+	} else {
+		delete(c.dependentServices, service.ServiceID())
+	}
+}
+
+// ServiceDeleted stops the service from being told about the events received by other clients. It must be
+// called whenever a service is deleted.
+func (c *Clients) ServiceDeleted(serviceID string) {
+	c.observersMutex.Lock()
+	defer c.observersMutex.Unlock()
+	delete(c.dependentServices, serviceID)
+}
+
+// nebCommands returns the "!neb" commands which Go-NEB provides for every syncing client,
+// regardless of which services are configured.
+func (c *Clients) nebCommands(client *gomatrix.Client, services []types.Service) []types.Command {
+	return append([]types.Command{
+		c.testEventCommand(client, services),
+		c.statusCommand(client, services),
+		c.whoamiCommand(services),
+	}, c.approvalCommands(client)...)
 }
 
 // runCommandForService runs a single command read from a matrix event. Runs
-// the matching command with the longest path. Returns the JSON encodable
+// the matching command with the longest path. Commands which require approval
+// are parked until they are approved instead. Returns the JSON encodable
 // content of a single matrix message event to use as a response or nil if no
 // response is appropriate.
-func runCommandForService(cmds []types.Command, event *gomatrix.Event, arguments []string) interface{} {
+func (c *Clients) runCommandForService(client *gomatrix.Client, cmds []types.Command, event *gomatrix.Event, arguments []string) interface{} {
 	var bestMatch *types.Command
 	for i, command := range cmds {
 		matches := command.Matches(arguments)
@@ -228,28 +398,47 @@ func runCommandForService(cmds []types.Command, event *gomatrix.Event, arguments
 	}
 
 	cmdArgs := arguments[len(bestMatch.Path):]
+	if bestMatch.Approval != nil {
+		log.WithFields(log.Fields{
+			"room_id": event.RoomID,
+			"user_id": event.Sender,
+			"command": bestMatch.Path,
+		}).Info("Parking command until it is approved")
+		c.parkCommand(client, *bestMatch, event, cmdArgs)
+		return nil
+	}
+	return runCommand(*bestMatch, event.RoomID, event.Sender, cmdArgs)
+}
+
+// runCommand runs the command as the given user. Returns the JSON encodable content of a single
+// matrix message event to use as a response, or a types.Response if it is private, or nil if no
+// response is appropriate.
+func runCommand(command types.Command, roomID, userID string, cmdArgs []string) interface{} {
 	log.WithFields(log.Fields{
-		"room_id": event.RoomID,
-		"user_id": event.Sender,
-		"command": bestMatch.Path,
+		"room_id": roomID,
+		"user_id": userID,
+		"command": command.Path,
 	}).Info("Executing command")
-	content, err := bestMatch.Command(event.RoomID, event.Sender, cmdArgs)
+	content, err := command.Command(roomID, userID, cmdArgs)
 	if err != nil {
 		if content != nil {
 			log.WithFields(log.Fields{
 				log.ErrorKey: err,
-				"room_id":    event.RoomID,
-				"user_id":    event.Sender,
-				"command":    bestMatch.Path,
+				"room_id":    roomID,
+				"user_id":    userID,
+				"command":    command.Path,
 				"args":       cmdArgs,
 			}).Warn("Command returned both error and content.")
 		}
-		metrics.IncrementCommand(bestMatch.Path[0], metrics.StatusFailure)
+		metrics.IncrementCommand(command.Path[0], metrics.StatusFailure)
 		content = gomatrix.TextMessage{"m.notice", err.Error()}
 	} else {
-		metrics.IncrementCommand(bestMatch.Path[0], metrics.StatusSuccess)
+		metrics.IncrementCommand(command.Path[0], metrics.StatusSuccess)
 	}
 
+	if _, isResponse := content.(types.Response); command.Private && !isResponse && content != nil {
+		content = types.PrivateResponse(content)
+	}
 	return content
 }
 
@@ -350,10 +539,22 @@ func (c *Clients) newClient(config api.ClientConfig) (*gomatrix.Client, error) {
 		c.onMessageEvent(client, event)
 	})
 
+	syncer.OnEventType("m.room.redaction", func(event *gomatrix.Event) {
+		c.onRedactionEvent(client, event)
+	})
+
+	syncer.OnEventType("m.reaction", func(event *gomatrix.Event) {
+		c.onReactionEvent(client, event)
+	})
+
 	syncer.OnEventType("m.room.bot.options", func(event *gomatrix.Event) {
 		c.onBotOptionsEvent(client, event)
 	})
 
+	syncer.OnEventType("m.space.child", func(event *gomatrix.Event) {
+		c.onSpaceChildEvent(client, event)
+	})
+
 	if config.AutoJoinRooms {
 		syncer.OnEventType("m.room.member", func(event *gomatrix.Event) {
 			c.onRoomMemberEvent(client, event)
@@ -1,12 +1,20 @@
 package clients
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/matrix-org/go-neb/api"
 	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/metrics"
 	"github.com/matrix-org/go-neb/types"
 	"github.com/matrix-org/gomatrix"
 )
@@ -25,6 +33,7 @@ var commandParseTests = []struct {
 
 type MockService struct {
 	types.DefaultService
+	types.CommandScope
 	commands []types.Command
 }
 
@@ -93,3 +102,656 @@ func TestCommandParsing(t *testing.T) {
 	}
 
 }
+
+type MockWebhookService struct {
+	types.DefaultService
+	rooms []string
+}
+
+func (s *MockWebhookService) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli *gomatrix.Client) {
+	if !types.IsTestRequest(req) {
+		w.WriteHeader(403)
+		return
+	}
+	for _, roomID := range s.rooms {
+		cli.SendMessageEvent(roomID, "m.room.message", gomatrix.GetHTMLMessage("m.notice", "<b>build passed</b>"))
+	}
+	w.WriteHeader(200)
+}
+
+func (s *MockWebhookService) TestWebhookRequests() ([]*http.Request, error) {
+	req, err := http.NewRequest("POST", "https://neb/services/hooks/abc", nil)
+	return []*http.Request{req}, err
+}
+
+func TestSendTestEvents(t *testing.T) {
+	s := &MockWebhookService{
+		DefaultService: types.NewDefaultService("webhook_service", "@service:user", "mock-webhook"),
+		rooms:          []string{"!joined:bar", "!forbidden:bar"},
+	}
+	store := MockStore{service: s}
+	database.SetServiceDB(&store)
+
+	sentBodies := make(map[string]map[string]interface{})
+	trans := struct{ MockTransport }{}
+	trans.roundTrip = func(req *http.Request) (*http.Response, error) {
+		roomID := sendMessagePathRoomID(req)
+		if roomID == "!forbidden:bar" {
+			return &http.Response{StatusCode: 403, Body: ioutil.NopCloser(strings.NewReader(`{}`))}, nil
+		}
+		var content map[string]interface{}
+		if err := json.NewDecoder(req.Body).Decode(&content); err != nil {
+			t.Fatalf("TestSendTestEvents failed to decode sent message: %s", err)
+		}
+		sentBodies[roomID] = content
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader(`{"event_id":"$1:bar"}`))}, nil
+	}
+	clients := New(&store, &http.Client{Transport: trans})
+	mxCli, _ := gomatrix.NewClient("https://someplace.somewhere", "@service:user", "token")
+	clients.setClient(clientEntry{config: api.ClientConfig{UserID: "@service:user"}, client: mxCli})
+
+	result, err := clients.SendTestEvents(s)
+	if err != nil {
+		t.Fatalf("TestSendTestEvents: SendTestEvents failed: %s", err)
+	}
+	if !reflect.DeepEqual(result.StatusCodes, []int{200}) {
+		t.Errorf("TestSendTestEvents want status codes [200], got %v", result.StatusCodes)
+	}
+	if !reflect.DeepEqual(result.Rooms, []string{"!joined:bar"}) {
+		t.Errorf("TestSendTestEvents want rooms [!joined:bar], got %v", result.Rooms)
+	}
+	if result.FailedRooms["!forbidden:bar"] != "HTTP 403" {
+		t.Errorf("TestSendTestEvents want !forbidden:bar to fail with HTTP 403, got %v", result.FailedRooms)
+	}
+	content := sentBodies["!joined:bar"]
+	if content["body"] != "[TEST] build passed" || content["formatted_body"] != "<strong>[TEST]</strong> <b>build passed</b>" {
+		t.Errorf("TestSendTestEvents want message labelled as a test, got %v", content)
+	}
+
+	if _, err := clients.SendTestEvents(&MockService{}); err != ErrTestEventsUnsupported {
+		t.Errorf("TestSendTestEvents want ErrTestEventsUnsupported, got %v", err)
+	}
+}
+
+// sendingTransport records the access token which sent to each room in sentBy. It rejects sends
+// listed in forbidden with HTTP 403, and sends to rooms in flaky with HTTP 502.
+func sendingTransport(forbidden, flaky map[string]bool, sentBy map[string]string) http.RoundTripper {
+	trans := struct{ MockTransport }{}
+	trans.roundTrip = func(req *http.Request) (*http.Response, error) {
+		roomID := sendPathRoomID(req)
+		token := req.URL.Query().Get("access_token")
+		if forbidden[token+" "+roomID] {
+			return &http.Response{StatusCode: 403, Body: ioutil.NopCloser(strings.NewReader(`{}`))}, nil
+		}
+		if flaky[roomID] {
+			// the event may have been sent, so it must not be sent again as the failover client
+			sentBy[roomID] += token
+			return &http.Response{StatusCode: 502, Body: ioutil.NopCloser(strings.NewReader(`{}`))}, nil
+		}
+		sentBy[roomID] = token
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader(`{"event_id":"$1:bar"}`))}, nil
+	}
+	return trans
+}
+
+func TestSendingClient(t *testing.T) {
+	s := &MockWebhookService{
+		DefaultService: types.NewDefaultService("failover_service", "@service:user", "mock-webhook"),
+		rooms:          []string{"!joined:bar", "!kicked:bar", "!nowhere:bar", "!flaky:bar"},
+	}
+	s.FailoverUserIDs = []string{"@backup:user"}
+	store := MockStore{service: s}
+	database.SetServiceDB(&store)
+
+	forbidden := map[string]bool{"token !kicked:bar": true, "token !nowhere:bar": true, "backup_token !nowhere:bar": true}
+	flaky := map[string]bool{"!flaky:bar": true}
+	sentBy := make(map[string]string) // room ID => access token
+	clients := New(&store, &http.Client{Transport: sendingTransport(forbidden, flaky, sentBy)})
+	for userID, token := range map[string]string{"@service:user": "token", "@backup:user": "backup_token"} {
+		mxCli, _ := gomatrix.NewClient("https://someplace.somewhere", userID, token)
+		clients.setClient(clientEntry{config: api.ClientConfig{UserID: userID}, client: mxCli})
+	}
+
+	cli, err := clients.SendingClient(s)
+	if err != nil {
+		t.Fatalf("TestSendingClient: SendingClient failed: %s", err)
+	}
+	req, _ := s.TestWebhookRequests()
+	s.OnReceiveWebhook(httptest.NewRecorder(), types.AsTestRequest(req[0]), cli)
+	want := map[string]string{"!joined:bar": "token", "!kicked:bar": "backup_token", "!flaky:bar": "token"}
+	if !reflect.DeepEqual(sentBy, want) {
+		t.Errorf("TestSendingClient want rooms sent to by %v, got %v", want, sentBy)
+	}
+	checkSendFailovers(t, clients, cli, s)
+
+	// a server error doesn't show that the service user can send to !nowhere:bar again
+	delete(forbidden, "token !kicked:bar")
+	delete(forbidden, "token !nowhere:bar")
+	flaky["!nowhere:bar"] = true
+	s.OnReceiveWebhook(httptest.NewRecorder(), types.AsTestRequest(req[0]), cli)
+	failovers := metrics.SendFailovers("failover_service")
+	if _, ok := failovers["!kicked:bar"]; ok || sentBy["!kicked:bar"] != "token" {
+		t.Errorf("TestSendingClient want !kicked:bar to recover, sent by %s", sentBy["!kicked:bar"])
+	}
+	if _, ok := failovers["!nowhere:bar"]; !ok {
+		t.Errorf("TestSendingClient want !nowhere:bar to stay failed over after HTTP 502, got %v", failovers)
+	}
+}
+
+// checkSendFailovers checks that sends to !kicked:bar failed over to @backup:user, and that sends to
+// !nowhere:bar failed as both clients.
+func checkSendFailovers(t *testing.T, clients *Clients, cli *gomatrix.Client, s types.Service) {
+	failovers := metrics.SendFailovers("failover_service")
+	if len(failovers) != 2 || failovers["!kicked:bar"].UserID != "@backup:user" || failovers["!kicked:bar"].Reason != "HTTP 403" ||
+		failovers["!nowhere:bar"].UserID != "" {
+		t.Errorf("TestSendingClient want failovers for !kicked:bar and !nowhere:bar, got %v", failovers)
+	}
+	res, _ := clients.statusCommand(cli, []types.Service{s}).Command("!kicked:bar", "@someone:bar", nil)
+	if body := res.(*gomatrix.TextMessage).Body; !strings.Contains(body, "Sending: @service:user failed with HTTP 403") ||
+		!strings.Contains(body, "sent as @backup:user instead") {
+		t.Errorf("TestSendingClient want the failover in the status, got %q", body)
+	}
+}
+
+func TestCommandScope(t *testing.T) {
+	var executedInRooms []string
+	s := MockService{commands: []types.Command{
+		types.Command{
+			Path: []string{"test"},
+			Command: func(roomID, userID string, args []string) (interface{}, error) {
+				executedInRooms = append(executedInRooms, roomID)
+				return nil, nil
+			},
+		},
+	}}
+	s.CommandRooms = []string{"!inspace:bar"}
+	store := MockStore{service: &s}
+	database.SetServiceDB(&store)
+
+	cli := &http.Client{Transport: MockTransport{func(*http.Request) (*http.Response, error) {
+		return nil, fmt.Errorf("unhandled test path")
+	}}}
+	clients := New(&store, cli)
+	mxCli, _ := gomatrix.NewClient("https://someplace.somewhere", "@service:user", "token")
+	mxCli.Client = cli
+
+	for _, roomID := range []string{"!inspace:bar", "!elsewhere:bar"} {
+		clients.onMessageEvent(mxCli, &gomatrix.Event{
+			Type:    "m.room.message",
+			Sender:  "@someone:somewhere",
+			RoomID:  roomID,
+			Content: map[string]interface{}{"body": "!test", "msgtype": "m.text"},
+		})
+	}
+	if !reflect.DeepEqual(executedInRooms, []string{"!inspace:bar"}) {
+		t.Errorf("TestCommandScope want command to run in [!inspace:bar], ran in %v", executedInRooms)
+	}
+}
+
+func TestPrivateResponses(t *testing.T) {
+	notice := func(body string) interface{} {
+		return gomatrix.TextMessage{MsgType: "m.notice", Body: body}
+	}
+	s := MockService{commands: []types.Command{
+		types.Command{
+			Path:    []string{"secret"},
+			Private: true,
+			Command: func(roomID, userID string, args []string) (interface{}, error) {
+				return nil, fmt.Errorf("Failed to load secret/repo")
+			},
+		},
+		types.Command{
+			Path:    []string{"mixed"},
+			Private: true,
+			Command: func(roomID, userID string, args []string) (interface{}, error) {
+				return types.PublicResponse(notice("for everyone")), nil
+			},
+		},
+		types.Command{
+			Path: []string{"link"},
+			Command: func(roomID, userID string, args []string) (interface{}, error) {
+				return types.PrivateResponse(notice("log in here")), nil
+			},
+		},
+	}}
+	store := MockStore{service: &s}
+	database.SetServiceDB(&store)
+
+	// The user has left the room they used to have with the client, so a new one is created.
+	direct := []byte(`{"@someone:bar":["!left:bar"]}`)
+	membership := map[string]string{"!left:bar": "leave", "!dm:bar": "invite"}
+	sent := make(map[string][]string) // room ID => bodies
+	cli := &http.Client{Transport: privateTransport(&direct, membership, sent)}
+	clients := New(&store, cli)
+	mxCli, _ := gomatrix.NewClient("https://someplace.somewhere", "@service:user", "token")
+	mxCli.Client = cli
+
+	for _, msg := range []struct{ roomID, body string }{
+		{"!room:bar", "!secret"}, {"!room:bar", "!mixed"}, {"!room:bar", "!link"}, {"!dm:bar", "!link"},
+		{"!room:bar", "!neb whoami"},
+	} {
+		clients.onMessageEvent(mxCli, &gomatrix.Event{
+			Type:    "m.room.message",
+			Sender:  "@someone:bar",
+			RoomID:  msg.roomID,
+			Content: map[string]interface{}{"body": msg.body, "msgtype": "m.text"},
+		})
+	}
+	ack := "@someone:bar: I've sent you the response in a direct message."
+	want := map[string][]string{
+		"!room:bar": {ack, "for everyone", ack, ack},
+		"!dm:bar":   {"Failed to load secret/repo", "log in here", "log in here", "You are @someone:bar. No services here use an auth realm."},
+	}
+	if !reflect.DeepEqual(sent, want) {
+		t.Errorf("TestPrivateResponses want %v, got %v", want, sent)
+	}
+	if string(direct) != `{"@someone:bar":["!left:bar","!dm:bar"]}` {
+		t.Errorf("TestPrivateResponses want the direct message room stored in m.direct, got %s", direct)
+	}
+}
+
+// privateTransport stores the client's m.direct account data in direct, and answers the membership of
+// @someone:bar in each room from membership. The bodies of messages sent are recorded in sent.
+func privateTransport(direct *[]byte, membership map[string]string, sent map[string][]string) http.RoundTripper {
+	return MockTransport{func(req *http.Request) (*http.Response, error) {
+		body := `{}`
+		switch {
+		case strings.HasSuffix(req.URL.Path, "/account_data/m.direct") && req.Method == "GET":
+			if *direct == nil {
+				return &http.Response{StatusCode: 404, Body: ioutil.NopCloser(strings.NewReader(`{"errcode":"M_NOT_FOUND"}`))}, nil
+			}
+			body = string(*direct)
+		case strings.HasSuffix(req.URL.Path, "/account_data/m.direct") && req.Method == "PUT":
+			*direct, _ = ioutil.ReadAll(req.Body)
+		case strings.HasSuffix(req.URL.Path, "/createRoom"):
+			body = `{"room_id":"!dm:bar"}`
+		case strings.HasSuffix(req.URL.Path, "/state/m.room.member/@someone:bar"):
+			roomID := strings.Split(req.URL.Path, "/")[5]
+			body = `{"membership":"` + membership[roomID] + `"}`
+		case sendPathRoomID(req) != "":
+			var content map[string]interface{}
+			if err := json.NewDecoder(req.Body).Decode(&content); err != nil {
+				return nil, err
+			}
+			roomID := sendPathRoomID(req)
+			sent[roomID] = append(sent[roomID], content["body"].(string))
+			body = `{"event_id":"$1:bar"}`
+		default:
+			return nil, fmt.Errorf("unhandled test path %s", req.URL.Path)
+		}
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader(body))}, nil
+	}}
+}
+
+// MockScopedService is a service whose config only holds the rooms it takes commands in.
+type MockScopedService struct {
+	types.DefaultService
+	types.CommandScope
+}
+
+func TestSpaceRooms(t *testing.T) {
+	types.RegisterService(func(serviceID, serviceUserID, webhookEndpointURL string) types.Service {
+		return &MockScopedService{DefaultService: types.NewDefaultService(serviceID, serviceUserID, "mock_scoped")}
+	})
+	store := MockStore{}
+	var requestedPaths []string
+	trans := MockTransport{func(req *http.Request) (*http.Response, error) {
+		requestedPaths = append(requestedPaths, req.URL.Path+"?from="+req.URL.Query().Get("from"))
+		var body string
+		switch req.URL.Path {
+		case "/_matrix/client/r0/directory/room/#team:bar":
+			body = `{"room_id":"!space:bar"}`
+		case "/_matrix/client/v1/rooms/!space:bar/hierarchy":
+			if req.URL.Query().Get("from") == "" {
+				body = `{"rooms":[
+					{"room_id":"!space:bar","room_type":"m.space"},
+					{"room_id":"!ops:bar"},
+					{"room_id":"!subspace:bar","room_type":"m.space"}
+				],"next_batch":"page2"}`
+			} else {
+				body = `{"rooms":[{"room_id":"!dev:bar"},{"room_id":"!ops:bar"}]}`
+			}
+		default:
+			return nil, fmt.Errorf("unhandled test path %s", req.URL.Path)
+		}
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader(body))}, nil
+	}}
+	cli := &http.Client{Transport: trans}
+	clients := New(&store, cli)
+	mxCli, _ := gomatrix.NewClient("https://someplace.somewhere", "@service:user", "token")
+	mxCli.Client = cli
+	clients.setClient(clientEntry{config: api.ClientConfig{UserID: "@service:user"}, client: mxCli})
+
+	config, spaces, err := clients.ExpandSpaces("@service:user", "mock_scoped", []byte(`{"command_rooms":["space:#team:bar"]}`))
+	if err != nil {
+		t.Fatalf("TestSpaceRooms: ExpandSpaces failed: %s (requested %v)", err, requestedPaths)
+	}
+	wantRooms := []string{"!dev:bar", "!ops:bar"}
+	if !reflect.DeepEqual(spaces["#team:bar"], wantRooms) {
+		t.Errorf("TestSpaceRooms want space rooms %v, got %v", wantRooms, spaces)
+	}
+	if string(config) != `{"command_rooms":["!dev:bar","!ops:bar"]}` {
+		t.Errorf("TestSpaceRooms want expanded config with the rooms of the space, got %s", config)
+	}
+}
+
+func (s *MockWebhookService) RoomTargets(roomID string) []string {
+	for _, r := range s.rooms {
+		if r == roomID {
+			return []string{"builds"}
+		}
+	}
+	return nil
+}
+
+func TestStatusCommand(t *testing.T) {
+	s := &MockWebhookService{
+		DefaultService: types.NewDefaultService("status_service", "@service:user", "mock-webhook"),
+		rooms:          []string{"!notified:bar"},
+	}
+	store := MockStore{service: s}
+	clients := New(&store, &http.Client{})
+	mxCli, _ := gomatrix.NewClient("https://someplace.somewhere", "@service:user", "token")
+	cmd := clients.statusCommand(mxCli, []types.Service{s})
+
+	res, err := cmd.Command("!elsewhere:bar", "@someone:bar", nil)
+	if err != nil {
+		t.Fatalf("TestStatusCommand: command failed: %s", err)
+	}
+	if body := res.(*gomatrix.TextMessage).Body; body != "No services are active in this room" {
+		t.Errorf("TestStatusCommand want no services for an unrelated room, got %q", body)
+	}
+
+	res, _ = cmd.Command("!notified:bar", "@someone:bar", nil)
+	body := res.(*gomatrix.TextMessage).Body
+	for _, want := range []string{"status_service (mock-webhook)", "Routes here: builds", "Last webhook: none received"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("TestStatusCommand want %q in the status, got %q", want, body)
+		}
+	}
+
+	metrics.RecordWebhookDelivery("status_service", 500)
+	res, _ = cmd.Command("!notified:bar", "@someone:bar", nil)
+	if body := res.(*gomatrix.TextMessage).Body; !strings.Contains(body, "HTTP 500") {
+		t.Errorf("TestStatusCommand want the last webhook result in the status, got %q", body)
+	}
+
+	// services are only listed for their commands in the rooms they are scoped to
+	commander := &MockService{
+		DefaultService: types.NewDefaultService("command_service", "@service:user", "mock"),
+		commands:       []types.Command{{Path: []string{"test"}}},
+	}
+	cmd = clients.statusCommand(mxCli, []types.Service{commander})
+	if res, _ := cmd.Command("!elsewhere:bar", "@someone:bar", nil); res.(*gomatrix.TextMessage).Body != "No services are active in this room" {
+		t.Errorf("TestStatusCommand want unscoped commands not to be listed, got %q", res.(*gomatrix.TextMessage).Body)
+	}
+	commander.CommandRooms = []string{"!commands:bar"}
+	if res, _ := cmd.Command("!commands:bar", "@someone:bar", nil); !strings.Contains(res.(*gomatrix.TextMessage).Body, "command_service (mock)\n  Commands: !test") {
+		t.Errorf("TestStatusCommand want scoped commands to be listed, got %q", res.(*gomatrix.TextMessage).Body)
+	}
+	if res, _ := cmd.Command("!elsewhere:bar", "@someone:bar", nil); res.(*gomatrix.TextMessage).Body != "No services are active in this room" {
+		t.Errorf("TestStatusCommand want scoped commands not to be listed in other rooms, got %q", res.(*gomatrix.TextMessage).Body)
+	}
+}
+
+type MockDependentService struct {
+	types.DefaultService
+	observed []string
+}
+
+func (s *MockDependentService) ClientUserIDs() []string {
+	return []string{"@service:user", "@other:user"}
+}
+
+func (s *MockDependentService) OnMessageEvent(cli *gomatrix.Client, event *gomatrix.Event) {
+	s.observed = append(s.observed, cli.UserID+" "+event.ID)
+}
+
+func (s *MockDependentService) OnRedactionEvent(cli *gomatrix.Client, event *gomatrix.Event) {
+	s.observed = append(s.observed, cli.UserID+" "+event.ID)
+}
+
+type MockDependentStore struct {
+	database.NopStorage
+	service   types.Service
+	typeLoads int
+}
+
+func (d *MockDependentStore) LoadServicesForUser(userID string) ([]types.Service, error) {
+	if userID == d.service.ServiceUserID() {
+		return []types.Service{d.service}, nil
+	}
+	return nil, nil
+}
+
+func (d *MockDependentStore) LoadServicesByType(serviceType string) ([]types.Service, error) {
+	d.typeLoads++
+	if serviceType == d.service.ServiceType() {
+		return []types.Service{d.service}, nil
+	}
+	return nil, nil
+}
+
+func TestClientDependentServices(t *testing.T) {
+	s := &MockDependentService{DefaultService: types.NewDefaultService("dependent", "@service:user", "mock_dependent")}
+	types.RegisterService(func(serviceID, serviceUserID, webhookEndpointURL string) types.Service {
+		return &MockDependentService{DefaultService: types.NewDefaultService(serviceID, serviceUserID, "mock_dependent")}
+	})
+	store := &MockDependentStore{service: s}
+	database.SetServiceDB(store)
+
+	cli := &http.Client{Transport: MockTransport{func(*http.Request) (*http.Response, error) {
+		return nil, fmt.Errorf("unhandled test path")
+	}}}
+	clients := New(store, cli)
+	if err := clients.loadDependentServices(); err != nil {
+		t.Fatalf("TestClientDependentServices: failed to load dependent services: %s", err)
+	}
+	loads := store.typeLoads
+	for _, userID := range []string{"@service:user", "@other:user", "@unused:user"} {
+		mxCli, _ := gomatrix.NewClient("https://someplace.somewhere", userID, "token")
+		mxCli.Client = cli
+		clients.onMessageEvent(mxCli, &gomatrix.Event{
+			ID:      "$message",
+			Type:    "m.room.message",
+			Sender:  "@someone:somewhere",
+			RoomID:  "!foo:bar",
+			Content: map[string]interface{}{"body": "hello", "msgtype": "m.text"},
+		})
+		clients.onRedactionEvent(mxCli, &gomatrix.Event{
+			ID:      "$redaction",
+			Type:    "m.room.redaction",
+			Sender:  "@someone:somewhere",
+			RoomID:  "!foo:bar",
+			Content: map[string]interface{}{"redacts": "$message"},
+		})
+	}
+	want := []string{"@service:user $message", "@service:user $redaction", "@other:user $message", "@other:user $redaction"}
+	if !reflect.DeepEqual(s.observed, want) {
+		t.Errorf("TestClientDependentServices want %v, got %v", want, s.observed)
+	}
+	if store.typeLoads != loads {
+		t.Errorf("TestClientDependentServices: services were loaded by type for each event")
+	}
+
+	// Once the service is deleted, other clients no longer tell it about events.
+	clients.ServiceDeleted(s.ServiceID())
+	s.observed = nil
+	mxCli, _ := gomatrix.NewClient("https://someplace.somewhere", "@other:user", "token")
+	mxCli.Client = cli
+	clients.onMessageEvent(mxCli, &gomatrix.Event{ID: "$later", Type: "m.room.message", RoomID: "!foo:bar"})
+	if len(s.observed) != 0 {
+		t.Errorf("TestClientDependentServices: deleted service observed %v", s.observed)
+	}
+}
+
+// approvalTestCommands returns commands which need approval, and record who they ran as in ranAs.
+func approvalTestCommands(ranAs *[]string) []types.Command {
+	return []types.Command{
+		types.Command{
+			Path:     []string{"silence"},
+			Approval: &types.ApprovalPolicy{},
+			Command: func(roomID, userID string, args []string) (interface{}, error) {
+				*ranAs = append(*ranAs, userID+" "+strings.Join(args, " "))
+				return &gomatrix.TextMessage{MsgType: "m.notice", Body: "silenced"}, nil
+			},
+		},
+		types.Command{
+			Path:     []string{"restart"},
+			Approval: &types.ApprovalPolicy{Timeout: 10 * time.Millisecond},
+			Command: func(roomID, userID string, args []string) (interface{}, error) {
+				*ranAs = append(*ranAs, userID+" restart")
+				return nil, nil
+			},
+		},
+		types.Command{
+			Path:     []string{"ack"},
+			Approval: &types.ApprovalPolicy{PowerLevel: -1},
+			Command: func(roomID, userID string, args []string) (interface{}, error) {
+				*ranAs = append(*ranAs, userID+" ack")
+				return nil, nil
+			},
+		},
+	}
+}
+
+// approvalRoom is !ops:user, in which @boss:user has power level 100. It records the notices which
+// clients send to it.
+type approvalRoom struct {
+	clients *Clients
+	mu      sync.Mutex
+	notices []string
+}
+
+func newApprovalRoom(ranAs *[]string) *approvalRoom {
+	room := &approvalRoom{}
+	store := MockStore{service: &MockService{commands: approvalTestCommands(ranAs)}}
+	database.SetServiceDB(&store)
+	room.clients = New(&store, &http.Client{Transport: MockTransport{room.roundTrip}})
+	return room
+}
+
+func (r *approvalRoom) roundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == "GET" && strings.HasSuffix(req.URL.Path, "/state/m.room.power_levels") {
+		body := `{"users":{"@boss:user":100},"users_default":0}`
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader(body))}, nil
+	}
+	if req.Method != "PUT" {
+		return nil, fmt.Errorf("unhandled test path")
+	}
+	var content map[string]interface{}
+	json.NewDecoder(req.Body).Decode(&content)
+	r.mu.Lock()
+	r.notices = append(r.notices, content["body"].(string))
+	eventID := fmt.Sprintf("$notice%d", len(r.notices))
+	r.mu.Unlock()
+	return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader(`{"event_id":"` + eventID + `"}`))}, nil
+}
+
+// client returns the client with the given user ID.
+func (r *approvalRoom) client(userID string) *gomatrix.Client {
+	mxCli, _ := gomatrix.NewClient("https://someplace.somewhere", userID, "token")
+	mxCli.Client = &http.Client{Transport: MockTransport{r.roundTrip}}
+	return mxCli
+}
+
+// say tells the client about a message from the sender in the room.
+func (r *approvalRoom) say(client *gomatrix.Client, sender, body string) {
+	r.clients.onMessageEvent(client, &gomatrix.Event{
+		Type:    "m.room.message",
+		Sender:  sender,
+		RoomID:  "!ops:user",
+		Content: map[string]interface{}{"body": body, "msgtype": "m.text"},
+	})
+}
+
+// lastNotices returns the last n notices sent to the room.
+func (r *approvalRoom) lastNotices(n int) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.notices) < n {
+		return r.notices
+	}
+	return append([]string{}, r.notices[len(r.notices)-n:]...)
+}
+
+func (r *approvalRoom) lastNotice() string {
+	if notices := r.lastNotices(1); len(notices) > 0 {
+		return notices[0]
+	}
+	return ""
+}
+
+func TestCommandApproval(t *testing.T) {
+	var ranAs []string
+	room := newApprovalRoom(&ranAs)
+	mxCli := room.client("@service:user")
+
+	room.say(mxCli, "@alice:user", "!silence disk alerts")
+	if len(ranAs) != 0 || !strings.Contains(room.lastNotice(), `"!neb approve 1"`) {
+		t.Fatalf("TestCommandApproval wanted the command to wait for approval, ran %v, notices %v", ranAs, room.notices)
+	}
+	room.say(mxCli, "@alice:user", "!neb approve 1")
+	if len(ranAs) != 0 || room.lastNotice() != "Another user must approve your command" {
+		t.Errorf("TestCommandApproval wanted an error approving your own command, got %q", room.lastNotice())
+	}
+	room.say(mxCli, "@bob:user", "!neb approve 1")
+	if len(ranAs) != 0 || room.lastNotice() != "You need power level 50 to approve this command" {
+		t.Errorf("TestCommandApproval wanted an error approving without power, got %q", room.lastNotice())
+	}
+	room.clients.onReactionEvent(mxCli, &gomatrix.Event{
+		Type:   "m.reaction",
+		Sender: "@boss:user",
+		RoomID: "!ops:user",
+		Content: map[string]interface{}{
+			"m.relates_to": map[string]interface{}{"rel_type": "m.annotation", "event_id": "$notice1", "key": "👍"},
+		},
+	})
+	if !reflect.DeepEqual(ranAs, []string{"@alice:user disk alerts"}) {
+		t.Fatalf("TestCommandApproval wanted the command to run as @alice:user once approved, ran %v", ranAs)
+	}
+	approved := room.lastNotices(2)
+	if !reflect.DeepEqual(approved, []string{"@boss:user approved !silence disk alerts for @alice:user", "silenced"}) {
+		t.Errorf("TestCommandApproval wanted the approver and the response to be sent, got %v", approved)
+	}
+	room.say(mxCli, "@boss:user", "!neb approve 1")
+	if len(ranAs) != 1 {
+		t.Errorf("TestCommandApproval wanted the command to only run once, ran %v", ranAs)
+	}
+}
+
+func TestCommandApprovalExpiry(t *testing.T) {
+	var ranAs []string
+	room := newApprovalRoom(&ranAs)
+	mxCli := room.client("@service:user")
+
+	room.say(mxCli, "@alice:user", "!restart")
+	time.Sleep(50 * time.Millisecond)
+	if room.lastNotice() != "!restart was not approved in time, so it will not run" {
+		t.Errorf("TestCommandApprovalExpiry wanted the command to expire, got %q", room.lastNotice())
+	}
+	room.say(mxCli, "@bob:user", "!neb approve 1")
+	if len(ranAs) != 0 {
+		t.Errorf("TestCommandApprovalExpiry wanted an expired command not to run, ran %v", ranAs)
+	}
+}
+
+// Other clients in the room don't respond to approvals of commands which they didn't park.
+func TestCommandApprovalByOtherClient(t *testing.T) {
+	var ranAs []string
+	room := newApprovalRoom(&ranAs)
+	mxCli := room.client("@service:user")
+	otherCli := room.client("@other:user")
+
+	// A negative power level lets anyone else approve.
+	room.say(mxCli, "@alice:user", "!ack")
+	room.say(otherCli, "@bob:user", "!neb approve 1")
+	room.say(otherCli, "@alice:user", "!neb cancel 1")
+	if len(room.notices) != 1 {
+		t.Errorf("TestCommandApprovalByOtherClient wanted other clients to stay silent, got %v", room.notices)
+	}
+	room.say(mxCli, "@bob:user", "!neb approve 1")
+	if len(ranAs) != 1 || ranAs[0] != "@alice:user ack" {
+		t.Errorf("TestCommandApprovalByOtherClient wanted any other user to be able to approve, ran %v", ranAs)
+	}
+}
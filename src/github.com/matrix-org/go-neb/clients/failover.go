@@ -0,0 +1,178 @@
+package clients
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/metrics"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+)
+
+// SendingClient returns the client which the service should send notifications with. This is the client
+// of its service user, unless the service names failover clients. Then the returned client sends each
+// event as the service user where it can, and as the first failover client which can otherwise. This is
+// decided per room, and the rooms which needed a failover client are recorded in the service's health.
+// An event is only sent as another client if the homeserver rejected it, so that it is never posted twice.
+func (c *Clients) SendingClient(service types.Service) (*gomatrix.Client, error) {
+	cli, err := c.Client(service.ServiceUserID())
+	if err != nil {
+		return nil, err
+	}
+	sender, ok := service.(types.FailoverSender)
+	if !ok || len(sender.FailoverUsers()) == 0 {
+		return cli, nil
+	}
+
+	transport := &failoverTransport{
+		clients:   c,
+		base:      http.DefaultTransport,
+		serviceID: service.ServiceID(),
+		userIDs:   sender.FailoverUsers(),
+	}
+	if c.httpClient != nil && c.httpClient.Transport != nil {
+		transport.base = c.httpClient.Transport
+	}
+	failoverCli, err := gomatrix.NewClient(cli.HomeserverURL.String(), cli.UserID, cli.AccessToken)
+	if err != nil {
+		return nil, err
+	}
+	failoverCli.Client = &http.Client{Transport: transport}
+	failoverCli.Store = cli.Store
+	return failoverCli, nil
+}
+
+// failoverTransport sends events to rooms as the failover clients when the service user can't.
+type failoverTransport struct {
+	clients   *Clients
+	base      http.RoundTripper
+	serviceID string
+	userIDs   []string
+}
+
+func (t *failoverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	roomID := sendPathRoomID(req)
+	if roomID == "" {
+		return t.base.RoundTrip(req)
+	}
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+	}
+
+	res, err := t.base.RoundTrip(withBody(req, body))
+	if !needsFailover(res, err) {
+		// Other failures say nothing about whether the service user can send to the room again.
+		if err == nil && res.StatusCode/100 == 2 {
+			metrics.RecordSendRecovered(t.serviceID, roomID)
+		}
+		return res, err
+	}
+	return t.sendAsFailover(req, body, roomID, res, err)
+}
+
+// sendAsFailover sends the request as each failover client in turn, until one of them sends it or it
+// may have been sent. res and err are the result of sending it as the service user, and are returned
+// if none of them can.
+func (t *failoverTransport) sendAsFailover(req *http.Request, body []byte, roomID string, res *http.Response, err error) (*http.Response, error) {
+	var reason string
+	if err != nil {
+		reason = err.Error()
+	} else {
+		reason = "HTTP " + strconv.Itoa(res.StatusCode)
+	}
+	logger := log.WithFields(log.Fields{
+		"service_id": t.serviceID,
+		"room_id":    roomID,
+		"reason":     reason,
+	})
+
+	for _, userID := range t.userIDs {
+		cli, cliErr := t.clients.Client(userID)
+		if cliErr != nil {
+			logger.WithError(cliErr).WithField("user_id", userID).Warn("Failed to load failover client")
+			continue
+		}
+		failoverRes, failoverErr := t.base.RoundTrip(asClient(withBody(req, body), cli))
+		if failoverErr == nil && failoverRes.StatusCode/100 == 2 {
+			logger.WithField("user_id", userID).Warn("Sent as failover client")
+			metrics.RecordSendFailover(t.serviceID, roomID, userID, reason)
+			if res != nil {
+				res.Body.Close()
+			}
+			return failoverRes, nil
+		}
+		if !needsFailover(failoverRes, failoverErr) {
+			// The event may have been sent, so sending it as the next client could post it twice.
+			logger.WithField("user_id", userID).Warn("Failed to send as failover client")
+			if failoverErr == nil {
+				failoverRes.Body.Close()
+			}
+			break
+		}
+		failoverRes.Body.Close()
+	}
+	logger.Warn("Failed to send as any failover client")
+	metrics.RecordSendFailover(t.serviceID, roomID, "", reason)
+	return res, err
+}
+
+// needsFailover returns true if the response shows that the homeserver rejected the event because the
+// client is rate-limited, not allowed to send to the room or has had its access token revoked. Network
+// errors and 5xx responses return false, as the event may have been sent regardless and sending it as
+// another client, which has its own transaction IDs, would post it twice.
+func needsFailover(res *http.Response, err error) bool {
+	if err != nil {
+		return false
+	}
+	switch res.StatusCode {
+	case 401, 403, 429:
+		return true
+	}
+	return false
+}
+
+// withBody returns a copy of req which sends the given body.
+func withBody(req *http.Request, body []byte) *http.Request {
+	r := req.WithContext(req.Context())
+	if body != nil {
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+	}
+	return r
+}
+
+// asClient changes req to be sent to the homeserver of the client with its access token.
+func asClient(req *http.Request, cli *gomatrix.Client) *http.Request {
+	u := *req.URL
+	u.Scheme = cli.HomeserverURL.Scheme
+	u.Host = cli.HomeserverURL.Host
+	query := u.Query()
+	query.Set("access_token", cli.AccessToken)
+	u.RawQuery = query.Encode()
+	req.URL = &u
+	req.Host = u.Host
+	return req
+}
+
+// sendPathRoomID returns the room ID if req sends an event to a room, else "".
+func sendPathRoomID(req *http.Request) string {
+	if req.Method != "PUT" {
+		return ""
+	}
+	segments := strings.Split(req.URL.Path, "/")
+	for i := 0; i+2 < len(segments); i++ {
+		if segments[i] == "rooms" && segments[i+2] == "send" {
+			return segments[i+1]
+		}
+	}
+	return ""
+}
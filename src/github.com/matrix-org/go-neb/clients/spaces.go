@@ -0,0 +1,150 @@
+package clients
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+)
+
+// spaceChangeDelay is how long to wait after a space changes before telling the space change
+// handler, so that a burst of changes (e.g. from an initial sync) only results in one call.
+var spaceChangeDelay = 5 * time.Second
+
+// respHierarchy is the response of GET /rooms/{roomId}/hierarchy
+type respHierarchy struct {
+	Rooms []struct {
+		RoomID   string `json:"room_id"`
+		RoomType string `json:"room_type"`
+	} `json:"rooms"`
+	NextBatch string `json:"next_batch"`
+}
+
+// SpaceRooms returns the sorted room IDs of the rooms in the space, including the rooms in any
+// subspaces, as seen by the client with the given user ID. The space can be a room ID or an alias.
+// Subspaces are not included themselves.
+func (c *Clients) SpaceRooms(userID, space string) ([]string, error) {
+	client, err := c.Client(userID)
+	if err != nil {
+		return nil, err
+	}
+	spaceID := space
+	if strings.HasPrefix(space, "#") {
+		if spaceID, err = resolveAlias(client, space); err != nil {
+			return nil, fmt.Errorf("Failed to resolve space alias %s: %s", space, err)
+		}
+	}
+
+	seen := map[string]bool{spaceID: true}
+	var rooms []string
+	from := ""
+	for {
+		res, err := hierarchyPage(client, spaceID, from)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load the rooms of space %s: %s", space, err)
+		}
+		for _, room := range res.Rooms {
+			if seen[room.RoomID] || room.RoomType == "m.space" {
+				continue
+			}
+			seen[room.RoomID] = true
+			rooms = append(rooms, room.RoomID)
+		}
+		if res.NextBatch == "" || res.NextBatch == from {
+			break
+		}
+		from = res.NextBatch
+	}
+	sort.Strings(rooms)
+	return rooms, nil
+}
+
+// resolveAlias returns the room ID of the room alias.
+func resolveAlias(client *gomatrix.Client, alias string) (string, error) {
+	resBody, err := client.SendJSON("GET", client.BuildURL("directory", "room", alias), nil)
+	if err != nil {
+		return "", err
+	}
+	var res struct {
+		RoomID string `json:"room_id"`
+	}
+	if err := json.Unmarshal(resBody, &res); err != nil {
+		return "", err
+	}
+	return res.RoomID, nil
+}
+
+// hierarchyPage returns the page of the room hierarchy of the space which starts at from, or the
+// first page if from is empty.
+func hierarchyPage(client *gomatrix.Client, spaceID, from string) (*respHierarchy, error) {
+	u, _ := url.Parse(client.BuildBaseURL("_matrix/client/v1/rooms", spaceID, "hierarchy"))
+	if from != "" {
+		q := u.Query()
+		q.Set("from", from)
+		u.RawQuery = q.Encode()
+	}
+	resBody, err := client.SendJSON("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	var res respHierarchy
+	if err := json.Unmarshal(resBody, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// ExpandSpaces replaces every space reference in the JSON config of a service of the given type with
+// the rooms of the space, as seen by the client with the given user ID. Returns the expanded config
+// along with the rooms of each space which was referenced.
+func (c *Clients) ExpandSpaces(userID, serviceType string, config []byte) ([]byte, map[string][]string, error) {
+	spaces := make(map[string][]string)
+	for _, space := range types.SpaceReferences(serviceType, config) {
+		rooms, err := c.SpaceRooms(userID, space)
+		if err != nil {
+			return nil, nil, err
+		}
+		spaces[space] = rooms
+	}
+	if len(spaces) == 0 {
+		return config, nil, nil
+	}
+	expanded, err := types.ExpandSpaces(serviceType, config, spaces)
+	return expanded, spaces, err
+}
+
+// OnSpaceChange sets the function which is called with the user ID of a syncing client when a space
+// which that client can see gains or loses a child room.
+func (c *Clients) OnSpaceChange(fn func(userID string)) {
+	c.mapMutex.Lock()
+	defer c.mapMutex.Unlock()
+	c.spaceChangeHandler = fn
+}
+
+func (c *Clients) onSpaceChildEvent(client *gomatrix.Client, event *gomatrix.Event) {
+	c.mapMutex.Lock()
+	defer c.mapMutex.Unlock()
+	if c.spaceChangeHandler == nil || c.spaceChangePending[client.UserID] {
+		return
+	}
+	c.spaceChangePending[client.UserID] = true
+	handler := c.spaceChangeHandler
+	log.WithFields(log.Fields{
+		"room_id":         event.RoomID,
+		"service_user_id": client.UserID,
+	}).Info("Space children changed")
+
+	go func() {
+		time.Sleep(spaceChangeDelay)
+		c.mapMutex.Lock()
+		delete(c.spaceChangePending, client.UserID)
+		c.mapMutex.Unlock()
+		handler(client.UserID)
+	}()
+}
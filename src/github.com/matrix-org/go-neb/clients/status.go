@@ -0,0 +1,194 @@
+package clients
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/metrics"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+)
+
+// statusTimeFormat is the format of times in the "!neb status" response.
+const statusTimeFormat = "2006-01-02 15:04:05 MST"
+
+// statusCommand returns the "!neb status" command, which lists the services of this client which target
+// the room along with their health, so that room members can see why a notification didn't arrive.
+func (c *Clients) statusCommand(client *gomatrix.Client, services []types.Service) types.Command {
+	return types.Command{
+		Path: []string{"neb", "status"},
+		Help: "List the services which are active in this room and their status",
+		Command: func(roomID, userID string, args []string) (interface{}, error) {
+			var sections []string
+			for _, service := range services {
+				if lines := c.serviceStatus(client, service, roomID, userID); lines != nil {
+					sections = append(sections, strings.Join(lines, "\n"))
+				}
+			}
+			if len(sections) == 0 {
+				return &gomatrix.TextMessage{MsgType: "m.notice", Body: "No services are active in this room"}, nil
+			}
+			header := fmt.Sprintf("%d service(s) active in this room:", len(sections))
+			return &gomatrix.TextMessage{MsgType: "m.notice", Body: header + "\n" + strings.Join(sections, "\n")}, nil
+		},
+	}
+}
+
+// whoamiCommand returns the "!neb whoami" command, which tells the user whether they are logged into the
+// auth realms of this client's services. The response is private, as it shows which accounts the user has.
+func (c *Clients) whoamiCommand(services []types.Service) types.Command {
+	return types.Command{
+		Path:    []string{"neb", "whoami"},
+		Help:    "Show which auth realms you are logged into, in a direct message",
+		Private: true,
+		Command: func(roomID, userID string, args []string) (interface{}, error) {
+			seen := make(map[string]bool)
+			var realmIDs []string
+			for _, service := range services {
+				dependent, ok := service.(types.RealmDependent)
+				if !ok {
+					continue
+				}
+				for _, realmID := range dependent.RealmIDs() {
+					if !seen[realmID] {
+						seen[realmID] = true
+						realmIDs = append(realmIDs, realmID)
+					}
+				}
+			}
+			if len(realmIDs) == 0 {
+				return &gomatrix.TextMessage{MsgType: "m.notice", Body: "You are " + userID + ". No services here use an auth realm."}, nil
+			}
+			sort.Strings(realmIDs)
+			lines := []string{"You are " + userID + "."}
+			for _, realmID := range realmIDs {
+				lines = append(lines, fmt.Sprintf("Realm %s: %s", realmID, c.sessionStatus(realmID, userID)))
+			}
+			return &gomatrix.TextMessage{MsgType: "m.notice", Body: strings.Join(lines, "\n")}, nil
+		},
+	}
+}
+
+// serviceStatus returns the lines describing the status of the service in the room, or nil if the
+// service isn't active in the room. A service is active in the room if it routes anything to it, or if
+// its commands are scoped to rooms which include it. Services whose commands can be used in every room
+// aren't listed in every room for that alone.
+func (c *Clients) serviceStatus(client *gomatrix.Client, service types.Service, roomID, userID string) []string {
+	targets, targeted := roomTargets(service, roomID)
+	commands := commandNames(client, service, roomID)
+	scoper, ok := service.(types.CommandScoper)
+	scopedHere := ok && scoper.HasCommandScope() && len(commands) > 0
+	if !targeted && !scopedHere {
+		return nil
+	}
+
+	lines := []string{fmt.Sprintf("%s (%s)", service.ServiceID(), service.ServiceType())}
+	if len(targets) > 0 {
+		lines = append(lines, "  Routes here: "+strings.Join(targets, "; "))
+	}
+	if len(commands) > 0 {
+		lines = append(lines, "  Commands: "+strings.Join(commands, ", "))
+	}
+	lines = append(lines, activityStatus(service, roomID)...)
+	if dependent, ok := service.(types.RealmDependent); ok {
+		for _, realmID := range dependent.RealmIDs() {
+			lines = append(lines, fmt.Sprintf("  Realm %s: %s", realmID, c.sessionStatus(realmID, userID)))
+		}
+	}
+	return lines
+}
+
+// activityStatus returns the lines describing the webhooks, polling and sending of the service in the room.
+func activityStatus(service types.Service, roomID string) []string {
+	var lines []string
+	if d, ok := metrics.LastWebhookDelivery(service.ServiceID()); ok {
+		lines = append(lines, fmt.Sprintf("  Last webhook: %s, HTTP %d", d.Time.UTC().Format(statusTimeFormat), d.StatusCode))
+	} else if _, ok := service.(types.WebhookTester); ok {
+		lines = append(lines, "  Last webhook: none received since Go-NEB started")
+	}
+	if _, ok := service.(types.Poller); ok {
+		lines = append(lines, "  Polling: "+pollStatus(service.ServiceID()))
+	}
+	if f, ok := metrics.SendFailovers(service.ServiceID())[roomID]; ok {
+		lines = append(lines, "  Sending: "+failoverStatus(service.ServiceUserID(), f))
+	}
+	return lines
+}
+
+// roomTargets returns what the service routes to the room, and whether it targets the room at all.
+// Services which don't implement types.RoomReporter target the room if their config mentions it.
+func roomTargets(service types.Service, roomID string) ([]string, bool) {
+	if reporter, ok := service.(types.RoomReporter); ok {
+		targets := reporter.RoomTargets(roomID)
+		return targets, len(targets) > 0
+	}
+	config, err := json.Marshal(service)
+	if err != nil {
+		return nil, false
+	}
+	quotedRoomID, _ := json.Marshal(roomID)
+	return nil, strings.Contains(string(config), string(quotedRoomID))
+}
+
+// commandNames returns the distinct top-level commands of the service which can be used in the room.
+func commandNames(client *gomatrix.Client, service types.Service, roomID string) []string {
+	if scoper, ok := service.(types.CommandScoper); ok && !scoper.InCommandScope(roomID) {
+		return nil
+	}
+	seen := make(map[string]bool)
+	var names []string
+	for _, cmd := range service.Commands(client) {
+		if len(cmd.Path) == 0 || seen[cmd.Path[0]] {
+			continue
+		}
+		seen[cmd.Path[0]] = true
+		names = append(names, "!"+cmd.Path[0])
+	}
+	if len(service.Expansions(client)) > 0 {
+		names = append(names, "(expansions)")
+	}
+	sort.Strings(names)
+	return names
+}
+
+func pollStatus(serviceID string) string {
+	st, ok := metrics.LastPollState(serviceID)
+	if !ok {
+		return "has not polled since Go-NEB started"
+	}
+	last := st.LastPoll.UTC().Format(statusTimeFormat)
+	if !st.Running {
+		if st.LastPoll.IsZero() {
+			return "stopped"
+		}
+		return "stopped, last polled " + last
+	}
+	return fmt.Sprintf("last polled %s, next poll in %s", last, st.NextPoll.Sub(time.Now()).Round(time.Second))
+}
+
+// failoverStatus describes why the service user couldn't send to a room and who sent instead.
+func failoverStatus(serviceUserID string, f metrics.SendFailover) string {
+	failed := fmt.Sprintf("%s failed with %s at %s", serviceUserID, f.Reason, f.Time.UTC().Format(statusTimeFormat))
+	if f.UserID == "" {
+		return failed + ", and no failover client could send"
+	}
+	return failed + ", sent as " + f.UserID + " instead"
+}
+
+// sessionStatus describes the auth session of the user with the realm.
+func (c *Clients) sessionStatus(realmID, userID string) string {
+	session, err := c.db.LoadAuthSessionByUser(realmID, userID)
+	if err == sql.ErrNoRows || (err == nil && session == nil) {
+		return "you are not logged in"
+	} else if err != nil {
+		return "failed to load your session"
+	}
+	if !session.Authenticated() {
+		return "your login has not been completed"
+	}
+	return "you are logged in"
+}
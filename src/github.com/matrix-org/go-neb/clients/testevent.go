@@ -0,0 +1,234 @@
+package clients
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+)
+
+// The label prepended to notifications sent as a result of a test event.
+const (
+	testLabel     = "[TEST] "
+	testLabelHTML = "<strong>[TEST]</strong> "
+)
+
+// ErrTestEventsUnsupported is returned when a service cannot generate test events.
+var ErrTestEventsUnsupported = errors.New("service does not support test events")
+
+// TestEventResult is the outcome of running synthetic test events through a service.
+type TestEventResult struct {
+	ServiceID   string
+	ServiceType string
+	// The HTTP status codes the service responded with, one per test request.
+	StatusCodes []int
+	// The rooms which received a test notification.
+	Rooms []string
+	// The rooms which the service tried to notify but could not, mapped to the reason why.
+	FailedRooms map[string]string
+}
+
+// SendTestEvents runs the sample webhook requests of the service through its OnReceiveWebhook
+// function. Any notifications sent as a result are labelled as a test. Returns
+// ErrTestEventsUnsupported if the service does not implement types.WebhookTester.
+func (c *Clients) SendTestEvents(service types.Service) (*TestEventResult, error) {
+	tester, ok := service.(types.WebhookTester)
+	if !ok {
+		return nil, ErrTestEventsUnsupported
+	}
+	reqs, err := tester.TestWebhookRequests()
+	if err != nil {
+		return nil, err
+	}
+	cli, err := c.Client(service.ServiceUserID())
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &testEventTransport{
+		base:   http.DefaultTransport,
+		sent:   make(map[string]bool),
+		failed: make(map[string]string),
+	}
+	if c.httpClient != nil && c.httpClient.Transport != nil {
+		transport.base = c.httpClient.Transport
+	}
+	testCli, err := gomatrix.NewClient(cli.HomeserverURL.String(), cli.UserID, cli.AccessToken)
+	if err != nil {
+		return nil, err
+	}
+	testCli.Client = &http.Client{Transport: transport}
+	testCli.Store = cli.Store
+
+	result := &TestEventResult{
+		ServiceID:   service.ServiceID(),
+		ServiceType: service.ServiceType(),
+		FailedRooms: make(map[string]string),
+	}
+	for _, req := range reqs {
+		w := httptest.NewRecorder()
+		service.OnReceiveWebhook(w, types.AsTestRequest(req), testCli)
+		result.StatusCodes = append(result.StatusCodes, w.Code)
+	}
+
+	for roomID := range transport.sent {
+		result.Rooms = append(result.Rooms, roomID)
+	}
+	sort.Strings(result.Rooms)
+	for roomID, reason := range transport.failed {
+		if !transport.sent[roomID] {
+			result.FailedRooms[roomID] = reason
+		}
+	}
+	log.WithFields(log.Fields{
+		"service_id":   result.ServiceID,
+		"service_type": result.ServiceType,
+		"rooms":        result.Rooms,
+		"failed_rooms": result.FailedRooms,
+	}).Info("Sent test events")
+	return result, nil
+}
+
+// testEventTransport labels the messages sent to Matrix as a test and records which rooms they
+// were sent to.
+type testEventTransport struct {
+	base   http.RoundTripper
+	mu     sync.Mutex
+	sent   map[string]bool
+	failed map[string]string
+}
+
+func (t *testEventTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	roomID := sendMessagePathRoomID(req)
+	if roomID == "" {
+		return t.base.RoundTrip(req)
+	}
+	if req.Body != nil {
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+		body = labelTestMessage(body)
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+	}
+
+	res, err := t.base.RoundTrip(req)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err != nil {
+		t.failed[roomID] = err.Error()
+	} else if res.StatusCode != 200 {
+		t.failed[roomID] = "HTTP " + strconv.Itoa(res.StatusCode)
+	} else {
+		t.sent[roomID] = true
+	}
+	return res, err
+}
+
+// sendMessagePathRoomID returns the room ID if req sends an m.room.message event, else "".
+func sendMessagePathRoomID(req *http.Request) string {
+	if req.Method != "PUT" {
+		return ""
+	}
+	segments := strings.Split(req.URL.Path, "/")
+	for i := 0; i+3 < len(segments); i++ {
+		if segments[i] == "rooms" && segments[i+2] == "send" && segments[i+3] == "m.room.message" {
+			return segments[i+1]
+		}
+	}
+	return ""
+}
+
+// labelTestMessage prepends the test label to the body and formatted body of a message.
+func labelTestMessage(body []byte) []byte {
+	var content map[string]interface{}
+	if err := json.Unmarshal(body, &content); err != nil {
+		return body
+	}
+	if b, ok := content["body"].(string); ok {
+		content["body"] = testLabel + b
+	}
+	if fb, ok := content["formatted_body"].(string); ok {
+		content["formatted_body"] = testLabelHTML + fb
+	}
+	labelled, err := json.Marshal(content)
+	if err != nil {
+		return body
+	}
+	return labelled
+}
+
+// testEventCommand returns the "!neb test" command, which sends test events through the services
+// of this client. Only users who can change the power levels of the room may use it, as test
+// events are sent to every room the service notifies.
+func (c *Clients) testEventCommand(client *gomatrix.Client, services []types.Service) types.Command {
+	return types.Command{
+		Path: []string{"neb", "test"},
+		Command: func(roomID, userID string, args []string) (interface{}, error) {
+			if len(args) != 1 {
+				return &gomatrix.TextMessage{MsgType: "m.notice", Body: "Usage: !neb test <service ID or type>"}, nil
+			}
+			pl, err := matrix.LoadPowerLevels(client, roomID)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to check power levels: %s", err)
+			}
+			if pl.UserLevel(userID) < pl.StateEventLevel("m.room.power_levels") {
+				return nil, fmt.Errorf("You must be able to change the power levels of this room to send test events")
+			}
+
+			var lines []string
+			for _, service := range services {
+				if service.ServiceID() != args[0] && service.ServiceType() != args[0] {
+					continue
+				}
+				result, err := c.SendTestEvents(service)
+				if err == ErrTestEventsUnsupported {
+					lines = append(lines, fmt.Sprintf("%s: test events are not supported by %s services", service.ServiceID(), service.ServiceType()))
+					continue
+				} else if err != nil {
+					lines = append(lines, fmt.Sprintf("%s: failed to send test events: %s", service.ServiceID(), err))
+					continue
+				}
+				lines = append(lines, result.summary())
+			}
+			if len(lines) == 0 {
+				return nil, fmt.Errorf("No service with ID or type '%s' is using this bot", args[0])
+			}
+			return &gomatrix.TextMessage{MsgType: "m.notice", Body: strings.Join(lines, "\n")}, nil
+		},
+	}
+}
+
+func (r *TestEventResult) summary() string {
+	if len(r.Rooms) == 0 && len(r.FailedRooms) == 0 {
+		return fmt.Sprintf("%s: no rooms were notified", r.ServiceID)
+	}
+	s := fmt.Sprintf("%s: notified %d room(s)", r.ServiceID, len(r.Rooms))
+	if len(r.Rooms) > 0 {
+		s += ": " + strings.Join(r.Rooms, ", ")
+	}
+	var failed []string
+	for roomID, reason := range r.FailedRooms {
+		failed = append(failed, roomID+" ("+reason+")")
+	}
+	sort.Strings(failed)
+	if len(failed) > 0 {
+		s += ". Failed: " + strings.Join(failed, ", ")
+	}
+	return s
+}
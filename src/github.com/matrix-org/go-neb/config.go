@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/matrix-org/go-neb/api"
+	"github.com/matrix-org/go-neb/database"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// loadFromConfig loads a config file and returns a ConfigFile.
+//
+// The path can be a single YAML file, a directory, in which case every .yaml and .yml file in it is
+// loaded, or a glob pattern such as "config/*.yaml". Each file can also list more paths to load under
+// "include", relative to the file. The clients, realms, services, sessions and room groups of every
+// file are merged into one ConfigFile. A file is only loaded once, however many times it is included.
+// IDs must be unique across all of the files.
+func loadFromConfig(db *database.ServiceDB, configFilePath string) (*api.ConfigFile, error) {
+	paths, err := configFilePaths(configFilePath)
+	if err != nil {
+		return nil, err
+	}
+	l := configLoader{
+		origins: make(map[string]string),
+		loaded:  make(map[string]bool),
+	}
+	for _, path := range paths {
+		if err := l.load(path); err != nil {
+			return nil, err
+		}
+	}
+
+	// sanity check (at least 1 client and 1 service)
+	if len(l.cfg.Clients) == 0 || len(l.cfg.Services) == 0 {
+		return nil, fmt.Errorf("At least 1 client and 1 service must be specified")
+	}
+
+	return &l.cfg, nil
+}
+
+// configFilePaths returns the config files which the path refers to, in a stable order.
+func configFilePaths(path string) ([]string, error) {
+	if strings.ContainsAny(path, "*?[") {
+		paths, err := filepath.Glob(path)
+		if err != nil {
+			return nil, fmt.Errorf("Bad config file pattern %q: %s", path, err)
+		}
+		if len(paths) == 0 {
+			return nil, fmt.Errorf("No config files match %q", path)
+		}
+		sort.Strings(paths)
+		return paths, nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+	infos, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, fi := range infos { // sorted by name
+		ext := filepath.Ext(fi.Name())
+		if !fi.IsDir() && (ext == ".yaml" || ext == ".yml") {
+			paths = append(paths, filepath.Join(path, fi.Name()))
+		}
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("No .yaml or .yml config files in %s", path)
+	}
+	return paths, nil
+}
+
+// configLoader merges config files into a single ConfigFile.
+type configLoader struct {
+	cfg api.ConfigFile
+	// The "file:line" each ID was defined at, keyed by the kind of thing and its ID, e.g. "service foo".
+	origins map[string]string
+	// The absolute paths of the files which have been loaded.
+	loaded map[string]bool
+}
+
+func (l *configLoader) load(path string) error {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if l.loaded[absPath] {
+		return nil
+	}
+	l.loaded[absPath] = true
+
+	// ::Horrible hacks ahead::
+	// The config is represented as YAML, and we want to convert that into NEB types.
+	// However, NEB types make liberal use of json.RawMessage which the YAML parser
+	// doesn't like. We can't implement MarshalYAML/UnmarshalYAML as a custom type easily
+	// because YAML is insane and supports numbers as keys. The YAML parser therefore has the
+	// generic form of map[interface{}]interface{} - but the JSON parser doesn't know
+	// how to parse that.
+	//
+	// The hack that follows gets around this by type asserting all parsed YAML keys as
+	// strings then re-encoding/decoding as JSON. That is:
+	// YAML bytes -> map[interface]interface -> map[string]interface -> JSON bytes -> NEB types
+	//
+	// Each entry is converted on its own, so that errors can say which file and line it came from.
+
+	// Convert to YAML bytes
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	// Convert to map[interface]interface
+	var cfg map[interface{}]interface{}
+	if err = yaml.Unmarshal(contents, &cfg); err != nil {
+		return fmt.Errorf("%s: Failed to unmarshal YAML: %s", path, err)
+	}
+
+	// Convert to map[string]interface
+	dict := convertKeysToStrings(cfg).(map[string]interface{})
+
+	var includes []string
+	for key, section := range dict {
+		if strings.ToLower(key) != "include" {
+			if err := l.addSection(path, contents, key, section); err != nil {
+				return err
+			}
+		} else if includes, err = configIncludes(section); err != nil {
+			keyLine, _ := yamlListLines(contents, key)
+			return fmt.Errorf("%s:%d: %s", path, keyLine, err)
+		}
+	}
+	return l.loadIncludes(path, includes)
+}
+
+// addSection adds each entry of a top-level section of the config file at the path to the merged config.
+func (l *configLoader) addSection(path string, contents []byte, key string, section interface{}) error {
+	keyLine, entryLines := yamlListLines(contents, key)
+	entries, isList := section.([]interface{})
+	if !isList && section != nil {
+		switch strings.ToLower(key) {
+		case "clients", "realms", "services", "sessions", "room_groups":
+			return fmt.Errorf("%s:%d: %s must be a list", path, keyLine, key)
+		}
+	}
+	for i, entry := range entries {
+		line := keyLine
+		if i < len(entryLines) {
+			line = entryLines[i]
+		}
+		origin := fmt.Sprintf("%s:%d", path, line)
+		if err := l.addEntry(key, entry, origin); err != nil {
+			return fmt.Errorf("%s: %s[%d]: %s", origin, key, i, err)
+		}
+	}
+	return nil
+}
+
+// loadIncludes loads the paths included by the config file at the path, relative to its directory.
+func (l *configLoader) loadIncludes(path string, includes []string) error {
+	dir := filepath.Dir(path)
+	for _, include := range includes {
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(dir, include)
+		}
+		paths, err := configFilePaths(include)
+		if err != nil {
+			return fmt.Errorf("%s: include: %s", path, err)
+		}
+		for _, p := range paths {
+			if err := l.load(p); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// addEntry converts a single entry of a section of a config file into NEB types and adds it to the
+// merged config. Entries of sections which aren't known are ignored.
+func (l *configLoader) addEntry(section string, entry interface{}, origin string) error {
+	// Convert to JSON bytes
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal config as JSON: %s", err)
+	}
+
+	// Finally, Convert to NEB types
+	kind, id, err := l.appendEntry(section, b)
+	if err != nil || kind == "" {
+		return err
+	}
+
+	key := kind + " " + id
+	if first, exists := l.origins[key]; exists {
+		return fmt.Errorf("Duplicate %s %q, which was first defined at %s", kind, id, first)
+	}
+	l.origins[key] = origin
+	return nil
+}
+
+// appendEntry decodes a JSON entry of the section and appends it to the merged config. Returns the kind
+// of thing and its ID, or an empty kind if the section isn't known.
+func (l *configLoader) appendEntry(section string, b []byte) (kind, id string, err error) {
+	switch strings.ToLower(section) {
+	case "clients":
+		var c api.ClientConfig
+		if err = decodeEntry(b, &c); err == nil {
+			l.cfg.Clients = append(l.cfg.Clients, c)
+		}
+		return "client", c.UserID, err
+	case "realms":
+		var r api.ConfigureAuthRealmRequest
+		if err = decodeEntry(b, &r); err == nil {
+			l.cfg.Realms = append(l.cfg.Realms, r)
+		}
+		return "realm", r.ID, err
+	case "services":
+		var s api.ConfigureServiceRequest
+		if err = decodeEntry(b, &s); err == nil {
+			l.cfg.Services = append(l.cfg.Services, s)
+		}
+		return "service", s.ID, err
+	case "sessions":
+		var s api.Session
+		if err = decodeEntry(b, &s); err == nil {
+			l.cfg.Sessions = append(l.cfg.Sessions, s)
+		}
+		return "session", s.SessionID, err
+	case "room_groups":
+		var g api.RoomGroup
+		if err = decodeEntry(b, &g); err == nil {
+			l.cfg.RoomGroups = append(l.cfg.RoomGroups, g)
+		}
+		return "room group", g.Name, err
+	}
+	return "", "", nil
+}
+
+// decodeEntry unmarshals the JSON entry into v and checks it.
+func decodeEntry(b []byte, v interface{ Check() error }) error {
+	if err := json.Unmarshal(b, v); err != nil {
+		return err
+	}
+	return v.Check()
+}
+
+// configIncludes returns the paths listed by an "include" section, which is either a single path or
+// a list of them.
+func configIncludes(section interface{}) ([]string, error) {
+	if path, ok := section.(string); ok {
+		return []string{path}, nil
+	}
+	list, ok := section.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("include must be a path or a list of paths")
+	}
+	var paths []string
+	for _, p := range list {
+		path, ok := p.(string)
+		if !ok {
+			return nil, fmt.Errorf("include must be a path or a list of paths")
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// yamlListLines finds the line of the top-level key in the YAML document, and the line which each
+// entry of the block-style list under it starts on. Lines are numbered from 1. If the key can't be
+// found, the key line is 0. If the list is written in flow style e.g. [a, b], no entry lines are
+// returned.
+//
+// The YAML parser doesn't expose line numbers, so this is only used to make error messages more
+// helpful.
+func yamlListLines(contents []byte, key string) (keyLine int, entryLines []int) {
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	entryIndent := -1
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := scanner.Text()
+		trimmed := strings.TrimLeft(line, " ")
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		indent := len(line) - len(trimmed)
+		if keyLine == 0 {
+			if indent == 0 && isYAMLKey(trimmed, key) {
+				keyLine = lineNum
+			}
+			continue
+		}
+		isEntry := isYAMLListEntry(trimmed)
+		if indent == 0 && !isEntry {
+			break // the next top-level key
+		}
+		if isEntry && (entryIndent == -1 || indent == entryIndent) {
+			entryIndent = indent
+			entryLines = append(entryLines, lineNum)
+		}
+	}
+	return
+}
+
+// isYAMLListEntry returns true if the line starts an entry of a block-style list.
+func isYAMLListEntry(line string) bool {
+	return line == "-" || strings.HasPrefix(line, "- ")
+}
+
+// isYAMLKey returns true if the line starts the mapping entry for the key, which may be quoted.
+func isYAMLKey(line, key string) bool {
+	for _, k := range []string{key, `"` + key + `"`, "'" + key + "'"} {
+		if strings.HasPrefix(line, k) && strings.HasPrefix(strings.TrimLeft(line[len(k):], " "), ":") {
+			return true
+		}
+	}
+	return false
+}
+
+func convertKeysToStrings(iface interface{}) interface{} {
+	obj, isObj := iface.(map[interface{}]interface{})
+	if isObj {
+		strObj := make(map[string]interface{})
+		for k, v := range obj {
+			strObj[k.(string)] = convertKeysToStrings(v) // handle nested objects
+		}
+		return strObj
+	}
+
+	arr, isArr := iface.([]interface{})
+	if isArr {
+		for i := range arr {
+			arr[i] = convertKeysToStrings(arr[i]) // handle nested objects
+		}
+		return arr
+	}
+	return iface // base type like string or number
+}
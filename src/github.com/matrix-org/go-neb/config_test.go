@@ -0,0 +1,144 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const baseConfig = `# shared clients
+clients:
+  - UserID: "@goneb:hyrule"
+    AccessToken: "its_a_secret"
+    HomeserverURL: "https://hyrule"
+
+include:
+  - teams
+`
+
+const opsConfig = `services:
+  - ID: "ops_rss"
+    Type: "rssbot"
+    UserID: "@goneb:hyrule"
+    Config:
+      feeds: {}
+room_groups:
+  - Name: "ops"
+    Rooms: ["!ops:hyrule"]
+`
+
+const devConfig = `realms:
+  - ID: "github_realm"
+    Type: "github"
+    Config: {}
+
+services:
+  - ID: "dev_echo"
+    Type: "echo"
+    UserID: "@goneb:hyrule"
+    Config: {}
+
+  - ID: "dev_rss"
+    Type: "rssbot"
+    UserID: "@goneb:hyrule"
+    Config:
+      feeds: {}
+`
+
+func writeConfigFiles(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "goneb-config")
+	if err != nil {
+		t.Fatal("Failed to create temporary directory: ", err)
+	}
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal("Failed to create directory: ", err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+			t.Fatal("Failed to write config file: ", err)
+		}
+	}
+	return dir
+}
+
+func TestLoadConfigIncludes(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"config.yaml":     baseConfig,
+		"teams/ops.yaml":  opsConfig,
+		"teams/dev.yml":   devConfig,
+		"teams/README.md": "not config",
+	})
+	defer os.RemoveAll(dir)
+
+	for _, path := range []string{
+		filepath.Join(dir, "config.yaml"),
+		dir,
+		filepath.Join(dir, "*.yaml"),
+	} {
+		cfg, err := loadFromConfig(nil, path)
+		if err != nil {
+			t.Errorf("TestLoadConfigIncludes(%s): failed to load config: %s", path, err)
+			continue
+		}
+		var serviceIDs []string
+		for _, s := range cfg.Services {
+			serviceIDs = append(serviceIDs, s.ID)
+		}
+		if got := strings.Join(serviceIDs, ","); got != "dev_echo,dev_rss,ops_rss" {
+			t.Errorf("TestLoadConfigIncludes(%s): want services dev_echo,dev_rss,ops_rss, got %s", path, got)
+		}
+		if len(cfg.Clients) != 1 || len(cfg.Realms) != 1 || len(cfg.RoomGroups) != 1 {
+			t.Errorf("TestLoadConfigIncludes(%s): want 1 client, realm and room group, got %+v", path, cfg)
+		}
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	for _, test := range []struct {
+		Files   map[string]string
+		WantErr string
+	}{
+		{
+			Files: map[string]string{
+				"config.yaml":    baseConfig,
+				"teams/ops.yaml": opsConfig,
+				"teams/dev.yaml": strings.Replace(devConfig, "dev_rss", "ops_rss", 1),
+			},
+			WantErr: `teams/ops.yaml:2: services[0]: Duplicate service "ops_rss", which was first defined at ` +
+				`teams/dev.yaml:12`,
+		},
+		{
+			Files: map[string]string{
+				"config.yaml":    baseConfig,
+				"teams/dev.yaml": strings.Replace(devConfig, `Type: "echo"`, `Type: ""`, 1),
+			},
+			WantErr: `teams/dev.yaml:7: services[0]: Must supply an "ID", a "Type", a "UserID" and a "Config"`,
+		},
+		{
+			Files: map[string]string{
+				"config.yaml": baseConfig + "services: dev_rss\n",
+			},
+			WantErr: `config.yaml:9: services must be a list`,
+		},
+		{
+			Files: map[string]string{
+				"config.yaml": strings.Replace(baseConfig, "teams", "missing/*.yaml", 1),
+			},
+			WantErr: `No config files match`,
+		},
+	} {
+		dir := writeConfigFiles(t, test.Files)
+		_, err := loadFromConfig(nil, filepath.Join(dir, "config.yaml"))
+		os.RemoveAll(dir)
+		if err == nil {
+			t.Errorf("TestLoadConfigErrors: want error %q, got none", test.WantErr)
+			continue
+		}
+		if got := strings.Replace(err.Error(), dir+"/", "", -1); !strings.Contains(got, test.WantErr) {
+			t.Errorf("TestLoadConfigErrors: want error %q, got %q", test.WantErr, got)
+		}
+	}
+}
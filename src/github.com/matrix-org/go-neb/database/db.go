@@ -6,12 +6,17 @@ import (
 	"fmt"
 	"github.com/matrix-org/go-neb/api"
 	"github.com/matrix-org/go-neb/types"
+	"sort"
+	"sync"
 	"time"
 )
 
 // A ServiceDB stores the configuration for the services
 type ServiceDB struct {
-	db *sql.DB
+	db      *sql.DB
+	dialect dialect
+	// Guards ModifyService, for databases which don't lock rows which are selected for update.
+	modifyMutex sync.Mutex
 }
 
 // A single global instance of the service DB.
@@ -29,20 +34,29 @@ func GetServiceDB() Storer {
 
 // Open a SQL database to use as a ServiceDB. This will automatically create
 // the necessary database tables if they aren't already present.
+//
+// The database type must be one of "sqlite3", "postgres" or "mysql". The "mysql"
+// type also supports MariaDB.
 func Open(databaseType, databaseURL string) (serviceDB *ServiceDB, err error) {
-	db, err := sql.Open(databaseType, databaseURL)
+	d, err := dialectFor(databaseType)
 	if err != nil {
 		return
 	}
-	if _, err = db.Exec(schemaSQL); err != nil {
+	db, err := sql.Open(databaseType, databaseURL)
+	if err != nil {
 		return
 	}
+	for _, stmt := range d.schema {
+		if _, err = db.Exec(stmt); err != nil {
+			return
+		}
+	}
 	if databaseType == "sqlite3" {
 		// Fix for "database is locked" errors
 		// https://github.com/mattn/go-sqlite3/issues/274
 		db.SetMaxOpenConns(1)
 	}
-	serviceDB = &ServiceDB{db: db}
+	serviceDB = &ServiceDB{db: db, dialect: d}
 	return
 }
 
@@ -50,7 +64,7 @@ func Open(databaseType, databaseURL string) (serviceDB *ServiceDB, err error) {
 // If a config already exists then it will be updated, otherwise a new config
 // will be inserted. The previous config is returned.
 func (d *ServiceDB) StoreMatrixClientConfig(config api.ClientConfig) (oldConfig api.ClientConfig, err error) {
-	err = runTransaction(d.db, func(txn *sql.Tx) error {
+	err = runTransaction(d, func(txn *sqlTxn) error {
 		oldConfig, err = selectMatrixClientConfigTxn(txn, config.UserID)
 		now := time.Now()
 		if err == nil {
@@ -66,7 +80,7 @@ func (d *ServiceDB) StoreMatrixClientConfig(config api.ClientConfig) (oldConfig
 
 // LoadMatrixClientConfigs loads all Matrix client configs from the database.
 func (d *ServiceDB) LoadMatrixClientConfigs() (configs []api.ClientConfig, err error) {
-	err = runTransaction(d.db, func(txn *sql.Tx) error {
+	err = runTransaction(d, func(txn *sqlTxn) error {
 		configs, err = selectMatrixClientConfigsTxn(txn)
 		return err
 	})
@@ -76,16 +90,38 @@ func (d *ServiceDB) LoadMatrixClientConfigs() (configs []api.ClientConfig, err e
 // LoadMatrixClientConfig loads a Matrix client config from the database.
 // Returns sql.ErrNoRows if the client isn't in the database.
 func (d *ServiceDB) LoadMatrixClientConfig(userID string) (config api.ClientConfig, err error) {
-	err = runTransaction(d.db, func(txn *sql.Tx) error {
+	err = runTransaction(d, func(txn *sqlTxn) error {
 		config, err = selectMatrixClientConfigTxn(txn, userID)
 		return err
 	})
 	return
 }
 
+// DeleteMatrixClientConfig deletes the Matrix client config for the given user.
+// Returns a *DependencyError if any services still use the client.
+func (d *ServiceDB) DeleteMatrixClientConfig(userID string) (err error) {
+	err = runTransaction(d, func(txn *sqlTxn) error {
+		dependents, err := clientDependentsTxn(txn, userID)
+		if err != nil {
+			return err
+		}
+		if len(dependents) > 0 {
+			return &DependencyError{"client " + userID, dependents}
+		}
+		if err := deleteSpaceRoomsForUserTxn(txn, userID); err != nil {
+			return err
+		}
+		if err := deleteResourceOwnerTxn(txn, ResourceClient, userID); err != nil {
+			return err
+		}
+		return deleteMatrixClientConfigTxn(txn, userID)
+	})
+	return
+}
+
 // UpdateNextBatch updates the next_batch token for the given user.
 func (d *ServiceDB) UpdateNextBatch(userID, nextBatch string) (err error) {
-	err = runTransaction(d.db, func(txn *sql.Tx) error {
+	err = runTransaction(d, func(txn *sqlTxn) error {
 		return updateNextBatchTxn(txn, userID, nextBatch)
 	})
 	return
@@ -93,7 +129,7 @@ func (d *ServiceDB) UpdateNextBatch(userID, nextBatch string) (err error) {
 
 // LoadNextBatch loads the next_batch token for the given user.
 func (d *ServiceDB) LoadNextBatch(userID string) (nextBatch string, err error) {
-	err = runTransaction(d.db, func(txn *sql.Tx) error {
+	err = runTransaction(d, func(txn *sqlTxn) error {
 		nextBatch, err = selectNextBatchTxn(txn, userID)
 		return err
 	})
@@ -103,7 +139,7 @@ func (d *ServiceDB) LoadNextBatch(userID string) (nextBatch string, err error) {
 // LoadService loads a service from the database.
 // Returns sql.ErrNoRows if the service isn't in the database.
 func (d *ServiceDB) LoadService(serviceID string) (service types.Service, err error) {
-	err = runTransaction(d.db, func(txn *sql.Tx) error {
+	err = runTransaction(d, func(txn *sqlTxn) error {
 		service, err = selectServiceTxn(txn, serviceID)
 		return err
 	})
@@ -112,16 +148,50 @@ func (d *ServiceDB) LoadService(serviceID string) (service types.Service, err er
 
 // DeleteService deletes the given service from the database.
 func (d *ServiceDB) DeleteService(serviceID string) (err error) {
-	err = runTransaction(d.db, func(txn *sql.Tx) error {
+	err = runTransaction(d, func(txn *sqlTxn) error {
+		if err := deleteResourceOwnerTxn(txn, ResourceService, serviceID); err != nil {
+			return err
+		}
+		if err := deleteRelayedEventsForServiceTxn(txn, serviceID); err != nil {
+			return err
+		}
+		if err := deleteNotificationThreadsForServiceTxn(txn, serviceID); err != nil {
+			return err
+		}
 		return deleteServiceTxn(txn, serviceID)
 	})
 	return
 }
 
+// ModifyService loads the service with the given ID, applies fn to it and stores it, all in one
+// transaction, so that concurrent modifications of a service are applied one after another to its
+// latest version. fn is called exactly once. If it returns an error, the service is not changed.
+// Returns the modified service, or sql.ErrNoRows if the service isn't in the database.
+func (d *ServiceDB) ModifyService(serviceID string, fn func(service types.Service) error) (types.Service, error) {
+	d.modifyMutex.Lock()
+	defer d.modifyMutex.Unlock()
+	var service types.Service
+	err := runTransaction(d, func(txn *sqlTxn) error {
+		var err error
+		if service, err = selectServiceForUpdateTxn(txn, serviceID); err != nil {
+			return err
+		}
+		if err = fn(service); err != nil {
+			return err
+		}
+		return updateServiceTxn(txn, time.Now(), service)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return service, nil
+}
+
 // LoadServicesForUser loads all the bot services configured for a given user.
 // Returns an empty list if there aren't any services configured.
+// Services whose type is disabled are skipped.
 func (d *ServiceDB) LoadServicesForUser(serviceUserID string) (services []types.Service, err error) {
-	err = runTransaction(d.db, func(txn *sql.Tx) error {
+	err = runTransaction(d, func(txn *sqlTxn) error {
 		services, err = selectServicesForUserTxn(txn, serviceUserID)
 		if err != nil {
 			return err
@@ -133,8 +203,9 @@ func (d *ServiceDB) LoadServicesForUser(serviceUserID string) (services []types.
 
 // LoadServicesByType loads all the bot services configured for a given type.
 // Returns an empty list if there aren't any services configured.
+// Services whose type is disabled are skipped.
 func (d *ServiceDB) LoadServicesByType(serviceType string) (services []types.Service, err error) {
-	err = runTransaction(d.db, func(txn *sql.Tx) error {
+	err = runTransaction(d, func(txn *sqlTxn) error {
 		services, err = selectServicesByTypeTxn(txn, serviceType)
 		if err != nil {
 			return err
@@ -146,9 +217,15 @@ func (d *ServiceDB) LoadServicesByType(serviceType string) (services []types.Ser
 
 // StoreService stores a service into the database either by inserting a new
 // service or updating an existing service. Returns the old service if there
-// was one.
+// was one. Returns an error if there is no client for the service user ID.
 func (d *ServiceDB) StoreService(service types.Service) (oldService types.Service, err error) {
-	err = runTransaction(d.db, func(txn *sql.Tx) error {
+	err = runTransaction(d, func(txn *sqlTxn) error {
+		exists, err := selectMatrixClientExistsTxn(txn, service.ServiceUserID())
+		if err != nil {
+			return err
+		} else if !exists {
+			return fmt.Errorf("client with user ID %s does not exist", service.ServiceUserID())
+		}
 		oldService, err = selectServiceTxn(txn, service.ServiceID())
 		if err == sql.ErrNoRows {
 			return insertServiceTxn(txn, time.Now(), service)
@@ -164,7 +241,7 @@ func (d *ServiceDB) StoreService(service types.Service) (oldService types.Servic
 // LoadAuthRealm loads an AuthRealm from the database.
 // Returns sql.ErrNoRows if the realm isn't in the database.
 func (d *ServiceDB) LoadAuthRealm(realmID string) (realm types.AuthRealm, err error) {
-	err = runTransaction(d.db, func(txn *sql.Tx) error {
+	err = runTransaction(d, func(txn *sqlTxn) error {
 		realm, err = selectRealmTxn(txn, realmID)
 		return err
 	})
@@ -175,7 +252,7 @@ func (d *ServiceDB) LoadAuthRealm(realmID string) (realm types.AuthRealm, err er
 // The realms are ordered based on their realm ID.
 // Returns an empty list if there are no realms with that type.
 func (d *ServiceDB) LoadAuthRealmsByType(realmType string) (realms []types.AuthRealm, err error) {
-	err = runTransaction(d.db, func(txn *sql.Tx) error {
+	err = runTransaction(d, func(txn *sqlTxn) error {
 		realms, err = selectRealmsByTypeTxn(txn, realmType)
 		return err
 	})
@@ -184,26 +261,58 @@ func (d *ServiceDB) LoadAuthRealmsByType(realmType string) (realms []types.AuthR
 
 // StoreAuthRealm stores the given AuthRealm, clobbering based on the realm ID.
 // This function updates the time added/updated values. The previous realm, if any, is
-// returned.
+// returned. Returns a *DependencyError if the realm type would change whilst sessions
+// or services still use the realm.
 func (d *ServiceDB) StoreAuthRealm(realm types.AuthRealm) (old types.AuthRealm, err error) {
-	err = runTransaction(d.db, func(txn *sql.Tx) error {
+	err = runTransaction(d, func(txn *sqlTxn) error {
 		old, err = selectRealmTxn(txn, realm.ID())
 		if err == sql.ErrNoRows {
 			return insertRealmTxn(txn, time.Now(), realm)
 		} else if err != nil {
 			return err
-		} else {
-			return updateRealmTxn(txn, time.Now(), realm)
 		}
+		if old.Type() != realm.Type() {
+			dependents, err := realmDependentsTxn(txn, realm.ID())
+			if err != nil {
+				return err
+			}
+			if len(dependents) > 0 {
+				return &DependencyError{"realm " + realm.ID() + " of type " + old.Type(), dependents}
+			}
+		}
+		return updateRealmTxn(txn, time.Now(), realm)
 	})
 	return
 }
 
+// DeleteAuthRealm deletes the given AuthRealm. Returns a *DependencyError if any sessions
+// or services still use the realm.
+func (d *ServiceDB) DeleteAuthRealm(realmID string) error {
+	return runTransaction(d, func(txn *sqlTxn) error {
+		dependents, err := realmDependentsTxn(txn, realmID)
+		if err != nil {
+			return err
+		}
+		if len(dependents) > 0 {
+			return &DependencyError{"realm " + realmID, dependents}
+		}
+		if err := deleteResourceOwnerTxn(txn, ResourceRealm, realmID); err != nil {
+			return err
+		}
+		return deleteRealmTxn(txn, realmID)
+	})
+}
+
 // StoreAuthSession stores the given AuthSession, clobbering based on the tuple of
 // user ID and realm ID. This function updates the time added/updated values.
-// The previous session, if any, is returned.
+// The previous session, if any, is returned. Returns an error if the realm does not exist.
 func (d *ServiceDB) StoreAuthSession(session types.AuthSession) (old types.AuthSession, err error) {
-	err = runTransaction(d.db, func(txn *sql.Tx) error {
+	err = runTransaction(d, func(txn *sqlTxn) error {
+		if _, err = selectRealmTxn(txn, session.RealmID()); err == sql.ErrNoRows {
+			return fmt.Errorf("realm with ID %s does not exist", session.RealmID())
+		} else if err != nil {
+			return err
+		}
 		old, err = selectAuthSessionByUserTxn(txn, session.RealmID(), session.UserID())
 		if err == sql.ErrNoRows {
 			return insertAuthSessionTxn(txn, time.Now(), session)
@@ -219,7 +328,7 @@ func (d *ServiceDB) StoreAuthSession(session types.AuthSession) (old types.AuthS
 // RemoveAuthSession removes the auth session for the given user on the given realm.
 // No error is returned if the session did not exist in the first place.
 func (d *ServiceDB) RemoveAuthSession(realmID, userID string) error {
-	return runTransaction(d.db, func(txn *sql.Tx) error {
+	return runTransaction(d, func(txn *sqlTxn) error {
 		return deleteAuthSessionTxn(txn, realmID, userID)
 	})
 }
@@ -228,7 +337,7 @@ func (d *ServiceDB) RemoveAuthSession(realmID, userID string) error {
 // realm and user ID.
 // Returns sql.ErrNoRows if the session isn't in the database.
 func (d *ServiceDB) LoadAuthSessionByUser(realmID, userID string) (session types.AuthSession, err error) {
-	err = runTransaction(d.db, func(txn *sql.Tx) error {
+	err = runTransaction(d, func(txn *sqlTxn) error {
 		session, err = selectAuthSessionByUserTxn(txn, realmID, userID)
 		return err
 	})
@@ -239,7 +348,7 @@ func (d *ServiceDB) LoadAuthSessionByUser(realmID, userID string) (session types
 // realm and session ID.
 // Returns sql.ErrNoRows if the session isn't in the database.
 func (d *ServiceDB) LoadAuthSessionByID(realmID, sessionID string) (session types.AuthSession, err error) {
-	err = runTransaction(d.db, func(txn *sql.Tx) error {
+	err = runTransaction(d, func(txn *sqlTxn) error {
 		session, err = selectAuthSessionByIDTxn(txn, realmID, sessionID)
 		return err
 	})
@@ -249,7 +358,7 @@ func (d *ServiceDB) LoadAuthSessionByID(realmID, sessionID string) (session type
 // LoadBotOptions loads bot options from the database.
 // Returns sql.ErrNoRows if the bot options isn't in the database.
 func (d *ServiceDB) LoadBotOptions(userID, roomID string) (opts types.BotOptions, err error) {
-	err = runTransaction(d.db, func(txn *sql.Tx) error {
+	err = runTransaction(d, func(txn *sqlTxn) error {
 		opts, err = selectBotOptionsTxn(txn, userID, roomID)
 		return err
 	})
@@ -260,7 +369,7 @@ func (d *ServiceDB) LoadBotOptions(userID, roomID string) (opts types.BotOptions
 // bot options or updating an existing bot options. Returns the old bot options if there
 // was one.
 func (d *ServiceDB) StoreBotOptions(opts types.BotOptions) (oldOpts types.BotOptions, err error) {
-	err = runTransaction(d.db, func(txn *sql.Tx) error {
+	err = runTransaction(d, func(txn *sqlTxn) error {
 		oldOpts, err = selectBotOptionsTxn(txn, opts.UserID, opts.RoomID)
 		if err == sql.ErrNoRows {
 			return insertBotOptionsTxn(txn, time.Now(), opts)
@@ -273,6 +382,212 @@ func (d *ServiceDB) StoreBotOptions(opts types.BotOptions) (oldOpts types.BotOpt
 	return
 }
 
+// StoreRoomGroup stores the given room group, clobbering based on the group name.
+// The previous room group, if any, is returned.
+func (d *ServiceDB) StoreRoomGroup(group api.RoomGroup) (old api.RoomGroup, err error) {
+	err = runTransaction(d, func(txn *sqlTxn) error {
+		old, err = selectRoomGroupTxn(txn, group.Name)
+		if err == sql.ErrNoRows {
+			return insertRoomGroupTxn(txn, time.Now(), group)
+		} else if err != nil {
+			return err
+		}
+		return updateRoomGroupTxn(txn, time.Now(), group)
+	})
+	return
+}
+
+// LoadRoomGroup loads the room group with the given name.
+// Returns sql.ErrNoRows if the room group doesn't exist.
+func (d *ServiceDB) LoadRoomGroup(name string) (group api.RoomGroup, err error) {
+	err = runTransaction(d, func(txn *sqlTxn) error {
+		group, err = selectRoomGroupTxn(txn, name)
+		return err
+	})
+	return
+}
+
+// LoadRoomGroups loads all room groups, sorted by name.
+func (d *ServiceDB) LoadRoomGroups() (groups []api.RoomGroup, err error) {
+	err = runTransaction(d, func(txn *sqlTxn) error {
+		groups, err = selectRoomGroupsTxn(txn)
+		return err
+	})
+	return
+}
+
+// DeleteRoomGroup deletes the room group with the given name. Returns a *DependencyError if any
+// service configs still refer to the group.
+func (d *ServiceDB) DeleteRoomGroup(name string) error {
+	return runTransaction(d, func(txn *sqlTxn) error {
+		serviceIDs, err := serviceIDsForRoomGroupTxn(txn, name)
+		if err != nil {
+			return err
+		}
+		if len(serviceIDs) > 0 {
+			var dependents []string
+			for _, id := range serviceIDs {
+				dependents = append(dependents, "service "+id)
+			}
+			return &DependencyError{"room group " + name, dependents}
+		}
+		return deleteRoomGroupTxn(txn, name)
+	})
+}
+
+// ExpandRoomGroups replaces the room group references in the config of a service of the given type
+// with the rooms in those groups. Returns the expanded config and the names of the groups which were
+// referenced.
+func (d *ServiceDB) ExpandRoomGroups(serviceType string, config json.RawMessage) (expanded json.RawMessage, names []string, err error) {
+	if len(types.RoomGroupReferences(serviceType, config)) == 0 {
+		return config, nil, nil
+	}
+	groups, err := d.LoadRoomGroups()
+	if err != nil {
+		return nil, nil, err
+	}
+	groupRooms := make(map[string][]string)
+	for _, g := range groups {
+		groupRooms[g.Name] = g.Rooms
+	}
+	return types.ExpandRoomGroups(serviceType, config, groupRooms)
+}
+
+// StoreServiceConfig stores the config of a service as it was supplied, before room groups were
+// expanded, so that the service can be registered again when those groups change. The config is
+// only stored if it refers to a room group: otherwise any stored config is removed.
+func (d *ServiceDB) StoreServiceConfig(serviceID, serviceType string, config json.RawMessage) error {
+	return runTransaction(d, func(txn *sqlTxn) error {
+		if err := deleteServiceConfigTxn(txn, serviceID); err != nil {
+			return err
+		}
+		if len(types.RoomGroupReferences(serviceType, config)) == 0 && len(types.SpaceReferences(serviceType, config)) == 0 {
+			return nil
+		}
+		return insertServiceConfigTxn(txn, time.Now(), serviceID, config)
+	})
+}
+
+// LoadServiceConfig loads the config of a service as it was supplied, before room groups and spaces
+// were expanded. Returns sql.ErrNoRows if the service config doesn't refer to any room groups or spaces.
+func (d *ServiceDB) LoadServiceConfig(serviceID string) (config json.RawMessage, err error) {
+	err = runTransaction(d, func(txn *sqlTxn) error {
+		config, err = selectServiceConfigTxn(txn, serviceID)
+		return err
+	})
+	return
+}
+
+// ServiceConfig is the config of a service as it was supplied, before room groups and spaces were expanded.
+type ServiceConfig struct {
+	ServiceType string
+	Config      json.RawMessage
+}
+
+// LoadServiceConfigs loads the configs of every service which refers to room groups or spaces, as
+// they were supplied. Returns a map of service ID to config.
+func (d *ServiceDB) LoadServiceConfigs() (configs map[string]ServiceConfig, err error) {
+	err = runTransaction(d, func(txn *sqlTxn) error {
+		configs, err = selectServiceConfigsTxn(txn)
+		return err
+	})
+	return
+}
+
+// StoreSpaceRooms stores the rooms which a space contained, as seen by the given client, when it was
+// last expanded. Returns the rooms which were previously stored, if any.
+func (d *ServiceDB) StoreSpaceRooms(userID, space string, rooms []string) (oldRooms []string, err error) {
+	err = runTransaction(d, func(txn *sqlTxn) error {
+		oldRooms, err = selectSpaceRoomsTxn(txn, userID, space)
+		if err == sql.ErrNoRows {
+			return insertSpaceRoomsTxn(txn, time.Now(), userID, space, rooms)
+		} else if err != nil {
+			return err
+		}
+		return updateSpaceRoomsTxn(txn, time.Now(), userID, space, rooms)
+	})
+	return
+}
+
+// LoadSpaceRooms loads the rooms which a space contained, as seen by the given client, when it was
+// last expanded. Returns sql.ErrNoRows if the space has not been expanded for the client.
+func (d *ServiceDB) LoadSpaceRooms(userID, space string) (rooms []string, err error) {
+	err = runTransaction(d, func(txn *sqlTxn) error {
+		rooms, err = selectSpaceRoomsTxn(txn, userID, space)
+		return err
+	})
+	return
+}
+
+// LoadServiceIDsForRoomGroup returns the IDs of the services whose config refers to the room
+// group with the given name.
+func (d *ServiceDB) LoadServiceIDsForRoomGroup(name string) (serviceIDs []string, err error) {
+	err = runTransaction(d, func(txn *sqlTxn) error {
+		serviceIDs, err = serviceIDsForRoomGroupTxn(txn, name)
+		return err
+	})
+	return
+}
+
+func serviceIDsForRoomGroupTxn(txn *sqlTxn, name string) ([]string, error) {
+	configs, err := selectServiceConfigsTxn(txn)
+	if err != nil {
+		return nil, err
+	}
+	var serviceIDs []string
+	for serviceID, config := range configs {
+		for _, ref := range types.RoomGroupReferences(config.ServiceType, config.Config) {
+			if ref == name {
+				serviceIDs = append(serviceIDs, serviceID)
+				break
+			}
+		}
+	}
+	sort.Strings(serviceIDs)
+	return serviceIDs, nil
+}
+
+// FindOrphans returns a report of services, sessions and bot options which refer to
+// clients or realms that do not exist.
+func (d *ServiceDB) FindOrphans() (report OrphanReport, err error) {
+	err = runTransaction(d, func(txn *sqlTxn) error {
+		report, err = findOrphansTxn(txn)
+		return err
+	})
+	return
+}
+
+// RemoveOrphans removes services without a client, sessions without a realm and bot options
+// without a client. Services which refer to missing realms or which cannot be loaded are
+// reported but not removed. Returns the report of what was found before removal.
+func (d *ServiceDB) RemoveOrphans() (report OrphanReport, err error) {
+	err = runTransaction(d, func(txn *sqlTxn) error {
+		if report, err = findOrphansTxn(txn); err != nil {
+			return err
+		}
+		if err = deleteServicesWithoutClientTxn(txn); err != nil {
+			return err
+		}
+		if err = deleteServiceConfigsWithoutServiceTxn(txn); err != nil {
+			return err
+		}
+		if err = deleteServiceOwnersWithoutServiceTxn(txn); err != nil {
+			return err
+		}
+		if err = deleteRelayedEventsWithoutServiceTxn(txn); err != nil {
+			return err
+		}
+		if err = deleteNotificationThreadsWithoutServiceTxn(txn); err != nil {
+			return err
+		}
+		if err = deleteAuthSessionsWithoutRealmTxn(txn); err != nil {
+			return err
+		}
+		return deleteBotOptionsWithoutClientTxn(txn)
+	})
+	return
+}
+
 // InsertFromConfig inserts entries from the config file into the database. This only really
 // makes sense for in-memory databases.
 func (d *ServiceDB) InsertFromConfig(cfg *api.ConfigFile) error {
@@ -283,11 +598,32 @@ func (d *ServiceDB) InsertFromConfig(cfg *api.ConfigFile) error {
 		}
 	}
 
+	// Insert room groups
+	for _, g := range cfg.RoomGroups {
+		if err := g.Check(); err != nil {
+			return err
+		}
+		if _, err := d.StoreRoomGroup(g); err != nil {
+			return err
+		}
+	}
+
+	if err := d.insertRealmsAndSessions(cfg.Realms, cfg.Sessions); err != nil {
+		return err
+	}
+
+	// Do not insert services yet, they require more work to set up.
+	return nil
+}
+
+// insertRealmsAndSessions inserts the auth realms and sessions from the config file. Sessions must
+// belong to one of the realms.
+func (d *ServiceDB) insertRealmsAndSessions(realmReqs []api.ConfigureAuthRealmRequest, sessions []api.Session) error {
 	// Keep a map of realms for inserting sessions
 	realms := map[string]types.AuthRealm{} // by realm ID
 
 	// Insert realms
-	for _, r := range cfg.Realms {
+	for _, r := range realmReqs {
 		if err := r.Check(); err != nil {
 			return err
 		}
@@ -302,7 +638,7 @@ func (d *ServiceDB) InsertFromConfig(cfg *api.ConfigFile) error {
 	}
 
 	// Insert sessions
-	for _, s := range cfg.Sessions {
+	for _, s := range sessions {
 		if err := s.Check(); err != nil {
 			return err
 		}
@@ -320,16 +656,15 @@ func (d *ServiceDB) InsertFromConfig(cfg *api.ConfigFile) error {
 			return err
 		}
 	}
-
-	// Do not insert services yet, they require more work to set up.
 	return nil
 }
 
-func runTransaction(db *sql.DB, fn func(txn *sql.Tx) error) (err error) {
-	txn, err := db.Begin()
+func runTransaction(d *ServiceDB, fn func(txn *sqlTxn) error) (err error) {
+	tx, err := d.db.Begin()
 	if err != nil {
 		return
 	}
+	txn := &sqlTxn{tx, d.dialect}
 	defer func() {
 		if r := recover(); r != nil {
 			txn.Rollback()
@@ -0,0 +1,711 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/matrix-org/go-neb/api"
+	"github.com/matrix-org/go-neb/types"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// The storage tests always run against an in-memory sqlite3 database. To also run them
+// against a MySQL/MariaDB database, set GONEB_TEST_MYSQL_URL to a DSN such as:
+//
+//	goneb:password@tcp(localhost:3306)/goneb_test
+//
+// WARNING: All Go-NEB tables in that database will be emptied.
+var testBackends = []struct {
+	databaseType string
+	envVar       string
+	defaultURL   string
+}{
+	{"sqlite3", "", ":memory:"},
+	{"mysql", "GONEB_TEST_MYSQL_URL", ""},
+}
+
+const testType = "storage-test"
+
+type testService struct {
+	types.DefaultService
+	Rooms []string `rooms:"values"`
+}
+
+type testRealm struct {
+	id       string
+	Endpoint string
+}
+
+func (r *testRealm) ID() string                                                 { return r.id }
+func (r *testRealm) Type() string                                               { return testType }
+func (r *testRealm) Init() error                                                { return nil }
+func (r *testRealm) Register() error                                            { return nil }
+func (r *testRealm) OnReceiveRedirect(w http.ResponseWriter, req *http.Request) {}
+func (r *testRealm) RequestAuthSession(userID string, config json.RawMessage) interface{} {
+	return nil
+}
+func (r *testRealm) AuthSession(id, userID, realmID string) types.AuthSession {
+	return &testSession{id: id, userID: userID, realmID: realmID}
+}
+
+type testSession struct {
+	id      string
+	userID  string
+	realmID string
+	Token   string
+}
+
+func (s *testSession) ID() string          { return s.id }
+func (s *testSession) UserID() string      { return s.userID }
+func (s *testSession) RealmID() string     { return s.realmID }
+func (s *testSession) Authenticated() bool { return s.Token != "" }
+func (s *testSession) Info() interface{}   { return nil }
+
+func init() {
+	types.RegisterService(func(serviceID, serviceUserID, webhookEndpointURL string) types.Service {
+		return &testService{DefaultService: types.NewDefaultService(serviceID, serviceUserID, testType)}
+	})
+	types.RegisterAuthRealm(func(realmID, redirectURL string) types.AuthRealm {
+		return &testRealm{id: realmID}
+	})
+}
+
+// openTestDatabases opens a fresh database for each backend which is available.
+func openTestDatabases(t *testing.T) map[string]*ServiceDB {
+	dbs := make(map[string]*ServiceDB)
+	for _, b := range testBackends {
+		url := b.defaultURL
+		if b.envVar != "" {
+			url = os.Getenv(b.envVar)
+		}
+		if url == "" {
+			continue
+		}
+		db, err := Open(b.databaseType, url)
+		if err != nil {
+			t.Fatalf("Failed to open %s database: %s", b.databaseType, err)
+		}
+		for _, table := range []string{"services", "matrix_clients", "auth_realms", "auth_sessions", "bot_options", "room_groups", "service_configs", "space_rooms", "tenants", "tenant_resources", "relayed_events", "notification_threads"} {
+			if _, err := db.db.Exec("DELETE FROM " + table); err != nil {
+				t.Fatalf("Failed to empty %s table %s: %s", b.databaseType, table, err)
+			}
+		}
+		dbs[b.databaseType] = db
+	}
+	return dbs
+}
+
+func TestMatrixClientConfigs(t *testing.T) {
+	for dbType, db := range openTestDatabases(t) {
+		cfg := api.ClientConfig{
+			UserID:        "@link:hyrule",
+			HomeserverURL: "https://hyrule",
+			AccessToken:   "its_dangerous",
+			Sync:          true,
+		}
+		if _, err := db.StoreMatrixClientConfig(cfg); err != nil {
+			t.Fatalf("%s: StoreMatrixClientConfig failed: %s", dbType, err)
+		}
+		cfg.DisplayName = "Link"
+		old, err := db.StoreMatrixClientConfig(cfg)
+		if err != nil {
+			t.Fatalf("%s: StoreMatrixClientConfig update failed: %s", dbType, err)
+		}
+		if old.DisplayName != "" {
+			t.Errorf("%s: want old display name '', got '%s'", dbType, old.DisplayName)
+		}
+		loaded, err := db.LoadMatrixClientConfig("@link:hyrule")
+		if err != nil || loaded != cfg {
+			t.Errorf("%s: LoadMatrixClientConfig want %+v, got %+v (err=%v)", dbType, cfg, loaded, err)
+		}
+		if _, err := db.LoadMatrixClientConfig("@ganon:hyrule"); err != sql.ErrNoRows {
+			t.Errorf("%s: LoadMatrixClientConfig want sql.ErrNoRows for unknown client, got %v", dbType, err)
+		}
+		configs, err := db.LoadMatrixClientConfigs()
+		if err != nil || len(configs) != 1 {
+			t.Errorf("%s: LoadMatrixClientConfigs want 1 config, got %d (err=%v)", dbType, len(configs), err)
+		}
+	}
+}
+
+func TestNextBatch(t *testing.T) {
+	for dbType, db := range openTestDatabases(t) {
+		storeTestClients(t, dbType, db, "@link:hyrule")
+		if err := db.UpdateNextBatch("@link:hyrule", "s123_456"); err != nil {
+			t.Fatalf("%s: UpdateNextBatch failed: %s", dbType, err)
+		}
+		if nb, err := db.LoadNextBatch("@link:hyrule"); err != nil || nb != "s123_456" {
+			t.Errorf("%s: LoadNextBatch want 's123_456', got '%s' (err=%v)", dbType, nb, err)
+		}
+	}
+}
+
+func storeTestClients(t *testing.T, dbType string, db *ServiceDB, userIDs ...string) {
+	for _, userID := range userIDs {
+		cfg := api.ClientConfig{UserID: userID, HomeserverURL: "https://hyrule", AccessToken: "its_dangerous"}
+		if _, err := db.StoreMatrixClientConfig(cfg); err != nil {
+			t.Fatalf("%s: StoreMatrixClientConfig failed: %s", dbType, err)
+		}
+	}
+}
+
+// Matrix IDs which only differ by case are different IDs.
+func TestIDsAreCaseSensitive(t *testing.T) {
+	for dbType, db := range openTestDatabases(t) {
+		storeTestClients(t, dbType, db, "@link:hyrule", "@Link:hyrule")
+		for _, userID := range []string{"@link:hyrule", "@Link:hyrule"} {
+			cfg, err := db.LoadMatrixClientConfig(userID)
+			if err != nil || cfg.UserID != userID {
+				t.Errorf("%s: LoadMatrixClientConfig(%s) got %s (err=%v)", dbType, userID, cfg.UserID, err)
+			}
+		}
+		if _, err := db.LoadMatrixClientConfig("@LINK:hyrule"); err != sql.ErrNoRows {
+			t.Errorf("%s: LoadMatrixClientConfig want sql.ErrNoRows for @LINK:hyrule, got %v", dbType, err)
+		}
+	}
+}
+
+// storeTestServices stores a_service and b_service for @link:hyrule and c_service for @zelda:hyrule.
+func storeTestServices(t *testing.T, dbType string, db *ServiceDB) {
+	storeTestClients(t, dbType, db, "@link:hyrule", "@zelda:hyrule")
+	for _, s := range []struct{ id, userID string }{
+		{"b_service", "@link:hyrule"},
+		{"a_service", "@link:hyrule"},
+		{"c_service", "@zelda:hyrule"},
+	} {
+		srv, _ := types.CreateService(s.id, testType, s.userID, []byte(`{"Rooms":["!castle:hyrule"]}`))
+		if _, err := db.StoreService(srv); err != nil {
+			t.Fatalf("%s: StoreService failed: %s", dbType, err)
+		}
+	}
+}
+
+func TestServices(t *testing.T) {
+	for dbType, db := range openTestDatabases(t) {
+		storeTestServices(t, dbType, db)
+		updated, _ := types.CreateService("a_service", testType, "@link:hyrule", []byte(`{"Rooms":["!temple:hyrule"]}`))
+		old, err := db.StoreService(updated)
+		if err != nil {
+			t.Fatalf("%s: StoreService update failed: %s", dbType, err)
+		}
+		if want := []string{"!castle:hyrule"}; !reflect.DeepEqual(old.(*testService).Rooms, want) {
+			t.Errorf("%s: StoreService want old rooms %v, got %v", dbType, want, old.(*testService).Rooms)
+		}
+
+		srv, err := db.LoadService("a_service")
+		if err != nil {
+			t.Fatalf("%s: LoadService failed: %s", dbType, err)
+		}
+		if want := []string{"!temple:hyrule"}; !reflect.DeepEqual(srv.(*testService).Rooms, want) {
+			t.Errorf("%s: LoadService want rooms %v, got %v", dbType, want, srv.(*testService).Rooms)
+		}
+
+		if err := db.DeleteService("a_service"); err != nil {
+			t.Fatalf("%s: DeleteService failed: %s", dbType, err)
+		}
+		if _, err := db.LoadService("a_service"); err != sql.ErrNoRows {
+			t.Errorf("%s: LoadService want sql.ErrNoRows for deleted service, got %v", dbType, err)
+		}
+	}
+}
+
+func TestLoadServicesForUserAndType(t *testing.T) {
+	for dbType, db := range openTestDatabases(t) {
+		storeTestServices(t, dbType, db)
+		srvs, err := db.LoadServicesForUser("@link:hyrule")
+		if err != nil || len(srvs) != 2 || srvs[0].ServiceID() != "a_service" || srvs[1].ServiceID() != "b_service" {
+			t.Errorf("%s: LoadServicesForUser want [a_service b_service], got %v (err=%v)", dbType, srvs, err)
+		}
+		srvs, err = db.LoadServicesByType(testType)
+		if err != nil || len(srvs) != 3 {
+			t.Errorf("%s: LoadServicesByType want 3 services, got %d (err=%v)", dbType, len(srvs), err)
+		}
+	}
+}
+
+func TestModifyService(t *testing.T) {
+	for dbType, db := range openTestDatabases(t) {
+		storeTestClients(t, dbType, db, "@link:hyrule")
+		srv, _ := types.CreateService("a_service", testType, "@link:hyrule", []byte(`{"Rooms":[]}`))
+		if _, err := db.StoreService(srv); err != nil {
+			t.Fatalf("%s: StoreService failed: %s", dbType, err)
+		}
+
+		// Concurrent modifications are each applied once to the latest version.
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := db.ModifyService("a_service", func(service types.Service) error {
+					s := service.(*testService)
+					s.Rooms = append(s.Rooms, "!castle:hyrule")
+					return nil
+				})
+				if err != nil {
+					t.Errorf("%s: ModifyService failed: %s", dbType, err)
+				}
+			}()
+		}
+		wg.Wait()
+		if _, err := db.ModifyService("a_service", func(service types.Service) error {
+			service.(*testService).Rooms = nil
+			return errors.New("changed my mind")
+		}); err == nil {
+			t.Errorf("%s: ModifyService want the error returned by fn", dbType)
+		}
+		srv, err := db.LoadService("a_service")
+		if err != nil {
+			t.Fatalf("%s: LoadService failed: %s", dbType, err)
+		}
+		if rooms := srv.(*testService).Rooms; len(rooms) != 10 {
+			t.Errorf("%s: ModifyService want 10 rooms, got %v", dbType, rooms)
+		}
+
+		if _, err := db.ModifyService("b_service", func(types.Service) error { return nil }); err != sql.ErrNoRows {
+			t.Errorf("%s: ModifyService want sql.ErrNoRows for unknown service, got %v", dbType, err)
+		}
+	}
+}
+
+func TestAuthRealms(t *testing.T) {
+	for dbType, db := range openTestDatabases(t) {
+		realm, _ := types.CreateAuthRealm("realm", testType, []byte(`{"Endpoint":"https://hyrule"}`))
+		if _, err := db.StoreAuthSession(realm.AuthSession("session", "@link:hyrule", "realm")); err == nil {
+			t.Errorf("%s: StoreAuthSession wanted an error for a realm which does not exist", dbType)
+		}
+		if _, err := db.StoreAuthRealm(realm); err != nil {
+			t.Fatalf("%s: StoreAuthRealm failed: %s", dbType, err)
+		}
+		loaded, err := db.LoadAuthRealm("realm")
+		if err != nil || loaded.(*testRealm).Endpoint != "https://hyrule" {
+			t.Errorf("%s: LoadAuthRealm want endpoint https://hyrule, got %+v (err=%v)", dbType, loaded, err)
+		}
+		realms, err := db.LoadAuthRealmsByType(testType)
+		if err != nil || len(realms) != 1 {
+			t.Errorf("%s: LoadAuthRealmsByType want 1 realm, got %d (err=%v)", dbType, len(realms), err)
+		}
+	}
+}
+
+func TestAuthSessions(t *testing.T) {
+	for dbType, db := range openTestDatabases(t) {
+		realm, _ := types.CreateAuthRealm("realm", testType, []byte(`{"Endpoint":"https://hyrule"}`))
+		if _, err := db.StoreAuthRealm(realm); err != nil {
+			t.Fatalf("%s: StoreAuthRealm failed: %s", dbType, err)
+		}
+		session := realm.AuthSession("session", "@link:hyrule", "realm")
+		session.(*testSession).Token = "master_sword"
+		if _, err := db.StoreAuthSession(session); err != nil {
+			t.Fatalf("%s: StoreAuthSession failed: %s", dbType, err)
+		}
+		byUser, err := db.LoadAuthSessionByUser("realm", "@link:hyrule")
+		if err != nil || !byUser.Authenticated() || byUser.ID() != "session" {
+			t.Errorf("%s: LoadAuthSessionByUser got %+v (err=%v)", dbType, byUser, err)
+		}
+		byID, err := db.LoadAuthSessionByID("realm", "session")
+		if err != nil || byID.UserID() != "@link:hyrule" {
+			t.Errorf("%s: LoadAuthSessionByID got %+v (err=%v)", dbType, byID, err)
+		}
+		if err := db.RemoveAuthSession("realm", "@link:hyrule"); err != nil {
+			t.Fatalf("%s: RemoveAuthSession failed: %s", dbType, err)
+		}
+		if _, err := db.LoadAuthSessionByUser("realm", "@link:hyrule"); err != sql.ErrNoRows {
+			t.Errorf("%s: LoadAuthSessionByUser want sql.ErrNoRows for removed session, got %v", dbType, err)
+		}
+	}
+}
+
+func TestBotOptions(t *testing.T) {
+	for dbType, db := range openTestDatabases(t) {
+		opts := types.BotOptions{
+			UserID:      "@neb:hyrule",
+			RoomID:      "!castle:hyrule",
+			SetByUserID: "@zelda:hyrule",
+			Options:     map[string]interface{}{"github": map[string]interface{}{"default_repo": "hyrule/castle"}},
+		}
+		if _, err := db.StoreBotOptions(opts); err != nil {
+			t.Fatalf("%s: StoreBotOptions failed: %s", dbType, err)
+		}
+		opts.SetByUserID = "@link:hyrule"
+		if _, err := db.StoreBotOptions(opts); err != nil {
+			t.Fatalf("%s: StoreBotOptions update failed: %s", dbType, err)
+		}
+		loaded, err := db.LoadBotOptions("@neb:hyrule", "!castle:hyrule")
+		if err != nil || loaded.SetByUserID != "@link:hyrule" || !reflect.DeepEqual(loaded.Options, opts.Options) {
+			t.Errorf("%s: LoadBotOptions want %+v, got %+v (err=%v)", dbType, opts, loaded, err)
+		}
+	}
+}
+
+func TestReferentialIntegrity(t *testing.T) {
+	for dbType, db := range openTestDatabases(t) {
+		srv, _ := types.CreateService("service", testType, "@link:hyrule", []byte(`{}`))
+		if _, err := db.StoreService(srv); err == nil {
+			t.Errorf("%s: StoreService wanted an error for a client which does not exist", dbType)
+		}
+		storeTestClients(t, dbType, db, "@link:hyrule")
+		if _, err := db.StoreService(srv); err != nil {
+			t.Fatalf("%s: StoreService failed: %s", dbType, err)
+		}
+		err := db.DeleteMatrixClientConfig("@link:hyrule")
+		if depErr, ok := err.(*DependencyError); !ok || !reflect.DeepEqual(depErr.Dependents, []string{"service service"}) {
+			t.Errorf("%s: DeleteMatrixClientConfig want a DependencyError for service, got %v", dbType, err)
+		}
+		if err := db.DeleteService("service"); err != nil {
+			t.Fatalf("%s: DeleteService failed: %s", dbType, err)
+		}
+		if err := db.DeleteMatrixClientConfig("@link:hyrule"); err != nil {
+			t.Errorf("%s: DeleteMatrixClientConfig failed: %s", dbType, err)
+		}
+		if _, err := db.LoadMatrixClientConfig("@link:hyrule"); err != sql.ErrNoRows {
+			t.Errorf("%s: LoadMatrixClientConfig want sql.ErrNoRows for deleted client, got %v", dbType, err)
+		}
+	}
+}
+
+// Services which can't be loaded still use the clients and realms they name.
+func TestUnloadableServiceIntegrity(t *testing.T) {
+	for dbType, db := range openTestDatabases(t) {
+		storeTestClients(t, dbType, db, "@link:hyrule", "@zelda:hyrule")
+		realm, _ := types.CreateAuthRealm("realm", testType, []byte(`{}`))
+		if _, err := db.StoreAuthRealm(realm); err != nil {
+			t.Fatalf("%s: StoreAuthRealm failed: %s", dbType, err)
+		}
+		q := `INSERT INTO services(service_id, service_type, service_user_id, service_json, time_added_ms, time_updated_ms) VALUES('unknown', 'no-such-type', '@zelda:hyrule', '{"failover_user_ids":["@link:hyrule"],"realm_id":"realm"}', 0, 0)`
+		if _, err := db.db.Exec(q); err != nil {
+			t.Fatalf("%s: failed to insert service: %s", dbType, err)
+		}
+		want := []string{"service unknown"}
+		if depErr, ok := db.DeleteMatrixClientConfig("@link:hyrule").(*DependencyError); !ok || !reflect.DeepEqual(depErr.Dependents, want) {
+			t.Errorf("%s: DeleteMatrixClientConfig want a DependencyError for service unknown, got %v", dbType, depErr)
+		}
+		if depErr, ok := db.DeleteAuthRealm("realm").(*DependencyError); !ok || !reflect.DeepEqual(depErr.Dependents, want) {
+			t.Errorf("%s: DeleteAuthRealm want a DependencyError for service unknown, got %v", dbType, depErr)
+		}
+	}
+}
+
+func TestRealmIntegrity(t *testing.T) {
+	for dbType, db := range openTestDatabases(t) {
+		storeTestClients(t, dbType, db, "@link:hyrule")
+		realm, _ := types.CreateAuthRealm("realm", testType, []byte(`{}`))
+		if _, err := db.StoreAuthRealm(realm); err != nil {
+			t.Fatalf("%s: StoreAuthRealm failed: %s", dbType, err)
+		}
+		if _, err := db.StoreAuthSession(realm.AuthSession("session", "@link:hyrule", "realm")); err != nil {
+			t.Fatalf("%s: StoreAuthSession failed: %s", dbType, err)
+		}
+		if _, ok := db.DeleteAuthRealm("realm").(*DependencyError); !ok {
+			t.Errorf("%s: DeleteAuthRealm wanted a DependencyError for a realm with sessions", dbType)
+		}
+		if err := db.RemoveAuthSession("realm", "@link:hyrule"); err != nil {
+			t.Fatalf("%s: RemoveAuthSession failed: %s", dbType, err)
+		}
+		if err := db.DeleteAuthRealm("realm"); err != nil {
+			t.Errorf("%s: DeleteAuthRealm failed: %s", dbType, err)
+		}
+	}
+}
+
+// insertOrphans inserts a service without a client, a service of an unknown type, a session
+// without a realm and bot options without a client. They are inserted directly, as the storage
+// API refuses to create them.
+func insertOrphans(t *testing.T, dbType string, db *ServiceDB) {
+	for _, q := range []string{
+		`INSERT INTO services(service_id, service_type, service_user_id, service_json, time_added_ms, time_updated_ms) VALUES('lost', '` + testType + `', '@ganon:hyrule', '{}', 0, 0)`,
+		`INSERT INTO services(service_id, service_type, service_user_id, service_json, time_added_ms, time_updated_ms) VALUES('unknown', 'no-such-type', '@link:hyrule', '{}', 0, 0)`,
+		`INSERT INTO auth_sessions(session_id, realm_id, user_id, session_json, time_added_ms, time_updated_ms) VALUES('session', 'gone', '@link:hyrule', '{}', 0, 0)`,
+		`INSERT INTO bot_options(user_id, room_id, set_by_user_id, bot_options_json, time_added_ms, time_updated_ms) VALUES('@ganon:hyrule', '!tower:hyrule', '@ganon:hyrule', '{}', 0, 0)`,
+	} {
+		if _, err := db.db.Exec(q); err != nil {
+			t.Fatalf("%s: failed to insert orphan: %s", dbType, err)
+		}
+	}
+}
+
+// checkOrphanReport checks that the report lists one of each orphan inserted by insertOrphans.
+func checkOrphanReport(t *testing.T, dbType string, report OrphanReport) {
+	if len(report.ServicesWithoutClient) != 1 || report.ServicesWithoutClient[0].ServiceID != "lost" {
+		t.Errorf("%s: FindOrphans want ServicesWithoutClient [lost], got %+v", dbType, report.ServicesWithoutClient)
+	}
+	if len(report.UnloadableServices) != 1 || report.UnloadableServices[0].ServiceID != "unknown" {
+		t.Errorf("%s: FindOrphans want UnloadableServices [unknown], got %+v", dbType, report.UnloadableServices)
+	}
+	if len(report.SessionsWithoutRealm) != 1 || len(report.BotOptionsWithoutClient) != 1 {
+		t.Errorf("%s: FindOrphans want 1 session and 1 bot options, got %+v", dbType, report)
+	}
+}
+
+func TestOrphans(t *testing.T) {
+	for dbType, db := range openTestDatabases(t) {
+		insertOrphans(t, dbType, db)
+		storeTestClients(t, dbType, db, "@link:hyrule")
+
+		report, err := db.FindOrphans()
+		if err != nil {
+			t.Fatalf("%s: FindOrphans failed: %s", dbType, err)
+		}
+		checkOrphanReport(t, dbType, report)
+
+		if _, err := db.RemoveOrphans(); err != nil {
+			t.Fatalf("%s: RemoveOrphans failed: %s", dbType, err)
+		}
+		report, err = db.FindOrphans()
+		if err != nil || len(report.ServicesWithoutClient) != 0 || len(report.SessionsWithoutRealm) != 0 || len(report.BotOptionsWithoutClient) != 0 {
+			t.Errorf("%s: want no orphans after RemoveOrphans, got %+v (err=%v)", dbType, report, err)
+		}
+		if len(report.UnloadableServices) != 1 {
+			t.Errorf("%s: RemoveOrphans should not remove unloadable services, got %+v", dbType, report.UnloadableServices)
+		}
+	}
+}
+
+// storeRoomGroupService stores the room group "ops" and a service which references it.
+func storeRoomGroupService(t *testing.T, dbType string, db *ServiceDB) {
+	storeTestClients(t, dbType, db, "@link:hyrule")
+	if _, err := db.StoreRoomGroup(api.RoomGroup{Name: "ops", Rooms: []string{"!ops:hyrule"}}); err != nil {
+		t.Fatalf("%s: StoreRoomGroup failed: %s", dbType, err)
+	}
+	old, err := db.StoreRoomGroup(api.RoomGroup{Name: "ops", Rooms: []string{"!ops:hyrule", "!dev:hyrule"}})
+	if err != nil || !reflect.DeepEqual(old.Rooms, []string{"!ops:hyrule"}) {
+		t.Errorf("%s: StoreRoomGroup update want old rooms [!ops:hyrule], got %v (err=%v)", dbType, old.Rooms, err)
+	}
+
+	config := json.RawMessage(`{"Rooms":["group:ops"]}`)
+	expanded, names, err := db.ExpandRoomGroups(testType, config)
+	if err != nil || !reflect.DeepEqual(names, []string{"ops"}) {
+		t.Fatalf("%s: ExpandRoomGroups want names [ops], got %v (err=%v)", dbType, names, err)
+	}
+	srv, _ := types.CreateService("service", testType, "@link:hyrule", expanded)
+	if want := []string{"!ops:hyrule", "!dev:hyrule"}; !reflect.DeepEqual(srv.(*testService).Rooms, want) {
+		t.Errorf("%s: ExpandRoomGroups want rooms %v, got %v", dbType, want, srv.(*testService).Rooms)
+	}
+	if _, err := db.StoreService(srv); err != nil {
+		t.Fatalf("%s: StoreService failed: %s", dbType, err)
+	}
+	if err := db.StoreServiceConfig("service", testType, config); err != nil {
+		t.Fatalf("%s: StoreServiceConfig failed: %s", dbType, err)
+	}
+}
+
+func TestRoomGroups(t *testing.T) {
+	for dbType, db := range openTestDatabases(t) {
+		storeRoomGroupService(t, dbType, db)
+		if ids, err := db.LoadServiceIDsForRoomGroup("ops"); err != nil || !reflect.DeepEqual(ids, []string{"service"}) {
+			t.Errorf("%s: LoadServiceIDsForRoomGroup want [service], got %v (err=%v)", dbType, ids, err)
+		}
+		if _, ok := db.DeleteRoomGroup("ops").(*DependencyError); !ok {
+			t.Errorf("%s: DeleteRoomGroup wanted a DependencyError for a group in use", dbType)
+		}
+
+		if err := db.DeleteService("service"); err != nil {
+			t.Fatalf("%s: DeleteService failed: %s", dbType, err)
+		}
+		if _, err := db.LoadServiceConfig("service"); err != sql.ErrNoRows {
+			t.Errorf("%s: LoadServiceConfig want sql.ErrNoRows for a deleted service, got %v", dbType, err)
+		}
+		var configs int
+		if err := db.db.QueryRow("SELECT COUNT(*) FROM service_configs").Scan(&configs); err != nil || configs != 0 {
+			t.Errorf("%s: DeleteService want no service configs left, got %d (err=%v)", dbType, configs, err)
+		}
+		if err := db.DeleteRoomGroup("ops"); err != nil {
+			t.Errorf("%s: DeleteRoomGroup failed: %s", dbType, err)
+		}
+		if _, err := db.LoadRoomGroup("ops"); err != sql.ErrNoRows {
+			t.Errorf("%s: LoadRoomGroup want sql.ErrNoRows for a deleted group, got %v", dbType, err)
+		}
+	}
+}
+
+func TestSpaceRooms(t *testing.T) {
+	for dbType, db := range openTestDatabases(t) {
+		if _, err := db.LoadSpaceRooms("@link:hyrule", "#team:hyrule"); err != sql.ErrNoRows {
+			t.Errorf("%s: LoadSpaceRooms want sql.ErrNoRows before the space is stored, got %v", dbType, err)
+		}
+		if _, err := db.StoreSpaceRooms("@link:hyrule", "#team:hyrule", []string{"!ops:hyrule"}); err != nil {
+			t.Fatalf("%s: StoreSpaceRooms failed: %s", dbType, err)
+		}
+		old, err := db.StoreSpaceRooms("@link:hyrule", "#team:hyrule", []string{"!dev:hyrule", "!ops:hyrule"})
+		if err != nil || !reflect.DeepEqual(old, []string{"!ops:hyrule"}) {
+			t.Errorf("%s: StoreSpaceRooms update want old rooms [!ops:hyrule], got %v (err=%v)", dbType, old, err)
+		}
+		rooms, err := db.LoadSpaceRooms("@link:hyrule", "#team:hyrule")
+		if err != nil || !reflect.DeepEqual(rooms, []string{"!dev:hyrule", "!ops:hyrule"}) {
+			t.Errorf("%s: LoadSpaceRooms want [!dev:hyrule !ops:hyrule], got %v (err=%v)", dbType, rooms, err)
+		}
+		if _, err := db.LoadSpaceRooms("@zelda:hyrule", "#team:hyrule"); err != sql.ErrNoRows {
+			t.Errorf("%s: LoadSpaceRooms want sql.ErrNoRows for a different client, got %v", dbType, err)
+		}
+	}
+}
+
+func TestTenants(t *testing.T) {
+	for dbType, db := range openTestDatabases(t) {
+		if has, err := db.HasTenants(); err != nil || has {
+			t.Errorf("%s: HasTenants want false before any tenants are stored, got %v (err=%v)", dbType, has, err)
+		}
+		tenant := api.Tenant{ID: "ops", AccessToken: "secret", Quotas: api.TenantQuotas{MaxServices: 2}}
+		if _, err := db.StoreTenant(tenant); err != nil {
+			t.Fatalf("%s: StoreTenant failed: %s", dbType, err)
+		}
+		if has, err := db.HasTenants(); err != nil || !has {
+			t.Errorf("%s: HasTenants want true, got %v (err=%v)", dbType, has, err)
+		}
+		checkTenantTokens(t, dbType, db, tenant)
+	}
+}
+
+// checkTenantTokens loads the stored tenant by its token "secret", then replaces the token.
+func checkTenantTokens(t *testing.T, dbType string, db *ServiceDB, tenant api.Tenant) {
+	loaded, err := db.LoadTenantByToken("secret")
+	if err != nil || loaded.ID != "ops" || loaded.AccessToken != "" || loaded.Quotas.MaxServices != 2 {
+		t.Errorf("%s: LoadTenantByToken want ops without a token, got %+v (err=%v)", dbType, loaded, err)
+	}
+	tenant.AccessToken = "rotated"
+	if _, err := db.StoreTenant(tenant); err != nil {
+		t.Fatalf("%s: StoreTenant update failed: %s", dbType, err)
+	}
+	if _, err := db.LoadTenantByToken("secret"); err != sql.ErrNoRows {
+		t.Errorf("%s: LoadTenantByToken want sql.ErrNoRows for a replaced token, got %v", dbType, err)
+	}
+}
+
+func TestResourceOwners(t *testing.T) {
+	for dbType, db := range openTestDatabases(t) {
+		if _, err := db.StoreTenant(api.Tenant{ID: "ops", AccessToken: "secret"}); err != nil {
+			t.Fatalf("%s: StoreTenant failed: %s", dbType, err)
+		}
+		storeTestClients(t, dbType, db, "@link:hyrule", "@zelda:hyrule")
+		if err := db.StoreResourceOwner(ResourceClient, "@link:hyrule", "ops"); err != nil {
+			t.Fatalf("%s: StoreResourceOwner failed: %s", dbType, err)
+		}
+		if owner, err := db.LoadResourceOwner(ResourceClient, "@link:hyrule"); err != nil || owner != "ops" {
+			t.Errorf("%s: LoadResourceOwner want ops, got '%s' (err=%v)", dbType, owner, err)
+		}
+		if owner, err := db.LoadResourceOwner(ResourceClient, "@zelda:hyrule"); err != nil || owner != "" {
+			t.Errorf("%s: LoadResourceOwner want no owner, got '%s' (err=%v)", dbType, owner, err)
+		}
+		resources, err := db.LoadOwnedResources(ResourceClient)
+		want := []OwnedResource{{"@link:hyrule", "", "ops"}, {"@zelda:hyrule", "", ""}}
+		if err != nil || !reflect.DeepEqual(resources, want) {
+			t.Errorf("%s: LoadOwnedResources want %v, got %v (err=%v)", dbType, want, resources, err)
+		}
+		if err := db.DeleteMatrixClientConfig("@link:hyrule"); err != nil {
+			t.Fatalf("%s: DeleteMatrixClientConfig failed: %s", dbType, err)
+		}
+		if owner, _ := db.LoadResourceOwner(ResourceClient, "@link:hyrule"); owner != "" {
+			t.Errorf("%s: LoadResourceOwner want no owner for a deleted client, got '%s'", dbType, owner)
+		}
+	}
+}
+
+func TestRelayedEvents(t *testing.T) {
+	for dbType, db := range openTestDatabases(t) {
+		relayed := map[string]string{"!private:corp": "$origin", "!public:matrix.org": "$copy"}
+		if err := db.StoreRelayedEvents("relay", "$origin", relayed); err != nil {
+			t.Fatalf("%s: StoreRelayedEvents failed: %s", dbType, err)
+		}
+		if err := db.StoreRelayedEvents("relay", "$other", map[string]string{"!private:corp": "$other"}); err != nil {
+			t.Fatalf("%s: StoreRelayedEvents failed: %s", dbType, err)
+		}
+		got, err := db.LoadRelayedEvents("relay", "!public:matrix.org", "$copy")
+		if err != nil || !reflect.DeepEqual(got, relayed) {
+			t.Errorf("%s: LoadRelayedEvents of a copy want %v, got %v (err=%v)", dbType, relayed, got, err)
+		}
+		if got, _ = db.LoadRelayedEvents("other_relay", "!private:corp", "$origin"); len(got) != 0 {
+			t.Errorf("%s: LoadRelayedEvents of another service want nothing, got %v", dbType, got)
+		}
+		if err := db.DeleteRelayedEventsBefore("relay", time.Now().Add(time.Minute)); err != nil {
+			t.Fatalf("%s: DeleteRelayedEventsBefore failed: %s", dbType, err)
+		}
+		if got, _ = db.LoadRelayedEvents("relay", "!private:corp", "$origin"); len(got) != 0 {
+			t.Errorf("%s: LoadRelayedEvents want nothing after deletion, got %v", dbType, got)
+		}
+	}
+}
+
+func TestNotificationThreads(t *testing.T) {
+	for dbType, db := range openTestDatabases(t) {
+		if root, err := db.LoadNotificationThread("ghwebhook", "!room:hyrule", "matrix-org/go-neb#1"); err != nil || root != "" {
+			t.Errorf("%s: LoadNotificationThread want no thread, got '%s' (err=%v)", dbType, root, err)
+		}
+		if err := db.StoreNotificationThread("ghwebhook", "!room:hyrule", "matrix-org/go-neb#1", "$root"); err != nil {
+			t.Fatalf("%s: StoreNotificationThread failed: %s", dbType, err)
+		}
+		if root, err := db.LoadNotificationThread("ghwebhook", "!room:hyrule", "matrix-org/go-neb#1"); err != nil || root != "$root" {
+			t.Errorf("%s: LoadNotificationThread want '$root', got '%s' (err=%v)", dbType, root, err)
+		}
+		if root, _ := db.LoadNotificationThread("ghwebhook", "!other:hyrule", "matrix-org/go-neb#1"); root != "" {
+			t.Errorf("%s: LoadNotificationThread want no thread in another room, got '%s'", dbType, root)
+		}
+		longSubject := strings.Repeat("matrix-org/go-neb: a very long subject ", 20)
+		if err := db.StoreNotificationThread("ghwebhook", "!room:hyrule", longSubject, "$long"); err != nil {
+			t.Fatalf("%s: StoreNotificationThread with a long subject failed: %s", dbType, err)
+		}
+		if root, err := db.LoadNotificationThread("ghwebhook", "!room:hyrule", longSubject); err != nil || root != "$long" {
+			t.Errorf("%s: LoadNotificationThread want '$long', got '%s' (err=%v)", dbType, root, err)
+		}
+		checkNotificationThreadDeletion(t, dbType, db)
+	}
+}
+
+// checkNotificationThreadDeletion checks that the thread stored for matrix-org/go-neb#1 in !room:hyrule is
+// forgotten once it is old or its service is deleted.
+func checkNotificationThreadDeletion(t *testing.T, dbType string, db *ServiceDB) {
+	if err := db.DeleteNotificationThreadsBefore(time.Now().Add(-time.Minute)); err != nil {
+		t.Fatalf("%s: DeleteNotificationThreadsBefore failed: %s", dbType, err)
+	}
+	if root, _ := db.LoadNotificationThread("ghwebhook", "!room:hyrule", "matrix-org/go-neb#1"); root != "$root" {
+		t.Errorf("%s: LoadNotificationThread want a new thread to be kept, got '%s'", dbType, root)
+	}
+	if err := db.DeleteNotificationThreadsBefore(time.Now().Add(time.Minute)); err != nil {
+		t.Fatalf("%s: DeleteNotificationThreadsBefore failed: %s", dbType, err)
+	}
+	if root, _ := db.LoadNotificationThread("ghwebhook", "!room:hyrule", "matrix-org/go-neb#1"); root != "" {
+		t.Errorf("%s: LoadNotificationThread want an old thread to be forgotten, got '%s'", dbType, root)
+	}
+	if err := db.StoreNotificationThread("ghwebhook", "!room:hyrule", "matrix-org/go-neb#1", "$root"); err != nil {
+		t.Fatalf("%s: StoreNotificationThread failed: %s", dbType, err)
+	}
+	if err := db.DeleteService("ghwebhook"); err != nil {
+		t.Fatalf("%s: DeleteService failed: %s", dbType, err)
+	}
+	if root, _ := db.LoadNotificationThread("ghwebhook", "!room:hyrule", "matrix-org/go-neb#1"); root != "" {
+		t.Errorf("%s: LoadNotificationThread want no thread once the service is deleted, got '%s'", dbType, root)
+	}
+}
+
+func TestRebind(t *testing.T) {
+	mysql, _ := dialectFor("mysql")
+	query, args, err := mysql.rebind("UPDATE t SET a = $2, b = $1 WHERE c = $2", []interface{}{"one", "two"})
+	if err != nil {
+		t.Fatal("rebind failed: ", err)
+	}
+	if want := "UPDATE t SET a = ?, b = ? WHERE c = ?"; query != want {
+		t.Errorf("TestRebind want query '%s', got '%s'", want, query)
+	}
+	if want := []interface{}{"two", "one", "two"}; !reflect.DeepEqual(args, want) {
+		t.Errorf("TestRebind want args %v, got %v", want, args)
+	}
+	if _, _, err := mysql.rebind("SELECT $3", []interface{}{"one"}); err == nil {
+		t.Errorf("TestRebind wanted an error for an out of range parameter")
+	}
+
+	sqlite, _ := dialectFor("sqlite3")
+	if query, _, _ := sqlite.rebind("SELECT $1", []interface{}{"one"}); query != "SELECT $1" {
+		t.Errorf("TestRebind want sqlite3 queries unchanged, got '%s'", query)
+	}
+	if _, err := dialectFor("oracle"); err == nil {
+		t.Errorf("TestRebind wanted an error for an unsupported database type")
+	}
+}
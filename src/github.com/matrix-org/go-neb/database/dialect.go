@@ -0,0 +1,100 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// A dialect describes how to talk to a particular type of SQL database.
+//
+// All SQL statements in this package are written using numbered "$1" style placeholders,
+// which sqlite3 and postgres understand natively. Dialects which only understand "?" style
+// placeholders have their statements rewritten before they are executed.
+type dialect struct {
+	// The statements to execute, in order, to create the schema.
+	schema []string
+	// True if the database driver only understands "?" placeholders.
+	questionMarkParams bool
+	// True if the database supports "SELECT ... FOR UPDATE" to lock the selected rows.
+	selectForUpdate bool
+}
+
+var dialects = map[string]dialect{
+	"sqlite3": {
+		schema: []string{schemaSQL},
+	},
+	"postgres": {
+		schema:          []string{schemaSQL},
+		selectForUpdate: true,
+	},
+	"mysql": {
+		schema:             mysqlSchemaSQL,
+		questionMarkParams: true,
+		selectForUpdate:    true,
+	},
+}
+
+func dialectFor(databaseType string) (dialect, error) {
+	d, ok := dialects[databaseType]
+	if !ok {
+		return dialect{}, fmt.Errorf("Unsupported database type: %s", databaseType)
+	}
+	return d, nil
+}
+
+var numberedParamRegex = regexp.MustCompile(`\$([0-9]+)`)
+
+// rebind rewrites the query and its arguments for this dialect. Numbered placeholders may
+// appear in any order and more than once: the arguments are reordered to match.
+func (d dialect) rebind(query string, args []interface{}) (string, []interface{}, error) {
+	if !d.questionMarkParams {
+		return query, args, nil
+	}
+	var reordered []interface{}
+	var err error
+	rewritten := numberedParamRegex.ReplaceAllStringFunc(query, func(param string) string {
+		n, _ := strconv.Atoi(param[1:])
+		if n < 1 || n > len(args) {
+			err = fmt.Errorf("Query parameter %s out of range: %d args supplied", param, len(args))
+			return param
+		}
+		reordered = append(reordered, args[n-1])
+		return "?"
+	})
+	return rewritten, reordered, err
+}
+
+// sqlTxn is a transaction which rewrites the queries executed on it for the
+// dialect of the database.
+type sqlTxn struct {
+	*sql.Tx
+	dialect dialect
+}
+
+// Exec executes a query that doesn't return rows.
+func (t *sqlTxn) Exec(query string, args ...interface{}) (sql.Result, error) {
+	query, args, err := t.dialect.rebind(query, args)
+	if err != nil {
+		return nil, err
+	}
+	return t.Tx.Exec(query, args...)
+}
+
+// Query executes a query that returns rows.
+func (t *sqlTxn) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	query, args, err := t.dialect.rebind(query, args)
+	if err != nil {
+		return nil, err
+	}
+	return t.Tx.Query(query, args...)
+}
+
+// QueryRow executes a query that is expected to return at most one row.
+func (t *sqlTxn) QueryRow(query string, args ...interface{}) *sql.Row {
+	// A bad query will fail when the row is scanned, so there's no need to handle
+	// the error here.
+	query, args, _ = t.dialect.rebind(query, args)
+	return t.Tx.QueryRow(query, args...)
+}
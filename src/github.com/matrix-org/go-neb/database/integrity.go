@@ -0,0 +1,216 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/matrix-org/go-neb/types"
+)
+
+// A DependencyError is returned when something cannot be removed or replaced because
+// other things still depend on it.
+type DependencyError struct {
+	// The thing being removed or replaced, e.g. "client @goneb:localhost".
+	Entry string
+	// The things which depend on it, e.g. "service github_service".
+	Dependents []string
+}
+
+func (e *DependencyError) Error() string {
+	return fmt.Sprintf("Cannot remove %s: it is still used by %s", e.Entry, strings.Join(e.Dependents, ", "))
+}
+
+// OrphanReport lists the stored entries which refer to things that no longer exist.
+type OrphanReport struct {
+	// Services whose service user ID does not have a configured client.
+	ServicesWithoutClient []OrphanedService
+	// Services which refer to auth realms that do not exist.
+	ServicesWithoutRealm []OrphanedService
+	// Services which cannot be loaded, e.g. because their type is no longer known.
+	UnloadableServices []OrphanedService
+	// Auth sessions whose realm does not exist.
+	SessionsWithoutRealm []OrphanedSession
+	// Bot options for bot users which do not have a configured client.
+	BotOptionsWithoutClient []OrphanedBotOptions
+}
+
+// OrphanedService is a service listed in an OrphanReport.
+type OrphanedService struct {
+	ServiceID     string
+	ServiceType   string
+	ServiceUserID string
+	// The realm IDs which this service refers to but which do not exist.
+	MissingRealmIDs []string `json:",omitempty"`
+	// Why the service could not be loaded.
+	Error string `json:",omitempty"`
+}
+
+// OrphanedSession is an auth session listed in an OrphanReport.
+type OrphanedSession struct {
+	SessionID string
+	RealmID   string
+	UserID    string
+}
+
+// OrphanedBotOptions are bot options listed in an OrphanReport.
+type OrphanedBotOptions struct {
+	UserID string
+	RoomID string
+}
+
+// clientDependentsTxn returns the things which use the client with the given user ID.
+func clientDependentsTxn(txn *sqlTxn, userID string) ([]string, error) {
+	serviceIDs, err := selectServiceIDsForUserTxn(txn, userID)
+	if err != nil {
+		return nil, err
+	}
+	var dependents []string
+	for _, id := range serviceIDs {
+		dependents = append(dependents, "service "+id)
+	}
+	srvs, err := selectAllServicesTxn(txn)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range srvs {
+		if s.UserID == userID {
+			continue // already listed
+		}
+		service, err := types.CreateService(s.ID, s.Type, s.UserID, s.ServiceJSON)
+		if err != nil && mentionsID(s.ServiceJSON, userID) {
+			dependents = append(dependents, "service "+s.ID)
+		} else if err == nil && dependsOnClient(service, userID) {
+			dependents = append(dependents, "service "+s.ID)
+		}
+	}
+	return dependents, nil
+}
+
+func dependsOnClient(service types.Service, userID string) bool {
+	if types.UsesClient(service, userID) {
+		return true
+	}
+	if fs, ok := service.(types.FailoverSender); ok {
+		for _, id := range fs.FailoverUsers() {
+			if id == userID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// realmDependentsTxn returns the things which use the realm with the given ID.
+func realmDependentsTxn(txn *sqlTxn, realmID string) ([]string, error) {
+	var dependents []string
+	sessions, err := selectAuthSessionsForRealmTxn(txn, realmID)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range sessions {
+		dependents = append(dependents, fmt.Sprintf("session %s (%s)", s.SessionID, s.UserID))
+	}
+	srvs, err := selectAllServicesTxn(txn)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range srvs {
+		service, err := types.CreateService(s.ID, s.Type, s.UserID, s.ServiceJSON)
+		if err != nil && mentionsID(s.ServiceJSON, realmID) {
+			dependents = append(dependents, "service "+s.ID)
+		} else if err == nil && dependsOnRealm(service, realmID) {
+			dependents = append(dependents, "service "+s.ID)
+		}
+	}
+	return dependents, nil
+}
+
+func dependsOnRealm(service types.Service, realmID string) bool {
+	rd, ok := service.(types.RealmDependent)
+	if !ok {
+		return false
+	}
+	for _, id := range rd.RealmIDs() {
+		if id == realmID {
+			return true
+		}
+	}
+	return false
+}
+
+// mentionsID returns true if any string in the service JSON is the given ID. This is used for
+// services which can't be loaded, e.g. because their type has been disabled or their config is
+// bad, since they will still use the clients and realms they name once they are fixed. If the JSON
+// can't be parsed, it is assumed to mention the ID.
+func mentionsID(serviceJSON []byte, id string) bool {
+	var v interface{}
+	if err := json.Unmarshal(serviceJSON, &v); err != nil {
+		return true
+	}
+	return containsStringValue(v, id)
+}
+
+func containsStringValue(v interface{}, str string) bool {
+	switch v := v.(type) {
+	case string:
+		return v == str
+	case []interface{}:
+		for _, elem := range v {
+			if containsStringValue(elem, str) {
+				return true
+			}
+		}
+	case map[string]interface{}:
+		for _, elem := range v {
+			if containsStringValue(elem, str) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func findOrphansTxn(txn *sqlTxn) (report OrphanReport, err error) {
+	if report.ServicesWithoutClient, err = selectServicesWithoutClientTxn(txn); err != nil {
+		return
+	}
+	if report.SessionsWithoutRealm, err = selectAuthSessionsWithoutRealmTxn(txn); err != nil {
+		return
+	}
+	if report.BotOptionsWithoutClient, err = selectBotOptionsWithoutClientTxn(txn); err != nil {
+		return
+	}
+
+	srvs, err := selectAllServicesTxn(txn)
+	if err != nil {
+		return
+	}
+	for _, s := range srvs {
+		orphan := OrphanedService{
+			ServiceID:     s.ID,
+			ServiceType:   s.Type,
+			ServiceUserID: s.UserID,
+		}
+		service, createErr := types.CreateService(s.ID, s.Type, s.UserID, s.ServiceJSON)
+		if createErr != nil {
+			orphan.Error = createErr.Error()
+			report.UnloadableServices = append(report.UnloadableServices, orphan)
+			continue
+		}
+		rd, ok := service.(types.RealmDependent)
+		if !ok {
+			continue
+		}
+		for _, realmID := range rd.RealmIDs() {
+			if _, realmErr := selectRealmTxn(txn, realmID); realmErr == sql.ErrNoRows {
+				orphan.MissingRealmIDs = append(orphan.MissingRealmIDs, realmID)
+			}
+		}
+		if len(orphan.MissingRealmIDs) > 0 {
+			report.ServicesWithoutRealm = append(report.ServicesWithoutRealm, orphan)
+		}
+	}
+	return
+}
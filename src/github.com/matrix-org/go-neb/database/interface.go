@@ -1,6 +1,9 @@
 package database
 
 import (
+	"encoding/json"
+	"time"
+
 	"github.com/matrix-org/go-neb/api"
 	"github.com/matrix-org/go-neb/types"
 )
@@ -10,6 +13,7 @@ type Storer interface {
 	StoreMatrixClientConfig(config api.ClientConfig) (oldConfig api.ClientConfig, err error)
 	LoadMatrixClientConfigs() (configs []api.ClientConfig, err error)
 	LoadMatrixClientConfig(userID string) (config api.ClientConfig, err error)
+	DeleteMatrixClientConfig(userID string) (err error)
 
 	UpdateNextBatch(userID, nextBatch string) (err error)
 	LoadNextBatch(userID string) (nextBatch string, err error)
@@ -19,10 +23,12 @@ type Storer interface {
 	LoadServicesForUser(serviceUserID string) (services []types.Service, err error)
 	LoadServicesByType(serviceType string) (services []types.Service, err error)
 	StoreService(service types.Service) (oldService types.Service, err error)
+	ModifyService(serviceID string, fn func(service types.Service) error) (service types.Service, err error)
 
 	LoadAuthRealm(realmID string) (realm types.AuthRealm, err error)
 	LoadAuthRealmsByType(realmType string) (realms []types.AuthRealm, err error)
 	StoreAuthRealm(realm types.AuthRealm) (old types.AuthRealm, err error)
+	DeleteAuthRealm(realmID string) error
 
 	StoreAuthSession(session types.AuthSession) (old types.AuthSession, err error)
 	LoadAuthSessionByUser(realmID, userID string) (session types.AuthSession, err error)
@@ -32,6 +38,37 @@ type Storer interface {
 	LoadBotOptions(userID, roomID string) (opts types.BotOptions, err error)
 	StoreBotOptions(opts types.BotOptions) (oldOpts types.BotOptions, err error)
 
+	StoreRoomGroup(group api.RoomGroup) (old api.RoomGroup, err error)
+	LoadRoomGroup(name string) (group api.RoomGroup, err error)
+	LoadRoomGroups() (groups []api.RoomGroup, err error)
+	DeleteRoomGroup(name string) error
+	ExpandRoomGroups(serviceType string, config json.RawMessage) (expanded json.RawMessage, names []string, err error)
+	StoreServiceConfig(serviceID, serviceType string, config json.RawMessage) error
+	LoadServiceConfig(serviceID string) (config json.RawMessage, err error)
+	LoadServiceIDsForRoomGroup(name string) (serviceIDs []string, err error)
+	LoadServiceConfigs() (configs map[string]ServiceConfig, err error)
+	StoreSpaceRooms(userID, space string, rooms []string) (oldRooms []string, err error)
+	LoadSpaceRooms(userID, space string) (rooms []string, err error)
+
+	StoreTenant(tenant api.Tenant) (old api.Tenant, err error)
+	LoadTenant(tenantID string) (tenant api.Tenant, err error)
+	LoadTenantByToken(token string) (tenant api.Tenant, err error)
+	HasTenants() (bool, error)
+	StoreResourceOwner(resourceType, resourceID, tenantID string) error
+	LoadResourceOwner(resourceType, resourceID string) (tenantID string, err error)
+	LoadOwnedResources(resourceType string) (resources []OwnedResource, err error)
+
+	StoreRelayedEvents(serviceID, originEventID string, eventIDs map[string]string) error
+	LoadRelayedEvents(serviceID, roomID, eventID string) (eventIDs map[string]string, err error)
+	DeleteRelayedEventsBefore(serviceID string, before time.Time) error
+
+	StoreNotificationThread(serviceID, roomID, subject, rootEventID string) error
+	LoadNotificationThread(serviceID, roomID, subject string) (rootEventID string, err error)
+	DeleteNotificationThreadsBefore(before time.Time) error
+
+	FindOrphans() (report OrphanReport, err error)
+	RemoveOrphans() (report OrphanReport, err error)
+
 	InsertFromConfig(cfg *api.ConfigFile) error
 }
 
@@ -54,6 +91,11 @@ func (s *NopStorage) LoadMatrixClientConfig(userID string) (config api.ClientCon
 	return
 }
 
+// DeleteMatrixClientConfig NOP
+func (s *NopStorage) DeleteMatrixClientConfig(userID string) (err error) {
+	return
+}
+
 // UpdateNextBatch NOP
 func (s *NopStorage) UpdateNextBatch(userID, nextBatch string) (err error) {
 	return
@@ -74,6 +116,11 @@ func (s *NopStorage) DeleteService(serviceID string) (err error) {
 	return
 }
 
+// ModifyService NOP
+func (s *NopStorage) ModifyService(serviceID string, fn func(service types.Service) error) (service types.Service, err error) {
+	return
+}
+
 // LoadServicesForUser NOP
 func (s *NopStorage) LoadServicesForUser(serviceUserID string) (services []types.Service, err error) {
 	return
@@ -104,6 +151,11 @@ func (s *NopStorage) StoreAuthRealm(realm types.AuthRealm) (old types.AuthRealm,
 	return
 }
 
+// DeleteAuthRealm NOP
+func (s *NopStorage) DeleteAuthRealm(realmID string) error {
+	return nil
+}
+
 // StoreAuthSession NOP
 func (s *NopStorage) StoreAuthSession(session types.AuthSession) (old types.AuthSession, err error) {
 	return
@@ -134,6 +186,136 @@ func (s *NopStorage) StoreBotOptions(opts types.BotOptions) (oldOpts types.BotOp
 	return
 }
 
+// StoreRoomGroup NOP
+func (s *NopStorage) StoreRoomGroup(group api.RoomGroup) (old api.RoomGroup, err error) {
+	return
+}
+
+// LoadRoomGroup NOP
+func (s *NopStorage) LoadRoomGroup(name string) (group api.RoomGroup, err error) {
+	return
+}
+
+// LoadRoomGroups NOP
+func (s *NopStorage) LoadRoomGroups() (groups []api.RoomGroup, err error) {
+	return
+}
+
+// DeleteRoomGroup NOP
+func (s *NopStorage) DeleteRoomGroup(name string) error {
+	return nil
+}
+
+// ExpandRoomGroups NOP
+func (s *NopStorage) ExpandRoomGroups(serviceType string, config json.RawMessage) (expanded json.RawMessage, names []string, err error) {
+	return config, nil, nil
+}
+
+// StoreServiceConfig NOP
+func (s *NopStorage) StoreServiceConfig(serviceID, serviceType string, config json.RawMessage) error {
+	return nil
+}
+
+// LoadServiceConfig NOP
+func (s *NopStorage) LoadServiceConfig(serviceID string) (config json.RawMessage, err error) {
+	return
+}
+
+// LoadServiceIDsForRoomGroup NOP
+func (s *NopStorage) LoadServiceIDsForRoomGroup(name string) (serviceIDs []string, err error) {
+	return
+}
+
+// LoadServiceConfigs NOP
+func (s *NopStorage) LoadServiceConfigs() (configs map[string]ServiceConfig, err error) {
+	return
+}
+
+// StoreSpaceRooms NOP
+func (s *NopStorage) StoreSpaceRooms(userID, space string, rooms []string) (oldRooms []string, err error) {
+	return
+}
+
+// LoadSpaceRooms NOP
+func (s *NopStorage) LoadSpaceRooms(userID, space string) (rooms []string, err error) {
+	return
+}
+
+// StoreTenant NOP
+func (s *NopStorage) StoreTenant(tenant api.Tenant) (old api.Tenant, err error) {
+	return
+}
+
+// LoadTenant NOP
+func (s *NopStorage) LoadTenant(tenantID string) (tenant api.Tenant, err error) {
+	return
+}
+
+// LoadTenantByToken NOP
+func (s *NopStorage) LoadTenantByToken(token string) (tenant api.Tenant, err error) {
+	return
+}
+
+// HasTenants NOP
+func (s *NopStorage) HasTenants() (bool, error) {
+	return false, nil
+}
+
+// StoreResourceOwner NOP
+func (s *NopStorage) StoreResourceOwner(resourceType, resourceID, tenantID string) error {
+	return nil
+}
+
+// LoadResourceOwner NOP
+func (s *NopStorage) LoadResourceOwner(resourceType, resourceID string) (tenantID string, err error) {
+	return
+}
+
+// LoadOwnedResources NOP
+func (s *NopStorage) LoadOwnedResources(resourceType string) (resources []OwnedResource, err error) {
+	return
+}
+
+// StoreRelayedEvents NOP
+func (s *NopStorage) StoreRelayedEvents(serviceID, originEventID string, eventIDs map[string]string) error {
+	return nil
+}
+
+// LoadRelayedEvents NOP
+func (s *NopStorage) LoadRelayedEvents(serviceID, roomID, eventID string) (eventIDs map[string]string, err error) {
+	return
+}
+
+// DeleteRelayedEventsBefore NOP
+func (s *NopStorage) DeleteRelayedEventsBefore(serviceID string, before time.Time) error {
+	return nil
+}
+
+// StoreNotificationThread NOP
+func (s *NopStorage) StoreNotificationThread(serviceID, roomID, subject, rootEventID string) error {
+	return nil
+}
+
+// LoadNotificationThread NOP
+func (s *NopStorage) LoadNotificationThread(serviceID, roomID, subject string) (rootEventID string, err error) {
+	return
+}
+
+// DeleteNotificationThreadsBefore NOP
+func (s *NopStorage) DeleteNotificationThreadsBefore(before time.Time) error {
+	return nil
+}
+
+// FindOrphans NOP
+func (s *NopStorage) FindOrphans() (report OrphanReport, err error) {
+	return
+}
+
+// RemoveOrphans NOP
+func (s *NopStorage) RemoveOrphans() (report OrphanReport, err error) {
+	return
+}
+
 // InsertFromConfig NOP
 func (s *NopStorage) InsertFromConfig(cfg *api.ConfigFile) error {
 	return nil
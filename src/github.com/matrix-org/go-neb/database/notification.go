@@ -0,0 +1,45 @@
+package database
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"time"
+)
+
+// hashSubject returns the hash of a notification subject. Subjects can be arbitrarily long, so hashes are
+// stored in their place to fit in an indexed column.
+func hashSubject(subject string) string {
+	h := sha256.Sum256([]byte(subject))
+	return hex.EncodeToString(h[:])
+}
+
+// StoreNotificationThread records the event which started the thread of notifications about a subject,
+// e.g. a pull request, in a room. Later notifications from the service about the subject are sent into it.
+// Only a hash of the subject is stored.
+func (d *ServiceDB) StoreNotificationThread(serviceID, roomID, subject, rootEventID string) error {
+	return runTransaction(d, func(txn *sqlTxn) error {
+		return insertNotificationThreadTxn(txn, time.Now(), serviceID, roomID, hashSubject(subject), rootEventID)
+	})
+}
+
+// LoadNotificationThread loads the event which started the thread of notifications about a subject in a
+// room. Returns an empty string if there is no thread for the subject yet.
+func (d *ServiceDB) LoadNotificationThread(serviceID, roomID, subject string) (rootEventID string, err error) {
+	err = runTransaction(d, func(txn *sqlTxn) error {
+		rootEventID, err = selectNotificationThreadTxn(txn, serviceID, roomID, hashSubject(subject))
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return err
+	})
+	return
+}
+
+// DeleteNotificationThreadsBefore forgets the threads of notifications which were started before the given
+// time. Later notifications about their subjects start new threads.
+func (d *ServiceDB) DeleteNotificationThreadsBefore(before time.Time) error {
+	return runTransaction(d, func(txn *sqlTxn) error {
+		return deleteNotificationThreadsBeforeTxn(txn, before)
+	})
+}
@@ -0,0 +1,35 @@
+package database
+
+import "time"
+
+// StoreRelayedEvents records the events which a relay service sent for an event, so that edits and
+// redactions of any one of them can be relayed to the others. The given map is from room ID to event
+// ID and should include the event which was relayed.
+func (d *ServiceDB) StoreRelayedEvents(serviceID, originEventID string, eventIDs map[string]string) error {
+	return runTransaction(d, func(txn *sqlTxn) error {
+		for roomID, eventID := range eventIDs {
+			if err := insertRelayedEventTxn(txn, time.Now(), serviceID, originEventID, roomID, eventID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// LoadRelayedEvents loads the events which were relayed along with the given event, including the
+// event itself. Returns a map from room ID to event ID, which is empty if the event wasn't relayed.
+func (d *ServiceDB) LoadRelayedEvents(serviceID, roomID, eventID string) (eventIDs map[string]string, err error) {
+	err = runTransaction(d, func(txn *sqlTxn) error {
+		eventIDs, err = selectRelayedEventsTxn(txn, serviceID, roomID, eventID)
+		return err
+	})
+	return
+}
+
+// DeleteRelayedEventsBefore forgets the events which a relay service sent before the given time. Edits
+// and redactions of those events are no longer relayed.
+func (d *ServiceDB) DeleteRelayedEventsBefore(serviceID string, before time.Time) error {
+	return runTransaction(d, func(txn *sqlTxn) error {
+		return deleteRelayedEventsBeforeTxn(txn, serviceID, before)
+	})
+}
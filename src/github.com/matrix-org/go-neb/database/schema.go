@@ -60,13 +60,192 @@ CREATE TABLE IF NOT EXISTS bot_options (
 	time_updated_ms BIGINT NOT NULL,
 	UNIQUE(user_id, room_id)
 );
+
+CREATE TABLE IF NOT EXISTS room_groups (
+	group_name TEXT NOT NULL,
+	rooms_json TEXT NOT NULL,
+	time_added_ms BIGINT NOT NULL,
+	time_updated_ms BIGINT NOT NULL,
+	UNIQUE(group_name)
+);
+
+CREATE TABLE IF NOT EXISTS service_configs (
+	service_id TEXT NOT NULL,
+	config_json TEXT NOT NULL,
+	time_added_ms BIGINT NOT NULL,
+	time_updated_ms BIGINT NOT NULL,
+	UNIQUE(service_id)
+);
+
+CREATE TABLE IF NOT EXISTS space_rooms (
+	user_id TEXT NOT NULL,
+	space TEXT NOT NULL,
+	rooms_json TEXT NOT NULL,
+	time_added_ms BIGINT NOT NULL,
+	time_updated_ms BIGINT NOT NULL,
+	UNIQUE(user_id, space)
+);
+
+CREATE TABLE IF NOT EXISTS tenants (
+	tenant_id TEXT NOT NULL,
+	token_hash TEXT NOT NULL,
+	quotas_json TEXT NOT NULL,
+	time_added_ms BIGINT NOT NULL,
+	time_updated_ms BIGINT NOT NULL,
+	UNIQUE(tenant_id),
+	UNIQUE(token_hash)
+);
+
+CREATE TABLE IF NOT EXISTS tenant_resources (
+	resource_type TEXT NOT NULL,
+	resource_id TEXT NOT NULL,
+	tenant_id TEXT NOT NULL,
+	time_added_ms BIGINT NOT NULL,
+	UNIQUE(resource_type, resource_id)
+);
+CREATE TABLE IF NOT EXISTS relayed_events (
+	service_id TEXT NOT NULL,
+	origin_event_id TEXT NOT NULL,
+	room_id TEXT NOT NULL,
+	event_id TEXT NOT NULL,
+	time_added_ms BIGINT NOT NULL,
+	UNIQUE(service_id, room_id, event_id)
+);
+CREATE INDEX IF NOT EXISTS relayed_events_origin_idx ON relayed_events(service_id, origin_event_id);
+
+CREATE TABLE IF NOT EXISTS notification_threads (
+	service_id TEXT NOT NULL,
+	room_id TEXT NOT NULL,
+	subject TEXT NOT NULL,
+	root_event_id TEXT NOT NULL,
+	time_added_ms BIGINT NOT NULL,
+	UNIQUE(service_id, room_id, subject)
+);
 `
 
+// mysqlSchemaSQL is the MySQL/MariaDB equivalent of schemaSQL. MySQL cannot execute multiple
+// statements at once, cannot index TEXT columns without a prefix length and doesn't support
+// CREATE INDEX IF NOT EXISTS, so IDs are VARCHARs and indexes are declared inline. Matrix IDs
+// are case-sensitive, so tables use a binary collation rather than MySQL's case-insensitive default.
+var mysqlSchemaSQL = []string{`
+CREATE TABLE IF NOT EXISTS services (
+	service_id VARCHAR(255) NOT NULL,
+	service_type VARCHAR(255) NOT NULL,
+	service_user_id VARCHAR(255) NOT NULL,
+	service_json LONGTEXT NOT NULL,
+	time_added_ms BIGINT NOT NULL,
+	time_updated_ms BIGINT NOT NULL,
+	UNIQUE(service_id),
+	UNIQUE INDEX service_id_and_user_idx (service_user_id, service_id)
+) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin
+`, `
+CREATE TABLE IF NOT EXISTS matrix_clients (
+	user_id VARCHAR(255) NOT NULL,
+	client_json LONGTEXT NOT NULL,
+	next_batch TEXT NOT NULL,
+	time_added_ms BIGINT NOT NULL,
+	time_updated_ms BIGINT NOT NULL,
+	UNIQUE(user_id)
+) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin
+`, `
+CREATE TABLE IF NOT EXISTS auth_realms (
+	realm_id VARCHAR(255) NOT NULL,
+	realm_type VARCHAR(255) NOT NULL,
+	realm_json LONGTEXT NOT NULL,
+	time_added_ms BIGINT NOT NULL,
+	time_updated_ms BIGINT NOT NULL,
+	UNIQUE(realm_id)
+) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin
+`, `
+CREATE TABLE IF NOT EXISTS auth_sessions (
+	session_id VARCHAR(255) NOT NULL,
+	realm_id VARCHAR(255) NOT NULL,
+	user_id VARCHAR(255) NOT NULL,
+	session_json LONGTEXT NOT NULL,
+	time_added_ms BIGINT NOT NULL,
+	time_updated_ms BIGINT NOT NULL,
+	UNIQUE(realm_id, user_id),
+	UNIQUE(realm_id, session_id)
+) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin
+`, `
+CREATE TABLE IF NOT EXISTS bot_options (
+	user_id VARCHAR(255) NOT NULL,
+	room_id VARCHAR(255) NOT NULL,
+	set_by_user_id VARCHAR(255) NOT NULL,
+	bot_options_json LONGTEXT NOT NULL,
+	time_added_ms BIGINT NOT NULL,
+	time_updated_ms BIGINT NOT NULL,
+	UNIQUE(user_id, room_id)
+) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin
+`, `
+CREATE TABLE IF NOT EXISTS room_groups (
+	group_name VARCHAR(255) NOT NULL,
+	rooms_json LONGTEXT NOT NULL,
+	time_added_ms BIGINT NOT NULL,
+	time_updated_ms BIGINT NOT NULL,
+	UNIQUE(group_name)
+) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin
+`, `
+CREATE TABLE IF NOT EXISTS service_configs (
+	service_id VARCHAR(255) NOT NULL,
+	config_json LONGTEXT NOT NULL,
+	time_added_ms BIGINT NOT NULL,
+	time_updated_ms BIGINT NOT NULL,
+	UNIQUE(service_id)
+) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin
+`, `
+CREATE TABLE IF NOT EXISTS space_rooms (
+	user_id VARCHAR(255) NOT NULL,
+	space VARCHAR(255) NOT NULL,
+	rooms_json LONGTEXT NOT NULL,
+	time_added_ms BIGINT NOT NULL,
+	time_updated_ms BIGINT NOT NULL,
+	UNIQUE(user_id, space)
+) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin
+`, `
+CREATE TABLE IF NOT EXISTS tenants (
+	tenant_id VARCHAR(255) NOT NULL,
+	token_hash VARCHAR(255) NOT NULL,
+	quotas_json LONGTEXT NOT NULL,
+	time_added_ms BIGINT NOT NULL,
+	time_updated_ms BIGINT NOT NULL,
+	UNIQUE(tenant_id),
+	UNIQUE(token_hash)
+) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin
+`, `
+CREATE TABLE IF NOT EXISTS tenant_resources (
+	resource_type VARCHAR(255) NOT NULL,
+	resource_id VARCHAR(255) NOT NULL,
+	tenant_id VARCHAR(255) NOT NULL,
+	time_added_ms BIGINT NOT NULL,
+	UNIQUE(resource_type, resource_id)
+) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin
+`, `
+CREATE TABLE IF NOT EXISTS relayed_events (
+	service_id VARCHAR(255) NOT NULL,
+	origin_event_id VARCHAR(255) NOT NULL,
+	room_id VARCHAR(255) NOT NULL,
+	event_id VARCHAR(255) NOT NULL,
+	time_added_ms BIGINT NOT NULL,
+	UNIQUE(service_id, room_id, event_id),
+	INDEX relayed_events_origin_idx (service_id, origin_event_id)
+) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin
+`, `
+CREATE TABLE IF NOT EXISTS notification_threads (
+	service_id VARCHAR(255) NOT NULL,
+	room_id VARCHAR(255) NOT NULL,
+	subject VARCHAR(64) NOT NULL,
+	root_event_id VARCHAR(255) NOT NULL,
+	time_added_ms BIGINT NOT NULL,
+	UNIQUE(service_id, room_id, subject)
+) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin
+`}
+
 const selectMatrixClientConfigSQL = `
 SELECT client_json FROM matrix_clients WHERE user_id = $1
 `
 
-func selectMatrixClientConfigTxn(txn *sql.Tx, userID string) (config api.ClientConfig, err error) {
+func selectMatrixClientConfigTxn(txn *sqlTxn, userID string) (config api.ClientConfig, err error) {
 	var configJSON []byte
 	err = txn.QueryRow(selectMatrixClientConfigSQL, userID).Scan(&configJSON)
 	if err != nil {
@@ -80,7 +259,7 @@ const selectMatrixClientConfigsSQL = `
 SELECT client_json FROM matrix_clients
 `
 
-func selectMatrixClientConfigsTxn(txn *sql.Tx) (configs []api.ClientConfig, err error) {
+func selectMatrixClientConfigsTxn(txn *sqlTxn) (configs []api.ClientConfig, err error) {
 	rows, err := txn.Query(selectMatrixClientConfigsSQL)
 	if err != nil {
 		return
@@ -106,7 +285,7 @@ INSERT INTO matrix_clients(
 ) VALUES ($1, $2, '', $3, $4)
 `
 
-func insertMatrixClientConfigTxn(txn *sql.Tx, now time.Time, config api.ClientConfig) error {
+func insertMatrixClientConfigTxn(txn *sqlTxn, now time.Time, config api.ClientConfig) error {
 	t := now.UnixNano() / 1000000
 	configJSON, err := json.Marshal(&config)
 	if err != nil {
@@ -121,7 +300,7 @@ UPDATE matrix_clients SET client_json = $1, time_updated_ms = $2
 	WHERE user_id = $3
 `
 
-func updateMatrixClientConfigTxn(txn *sql.Tx, now time.Time, config api.ClientConfig) error {
+func updateMatrixClientConfigTxn(txn *sqlTxn, now time.Time, config api.ClientConfig) error {
 	t := now.UnixNano() / 1000000
 	configJSON, err := json.Marshal(&config)
 	if err != nil {
@@ -131,11 +310,33 @@ func updateMatrixClientConfigTxn(txn *sql.Tx, now time.Time, config api.ClientCo
 	return err
 }
 
+const deleteMatrixClientConfigSQL = `
+DELETE FROM matrix_clients WHERE user_id = $1
+`
+
+func deleteMatrixClientConfigTxn(txn *sqlTxn, userID string) error {
+	_, err := txn.Exec(deleteMatrixClientConfigSQL, userID)
+	return err
+}
+
+const selectMatrixClientExistsSQL = `
+SELECT 1 FROM matrix_clients WHERE user_id = $1
+`
+
+func selectMatrixClientExistsTxn(txn *sqlTxn, userID string) (bool, error) {
+	var exists int
+	err := txn.QueryRow(selectMatrixClientExistsSQL, userID).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
 const updateNextBatchSQL = `
 UPDATE matrix_clients SET next_batch = $1 WHERE user_id = $2
 `
 
-func updateNextBatchTxn(txn *sql.Tx, userID, nextBatch string) error {
+func updateNextBatchTxn(txn *sqlTxn, userID, nextBatch string) error {
 	_, err := txn.Exec(updateNextBatchSQL, nextBatch, userID)
 	return err
 }
@@ -144,7 +345,7 @@ const selectNextBatchSQL = `
 SELECT next_batch FROM matrix_clients WHERE user_id = $1
 `
 
-func selectNextBatchTxn(txn *sql.Tx, userID string) (string, error) {
+func selectNextBatchTxn(txn *sqlTxn, userID string) (string, error) {
 	var nextBatch string
 	row := txn.QueryRow(selectNextBatchSQL, userID)
 	if err := row.Scan(&nextBatch); err != nil {
@@ -158,11 +359,25 @@ SELECT service_type, service_user_id, service_json FROM services
 	WHERE service_id = $1
 `
 
-func selectServiceTxn(txn *sql.Tx, serviceID string) (types.Service, error) {
+func selectServiceTxn(txn *sqlTxn, serviceID string) (types.Service, error) {
+	return queryServiceTxn(txn, selectServiceSQL, serviceID)
+}
+
+// selectServiceForUpdateTxn selects a service like selectServiceTxn, and locks its row until the
+// transaction ends where the database supports it.
+func selectServiceForUpdateTxn(txn *sqlTxn, serviceID string) (types.Service, error) {
+	query := selectServiceSQL
+	if txn.dialect.selectForUpdate {
+		query += "FOR UPDATE\n"
+	}
+	return queryServiceTxn(txn, query, serviceID)
+}
+
+func queryServiceTxn(txn *sqlTxn, query, serviceID string) (types.Service, error) {
 	var serviceType string
 	var serviceUserID string
 	var serviceJSON []byte
-	row := txn.QueryRow(selectServiceSQL, serviceID)
+	row := txn.QueryRow(query, serviceID)
 	if err := row.Scan(&serviceType, &serviceUserID, &serviceJSON); err != nil {
 		return nil, err
 	}
@@ -174,7 +389,7 @@ UPDATE services SET service_type=$1, service_user_id=$2, service_json=$3, time_u
 	WHERE service_id=$5
 `
 
-func updateServiceTxn(txn *sql.Tx, now time.Time, service types.Service) error {
+func updateServiceTxn(txn *sqlTxn, now time.Time, service types.Service) error {
 	serviceJSON, err := json.Marshal(service)
 	if err != nil {
 		return err
@@ -193,7 +408,7 @@ INSERT INTO services(
 ) VALUES ($1, $2, $3, $4, $5, $6)
 `
 
-func insertServiceTxn(txn *sql.Tx, now time.Time, service types.Service) error {
+func insertServiceTxn(txn *sqlTxn, now time.Time, service types.Service) error {
 	serviceJSON, err := json.Marshal(service)
 	if err != nil {
 		return err
@@ -207,10 +422,12 @@ func insertServiceTxn(txn *sql.Tx, now time.Time, service types.Service) error {
 }
 
 const selectServicesForUserSQL = `
-SELECT service_id, service_type, service_json FROM services WHERE service_user_id=$1 ORDER BY service_id
+SELECT service_id, service_type, service_json FROM services WHERE service_user_id=$1
+	AND EXISTS (SELECT 1 FROM matrix_clients WHERE matrix_clients.user_id = services.service_user_id)
+	ORDER BY service_id
 `
 
-func selectServicesForUserTxn(txn *sql.Tx, userID string) (srvs []types.Service, err error) {
+func selectServicesForUserTxn(txn *sqlTxn, userID string) (srvs []types.Service, err error) {
 	rows, err := txn.Query(selectServicesForUserSQL, userID)
 	if err != nil {
 		return
@@ -224,6 +441,9 @@ func selectServicesForUserTxn(txn *sql.Tx, userID string) (srvs []types.Service,
 		if err = rows.Scan(&serviceID, &serviceType, &serviceJSON); err != nil {
 			return
 		}
+		if !types.ServiceTypeEnabled(serviceType) {
+			continue // reported at startup
+		}
 		s, err = types.CreateService(serviceID, serviceType, userID, serviceJSON)
 		if err != nil {
 			return
@@ -237,7 +457,10 @@ const selectServicesByTypeSQL = `
 SELECT service_id, service_user_id, service_json FROM services WHERE service_type=$1 ORDER BY service_id
 `
 
-func selectServicesByTypeTxn(txn *sql.Tx, serviceType string) (srvs []types.Service, err error) {
+func selectServicesByTypeTxn(txn *sqlTxn, serviceType string) (srvs []types.Service, err error) {
+	if !types.ServiceTypeEnabled(serviceType) {
+		return // reported at startup
+	}
 	rows, err := txn.Query(selectServicesByTypeSQL, serviceType)
 	if err != nil {
 		return
@@ -260,13 +483,93 @@ func selectServicesByTypeTxn(txn *sql.Tx, serviceType string) (srvs []types.Serv
 	return
 }
 
+const selectServiceIDsForUserSQL = `
+SELECT service_id FROM services WHERE service_user_id = $1 ORDER BY service_id
+`
+
+func selectServiceIDsForUserTxn(txn *sqlTxn, userID string) (serviceIDs []string, err error) {
+	rows, err := txn.Query(selectServiceIDsForUserSQL, userID)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var serviceID string
+		if err = rows.Scan(&serviceID); err != nil {
+			return
+		}
+		serviceIDs = append(serviceIDs, serviceID)
+	}
+	return
+}
+
+// storedService is a row in the services table which has not been turned into a types.Service.
+type storedService struct {
+	ID          string
+	Type        string
+	UserID      string
+	ServiceJSON []byte
+}
+
+const selectAllServicesSQL = `
+SELECT service_id, service_type, service_user_id, service_json FROM services ORDER BY service_id
+`
+
+func selectAllServicesTxn(txn *sqlTxn) (srvs []storedService, err error) {
+	rows, err := txn.Query(selectAllServicesSQL)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s storedService
+		if err = rows.Scan(&s.ID, &s.Type, &s.UserID, &s.ServiceJSON); err != nil {
+			return
+		}
+		srvs = append(srvs, s)
+	}
+	return
+}
+
+const selectServicesWithoutClientSQL = `
+SELECT service_id, service_type, service_user_id FROM services
+	WHERE service_user_id NOT IN (SELECT user_id FROM matrix_clients) ORDER BY service_id
+`
+
+func selectServicesWithoutClientTxn(txn *sqlTxn) (srvs []OrphanedService, err error) {
+	rows, err := txn.Query(selectServicesWithoutClientSQL)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s OrphanedService
+		if err = rows.Scan(&s.ServiceID, &s.ServiceType, &s.ServiceUserID); err != nil {
+			return
+		}
+		srvs = append(srvs, s)
+	}
+	return
+}
+
+const deleteServicesWithoutClientSQL = `
+DELETE FROM services WHERE service_user_id NOT IN (SELECT user_id FROM matrix_clients)
+`
+
+func deleteServicesWithoutClientTxn(txn *sqlTxn) error {
+	_, err := txn.Exec(deleteServicesWithoutClientSQL)
+	return err
+}
+
 const deleteServiceSQL = `
 DELETE FROM services WHERE service_id = $1
 `
 
-func deleteServiceTxn(txn *sql.Tx, serviceID string) error {
-	_, err := txn.Exec(deleteServiceSQL, serviceID)
-	return err
+func deleteServiceTxn(txn *sqlTxn, serviceID string) error {
+	if _, err := txn.Exec(deleteServiceSQL, serviceID); err != nil {
+		return err
+	}
+	return deleteServiceConfigTxn(txn, serviceID)
 }
 
 const insertRealmSQL = `
@@ -275,7 +578,7 @@ INSERT INTO auth_realms(
 ) VALUES ($1, $2, $3, $4, $5)
 `
 
-func insertRealmTxn(txn *sql.Tx, now time.Time, realm types.AuthRealm) error {
+func insertRealmTxn(txn *sqlTxn, now time.Time, realm types.AuthRealm) error {
 	realmJSON, err := json.Marshal(realm)
 	if err != nil {
 		return err
@@ -288,11 +591,20 @@ func insertRealmTxn(txn *sql.Tx, now time.Time, realm types.AuthRealm) error {
 	return err
 }
 
+const deleteRealmSQL = `
+DELETE FROM auth_realms WHERE realm_id = $1
+`
+
+func deleteRealmTxn(txn *sqlTxn, realmID string) error {
+	_, err := txn.Exec(deleteRealmSQL, realmID)
+	return err
+}
+
 const selectRealmSQL = `
 SELECT realm_type, realm_json FROM auth_realms WHERE realm_id = $1
 `
 
-func selectRealmTxn(txn *sql.Tx, realmID string) (types.AuthRealm, error) {
+func selectRealmTxn(txn *sqlTxn, realmID string) (types.AuthRealm, error) {
 	var realmType string
 	var realmJSON []byte
 	row := txn.QueryRow(selectRealmSQL, realmID)
@@ -306,7 +618,7 @@ const selectRealmsByTypeSQL = `
 SELECT realm_id, realm_json FROM auth_realms WHERE realm_type = $1 ORDER BY realm_id
 `
 
-func selectRealmsByTypeTxn(txn *sql.Tx, realmType string) (realms []types.AuthRealm, err error) {
+func selectRealmsByTypeTxn(txn *sqlTxn, realmType string) (realms []types.AuthRealm, err error) {
 	rows, err := txn.Query(selectRealmsByTypeSQL, realmType)
 	if err != nil {
 		return
@@ -333,7 +645,7 @@ UPDATE auth_realms SET realm_type=$1, realm_json=$2, time_updated_ms=$3
 	WHERE realm_id=$4
 `
 
-func updateRealmTxn(txn *sql.Tx, now time.Time, realm types.AuthRealm) error {
+func updateRealmTxn(txn *sqlTxn, now time.Time, realm types.AuthRealm) error {
 	realmJSON, err := json.Marshal(realm)
 	if err != nil {
 		return err
@@ -352,7 +664,7 @@ INSERT INTO auth_sessions(
 ) VALUES ($1, $2, $3, $4, $5, $6)
 `
 
-func insertAuthSessionTxn(txn *sql.Tx, now time.Time, session types.AuthSession) error {
+func insertAuthSessionTxn(txn *sqlTxn, now time.Time, session types.AuthSession) error {
 	sessionJSON, err := json.Marshal(session)
 	if err != nil {
 		return err
@@ -369,18 +681,68 @@ const deleteAuthSessionSQL = `
 DELETE FROM auth_sessions WHERE realm_id=$1 AND user_id=$2
 `
 
-func deleteAuthSessionTxn(txn *sql.Tx, realmID, userID string) error {
+func deleteAuthSessionTxn(txn *sqlTxn, realmID, userID string) error {
 	_, err := txn.Exec(deleteAuthSessionSQL, realmID, userID)
 	return err
 }
 
+const selectAuthSessionsForRealmSQL = `
+SELECT session_id, user_id FROM auth_sessions WHERE realm_id = $1 ORDER BY user_id
+`
+
+func selectAuthSessionsForRealmTxn(txn *sqlTxn, realmID string) (sessions []OrphanedSession, err error) {
+	rows, err := txn.Query(selectAuthSessionsForRealmSQL, realmID)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		s := OrphanedSession{RealmID: realmID}
+		if err = rows.Scan(&s.SessionID, &s.UserID); err != nil {
+			return
+		}
+		sessions = append(sessions, s)
+	}
+	return
+}
+
+const selectAuthSessionsWithoutRealmSQL = `
+SELECT session_id, realm_id, user_id FROM auth_sessions
+	WHERE realm_id NOT IN (SELECT realm_id FROM auth_realms) ORDER BY realm_id, user_id
+`
+
+func selectAuthSessionsWithoutRealmTxn(txn *sqlTxn) (sessions []OrphanedSession, err error) {
+	rows, err := txn.Query(selectAuthSessionsWithoutRealmSQL)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s OrphanedSession
+		if err = rows.Scan(&s.SessionID, &s.RealmID, &s.UserID); err != nil {
+			return
+		}
+		sessions = append(sessions, s)
+	}
+	return
+}
+
+const deleteAuthSessionsWithoutRealmSQL = `
+DELETE FROM auth_sessions WHERE realm_id NOT IN (SELECT realm_id FROM auth_realms)
+`
+
+func deleteAuthSessionsWithoutRealmTxn(txn *sqlTxn) error {
+	_, err := txn.Exec(deleteAuthSessionsWithoutRealmSQL)
+	return err
+}
+
 const selectAuthSessionByUserSQL = `
 SELECT session_id, realm_type, realm_json, session_json FROM auth_sessions
 	JOIN auth_realms ON auth_sessions.realm_id = auth_realms.realm_id
 	WHERE auth_sessions.realm_id = $1 AND auth_sessions.user_id = $2
 `
 
-func selectAuthSessionByUserTxn(txn *sql.Tx, realmID, userID string) (types.AuthSession, error) {
+func selectAuthSessionByUserTxn(txn *sqlTxn, realmID, userID string) (types.AuthSession, error) {
 	var id string
 	var realmType string
 	var realmJSON []byte
@@ -409,7 +771,7 @@ SELECT user_id, realm_type, realm_json, session_json FROM auth_sessions
 	WHERE auth_sessions.realm_id = $1 AND auth_sessions.session_id = $2
 `
 
-func selectAuthSessionByIDTxn(txn *sql.Tx, realmID, id string) (types.AuthSession, error) {
+func selectAuthSessionByIDTxn(txn *sqlTxn, realmID, id string) (types.AuthSession, error) {
 	var userID string
 	var realmType string
 	var realmJSON []byte
@@ -437,7 +799,7 @@ UPDATE auth_sessions SET session_id=$1, session_json=$2, time_updated_ms=$3
 	WHERE realm_id=$4 AND user_id=$5
 `
 
-func updateAuthSessionTxn(txn *sql.Tx, now time.Time, session types.AuthSession) error {
+func updateAuthSessionTxn(txn *sqlTxn, now time.Time, session types.AuthSession) error {
 	sessionJSON, err := json.Marshal(session)
 	if err != nil {
 		return err
@@ -454,7 +816,7 @@ const selectBotOptionsSQL = `
 SELECT bot_options_json, set_by_user_id FROM bot_options WHERE user_id = $1 AND room_id = $2
 `
 
-func selectBotOptionsTxn(txn *sql.Tx, userID, roomID string) (opts types.BotOptions, err error) {
+func selectBotOptionsTxn(txn *sqlTxn, userID, roomID string) (opts types.BotOptions, err error) {
 	var optionsJSON []byte
 	err = txn.QueryRow(selectBotOptionsSQL, userID, roomID).Scan(&optionsJSON, &opts.SetByUserID)
 	if err != nil {
@@ -470,7 +832,7 @@ INSERT INTO bot_options(
 ) VALUES ($1, $2, $3, $4, $5, $6)
 `
 
-func insertBotOptionsTxn(txn *sql.Tx, now time.Time, opts types.BotOptions) error {
+func insertBotOptionsTxn(txn *sqlTxn, now time.Time, opts types.BotOptions) error {
 	t := now.UnixNano() / 1000000
 	optsJSON, err := json.Marshal(&opts.Options)
 	if err != nil {
@@ -485,7 +847,7 @@ UPDATE bot_options SET bot_options_json = $1, set_by_user_id = $2, time_updated_
 	WHERE user_id = $4 AND room_id = $5
 `
 
-func updateBotOptionsTxn(txn *sql.Tx, now time.Time, opts types.BotOptions) error {
+func updateBotOptionsTxn(txn *sqlTxn, now time.Time, opts types.BotOptions) error {
 	t := now.UnixNano() / 1000000
 	optsJSON, err := json.Marshal(&opts.Options)
 	if err != nil {
@@ -494,3 +856,484 @@ func updateBotOptionsTxn(txn *sql.Tx, now time.Time, opts types.BotOptions) erro
 	_, err = txn.Exec(updateBotOptionsSQL, optsJSON, opts.SetByUserID, t, opts.UserID, opts.RoomID)
 	return err
 }
+
+const selectBotOptionsWithoutClientSQL = `
+SELECT user_id, room_id FROM bot_options
+	WHERE user_id NOT IN (SELECT user_id FROM matrix_clients) ORDER BY user_id, room_id
+`
+
+func selectBotOptionsWithoutClientTxn(txn *sqlTxn) (opts []OrphanedBotOptions, err error) {
+	rows, err := txn.Query(selectBotOptionsWithoutClientSQL)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var o OrphanedBotOptions
+		if err = rows.Scan(&o.UserID, &o.RoomID); err != nil {
+			return
+		}
+		opts = append(opts, o)
+	}
+	return
+}
+
+const deleteBotOptionsWithoutClientSQL = `
+DELETE FROM bot_options WHERE user_id NOT IN (SELECT user_id FROM matrix_clients)
+`
+
+func deleteBotOptionsWithoutClientTxn(txn *sqlTxn) error {
+	_, err := txn.Exec(deleteBotOptionsWithoutClientSQL)
+	return err
+}
+
+const selectRoomGroupSQL = `
+SELECT rooms_json FROM room_groups WHERE group_name = $1
+`
+
+func selectRoomGroupTxn(txn *sqlTxn, name string) (group api.RoomGroup, err error) {
+	var roomsJSON []byte
+	if err = txn.QueryRow(selectRoomGroupSQL, name).Scan(&roomsJSON); err != nil {
+		return
+	}
+	group.Name = name
+	err = json.Unmarshal(roomsJSON, &group.Rooms)
+	return
+}
+
+const selectRoomGroupsSQL = `
+SELECT group_name, rooms_json FROM room_groups ORDER BY group_name
+`
+
+func selectRoomGroupsTxn(txn *sqlTxn) (groups []api.RoomGroup, err error) {
+	rows, err := txn.Query(selectRoomGroupsSQL)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var group api.RoomGroup
+		var roomsJSON []byte
+		if err = rows.Scan(&group.Name, &roomsJSON); err != nil {
+			return
+		}
+		if err = json.Unmarshal(roomsJSON, &group.Rooms); err != nil {
+			return
+		}
+		groups = append(groups, group)
+	}
+	return
+}
+
+const insertRoomGroupSQL = `
+INSERT INTO room_groups(
+	group_name, rooms_json, time_added_ms, time_updated_ms
+) VALUES ($1, $2, $3, $4)
+`
+
+func insertRoomGroupTxn(txn *sqlTxn, now time.Time, group api.RoomGroup) error {
+	roomsJSON, err := json.Marshal(group.Rooms)
+	if err != nil {
+		return err
+	}
+	t := now.UnixNano() / 1000000
+	_, err = txn.Exec(insertRoomGroupSQL, group.Name, roomsJSON, t, t)
+	return err
+}
+
+const updateRoomGroupSQL = `
+UPDATE room_groups SET rooms_json = $1, time_updated_ms = $2
+	WHERE group_name = $3
+`
+
+func updateRoomGroupTxn(txn *sqlTxn, now time.Time, group api.RoomGroup) error {
+	roomsJSON, err := json.Marshal(group.Rooms)
+	if err != nil {
+		return err
+	}
+	t := now.UnixNano() / 1000000
+	_, err = txn.Exec(updateRoomGroupSQL, roomsJSON, t, group.Name)
+	return err
+}
+
+const deleteRoomGroupSQL = `
+DELETE FROM room_groups WHERE group_name = $1
+`
+
+func deleteRoomGroupTxn(txn *sqlTxn, name string) error {
+	_, err := txn.Exec(deleteRoomGroupSQL, name)
+	return err
+}
+
+const selectServiceConfigSQL = `
+SELECT config_json FROM service_configs WHERE service_id = $1
+`
+
+func selectServiceConfigTxn(txn *sqlTxn, serviceID string) (json.RawMessage, error) {
+	var config []byte
+	err := txn.QueryRow(selectServiceConfigSQL, serviceID).Scan(&config)
+	return config, err
+}
+
+const selectServiceConfigsSQL = `
+SELECT service_configs.service_id, service_type, config_json FROM service_configs
+	JOIN services ON services.service_id = service_configs.service_id ORDER BY service_configs.service_id
+`
+
+func selectServiceConfigsTxn(txn *sqlTxn) (configs map[string]ServiceConfig, err error) {
+	rows, err := txn.Query(selectServiceConfigsSQL)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	configs = make(map[string]ServiceConfig)
+	for rows.Next() {
+		var serviceID, serviceType string
+		var config []byte
+		if err = rows.Scan(&serviceID, &serviceType, &config); err != nil {
+			return
+		}
+		configs[serviceID] = ServiceConfig{serviceType, config}
+	}
+	return
+}
+
+const insertServiceConfigSQL = `
+INSERT INTO service_configs(
+	service_id, config_json, time_added_ms, time_updated_ms
+) VALUES ($1, $2, $3, $4)
+`
+
+func insertServiceConfigTxn(txn *sqlTxn, now time.Time, serviceID string, config json.RawMessage) error {
+	t := now.UnixNano() / 1000000
+	_, err := txn.Exec(insertServiceConfigSQL, serviceID, []byte(config), t, t)
+	return err
+}
+
+const deleteServiceConfigSQL = `
+DELETE FROM service_configs WHERE service_id = $1
+`
+
+func deleteServiceConfigTxn(txn *sqlTxn, serviceID string) error {
+	_, err := txn.Exec(deleteServiceConfigSQL, serviceID)
+	return err
+}
+
+const deleteServiceConfigsWithoutServiceSQL = `
+DELETE FROM service_configs WHERE service_id NOT IN (SELECT service_id FROM services)
+`
+
+func deleteServiceConfigsWithoutServiceTxn(txn *sqlTxn) error {
+	_, err := txn.Exec(deleteServiceConfigsWithoutServiceSQL)
+	return err
+}
+
+const selectSpaceRoomsSQL = `
+SELECT rooms_json FROM space_rooms WHERE user_id = $1 AND space = $2
+`
+
+func selectSpaceRoomsTxn(txn *sqlTxn, userID, space string) (rooms []string, err error) {
+	var roomsJSON []byte
+	if err = txn.QueryRow(selectSpaceRoomsSQL, userID, space).Scan(&roomsJSON); err != nil {
+		return
+	}
+	err = json.Unmarshal(roomsJSON, &rooms)
+	return
+}
+
+const insertSpaceRoomsSQL = `
+INSERT INTO space_rooms(
+	user_id, space, rooms_json, time_added_ms, time_updated_ms
+) VALUES ($1, $2, $3, $4, $5)
+`
+
+func insertSpaceRoomsTxn(txn *sqlTxn, now time.Time, userID, space string, rooms []string) error {
+	roomsJSON, err := json.Marshal(rooms)
+	if err != nil {
+		return err
+	}
+	t := now.UnixNano() / 1000000
+	_, err = txn.Exec(insertSpaceRoomsSQL, userID, space, roomsJSON, t, t)
+	return err
+}
+
+const updateSpaceRoomsSQL = `
+UPDATE space_rooms SET rooms_json = $1, time_updated_ms = $2
+	WHERE user_id = $3 AND space = $4
+`
+
+func updateSpaceRoomsTxn(txn *sqlTxn, now time.Time, userID, space string, rooms []string) error {
+	roomsJSON, err := json.Marshal(rooms)
+	if err != nil {
+		return err
+	}
+	t := now.UnixNano() / 1000000
+	_, err = txn.Exec(updateSpaceRoomsSQL, roomsJSON, t, userID, space)
+	return err
+}
+
+const deleteSpaceRoomsForUserSQL = `
+DELETE FROM space_rooms WHERE user_id = $1
+`
+
+func deleteSpaceRoomsForUserTxn(txn *sqlTxn, userID string) error {
+	_, err := txn.Exec(deleteSpaceRoomsForUserSQL, userID)
+	return err
+}
+
+const selectTenantSQL = `
+SELECT tenant_id, quotas_json FROM tenants WHERE tenant_id = $1
+`
+
+func selectTenantTxn(txn *sqlTxn, tenantID string) (tenant api.Tenant, err error) {
+	var quotasJSON []byte
+	if err = txn.QueryRow(selectTenantSQL, tenantID).Scan(&tenant.ID, &quotasJSON); err != nil {
+		return
+	}
+	err = json.Unmarshal(quotasJSON, &tenant.Quotas)
+	return
+}
+
+const selectTenantByTokenHashSQL = `
+SELECT tenant_id, quotas_json FROM tenants WHERE token_hash = $1
+`
+
+func selectTenantByTokenHashTxn(txn *sqlTxn, tokenHash string) (tenant api.Tenant, err error) {
+	var quotasJSON []byte
+	if err = txn.QueryRow(selectTenantByTokenHashSQL, tokenHash).Scan(&tenant.ID, &quotasJSON); err != nil {
+		return
+	}
+	err = json.Unmarshal(quotasJSON, &tenant.Quotas)
+	return
+}
+
+const selectHasTenantsSQL = `
+SELECT COUNT(*) > 0 FROM tenants
+`
+
+func selectHasTenantsTxn(txn *sqlTxn) (has bool, err error) {
+	err = txn.QueryRow(selectHasTenantsSQL).Scan(&has)
+	return
+}
+
+const insertTenantSQL = `
+INSERT INTO tenants(
+	tenant_id, token_hash, quotas_json, time_added_ms, time_updated_ms
+) VALUES ($1, $2, $3, $4, $5)
+`
+
+func insertTenantTxn(txn *sqlTxn, now time.Time, tenant api.Tenant, tokenHash string) error {
+	quotasJSON, err := json.Marshal(tenant.Quotas)
+	if err != nil {
+		return err
+	}
+	t := now.UnixNano() / 1000000
+	_, err = txn.Exec(insertTenantSQL, tenant.ID, tokenHash, quotasJSON, t, t)
+	return err
+}
+
+const updateTenantSQL = `
+UPDATE tenants SET token_hash = $1, quotas_json = $2, time_updated_ms = $3
+	WHERE tenant_id = $4
+`
+
+func updateTenantTxn(txn *sqlTxn, now time.Time, tenant api.Tenant, tokenHash string) error {
+	quotasJSON, err := json.Marshal(tenant.Quotas)
+	if err != nil {
+		return err
+	}
+	t := now.UnixNano() / 1000000
+	_, err = txn.Exec(updateTenantSQL, tokenHash, quotasJSON, t, tenant.ID)
+	return err
+}
+
+const selectResourceOwnerSQL = `
+SELECT tenant_id FROM tenant_resources WHERE resource_type = $1 AND resource_id = $2
+`
+
+func selectResourceOwnerTxn(txn *sqlTxn, resourceType, resourceID string) (tenantID string, err error) {
+	err = txn.QueryRow(selectResourceOwnerSQL, resourceType, resourceID).Scan(&tenantID)
+	return
+}
+
+const insertResourceOwnerSQL = `
+INSERT INTO tenant_resources(
+	resource_type, resource_id, tenant_id, time_added_ms
+) VALUES ($1, $2, $3, $4)
+`
+
+func insertResourceOwnerTxn(txn *sqlTxn, now time.Time, resourceType, resourceID, tenantID string) error {
+	t := now.UnixNano() / 1000000
+	_, err := txn.Exec(insertResourceOwnerSQL, resourceType, resourceID, tenantID, t)
+	return err
+}
+
+const deleteResourceOwnerSQL = `
+DELETE FROM tenant_resources WHERE resource_type = $1 AND resource_id = $2
+`
+
+func deleteResourceOwnerTxn(txn *sqlTxn, resourceType, resourceID string) error {
+	_, err := txn.Exec(deleteResourceOwnerSQL, resourceType, resourceID)
+	return err
+}
+
+const deleteServiceOwnersWithoutServiceSQL = `
+DELETE FROM tenant_resources WHERE resource_type = 'service'
+	AND resource_id NOT IN (SELECT service_id FROM services)
+`
+
+func deleteServiceOwnersWithoutServiceTxn(txn *sqlTxn) error {
+	_, err := txn.Exec(deleteServiceOwnersWithoutServiceSQL)
+	return err
+}
+
+// The resources of each type along with their owners. Resources without an owner have an empty tenant ID.
+var selectOwnedResourcesSQL = map[string]string{
+	ResourceService: `
+SELECT s.service_id, s.service_type, COALESCE(r.tenant_id, '') FROM services s
+	LEFT JOIN tenant_resources r ON r.resource_type = 'service' AND r.resource_id = s.service_id
+	ORDER BY s.service_id
+`,
+	ResourceClient: `
+SELECT c.user_id, '', COALESCE(r.tenant_id, '') FROM matrix_clients c
+	LEFT JOIN tenant_resources r ON r.resource_type = 'client' AND r.resource_id = c.user_id
+	ORDER BY c.user_id
+`,
+	ResourceRealm: `
+SELECT a.realm_id, a.realm_type, COALESCE(r.tenant_id, '') FROM auth_realms a
+	LEFT JOIN tenant_resources r ON r.resource_type = 'realm' AND r.resource_id = a.realm_id
+	ORDER BY a.realm_id
+`,
+}
+
+func selectOwnedResourcesTxn(txn *sqlTxn, resourceType string) (resources []OwnedResource, err error) {
+	query, ok := selectOwnedResourcesSQL[resourceType]
+	if !ok {
+		return nil, fmt.Errorf("unknown resource type %s", resourceType)
+	}
+	rows, err := txn.Query(query)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var r OwnedResource
+		if err = rows.Scan(&r.ID, &r.Type, &r.TenantID); err != nil {
+			return
+		}
+		resources = append(resources, r)
+	}
+	return
+}
+
+const insertRelayedEventSQL = `
+INSERT INTO relayed_events(
+	service_id, origin_event_id, room_id, event_id, time_added_ms
+) VALUES ($1, $2, $3, $4, $5)
+`
+
+func insertRelayedEventTxn(txn *sqlTxn, now time.Time, serviceID, originEventID, roomID, eventID string) error {
+	t := now.UnixNano() / 1000000
+	_, err := txn.Exec(insertRelayedEventSQL, serviceID, originEventID, roomID, eventID, t)
+	return err
+}
+
+const selectRelayedEventsSQL = `
+SELECT room_id, event_id FROM relayed_events WHERE service_id = $1 AND origin_event_id IN (
+	SELECT origin_event_id FROM relayed_events WHERE service_id = $2 AND room_id = $3 AND event_id = $4
+)
+`
+
+func selectRelayedEventsTxn(txn *sqlTxn, serviceID, roomID, eventID string) (eventIDs map[string]string, err error) {
+	rows, err := txn.Query(selectRelayedEventsSQL, serviceID, serviceID, roomID, eventID)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	eventIDs = make(map[string]string)
+	for rows.Next() {
+		var r, e string
+		if err = rows.Scan(&r, &e); err != nil {
+			return
+		}
+		eventIDs[r] = e
+	}
+	return
+}
+
+const deleteRelayedEventsBeforeSQL = `
+DELETE FROM relayed_events WHERE service_id = $1 AND time_added_ms < $2
+`
+
+func deleteRelayedEventsBeforeTxn(txn *sqlTxn, serviceID string, before time.Time) error {
+	t := before.UnixNano() / 1000000
+	_, err := txn.Exec(deleteRelayedEventsBeforeSQL, serviceID, t)
+	return err
+}
+
+const deleteRelayedEventsForServiceSQL = `
+DELETE FROM relayed_events WHERE service_id = $1
+`
+
+func deleteRelayedEventsForServiceTxn(txn *sqlTxn, serviceID string) error {
+	_, err := txn.Exec(deleteRelayedEventsForServiceSQL, serviceID)
+	return err
+}
+
+const deleteRelayedEventsWithoutServiceSQL = `
+DELETE FROM relayed_events WHERE service_id NOT IN (SELECT service_id FROM services)
+`
+
+func deleteRelayedEventsWithoutServiceTxn(txn *sqlTxn) error {
+	_, err := txn.Exec(deleteRelayedEventsWithoutServiceSQL)
+	return err
+}
+
+const insertNotificationThreadSQL = `
+INSERT INTO notification_threads(
+	service_id, room_id, subject, root_event_id, time_added_ms
+) VALUES ($1, $2, $3, $4, $5)
+`
+
+func insertNotificationThreadTxn(txn *sqlTxn, now time.Time, serviceID, roomID, subject, rootEventID string) error {
+	t := now.UnixNano() / 1000000
+	_, err := txn.Exec(insertNotificationThreadSQL, serviceID, roomID, subject, rootEventID, t)
+	return err
+}
+
+const selectNotificationThreadSQL = `
+SELECT root_event_id FROM notification_threads WHERE service_id = $1 AND room_id = $2 AND subject = $3
+`
+
+func selectNotificationThreadTxn(txn *sqlTxn, serviceID, roomID, subject string) (rootEventID string, err error) {
+	err = txn.QueryRow(selectNotificationThreadSQL, serviceID, roomID, subject).Scan(&rootEventID)
+	return
+}
+
+const deleteNotificationThreadsBeforeSQL = `
+DELETE FROM notification_threads WHERE time_added_ms < $1
+`
+
+func deleteNotificationThreadsBeforeTxn(txn *sqlTxn, before time.Time) error {
+	t := before.UnixNano() / 1000000
+	_, err := txn.Exec(deleteNotificationThreadsBeforeSQL, t)
+	return err
+}
+
+const deleteNotificationThreadsForServiceSQL = `
+DELETE FROM notification_threads WHERE service_id = $1
+`
+
+func deleteNotificationThreadsForServiceTxn(txn *sqlTxn, serviceID string) error {
+	_, err := txn.Exec(deleteNotificationThreadsForServiceSQL, serviceID)
+	return err
+}
+
+const deleteNotificationThreadsWithoutServiceSQL = `
+DELETE FROM notification_threads WHERE service_id NOT IN (SELECT service_id FROM services)
+`
+
+func deleteNotificationThreadsWithoutServiceTxn(txn *sqlTxn) error {
+	_, err := txn.Exec(deleteNotificationThreadsWithoutServiceSQL)
+	return err
+}
@@ -0,0 +1,116 @@
+package database
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"time"
+
+	"github.com/matrix-org/go-neb/api"
+)
+
+// The types of resource which can be owned by a tenant.
+const (
+	ResourceService = "service"
+	ResourceClient  = "client"
+	ResourceRealm   = "realm"
+)
+
+// An OwnedResource is a service, client or realm along with the tenant which owns it.
+type OwnedResource struct {
+	// The service ID, client user ID or realm ID.
+	ID string
+	// The service or realm type. Empty for clients.
+	Type string
+	// The ID of the tenant which owns the resource. Empty if the resource is only managed with the
+	// admin token.
+	TenantID string
+}
+
+// hashToken returns the hash of a tenant access token. Only hashes are stored, so that the tokens
+// can't be read back out of the database.
+func hashToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// StoreTenant stores the given tenant, clobbering based on the tenant ID. Only a hash of its access
+// token is stored. The previous tenant, if any, is returned without an access token.
+func (d *ServiceDB) StoreTenant(tenant api.Tenant) (old api.Tenant, err error) {
+	err = runTransaction(d, func(txn *sqlTxn) error {
+		old, err = selectTenantTxn(txn, tenant.ID)
+		if err == sql.ErrNoRows {
+			return insertTenantTxn(txn, time.Now(), tenant, hashToken(tenant.AccessToken))
+		} else if err != nil {
+			return err
+		}
+		return updateTenantTxn(txn, time.Now(), tenant, hashToken(tenant.AccessToken))
+	})
+	return
+}
+
+// LoadTenant loads the tenant with the given ID, without its access token.
+// Returns sql.ErrNoRows if the tenant doesn't exist.
+func (d *ServiceDB) LoadTenant(tenantID string) (tenant api.Tenant, err error) {
+	err = runTransaction(d, func(txn *sqlTxn) error {
+		tenant, err = selectTenantTxn(txn, tenantID)
+		return err
+	})
+	return
+}
+
+// LoadTenantByToken loads the tenant with the given access token, without its access token.
+// Returns sql.ErrNoRows if no tenant has the token.
+func (d *ServiceDB) LoadTenantByToken(token string) (tenant api.Tenant, err error) {
+	err = runTransaction(d, func(txn *sqlTxn) error {
+		tenant, err = selectTenantByTokenHashTxn(txn, hashToken(token))
+		return err
+	})
+	return
+}
+
+// HasTenants returns true if any tenants have been configured.
+func (d *ServiceDB) HasTenants() (has bool, err error) {
+	err = runTransaction(d, func(txn *sqlTxn) error {
+		has, err = selectHasTenantsTxn(txn)
+		return err
+	})
+	return
+}
+
+// StoreResourceOwner records that the resource with the given type and ID is owned by the given tenant,
+// replacing any previous owner. An empty tenant ID removes the owner.
+func (d *ServiceDB) StoreResourceOwner(resourceType, resourceID, tenantID string) error {
+	return runTransaction(d, func(txn *sqlTxn) error {
+		if err := deleteResourceOwnerTxn(txn, resourceType, resourceID); err != nil {
+			return err
+		}
+		if tenantID == "" {
+			return nil
+		}
+		return insertResourceOwnerTxn(txn, time.Now(), resourceType, resourceID, tenantID)
+	})
+}
+
+// LoadResourceOwner returns the ID of the tenant which owns the resource with the given type and ID.
+// Returns an empty tenant ID if the resource has no owner or doesn't exist.
+func (d *ServiceDB) LoadResourceOwner(resourceType, resourceID string) (tenantID string, err error) {
+	err = runTransaction(d, func(txn *sqlTxn) error {
+		tenantID, err = selectResourceOwnerTxn(txn, resourceType, resourceID)
+		if err == sql.ErrNoRows {
+			tenantID = ""
+			return nil
+		}
+		return err
+	})
+	return
+}
+
+// LoadOwnedResources loads every resource of the given type along with its owner, sorted by ID.
+func (d *ServiceDB) LoadOwnedResources(resourceType string) (resources []OwnedResource, err error) {
+	err = runTransaction(d, func(txn *sqlTxn) error {
+		resources, err = selectOwnedResourcesTxn(txn, resourceType)
+		return err
+	})
+	return
+}
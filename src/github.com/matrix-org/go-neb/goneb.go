@@ -1,118 +1,48 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
+	_ "github.com/go-sql-driver/mysql"
 	"github.com/matrix-org/dugong"
 	"github.com/matrix-org/go-neb/api"
 	"github.com/matrix-org/go-neb/api/handlers"
 	"github.com/matrix-org/go-neb/clients"
 	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/matrix"
 	_ "github.com/matrix-org/go-neb/metrics"
 	"github.com/matrix-org/go-neb/polling"
 	_ "github.com/matrix-org/go-neb/realms/github"
 	_ "github.com/matrix-org/go-neb/realms/jira"
-	_ "github.com/matrix-org/go-neb/services/alertmanager"
-	_ "github.com/matrix-org/go-neb/services/echo"
-	_ "github.com/matrix-org/go-neb/services/giphy"
-	_ "github.com/matrix-org/go-neb/services/github"
-	_ "github.com/matrix-org/go-neb/services/google"
-	_ "github.com/matrix-org/go-neb/services/guggy"
-	_ "github.com/matrix-org/go-neb/services/imgur"
-	_ "github.com/matrix-org/go-neb/services/jira"
-	_ "github.com/matrix-org/go-neb/services/rssbot"
-	_ "github.com/matrix-org/go-neb/services/slackapi"
-	_ "github.com/matrix-org/go-neb/services/travisci"
-	_ "github.com/matrix-org/go-neb/services/wikipedia"
+	// Services are imported in services_*.go so that they can be excluded with build tags.
 	"github.com/matrix-org/go-neb/types"
 	"github.com/matrix-org/util"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/prometheus/client_golang/prometheus"
-	yaml "gopkg.in/yaml.v2"
 )
 
-// loadFromConfig loads a config file and returns a ConfigFile
-func loadFromConfig(db *database.ServiceDB, configFilePath string) (*api.ConfigFile, error) {
-	// ::Horrible hacks ahead::
-	// The config is represented as YAML, and we want to convert that into NEB types.
-	// However, NEB types make liberal use of json.RawMessage which the YAML parser
-	// doesn't like. We can't implement MarshalYAML/UnmarshalYAML as a custom type easily
-	// because YAML is insane and supports numbers as keys. The YAML parser therefore has the
-	// generic form of map[interface{}]interface{} - but the JSON parser doesn't know
-	// how to parse that.
-	//
-	// The hack that follows gets around this by type asserting all parsed YAML keys as
-	// strings then re-encoding/decoding as JSON. That is:
-	// YAML bytes -> map[interface]interface -> map[string]interface -> JSON bytes -> NEB types
-
-	// Convert to YAML bytes
-	contents, err := ioutil.ReadFile(configFilePath)
-	if err != nil {
-		return nil, err
-	}
-
-	// Convert to map[interface]interface
-	var cfg map[interface{}]interface{}
-	if err = yaml.Unmarshal(contents, &cfg); err != nil {
-		return nil, fmt.Errorf("Failed to unmarshal YAML: %s", err)
-	}
-
-	// Convert to map[string]interface
-	dict := convertKeysToStrings(cfg)
-
-	// Convert to JSON bytes
-	b, err := json.Marshal(dict)
-	if err != nil {
-		return nil, fmt.Errorf("Failed to marshal config as JSON: %s", err)
-	}
-
-	// Finally, Convert to NEB types
-	var c api.ConfigFile
-	if err := json.Unmarshal(b, &c); err != nil {
-		return nil, fmt.Errorf("Failed to convert to config file: %s", err)
-	}
-
-	// sanity check (at least 1 client and 1 service)
-	if len(c.Clients) == 0 || len(c.Services) == 0 {
-		return nil, fmt.Errorf("At least 1 client and 1 service must be specified")
-	}
-
-	return &c, nil
-}
-
-func convertKeysToStrings(iface interface{}) interface{} {
-	obj, isObj := iface.(map[interface{}]interface{})
-	if isObj {
-		strObj := make(map[string]interface{})
-		for k, v := range obj {
-			strObj[k.(string)] = convertKeysToStrings(v) // handle nested objects
-		}
-		return strObj
-	}
-
-	arr, isArr := iface.([]interface{})
-	if isArr {
-		for i := range arr {
-			arr[i] = convertKeysToStrings(arr[i]) // handle nested objects
-		}
-		return arr
-	}
-	return iface // base type like string or number
-}
-
 func insertServicesFromConfig(clis *clients.Clients, serviceReqs []api.ConfigureServiceRequest) error {
 	for i, s := range serviceReqs {
 		if err := s.Check(); err != nil {
 			return fmt.Errorf("config: Service[%d] : %s", i, err)
 		}
-		service, err := types.CreateService(s.ID, s.Type, s.UserID, s.Config)
+		config, _, err := database.GetServiceDB().ExpandRoomGroups(s.Type, s.Config)
+		if err != nil {
+			return fmt.Errorf("config: Service[%d] : %s", i, err)
+		}
+		config, _, err = clis.ExpandSpaces(s.UserID, s.Type, config)
+		if err != nil {
+			return fmt.Errorf("config: Service[%d] : %s", i, err)
+		}
+		service, err := types.CreateService(s.ID, s.Type, s.UserID, config)
 		if err != nil {
 			return fmt.Errorf("config: Service[%d] : %s", i, err)
 		}
@@ -129,11 +59,99 @@ func insertServicesFromConfig(clis *clients.Clients, serviceReqs []api.Configure
 		if _, err := database.GetServiceDB().StoreService(service); err != nil {
 			return fmt.Errorf("config: Service[%d] : %s", i, err)
 		}
+		clis.ServiceRegistered(service)
 		service.PostRegister(nil)
 	}
 	return nil
 }
 
+// spaceRefreshInterval is how often spaces are checked for changes, to catch changes to spaces which
+// no syncing client is joined to.
+const spaceRefreshInterval = 1 * time.Hour
+
+// refreshSpaces registers again the services which refer to spaces that have changed.
+func refreshSpaces(cs *handlers.ConfigureService, userID string) {
+	logger := log.WithField("user_id", userID)
+	registered, failed, err := cs.RefreshSpaces(userID, logger)
+	if err != nil {
+		logger.WithError(err).Error("Failed to refresh spaces")
+		return
+	}
+	if len(registered) > 0 || len(failed) > 0 {
+		logger.WithFields(log.Fields{
+			"registered": registered,
+			"failed":     failed,
+		}).Info("Refreshed spaces")
+	}
+}
+
+// refreshSpacesPeriodically registers again the services which refer to spaces that have changed, every
+// spaceRefreshInterval.
+func refreshSpacesPeriodically(cs *handlers.ConfigureService) {
+	ticker := time.NewTicker(spaceRefreshInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		refreshSpaces(cs, "")
+	}
+}
+
+// notificationThreadPruneInterval is how often threads of notifications which are past their retention
+// period are forgotten.
+const notificationThreadPruneInterval = 24 * time.Hour
+
+// pruneNotificationThreads forgets old notification threads now and then every notificationThreadPruneInterval.
+func pruneNotificationThreads() {
+	ticker := time.NewTicker(notificationThreadPruneInterval)
+	defer ticker.Stop()
+	for {
+		matrix.PruneNotificationThreads()
+		<-ticker.C
+	}
+}
+
+// enableServiceTypes restricts the service types which can be used to those in the comma-separated list.
+func enableServiceTypes(list string) error {
+	var serviceTypes []string
+	for _, t := range strings.Split(list, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			serviceTypes = append(serviceTypes, t)
+		}
+	}
+	return types.EnableServiceTypes(serviceTypes)
+}
+
+// reportDisabledServices logs the services in the database which won't run because their type is
+// disabled or was excluded at build time.
+func reportDisabledServices(db *database.ServiceDB) {
+	srvs, err := db.LoadOwnedResources(database.ResourceService)
+	if err != nil {
+		log.WithError(err).Error("Failed to load services")
+		return
+	}
+	for _, s := range srvs {
+		if types.ServiceTypeEnabled(s.Type) {
+			continue
+		}
+		reason := "the service type is not built into this binary"
+		if types.ServiceTypeRegistered(s.Type) {
+			reason = "the service type is not in ENABLED_SERVICE_TYPES"
+		}
+		log.WithFields(log.Fields{
+			"service_id":   s.ID,
+			"service_type": s.Type,
+		}).Warn("Service will not run: ", reason)
+	}
+}
+
+func enabledServiceTypes() (enabled []string) {
+	for _, t := range types.ServiceTypes() {
+		if types.ServiceTypeEnabled(t) {
+			enabled = append(enabled, t)
+		}
+	}
+	return
+}
+
 func loadDatabase(databaseType, databaseURL, configYAML string) (*database.ServiceDB, error) {
 	if configYAML != "" {
 		databaseType = "sqlite3"
@@ -147,32 +165,65 @@ func loadDatabase(databaseType, databaseURL, configYAML string) (*database.Servi
 	return db, err
 }
 
+// checkAdminToken panics if there is no admin token but there are tenants. Without an admin token, admin
+// requests without an access token can change everything, which tenants must not be able to do.
+func checkAdminToken(db *database.ServiceDB, adminToken string) {
+	if adminToken != "" {
+		return
+	}
+	if hasTenants, err := db.HasTenants(); err != nil {
+		log.WithError(err).Panic("Failed to load tenants")
+	} else if hasTenants {
+		log.Panic("Tenants are configured so ADMIN_TOKEN must be set")
+	}
+}
+
+// insertFromConfig inserts everything but the services from the config file into the database, and
+// returns the config file.
+func insertFromConfig(db *database.ServiceDB, configFile string) *api.ConfigFile {
+	cfg, err := loadFromConfig(db, configFile)
+	if err != nil {
+		log.WithError(err).WithField("config_file", configFile).Panic("Failed to load config file")
+	}
+	if err := db.InsertFromConfig(cfg); err != nil {
+		log.WithError(err).Panic("Failed to persist config data into in-memory DB")
+	}
+	log.Info("Inserted ", len(cfg.Clients), " clients")
+	log.Info("Inserted ", len(cfg.Realms), " realms")
+	log.Info("Inserted ", len(cfg.Sessions), " sessions")
+	log.Info("Inserted ", len(cfg.RoomGroups), " room groups")
+	return cfg
+}
+
 func setup(e envVars, mux *http.ServeMux, matrixClient *http.Client) {
 	err := types.BaseURL(e.BaseURL)
 	if err != nil {
 		log.WithError(err).Panic("Failed to get base url")
 	}
 
+	if e.EnabledServiceTypes != "" {
+		if err := enableServiceTypes(e.EnabledServiceTypes); err != nil {
+			log.WithError(err).Panic("Failed to enable service types")
+		}
+	}
+	log.Info("Enabled service types: ", strings.Join(enabledServiceTypes(), ", "))
+
 	db, err := loadDatabase(e.DatabaseType, e.DatabaseURL, e.ConfigFile)
 	if err != nil {
 		log.WithError(err).Panic("Failed to open database")
 	}
+	reportDisabledServices(db)
+
+	checkAdminToken(db, e.AdminToken)
 
 	// Populate the database from the config file if one was supplied.
 	var cfg *api.ConfigFile
 	if e.ConfigFile != "" {
-		if cfg, err = loadFromConfig(db, e.ConfigFile); err != nil {
-			log.WithError(err).WithField("config_file", e.ConfigFile).Panic("Failed to load config file")
-		}
-		if err := db.InsertFromConfig(cfg); err != nil {
-			log.WithError(err).Panic("Failed to persist config data into in-memory DB")
-		}
-		log.Info("Inserted ", len(cfg.Clients), " clients")
-		log.Info("Inserted ", len(cfg.Realms), " realms")
-		log.Info("Inserted ", len(cfg.Sessions), " sessions")
+		cfg = insertFromConfig(db, e.ConfigFile)
 	}
 
 	clients := clients.New(db, matrixClient)
+	types.SetClientLookup(clients.Client)
 	if err := clients.Start(); err != nil {
 		log.WithError(err).Panic("Failed to start up clients")
 	}
@@ -180,7 +231,7 @@ func setup(e envVars, mux *http.ServeMux, matrixClient *http.Client) {
 	// Handle non-admin paths for normal NEB functioning
 	mux.Handle("/metrics", prometheus.Handler())
 	mux.Handle("/test", prometheus.InstrumentHandler("test", util.MakeJSONAPI(&handlers.Heartbeat{})))
-	wh := handlers.NewWebhook(db, clients)
+	wh := handlers.NewWebhook(db, clients, e.AdminToken)
 	mux.HandleFunc("/services/hooks/", prometheus.InstrumentHandlerFunc("webhookHandler", util.Protect(wh.Handle)))
 	rh := &handlers.RealmRedirect{db}
 	mux.HandleFunc("/realms/redirects/", prometheus.InstrumentHandlerFunc("realmRedirectHandler", util.Protect(rh.Handle)))
@@ -194,18 +245,38 @@ func setup(e envVars, mux *http.ServeMux, matrixClient *http.Client) {
 
 		log.Info("Inserted ", len(cfg.Services), " services")
 	} else {
-		mux.Handle("/admin/getService", prometheus.InstrumentHandler("getService", util.MakeJSONAPI(&handlers.GetService{db})))
-		mux.Handle("/admin/getSession", prometheus.InstrumentHandler("getSession", util.MakeJSONAPI(&handlers.GetSession{db})))
-		mux.Handle("/admin/configureClient", prometheus.InstrumentHandler("configureClient", util.MakeJSONAPI(&handlers.ConfigureClient{clients})))
-		mux.Handle("/admin/configureService", prometheus.InstrumentHandler("configureService", util.MakeJSONAPI(handlers.NewConfigureService(db, clients))))
-		mux.Handle("/admin/configureAuthRealm", prometheus.InstrumentHandler("configureAuthRealm", util.MakeJSONAPI(&handlers.ConfigureAuthRealm{db})))
-		mux.Handle("/admin/requestAuthSession", prometheus.InstrumentHandler("requestAuthSession", util.MakeJSONAPI(&handlers.RequestAuthSession{db})))
-		mux.Handle("/admin/removeAuthSession", prometheus.InstrumentHandler("removeAuthSession", util.MakeJSONAPI(&handlers.RemoveAuthSession{db})))
+		auth := &handlers.AdminAuth{Db: db, AdminToken: e.AdminToken}
+		mux.Handle("/admin/getService", prometheus.InstrumentHandler("getService", util.MakeJSONAPI(auth.Protect(&handlers.GetService{db}))))
+		mux.Handle("/admin/testService", prometheus.InstrumentHandler("testService", util.MakeJSONAPI(auth.Protect(&handlers.TestService{Db: db, Clients: clients}))))
+		mux.Handle("/admin/getSession", prometheus.InstrumentHandler("getSession", util.MakeJSONAPI(auth.Protect(&handlers.GetSession{db}))))
+		mux.Handle("/admin/configureClient", prometheus.InstrumentHandler("configureClient", util.MakeJSONAPI(auth.Protect(&handlers.ConfigureClient{Db: db, Clients: clients}))))
+		mux.Handle("/admin/removeClient", prometheus.InstrumentHandler("removeClient", util.MakeJSONAPI(auth.Protect(&handlers.RemoveClient{Db: db, Clients: clients}))))
+		cs := handlers.NewConfigureService(db, clients)
+		mux.Handle("/admin/configureService", prometheus.InstrumentHandler("configureService", util.MakeJSONAPI(auth.Protect(cs))))
+		mux.Handle("/admin/configureRoomGroup", prometheus.InstrumentHandler("configureRoomGroup", util.MakeJSONAPI(auth.Protect(&handlers.ConfigureRoomGroup{Db: db, ConfigureService: cs}))))
+		mux.Handle("/admin/getRoomGroup", prometheus.InstrumentHandler("getRoomGroup", util.MakeJSONAPI(auth.Protect(&handlers.GetRoomGroup{Db: db}))))
+		mux.Handle("/admin/removeRoomGroup", prometheus.InstrumentHandler("removeRoomGroup", util.MakeJSONAPI(auth.Protect(&handlers.RemoveRoomGroup{Db: db}))))
+		mux.Handle("/admin/refreshSpaces", prometheus.InstrumentHandler("refreshSpaces", util.MakeJSONAPI(auth.Protect(&handlers.RefreshSpaces{ConfigureService: cs}))))
+		mux.Handle("/admin/moveService", prometheus.InstrumentHandler("moveService", util.MakeJSONAPI(auth.Protect(&handlers.MoveService{ConfigureService: cs}))))
+		clients.OnSpaceChange(func(userID string) {
+			refreshSpaces(cs, userID)
+		})
+		go refreshSpacesPeriodically(cs)
+		mux.Handle("/admin/configureAuthRealm", prometheus.InstrumentHandler("configureAuthRealm", util.MakeJSONAPI(auth.Protect(&handlers.ConfigureAuthRealm{db}))))
+		mux.Handle("/admin/removeAuthRealm", prometheus.InstrumentHandler("removeAuthRealm", util.MakeJSONAPI(auth.Protect(&handlers.RemoveAuthRealm{Db: db}))))
+		mux.Handle("/admin/requestAuthSession", prometheus.InstrumentHandler("requestAuthSession", util.MakeJSONAPI(auth.Protect(&handlers.RequestAuthSession{db}))))
+		mux.Handle("/admin/removeAuthSession", prometheus.InstrumentHandler("removeAuthSession", util.MakeJSONAPI(auth.Protect(&handlers.RemoveAuthSession{db}))))
+		mux.Handle("/admin/configureTenant", prometheus.InstrumentHandler("configureTenant", util.MakeJSONAPI(auth.Protect(&handlers.ConfigureTenant{Db: db, Auth: auth}))))
+		mux.Handle("/admin/listServices", prometheus.InstrumentHandler("listServices", util.MakeJSONAPI(auth.Protect(&handlers.ListResources{Db: db, ResourceType: database.ResourceService}))))
+		mux.Handle("/admin/listClients", prometheus.InstrumentHandler("listClients", util.MakeJSONAPI(auth.Protect(&handlers.ListResources{Db: db, ResourceType: database.ResourceClient}))))
+		mux.Handle("/admin/listAuthRealms", prometheus.InstrumentHandler("listAuthRealms", util.MakeJSONAPI(auth.Protect(&handlers.ListResources{Db: db, ResourceType: database.ResourceRealm}))))
+		mux.Handle("/admin/doctor", prometheus.InstrumentHandler("doctor", util.MakeJSONAPI(auth.Protect(&handlers.Doctor{Db: db, Clients: clients}))))
 	}
 	polling.SetClients(clients)
 	if err := polling.Start(); err != nil {
 		log.WithError(err).Panic("Failed to start polling")
 	}
+	go pruneNotificationThreads()
 }
 
 type envVars struct {
@@ -215,16 +286,21 @@ type envVars struct {
 	BaseURL      string
 	LogDir       string
 	ConfigFile   string
+	AdminToken   string
+	// A comma-separated list of the service types which can be used. Empty means every type.
+	EnabledServiceTypes string
 }
 
 func main() {
 	e := envVars{
-		BindAddress:  os.Getenv("BIND_ADDRESS"),
-		DatabaseType: os.Getenv("DATABASE_TYPE"),
-		DatabaseURL:  os.Getenv("DATABASE_URL"),
-		BaseURL:      os.Getenv("BASE_URL"),
-		LogDir:       os.Getenv("LOG_DIR"),
-		ConfigFile:   os.Getenv("CONFIG_FILE"),
+		BindAddress:         os.Getenv("BIND_ADDRESS"),
+		DatabaseType:        os.Getenv("DATABASE_TYPE"),
+		DatabaseURL:         os.Getenv("DATABASE_URL"),
+		BaseURL:             os.Getenv("BASE_URL"),
+		LogDir:              os.Getenv("LOG_DIR"),
+		ConfigFile:          os.Getenv("CONFIG_FILE"),
+		AdminToken:          os.Getenv("ADMIN_TOKEN"),
+		EnabledServiceTypes: os.Getenv("ENABLED_SERVICE_TYPES"),
 	}
 
 	if e.LogDir != "" {
@@ -242,7 +318,11 @@ func main() {
 		log.SetOutput(ioutil.Discard)
 	}
 
-	log.Infof("Go-NEB (%+v)", e)
+	logged := e
+	if logged.AdminToken != "" {
+		logged.AdminToken = "<redacted>"
+	}
+	log.Infof("Go-NEB (%+v)", logged)
 
 	setup(e, http.DefaultServeMux, http.DefaultClient)
 	log.Fatal(http.ListenAndServe(e.BindAddress, nil))
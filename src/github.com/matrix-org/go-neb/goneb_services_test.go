@@ -2,20 +2,56 @@ package main
 
 import (
 	"bytes"
+	"encoding/base64"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/services/rssbot"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
 )
 
 var mux = http.NewServeMux()
 var mxTripper = newMatrixTripper()
 
+// adminToken is the token which admin API requests are made with.
+const adminToken = "triforce"
+
+// routedService is a service which serves HTTP routes below its webhook endpoint URL.
+type routedService struct {
+	types.DefaultService
+}
+
+func (s *routedService) WebhookRoutes() []types.WebhookRoute {
+	reply := func(body string) func(http.ResponseWriter, *http.Request, *gomatrix.Client) {
+		return func(w http.ResponseWriter, req *http.Request, cli *gomatrix.Client) {
+			w.Write([]byte(body))
+		}
+	}
+	return []types.WebhookRoute{
+		{Path: "feed", Method: "GET", Auth: types.RouteAuthNone, Handler: reply("feed")},
+		{Path: "settings/export", Method: "GET", Auth: types.RouteAuthAdmin, Handler: reply("export")},
+	}
+}
+
+func init() {
+	types.RegisterService(func(serviceID, serviceUserID, webhookEndpointURL string) types.Service {
+		return &routedService{types.NewDefaultService(serviceID, serviceUserID, "test_routed")}
+	})
+}
+
 func TestMain(m *testing.M) {
 	setup(envVars{
 		BaseURL:      "http://go.neb",
 		DatabaseType: "sqlite3",
 		DatabaseURL:  ":memory:",
+		AdminToken:   adminToken,
 	}, mux, &http.Client{
 		Transport: mxTripper,
 	})
@@ -46,6 +82,7 @@ func TestConfigureClient(t *testing.T) {
 		"Sync":true,
 		"AutoJoinRooms":true
 	}`))
+	mockReq.Header.Set("Authorization", "Bearer "+adminToken)
 	mux.ServeHTTP(mockWriter, mockReq)
 	expectCode := 200
 	if mockWriter.Code != expectCode {
@@ -54,3 +91,517 @@ func TestConfigureClient(t *testing.T) {
 
 	<-syncChan
 }
+
+// handleJoins records in joined the rooms which are joined out of roomIDs.
+func handleJoins(joined map[string]bool, roomIDs ...string) {
+	for _, roomID := range roomIDs {
+		roomID := roomID
+		mxTripper.Handle("POST", "/_matrix/client/r0/join/"+roomID,
+			func(req *http.Request) (*http.Response, error) {
+				joined[roomID] = true
+				return newResponse(200, `{"room_id":"`+roomID+`"}`), nil
+			},
+		)
+	}
+}
+
+// adminPost makes a POST request to the admin API with the admin token.
+func adminPost(path, body string) *httptest.ResponseRecorder {
+	mockWriter := httptest.NewRecorder()
+	mockReq, _ := http.NewRequest("POST", "http://go.neb"+path, bytes.NewBufferString(body))
+	mockReq.Header.Set("Authorization", "Bearer "+adminToken)
+	mux.ServeHTTP(mockWriter, mockReq)
+	return mockWriter
+}
+
+func TestRoomGroups(t *testing.T) {
+	mxTripper.ClearHandlers()
+	joined := make(map[string]bool)
+	handleJoins(joined, "!ops:hyrule", "!dev:hyrule")
+	post := adminPost
+
+	if res := post("/admin/configureClient", `{
+		"UserID":"@zelda:hyrule",
+		"HomeserverURL":"http://hyrule.loz",
+		"AccessToken":"wisdom"
+	}`); res.Code != 200 {
+		t.Fatalf("TestRoomGroups: configureClient wanted HTTP 200, got %d", res.Code)
+	}
+	if res := post("/admin/configureRoomGroup", `{"Name":"ops","Rooms":["!ops:hyrule"]}`); res.Code != 200 {
+		t.Fatalf("TestRoomGroups: configureRoomGroup wanted HTTP 200, got %d", res.Code)
+	}
+	serviceJSON := `{
+		"ID":"alerts",
+		"Type":"alertmanager",
+		"UserID":"@zelda:hyrule",
+		"Config":{
+			"rooms":{
+				"group:ops":{"text_template":"{{.Status}}","msg_type":"m.notice"}
+			}
+		}
+	}`
+	if res := post("/admin/configureService", serviceJSON); res.Code != 200 {
+		t.Fatalf("TestRoomGroups: configureService wanted HTTP 200, got %d: %s", res.Code, res.Body.String())
+	}
+	if !joined["!ops:hyrule"] || joined["!dev:hyrule"] {
+		t.Errorf("TestRoomGroups: wanted to join only !ops:hyrule, joined %v", joined)
+	}
+
+	res := post("/admin/configureRoomGroup", `{"Name":"ops","Rooms":["!ops:hyrule","!dev:hyrule"]}`)
+	if res.Code != 200 || !strings.Contains(res.Body.String(), `"Registered":["alerts"]`) {
+		t.Fatalf("TestRoomGroups: configureRoomGroup wanted alerts to be registered, got %d: %s", res.Code, res.Body.String())
+	}
+	if !joined["!dev:hyrule"] {
+		t.Errorf("TestRoomGroups: wanted to join !dev:hyrule after the group changed, joined %v", joined)
+	}
+	res = post("/admin/getService", `{"ID":"alerts"}`)
+	if !strings.Contains(res.Body.String(), "!dev:hyrule") {
+		t.Errorf("TestRoomGroups: wanted service config to contain !dev:hyrule, got %s", res.Body.String())
+	}
+
+	if res := post("/admin/removeRoomGroup", `{"Name":"ops"}`); res.Code != 400 {
+		t.Errorf("TestRoomGroups: removeRoomGroup wanted HTTP 400 for a group in use, got %d", res.Code)
+	}
+	if res := post("/admin/configureService", strings.Replace(serviceJSON, "group:ops", "group:nope", 1)); res.Code != 400 {
+		t.Errorf("TestRoomGroups: configureService wanted HTTP 400 for an unknown group, got %d", res.Code)
+	}
+}
+
+func TestSpaces(t *testing.T) {
+	mxTripper.ClearHandlers()
+	spaceRooms := `[{"room_id":"!space:hyrule","room_type":"m.space"},{"room_id":"!ops:hyrule"}]`
+	mxTripper.Handle("GET", "/_matrix/client/r0/directory/room/#team:hyrule",
+		func(req *http.Request) (*http.Response, error) {
+			return newResponse(200, `{"room_id":"!space:hyrule"}`), nil
+		},
+	)
+	mxTripper.Handle("GET", "/_matrix/client/v1/rooms/!space:hyrule/hierarchy",
+		func(req *http.Request) (*http.Response, error) {
+			return newResponse(200, `{"rooms":`+spaceRooms+`}`), nil
+		},
+	)
+	joined := make(map[string]bool)
+	for _, roomID := range []string{"!ops:hyrule", "!dev:hyrule"} {
+		roomID := roomID
+		mxTripper.Handle("POST", "/_matrix/client/r0/join/"+roomID,
+			func(req *http.Request) (*http.Response, error) {
+				joined[roomID] = true
+				return newResponse(200, `{"room_id":"`+roomID+`"}`), nil
+			},
+		)
+	}
+	post := func(path, body string) *httptest.ResponseRecorder {
+		mockWriter := httptest.NewRecorder()
+		mockReq, _ := http.NewRequest("POST", "http://go.neb"+path, bytes.NewBufferString(body))
+		mockReq.Header.Set("Authorization", "Bearer "+adminToken)
+		mux.ServeHTTP(mockWriter, mockReq)
+		return mockWriter
+	}
+
+	if res := post("/admin/configureClient", `{
+		"UserID":"@impa:hyrule",
+		"HomeserverURL":"http://hyrule.loz",
+		"AccessToken":"shadow"
+	}`); res.Code != 200 {
+		t.Fatalf("TestSpaces: configureClient wanted HTTP 200, got %d", res.Code)
+	}
+	if res := post("/admin/configureService", `{
+		"ID":"space_alerts",
+		"Type":"alertmanager",
+		"UserID":"@impa:hyrule",
+		"Config":{
+			"rooms":{
+				"space:#team:hyrule":{"text_template":"{{.Status}}","msg_type":"m.notice"}
+			}
+		}
+	}`); res.Code != 200 {
+		t.Fatalf("TestSpaces: configureService wanted HTTP 200, got %d: %s", res.Code, res.Body.String())
+	}
+	if !joined["!ops:hyrule"] || joined["!dev:hyrule"] {
+		t.Errorf("TestSpaces: wanted to join only !ops:hyrule, joined %v", joined)
+	}
+
+	// Nothing has changed so nothing should be registered again.
+	res := post("/admin/refreshSpaces", `{"UserID":"@impa:hyrule"}`)
+	if res.Code != 200 || !strings.Contains(res.Body.String(), `"Registered":[]`) {
+		t.Fatalf("TestSpaces: refreshSpaces wanted no services to be registered, got %d: %s", res.Code, res.Body.String())
+	}
+
+	spaceRooms = `[{"room_id":"!ops:hyrule"},{"room_id":"!dev:hyrule"}]`
+	res = post("/admin/refreshSpaces", `{"UserID":"@impa:hyrule"}`)
+	if res.Code != 200 || !strings.Contains(res.Body.String(), `"Registered":["space_alerts"]`) {
+		t.Fatalf("TestSpaces: refreshSpaces wanted space_alerts to be registered, got %d: %s", res.Code, res.Body.String())
+	}
+	if !joined["!dev:hyrule"] {
+		t.Errorf("TestSpaces: wanted to join !dev:hyrule after the space changed, joined %v", joined)
+	}
+}
+
+// tenantPost makes a POST request to the admin API with the given token, or without one if it is empty.
+func tenantPost(path, token, body string) *httptest.ResponseRecorder {
+	mockWriter := httptest.NewRecorder()
+	mockReq, _ := http.NewRequest("POST", "http://go.neb"+path, bytes.NewBufferString(body))
+	if token != "" {
+		mockReq.Header.Set("Authorization", "Bearer "+token)
+	}
+	mux.ServeHTTP(mockWriter, mockReq)
+	return mockWriter
+}
+
+func TestTenants(t *testing.T) {
+	mxTripper.ClearHandlers()
+	mxTripper.Handle("POST", "/_matrix/client/r0/join/!ops:hyrule",
+		func(req *http.Request) (*http.Response, error) {
+			return newResponse(200, `{"room_id":"!ops:hyrule"}`), nil
+		},
+	)
+
+	// The ops and dev tenants each have a client and an alertmanager service.
+	serviceJSON := `{
+		"ID":"ops_alerts",
+		"Type":"alertmanager",
+		"UserID":"@ganon:hyrule",
+		"Config":{
+			"rooms":{
+				"!ops:hyrule":{"text_template":"{{.Status}}","msg_type":"m.notice"}
+			}
+		}
+	}`
+	checkTenantClients(t)
+	checkTenantServices(t, serviceJSON)
+	checkTenantRoomGroups(t, serviceJSON)
+	checkTenantWebhookQuota(t)
+}
+
+// checkTenantClients configures the ops and dev tenants, and a client for ops.
+func checkTenantClients(t *testing.T) {
+	post := tenantPost
+	if res := post("/admin/configureTenant", "", `{"ID":"ops","AccessToken":"ops_token"}`); res.Code != 401 {
+		t.Errorf("TestTenants: configureTenant without a token wanted HTTP 401, got %d", res.Code)
+	}
+	if res := post("/admin/configureTenant", adminToken, `{
+		"ID":"ops",
+		"AccessToken":"ops_token",
+		"Quotas":{"MaxServices":1,"MaxWebhooksPerMinute":1}
+	}`); res.Code != 200 || strings.Contains(res.Body.String(), "ops_token") {
+		t.Fatalf("TestTenants: configureTenant wanted HTTP 200 without the token, got %d: %s", res.Code, res.Body.String())
+	}
+	if res := post("/admin/configureTenant", adminToken, `{"ID":"dev","AccessToken":"dev_token"}`); res.Code != 200 {
+		t.Fatalf("TestTenants: configureTenant wanted HTTP 200, got %d", res.Code)
+	}
+	if res := post("/admin/configureTenant", "ops_token", `{"ID":"ops","AccessToken":"mine_now"}`); res.Code != 403 {
+		t.Errorf("TestTenants: configureTenant by a tenant wanted HTTP 403, got %d", res.Code)
+	}
+	if res := post("/admin/listServices", "not_a_token", `{}`); res.Code != 401 {
+		t.Errorf("TestTenants: unknown token wanted HTTP 401, got %d", res.Code)
+	}
+
+	if res := post("/admin/configureClient", "ops_token", `{
+		"UserID":"@ganon:hyrule",
+		"HomeserverURL":"http://hyrule.loz",
+		"AccessToken":"power"
+	}`); res.Code != 200 {
+		t.Fatalf("TestTenants: configureClient wanted HTTP 200, got %d", res.Code)
+	}
+	if res := post("/admin/configureClient", "dev_token", `{
+		"UserID":"@ganon:hyrule",
+		"HomeserverURL":"http://hyrule.loz",
+		"AccessToken":"stolen"
+	}`); res.Code != 403 {
+		t.Errorf("TestTenants: configureClient of another tenant's client wanted HTTP 403, got %d", res.Code)
+	}
+}
+
+// checkTenantServices configures a service for ops, and checks that dev can't see or change it.
+func checkTenantServices(t *testing.T, serviceJSON string) {
+	post := tenantPost
+	if res := post("/admin/configureService", "dev_token", serviceJSON); res.Code != 403 {
+		t.Errorf("TestTenants: configureService with another tenant's client wanted HTTP 403, got %d", res.Code)
+	}
+	if res := post("/admin/configureService", "ops_token", serviceJSON); res.Code != 200 {
+		t.Fatalf("TestTenants: configureService wanted HTTP 200, got %d: %s", res.Code, res.Body.String())
+	}
+	if res := post("/admin/configureService", "ops_token", serviceJSON); res.Code != 200 {
+		t.Errorf("TestTenants: replacing a service within the quota wanted HTTP 200, got %d: %s", res.Code, res.Body.String())
+	}
+	if res := post("/admin/configureService", "ops_token", strings.Replace(serviceJSON, "ops_alerts", "ops_alerts_2", 1)); res.Code != 403 {
+		t.Errorf("TestTenants: configureService over the quota wanted HTTP 403, got %d", res.Code)
+	}
+
+	if res := post("/admin/getService", "dev_token", `{"ID":"ops_alerts"}`); res.Code != 404 {
+		t.Errorf("TestTenants: getService of another tenant's service wanted HTTP 404, got %d", res.Code)
+	}
+	if res := post("/admin/getService", "ops_token", `{"ID":"ops_alerts"}`); res.Code != 200 {
+		t.Errorf("TestTenants: getService wanted HTTP 200, got %d", res.Code)
+	}
+	want := `{"Resources":[{"ID":"ops_alerts","Type":"alertmanager","TenantID":"ops"}]}`
+	if res := post("/admin/listServices", "ops_token", `{}`); strings.TrimSpace(res.Body.String()) != want {
+		t.Errorf("TestTenants: listServices wanted %s, got %s", want, res.Body.String())
+	}
+	if res := post("/admin/listServices", "dev_token", `{}`); strings.TrimSpace(res.Body.String()) != `{"Resources":[]}` {
+		t.Errorf("TestTenants: listServices wanted no services for dev, got %s", res.Body.String())
+	}
+	if res := post("/admin/listClients", adminToken, `{}`); !strings.Contains(res.Body.String(), `{"ID":"@ganon:hyrule","Type":"","TenantID":"ops"}`) {
+		t.Errorf("TestTenants: listClients with the admin token wanted @ganon:hyrule, got %s", res.Body.String())
+	}
+}
+
+// checkTenantRoomGroups checks that only the admin can configure room groups, and that tenants only see
+// their own services which refer to them.
+func checkTenantRoomGroups(t *testing.T, serviceJSON string) {
+	post := tenantPost
+	if res := post("/admin/configureRoomGroup", "ops_token", `{"Name":"ops","Rooms":["!ops:hyrule"]}`); res.Code != 403 {
+		t.Errorf("TestTenants: configureRoomGroup by a tenant wanted HTTP 403, got %d", res.Code)
+	}
+	if res := post("/admin/configureRoomGroup", adminToken, `{"Name":"sages","Rooms":["!ops:hyrule"]}`); res.Code != 200 {
+		t.Fatalf("TestTenants: configureRoomGroup wanted HTTP 200, got %d", res.Code)
+	}
+	if res := post("/admin/configureClient", "dev_token", `{
+		"UserID":"@vaati:hyrule",
+		"HomeserverURL":"http://hyrule.loz",
+		"AccessToken":"wind"
+	}`); res.Code != 200 {
+		t.Fatalf("TestTenants: configureClient wanted HTTP 200, got %d", res.Code)
+	}
+	devJSON := strings.NewReplacer("ops_alerts", "dev_alerts", "@ganon:hyrule", "@vaati:hyrule", "!ops:hyrule", "group:sages").Replace(serviceJSON)
+	if res := post("/admin/configureService", "dev_token", devJSON); res.Code != 200 {
+		t.Fatalf("TestTenants: configureService with a room group wanted HTTP 200, got %d: %s", res.Code, res.Body.String())
+	}
+	for token, want := range map[string]string{adminToken: `["dev_alerts"]`, "dev_token": `["dev_alerts"]`, "ops_token": `[]`} {
+		if res := post("/admin/getRoomGroup", token, `{"Name":"sages"}`); !strings.Contains(res.Body.String(), `"Services":`+want) {
+			t.Errorf("TestTenants: getRoomGroup with %s wanted services %s, got %s", token, want, res.Body.String())
+		}
+	}
+}
+
+// checkTenantWebhookQuota checks that webhooks for the services of ops are rate limited.
+func checkTenantWebhookQuota(t *testing.T) {
+	hookPath := "/services/hooks/" + base64.RawURLEncoding.EncodeToString([]byte("ops_alerts"))
+	var codes []int
+	for i := 0; i < 2; i++ {
+		// An invalid payload is still counted, and means the service doesn't try to send anything.
+		mockWriter := httptest.NewRecorder()
+		mockReq, _ := http.NewRequest("POST", "http://go.neb"+hookPath, bytes.NewBufferString(`not json`))
+		mux.ServeHTTP(mockWriter, mockReq)
+		codes = append(codes, mockWriter.Code)
+	}
+	if codes[0] != 400 || codes[1] != 429 {
+		t.Errorf("TestTenants: wanted only the second webhook to be rate limited, got %v", codes)
+	}
+}
+
+// handleJoinsAndLeaves records in joined and left the rooms which are joined and left out of roomIDs,
+// keyed by the access token of the client.
+func handleJoinsAndLeaves(joined, left map[string]map[string]bool, roomIDs ...string) {
+	for _, roomID := range roomIDs {
+		roomID := roomID
+		mxTripper.Handle("POST", "/_matrix/client/r0/join/"+roomID,
+			func(req *http.Request) (*http.Response, error) {
+				recordRoom(joined, req, roomID)
+				return newResponse(200, `{"room_id":"`+roomID+`"}`), nil
+			},
+		)
+		mxTripper.Handle("POST", "/_matrix/client/r0/rooms/"+roomID+"/leave",
+			func(req *http.Request) (*http.Response, error) {
+				recordRoom(left, req, roomID)
+				return newResponse(200, `{}`), nil
+			},
+		)
+	}
+}
+
+// recordRoom records the room in rooms under the access token of the request.
+func recordRoom(rooms map[string]map[string]bool, req *http.Request, roomID string) {
+	token := req.URL.Query().Get("access_token")
+	if rooms[token] == nil {
+		rooms[token] = make(map[string]bool)
+	}
+	rooms[token][roomID] = true
+}
+
+func TestMoveService(t *testing.T) {
+	mxTripper.ClearHandlers()
+	joined := make(map[string]map[string]bool) // access token => room IDs
+	left := make(map[string]map[string]bool)
+	handleJoinsAndLeaves(joined, left, "!ops:hyrule", "!dev:hyrule")
+
+	for _, client := range []string{`"UserID":"@navi:hyrule","AccessToken":"hey"`, `"UserID":"@tatl:hyrule","AccessToken":"listen"`} {
+		if res := adminPost("/admin/configureClient", `{`+client+`,"HomeserverURL":"http://hyrule.loz"}`); res.Code != 200 {
+			t.Fatalf("TestMoveService: configureClient wanted HTTP 200, got %d", res.Code)
+		}
+	}
+	serviceJSON := `{
+		"ID":"%s",
+		"Type":"alertmanager",
+		"UserID":"@navi:hyrule",
+		"Config":{
+			"rooms":{%s}
+		}
+	}`
+	room := `"%s":{"text_template":"{{.Status}}","msg_type":"m.notice"}`
+	for _, srv := range []string{
+		fmt.Sprintf(serviceJSON, "fairy_alerts", fmt.Sprintf(room, "!ops:hyrule")+","+fmt.Sprintf(room, "!dev:hyrule")),
+		fmt.Sprintf(serviceJSON, "navi_alerts", fmt.Sprintf(room, "!dev:hyrule")),
+	} {
+		if res := adminPost("/admin/configureService", srv); res.Code != 200 {
+			t.Fatalf("TestMoveService: configureService wanted HTTP 200, got %d: %s", res.Code, res.Body.String())
+		}
+	}
+
+	checkMoveAlerts(t, joined, left)
+	checkMoveFeed(t)
+}
+
+// checkMoveAlerts moves fairy_alerts from @navi:hyrule to @tatl:hyrule, leaving the rooms which
+// navi_alerts doesn't use.
+func checkMoveAlerts(t *testing.T, joined, left map[string]map[string]bool) {
+	if res := adminPost("/admin/moveService", `{"ID":"fairy_alerts","UserID":"@nobody:hyrule"}`); res.Code != 400 {
+		t.Errorf("TestMoveService: moveService to an unknown client wanted HTTP 400, got %d", res.Code)
+	}
+	res := adminPost("/admin/moveService", `{"ID":"fairy_alerts","UserID":"@tatl:hyrule","LeaveOldRooms":true}`)
+	if res.Code != 200 {
+		t.Fatalf("TestMoveService: moveService wanted HTTP 200, got %d: %s", res.Code, res.Body.String())
+	}
+	want := `"OldUserID":"@navi:hyrule","NewUserID":"@tatl:hyrule","JoinedRooms":["!dev:hyrule","!ops:hyrule"],"LeftRooms":["!ops:hyrule"]`
+	if !strings.Contains(res.Body.String(), want) {
+		t.Errorf("TestMoveService: moveService wanted %s, got %s", want, res.Body.String())
+	}
+	if !joined["listen"]["!ops:hyrule"] || !joined["listen"]["!dev:hyrule"] {
+		t.Errorf("TestMoveService: wanted @tatl:hyrule to join both rooms, joined %v", joined)
+	}
+	// !dev:hyrule is still used by navi_alerts.
+	if !left["hey"]["!ops:hyrule"] || left["hey"]["!dev:hyrule"] || len(left["listen"]) > 0 {
+		t.Errorf("TestMoveService: wanted @navi:hyrule to leave only !ops:hyrule, left %v", left)
+	}
+	if res := adminPost("/admin/moveService", `{"ID":"fairy_alerts","UserID":"@tatl:hyrule"}`); res.Code != 400 {
+		t.Errorf("TestMoveService: moveService to the same client wanted HTTP 400, got %d", res.Code)
+	}
+
+	// The service keeps its webhook URL, and an invalid payload is refused by the moved service.
+	hookPath := "/services/hooks/" + base64.RawURLEncoding.EncodeToString([]byte("fairy_alerts"))
+	if res := adminPost(hookPath, `not json`); res.Code != 400 {
+		t.Errorf("TestMoveService: webhook wanted HTTP 400 from the moved service, got %d", res.Code)
+	}
+}
+
+// checkMoveFeed checks that a moved feed keeps the items it has seen, so they are not posted again by the
+// new client, even though its rooms are expanded again from its room group.
+func checkMoveFeed(t *testing.T) {
+	feedServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`<rss version="2.0"><channel><title>Hyrule News</title>` +
+			`<item><title>Ganon returns</title><guid>ganon</guid></item></channel></rss>`))
+	}))
+	defer feedServer.Close()
+	feedJSON := `{
+		"ID":"fairy_feeds",
+		"Type":"rssbot",
+		"UserID":"@navi:hyrule",
+		"Config":{
+			"feeds":{"%s":{"rooms":["group:fairies"]}}
+		}
+	}`
+	if res := adminPost("/admin/configureRoomGroup", `{"Name":"fairies","Rooms":["!ops:hyrule"]}`); res.Code != 200 {
+		t.Fatalf("TestMoveService: configureRoomGroup wanted HTTP 200, got %d", res.Code)
+	}
+	if res := adminPost("/admin/configureService", fmt.Sprintf(feedJSON, feedServer.URL)); res.Code != 200 {
+		t.Fatalf("TestMoveService: configureService of rssbot wanted HTTP 200, got %d: %s", res.Code, res.Body.String())
+	}
+	// Wait for the first poll to store the feed state, then remember an older item too.
+	waitForFeedPoll(t, feedServer.URL)
+	_, err := database.GetServiceDB().ModifyService("fairy_feeds", func(service types.Service) error {
+		srv := service.(*rssbot.Service)
+		feed := srv.Feeds[feedServer.URL]
+		feed.RecentGUIDs = append(feed.RecentGUIDs, "zelda")
+		srv.Feeds[feedServer.URL] = feed
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("TestMoveService: failed to modify rssbot service: %s", err)
+	}
+	if res := adminPost("/admin/moveService", `{"ID":"fairy_feeds","UserID":"@tatl:hyrule"}`); res.Code != 200 {
+		t.Fatalf("TestMoveService: moveService of rssbot wanted HTTP 200, got %d: %s", res.Code, res.Body.String())
+	}
+	moved, ok := storedFeedService(feedServer.URL)
+	if !ok || moved.ServiceUserID() != "@tatl:hyrule" {
+		t.Fatalf("TestMoveService: wanted the rssbot service to be moved to @tatl:hyrule, got %v", moved)
+	}
+	if guids := moved.Feeds[feedServer.URL].RecentGUIDs; len(guids) != 2 || guids[0] != "ganon" || guids[1] != "zelda" {
+		t.Errorf("TestMoveService: wanted the moved rssbot service to keep its GUIDs, got %v", guids)
+	}
+}
+
+// storedFeedService loads the fairy_feeds service. Returns false if it hasn't polled the feed yet.
+func storedFeedService(feedURL string) (*rssbot.Service, bool) {
+	stored, err := database.GetServiceDB().LoadService("fairy_feeds")
+	srv, ok := stored.(*rssbot.Service)
+	return srv, err == nil && ok && srv.Feeds[feedURL].NextPollTimestampSecs != 0
+}
+
+// waitForFeedPoll waits for the fairy_feeds service to store the state of its first poll of the feed.
+func waitForFeedPoll(t *testing.T, feedURL string) {
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, ok := storedFeedService(feedURL); ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("TestMoveService: rssbot service did not poll its feed")
+		}
+	}
+}
+
+func TestWebhookRoutes(t *testing.T) {
+	mxTripper.ClearHandlers()
+	request := func(method, path, token, body string) *httptest.ResponseRecorder {
+		mockWriter := httptest.NewRecorder()
+		mockReq, _ := http.NewRequest(method, "http://go.neb"+path, bytes.NewBufferString(body))
+		if token != "" {
+			mockReq.Header.Set("Authorization", "Bearer "+token)
+		}
+		mux.ServeHTTP(mockWriter, mockReq)
+		return mockWriter
+	}
+
+	if res := request("POST", "/admin/configureTenant", adminToken, `{"ID":"routes","AccessToken":"routes_token"}`); res.Code != 200 {
+		t.Fatalf("TestWebhookRoutes: configureTenant wanted HTTP 200, got %d", res.Code)
+	}
+	if res := request("POST", "/admin/configureClient", "routes_token", `{
+		"UserID":"@rauru:hyrule",
+		"HomeserverURL":"http://hyrule.loz",
+		"AccessToken":"sages"
+	}`); res.Code != 200 {
+		t.Fatalf("TestWebhookRoutes: configureClient wanted HTTP 200, got %d", res.Code)
+	}
+	if res := request("POST", "/admin/configureService", "routes_token", `{
+		"ID":"routed",
+		"Type":"test_routed",
+		"UserID":"@rauru:hyrule",
+		"Config":{}
+	}`); res.Code != 200 {
+		t.Fatalf("TestWebhookRoutes: configureService wanted HTTP 200, got %d: %s", res.Code, res.Body.String())
+	}
+
+	hookPath := "/services/hooks/" + base64.RawURLEncoding.EncodeToString([]byte("routed"))
+	testCases := []struct {
+		method, path, token string
+		wantCode            int
+		wantBody            string
+	}{
+		{"GET", "/feed", "", 200, "feed"},
+		{"GET", "/feed/", "", 200, "feed"},
+		{"POST", "/feed", "", 405, ""},
+		{"GET", "/nothing", "", 404, ""},
+		{"GET", "/settings/export", "", 401, ""},
+		{"GET", "/settings/export", "not_a_token", 401, ""},
+		{"GET", "/settings/export", "routes_token", 200, "export"},
+		{"GET", "", "", 200, ""}, // passed to OnReceiveWebhook
+	}
+	for _, tc := range testCases {
+		res := request(tc.method, hookPath+tc.path, tc.token, "")
+		if res.Code != tc.wantCode || (tc.wantBody != "" && res.Body.String() != tc.wantBody) {
+			t.Errorf("TestWebhookRoutes: %s %s wanted HTTP %d %q, got %d %q", tc.method, tc.path, tc.wantCode, tc.wantBody, res.Code, res.Body.String())
+		}
+		if tc.wantCode == 405 && res.Header().Get("Allow") != "GET" {
+			t.Errorf("TestWebhookRoutes: %s %s wanted Allow: GET, got %q", tc.method, tc.path, res.Header().Get("Allow"))
+		}
+	}
+}
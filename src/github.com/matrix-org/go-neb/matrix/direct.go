@@ -0,0 +1,84 @@
+package matrix
+
+import (
+	"encoding/json"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/gomatrix"
+)
+
+// Guards looking up and creating direct message rooms, so that two private responses to the same user
+// which are sent at once don't create two rooms.
+var directRoomMutex sync.Mutex
+
+// DirectRoom returns the ID of a direct message room between the client and the user. The rooms are
+// looked up in the client's "m.direct" account data, and one is only used if the user is still joined to
+// or invited to it. If there isn't one for the user, a room is created and the user is invited to it, and
+// it is added to the account data.
+func DirectRoom(client *gomatrix.Client, userID string) (string, error) {
+	directRoomMutex.Lock()
+	defer directRoomMutex.Unlock()
+
+	accountDataURL := client.BuildURL("user", client.UserID, "account_data", "m.direct")
+	direct := make(map[string][]string) // user ID => room IDs
+	resBody, err := client.SendJSON("GET", accountDataURL, nil)
+	if err != nil {
+		if httpErr, ok := err.(gomatrix.HTTPError); !ok || httpErr.Code != 404 {
+			return "", err
+		}
+	} else if err := json.Unmarshal(resBody, &direct); err != nil {
+		return "", err
+	}
+	// The most recently added rooms are the ones most likely to still be in use.
+	rooms := direct[userID]
+	for i := len(rooms) - 1; i >= 0; i-- {
+		inRoom, err := isJoinedOrInvited(client, rooms[i], userID)
+		if err != nil {
+			return "", err
+		}
+		if inRoom {
+			return rooms[i], nil
+		}
+	}
+
+	resBody, err = client.SendJSON("POST", client.BuildURL("createRoom"), map[string]interface{}{
+		"invite":    []string{userID},
+		"is_direct": true,
+		"preset":    "trusted_private_chat",
+	})
+	if err != nil {
+		return "", err
+	}
+	var created struct {
+		RoomID string `json:"room_id"`
+	}
+	if err := json.Unmarshal(resBody, &created); err != nil {
+		return "", err
+	}
+	direct[userID] = append(direct[userID], created.RoomID)
+	if _, err := client.SendJSON("PUT", accountDataURL, direct); err != nil {
+		// The room can still be used, but another one will be created next time.
+		log.WithError(err).WithField("user_id", client.UserID).Warn("Failed to store m.direct account data")
+	}
+	return created.RoomID, nil
+}
+
+// isJoinedOrInvited returns true if the user is joined to or invited to the room. Returns false if the
+// client can't see the user's membership, e.g. because the client has left the room.
+func isJoinedOrInvited(client *gomatrix.Client, roomID, userID string) (bool, error) {
+	resBody, err := client.SendJSON("GET", client.BuildURL("rooms", roomID, "state", "m.room.member", userID), nil)
+	if err != nil {
+		if _, ok := err.(gomatrix.HTTPError); ok {
+			return false, nil
+		}
+		return false, err
+	}
+	var member struct {
+		Membership string `json:"membership"`
+	}
+	if err := json.Unmarshal(resBody, &member); err != nil {
+		return false, err
+	}
+	return member.Membership == "join" || member.Membership == "invite", nil
+}
@@ -67,3 +67,23 @@ func (m StarterLinkMessage) MarshalJSON() ([]byte, error) {
 	}
 	return json.Marshal(msg)
 }
+
+// RedactedEventID returns the ID of the event which a m.room.redaction event redacts. From room version
+// 11 this is in the content. In older rooms it is a top-level key which gomatrix.Event does not have, so
+// the event is fetched again as raw JSON.
+func RedactedEventID(client *gomatrix.Client, event *gomatrix.Event) (string, error) {
+	if redacts, ok := event.Content["redacts"].(string); ok && redacts != "" {
+		return redacts, nil
+	}
+	resBody, err := client.SendJSON("GET", client.BuildURL("rooms", event.RoomID, "event", event.ID), nil)
+	if err != nil {
+		return "", err
+	}
+	var raw struct {
+		Redacts string `json:"redacts"`
+	}
+	if err := json.Unmarshal(resBody, &raw); err != nil {
+		return "", err
+	}
+	return raw.Redacts, nil
+}
@@ -0,0 +1,48 @@
+package matrix
+
+import (
+	"encoding/json"
+
+	"github.com/matrix-org/gomatrix"
+)
+
+// PowerLevels is the content of an m.room.power_levels event.
+type PowerLevels struct {
+	Users         map[string]int `json:"users"`
+	UsersDefault  int            `json:"users_default"`
+	Events        map[string]int `json:"events"`
+	EventsDefault int            `json:"events_default"`
+	StateDefault  *int           `json:"state_default"`
+}
+
+// LoadPowerLevels fetches the current power levels of a room.
+func LoadPowerLevels(client *gomatrix.Client, roomID string) (*PowerLevels, error) {
+	resBody, err := client.SendJSON("GET", client.BuildURL("rooms", roomID, "state", "m.room.power_levels"), nil)
+	if err != nil {
+		return nil, err
+	}
+	var pl PowerLevels
+	if err := json.Unmarshal(resBody, &pl); err != nil {
+		return nil, err
+	}
+	return &pl, nil
+}
+
+// UserLevel returns the power level of the user.
+func (pl *PowerLevels) UserLevel(userID string) int {
+	if level, ok := pl.Users[userID]; ok {
+		return level
+	}
+	return pl.UsersDefault
+}
+
+// StateEventLevel returns the power level required to send a state event of the given type.
+func (pl *PowerLevels) StateEventLevel(eventType string) int {
+	if level, ok := pl.Events[eventType]; ok {
+		return level
+	}
+	if pl.StateDefault != nil {
+		return *pl.StateDefault
+	}
+	return 50
+}
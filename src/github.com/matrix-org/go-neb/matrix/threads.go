@@ -0,0 +1,141 @@
+package matrix
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/gomatrix"
+)
+
+// notificationThreadRetention is how long notifications about a subject are sent into the same thread.
+// Notifications about the subject after that start a new thread.
+const notificationThreadRetention = 90 * 24 * time.Hour
+
+// threadKey identifies the thread of notifications from a service about a subject in a room.
+type threadKey struct {
+	serviceID string
+	roomID    string
+	subject   string
+}
+
+// startingThreads holds a channel for each thread whose root notification is being sent, which is closed
+// once it has been sent. Other notifications about the subject wait for it rather than starting a second
+// thread. The mutex is never held whilst sending.
+var (
+	startingThreadsMutex sync.Mutex
+	startingThreads      = make(map[threadKey]chan struct{})
+)
+
+// ThreadMessage returns the message content with a relation which puts it in the thread rooted at
+// threadID. Clients which don't support threads see it as a reply to the thread's root event. If
+// threadID is empty the message is returned unchanged.
+func ThreadMessage(threadID string, msg interface{}) interface{} {
+	if threadID == "" {
+		return msg
+	}
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return msg
+	}
+	var content map[string]interface{}
+	if err := json.Unmarshal(b, &content); err != nil {
+		return msg
+	}
+	content["m.relates_to"] = map[string]interface{}{
+		"rel_type":        "m.thread",
+		"event_id":        threadID,
+		"is_falling_back": true,
+		"m.in_reply_to":   map[string]interface{}{"event_id": threadID},
+	}
+	return content
+}
+
+// SendNotification sends a notification from a service into a room. Notifications about the same
+// subject, e.g. a pull request, are grouped into a thread which is rooted at the first of them. If
+// subject is empty the notification is sent into the room as normal.
+func SendNotification(cli *gomatrix.Client, serviceID, roomID, subject string, msg interface{}) (*gomatrix.RespSendEvent, error) {
+	if subject == "" {
+		return cli.SendMessageEvent(roomID, "m.room.message", msg)
+	}
+	key := threadKey{serviceID, roomID, subject}
+	rootEventID, start := startThread(key)
+	if !start {
+		return cli.SendMessageEvent(roomID, "m.room.message", ThreadMessage(rootEventID, msg))
+	}
+	defer finishThread(key)
+
+	resp, err := cli.SendMessageEvent(roomID, "m.room.message", msg)
+	if err != nil {
+		return nil, err
+	}
+	if err := database.GetServiceDB().StoreNotificationThread(serviceID, roomID, subject, resp.EventID); err != nil {
+		log.WithFields(log.Fields{
+			log.ErrorKey: err,
+			"service_id": serviceID,
+			"room_id":    roomID,
+			"subject":    subject,
+		}).Error("Failed to store notification thread")
+	}
+	return resp, nil
+}
+
+// startThread returns the root event of the thread for the key. If there is no thread yet, it returns
+// true and the caller must send the root notification and then call finishThread. If another
+// notification is starting the thread, it waits for that notification to be sent.
+func startThread(key threadKey) (rootEventID string, start bool) {
+	for {
+		if rootEventID = loadThread(key); rootEventID != "" {
+			return rootEventID, false
+		}
+		startingThreadsMutex.Lock()
+		started, ok := startingThreads[key]
+		if !ok {
+			startingThreads[key] = make(chan struct{})
+		}
+		startingThreadsMutex.Unlock()
+		if ok {
+			<-started
+			continue
+		}
+		// another notification may have finished starting the thread since it was loaded
+		if rootEventID = loadThread(key); rootEventID != "" {
+			finishThread(key)
+			return rootEventID, false
+		}
+		return "", true
+	}
+}
+
+// finishThread wakes the notifications which are waiting for the root notification of the thread
+// for the key to be sent.
+func finishThread(key threadKey) {
+	startingThreadsMutex.Lock()
+	defer startingThreadsMutex.Unlock()
+	close(startingThreads[key])
+	delete(startingThreads, key)
+}
+
+func loadThread(key threadKey) string {
+	rootEventID, err := database.GetServiceDB().LoadNotificationThread(key.serviceID, key.roomID, key.subject)
+	if err != nil {
+		// we can still send the notification, it just won't be in the thread
+		log.WithFields(log.Fields{
+			log.ErrorKey: err,
+			"service_id": key.serviceID,
+			"room_id":    key.roomID,
+			"subject":    key.subject,
+		}).Error("Failed to load notification thread")
+	}
+	return rootEventID
+}
+
+// PruneNotificationThreads forgets the threads which were started longer ago than the retention period.
+func PruneNotificationThreads() {
+	before := time.Now().Add(-notificationThreadRetention)
+	if err := database.GetServiceDB().DeleteNotificationThreadsBefore(before); err != nil {
+		log.WithError(err).Error("Failed to delete old notification threads")
+	}
+}
@@ -0,0 +1,110 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+)
+
+// WebhookDelivery is the outcome of the last incoming webhook request for a service.
+type WebhookDelivery struct {
+	Time time.Time
+	// The HTTP status code the service responded with.
+	StatusCode int
+}
+
+// PollState is the state of the poll loop for a service.
+type PollState struct {
+	Running  bool
+	LastPoll time.Time
+	NextPoll time.Time
+}
+
+// SendFailover is the state of a room which a service couldn't send to as its service user.
+type SendFailover struct {
+	// When the service user last failed to send to the room.
+	Time time.Time
+	// The user ID of the failover client which the message was sent as instead, or "" if none could send it.
+	UserID string
+	// Why the service user couldn't send, e.g. "HTTP 403".
+	Reason string
+}
+
+// Health is only kept in memory, so it only covers the time since Go-NEB started.
+var (
+	healthMutex       sync.Mutex
+	webhookDeliveries = make(map[string]WebhookDelivery)         // service_id => last delivery
+	pollStates        = make(map[string]PollState)               // service_id => poll state
+	sendFailovers     = make(map[string]map[string]SendFailover) // service_id => room_id => failover
+)
+
+// RecordWebhookDelivery records the outcome of an incoming webhook request for a service.
+func RecordWebhookDelivery(serviceID string, statusCode int) {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+	webhookDeliveries[serviceID] = WebhookDelivery{time.Now(), statusCode}
+}
+
+// LastWebhookDelivery returns the outcome of the last incoming webhook request for a service. Returns
+// false if the service has not received a webhook request since Go-NEB started.
+func LastWebhookDelivery(serviceID string) (WebhookDelivery, bool) {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+	d, ok := webhookDeliveries[serviceID]
+	return d, ok
+}
+
+// RecordPoll records that a service has polled and when it will next poll.
+func RecordPoll(serviceID string, nextPoll time.Time) {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+	pollStates[serviceID] = PollState{true, time.Now(), nextPoll}
+}
+
+// RecordPollStopped records that the poll loop for a service has stopped.
+func RecordPollStopped(serviceID string) {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+	st := pollStates[serviceID]
+	st.Running = false
+	st.NextPoll = time.Time{}
+	pollStates[serviceID] = st
+}
+
+// LastPollState returns the state of the poll loop for a service. Returns false if the service has
+// not polled since Go-NEB started.
+func LastPollState(serviceID string) (PollState, bool) {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+	st, ok := pollStates[serviceID]
+	return st, ok
+}
+
+// RecordSendFailover records that a service couldn't send to a room as its service user, and which
+// failover client sent the message instead, if any.
+func RecordSendFailover(serviceID, roomID, userID, reason string) {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+	if sendFailovers[serviceID] == nil {
+		sendFailovers[serviceID] = make(map[string]SendFailover)
+	}
+	sendFailovers[serviceID][roomID] = SendFailover{time.Now(), userID, reason}
+}
+
+// RecordSendRecovered records that a service has sent to a room as its service user.
+func RecordSendRecovered(serviceID, roomID string) {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+	delete(sendFailovers[serviceID], roomID)
+}
+
+// SendFailovers returns the rooms which a service couldn't send to as its service user the last time
+// it tried. Returns an empty map if the service is not degraded in any room.
+func SendFailovers(serviceID string) map[string]SendFailover {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+	failovers := make(map[string]SendFailover)
+	for roomID, f := range sendFailovers[serviceID] {
+		failovers[roomID] = f
+	}
+	return failovers
+}
@@ -0,0 +1,162 @@
+// Package cron parses cron schedule expressions so pollers can work out when they should next run.
+// Expressions have the standard five fields:
+//    minute hour day-of-month month day-of-week
+// Each field is "*", a number, a range "1-5", a step "*/15" or "1-30/2", or a comma separated list
+// of these. Days of the week are 0-7, where both 0 and 7 are Sunday. If both day fields are
+// restricted, a day matches if either of them does. The shorthands "@hourly", "@daily", "@weekly",
+// "@monthly" and "@yearly" are also accepted.
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How far ahead Next searches before deciding that a schedule never matches, e.g "0 0 30 2 *".
+const maxSearchYears = 5
+
+var shorthands = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+}
+
+// Schedule is a parsed cron expression.
+type Schedule struct {
+	minute, hour, dom, month, dow uint64 // bit N is set if value N matches
+	domStar, dowStar              bool
+}
+
+// Parse parses a cron expression.
+func Parse(spec string) (*Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if expanded, ok := shorthands[spec]; ok {
+		spec = expanded
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron: expected 5 fields, got %d in %q", len(fields), spec)
+	}
+	var s Schedule
+	var err error
+	if s.minute, err = parseField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if s.hour, err = parseField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if s.dom, err = parseField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if s.month, err = parseField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	if s.dow, err = parseField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+	if s.dow&(1<<7) != 0 { // 7 is also Sunday
+		s.dow |= 1
+	}
+	s.domStar = fields[2] == "*"
+	s.dowStar = fields[4] == "*"
+	return &s, nil
+}
+
+// Next returns the first time after t which matches the schedule, in t's location. Returns the zero
+// time if the schedule never matches.
+func (s *Schedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(maxSearchYears, 0, 0)
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+func (s *Schedule) dayMatches(t time.Time) bool {
+	domMatch := s.dom&(1<<uint(t.Day())) != 0
+	dowMatch := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+// parseField parses a comma separated list of values, ranges and steps into a bitmask.
+func parseField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		part, step, err := parseStep(part)
+		if err != nil {
+			return 0, err
+		}
+		lo, hi, err := parseRange(part, field, min, max, step)
+		if err != nil {
+			return 0, err
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("cron: %q is out of range %d-%d", field, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// parseStep splits the "/step" suffix off a part of a field. The step is 1 if there is no suffix.
+func parseStep(part string) (string, int, error) {
+	i := strings.Index(part, "/")
+	if i == -1 {
+		return part, 1, nil
+	}
+	step, err := strconv.Atoi(part[i+1:])
+	if err != nil || step < 1 {
+		return "", 0, fmt.Errorf("cron: bad step in %q", part)
+	}
+	return part[:i], step, nil
+}
+
+// parseRange parses "*", a single value or a "lo-hi" range from a part of a field, without the step.
+func parseRange(part, field string, min, max, step int) (int, int, error) {
+	if part == "*" {
+		return min, max, nil
+	}
+	bounds := strings.SplitN(part, "-", 2)
+	lo, err := strconv.Atoi(bounds[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("cron: bad value in %q", field)
+	}
+	if len(bounds) == 2 {
+		hi, err := strconv.Atoi(bounds[1])
+		if err != nil {
+			return 0, 0, fmt.Errorf("cron: bad range in %q", field)
+		}
+		return lo, hi, nil
+	}
+	if step > 1 {
+		return lo, max, nil // "5/10" means every 10 starting at 5
+	}
+	return lo, lo, nil
+}
@@ -0,0 +1,42 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNext(t *testing.T) {
+	from := time.Date(2017, 3, 7, 9, 30, 15, 0, time.UTC) // a Tuesday
+	for _, test := range []struct {
+		Spec string
+		Want time.Time
+	}{
+		{"* * * * *", time.Date(2017, 3, 7, 9, 31, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2017, 3, 7, 9, 45, 0, 0, time.UTC)},
+		{"0 9 * * 1", time.Date(2017, 3, 13, 9, 0, 0, 0, time.UTC)},
+		{"0 9 * * 7", time.Date(2017, 3, 12, 9, 0, 0, 0, time.UTC)},
+		{"30 17 * * 1-5", time.Date(2017, 3, 7, 17, 30, 0, 0, time.UTC)},
+		{"0 0 1,15 * *", time.Date(2017, 3, 15, 0, 0, 0, 0, time.UTC)},
+		{"0 0 13 * 5", time.Date(2017, 3, 10, 0, 0, 0, 0, time.UTC)}, // Friday or the 13th
+		{"0 0 29 2 *", time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"@weekly", time.Date(2017, 3, 12, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	} {
+		s, err := Parse(test.Spec)
+		if err != nil {
+			t.Errorf("TestNext %q: failed to parse: %s", test.Spec, err)
+			continue
+		}
+		if got := s.Next(from); !got.Equal(test.Want) {
+			t.Errorf("TestNext %q: want %s, got %s", test.Spec, test.Want, got)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		if _, err := Parse(spec); err == nil {
+			t.Errorf("TestParseErrors %q: expected an error", spec)
+		}
+	}
+}
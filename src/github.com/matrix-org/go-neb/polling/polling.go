@@ -8,6 +8,7 @@ import (
 	log "github.com/Sirupsen/logrus"
 	"github.com/matrix-org/go-neb/clients"
 	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/metrics"
 	"github.com/matrix-org/go-neb/types"
 )
 
@@ -63,6 +64,7 @@ func StopPolling(service types.Service) {
 		"service_type": service.ServiceType(),
 	}).Info("StopPolling")
 	setPollStartTime(service, 0)
+	metrics.RecordPollStopped(service.ServiceID())
 }
 
 // pollLoop begins the polling loop for this service. Does not return, so call this
@@ -81,6 +83,7 @@ func pollLoop(service types.Service, ts int64) {
 			logger.WithField("panic", r).Errorf(
 				"pollLoop panicked!\n%s", debug.Stack(),
 			)
+			metrics.RecordPollStopped(service.ServiceID())
 		}
 	}()
 
@@ -90,7 +93,7 @@ func pollLoop(service types.Service, ts int64) {
 		return
 	}
 	logger.Info("Starting polling loop")
-	cli, err := clientPool.Client(service.ServiceUserID())
+	cli, err := clientPool.SendingClient(service)
 	if err != nil {
 		logger.WithError(err).WithField("user_id", service.ServiceUserID()).Error("Poll setup failed: failed to load client")
 		return
@@ -105,8 +108,10 @@ func pollLoop(service types.Service, ts int64) {
 		// work out how long to sleep
 		if nextTime.Unix() == 0 {
 			logger.Info("Terminating poll - OnPoll returned 0")
+			metrics.RecordPollStopped(service.ServiceID())
 			break
 		}
+		metrics.RecordPoll(service.ServiceID(), nextTime)
 		now := time.Now()
 		time.Sleep(nextTime.Sub(now))
 
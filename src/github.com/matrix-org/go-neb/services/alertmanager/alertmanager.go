@@ -7,6 +7,7 @@ import (
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/matrix"
 	"github.com/matrix-org/go-neb/types"
 	"github.com/matrix-org/gomatrix"
 	html "html/template"
@@ -25,7 +26,12 @@ const ServiceType = "alertmanager"
 //
 // For the template strings, take a look at https://golang.org/pkg/text/template/
 // and the html variant https://golang.org/pkg/html/template/.
-// The data they get is a webhookNotification
+// The data they get is a Data, and the functions available to them are the same as
+// in Alertmanager's own notification templates (toUpper, toLower, title, join, match,
+// safeHtml, reReplaceAll and stringSlice), so templates written for Alertmanager's
+// notifiers can be used unchanged. For example:
+//    {{ .Status | toUpper }}{{ if eq .Status "firing" }}:{{ .Alerts.Firing | len }}{{ end }}
+//    {{ range .CommonLabels.SortedPairs }}{{ .Name }}={{ .Value }} {{ end }}
 //
 // You can set msg_type to either m.text or m.notice
 //
@@ -41,6 +47,7 @@ const ServiceType = "alertmanager"
 //    }
 type Service struct {
 	types.DefaultService
+	types.CommandScope
 	webhookEndpointURL string
 	// The URL which should be added to alertmanagers config - Populated by Go-NEB after Service registration.
 	WebhookURL string `json:"webhook_url"`
@@ -49,7 +56,13 @@ type Service struct {
 		TextTemplate string `json:"text_template"`
 		HTMLTemplate string `json:"html_template"`
 		MsgType      string `json:"msg_type"`
-	} `json:"rooms"`
+	} `json:"rooms" rooms:"keys"`
+	// Optional. If true, notifications about the same alert group are grouped into a thread
+	// which is rooted at the first notification about it.
+	ThreadBySubject bool `json:"thread_by_subject"`
+	// Optional. The URL of Alertmanager, e.g. "http://alertmanager:9093". If set, "!alertmanager silence"
+	// silences alerts from the rooms of this service, once another user in the room approves it.
+	APIURL string `json:"api_url"`
 }
 
 // The payload from Alertmanager
@@ -69,6 +82,7 @@ type WebhookNotification struct {
 		StartsAt     string            `json:"startsAt"`
 		EndsAt       string            `json:"endsAt"`
 		GeneratorUrl string            `json:"generatorURL"`
+		Fingerprint  string            `json:"fingerprint"`
 	} `json:"alerts"`
 }
 
@@ -82,17 +96,22 @@ func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli
 		return
 	}
 
+	var subject string
+	if s.ThreadBySubject && !types.IsTestRequest(req) {
+		subject = notif.GroupKey
+	}
+	data := templateData(notif)
 	for roomID, templates := range s.Rooms {
 		var msg interface{}
 		// we don't check whether the templates parse because we already did when storing them in the db
-		textTemplate, _ := text.New("textTemplate").Parse(templates.TextTemplate)
+		textTemplate, _ := text.New("textTemplate").Funcs(templateFuncs).Parse(templates.TextTemplate)
 		var bodyBuffer bytes.Buffer
-		textTemplate.Execute(&bodyBuffer, notif)
+		textTemplate.Execute(&bodyBuffer, data)
 		if templates.HTMLTemplate != "" {
 			// we don't check whether the templates parse because we already did when storing them in the db
-			htmlTemplate, _ := html.New("htmlTemplate").Parse(templates.HTMLTemplate)
+			htmlTemplate, _ := html.New("htmlTemplate").Funcs(templateFuncs).Parse(templates.HTMLTemplate)
 			var formattedBodyBuffer bytes.Buffer
-			htmlTemplate.Execute(&formattedBodyBuffer, notif)
+			htmlTemplate.Execute(&formattedBodyBuffer, data)
 			msg = gomatrix.HTMLMessage{
 				Body:          bodyBuffer.String(),
 				MsgType:       templates.MsgType,
@@ -110,7 +129,7 @@ func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli
 			"message": msg,
 			"room_id": roomID,
 		}).Print("Sending Alertmanager notification to room")
-		if _, e := cli.SendMessageEvent(roomID, "m.room.message", msg); e != nil {
+		if _, e := matrix.SendNotification(cli, s.ServiceID(), roomID, subject, msg); e != nil {
 			log.WithError(e).WithField("room_id", roomID).Print(
 				"Failed to send Alertmanager notification to room.")
 		}
@@ -118,6 +137,42 @@ func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli
 	w.WriteHeader(200)
 }
 
+// TestWebhookRequests returns a sample Alertmanager webhook request containing a firing alert.
+func (s *Service) TestWebhookRequests() ([]*http.Request, error) {
+	payload := []byte(`{
+		"version": "4",
+		"groupKey": "{}:{alertname=\"GoNEBTest\"}",
+		"status": "firing",
+		"receiver": "go-neb",
+		"groupLabels": {"alertname": "GoNEBTest"},
+		"commonLabels": {"alertname": "GoNEBTest", "severity": "warning"},
+		"commonAnnotations": {"summary": "Test alert from Go-NEB"},
+		"externalURL": "http://alertmanager.example.com",
+		"alerts": [{
+			"status": "firing",
+			"labels": {"alertname": "GoNEBTest", "severity": "warning"},
+			"annotations": {"summary": "Test alert from Go-NEB"},
+			"startsAt": "2017-01-01T12:00:00Z",
+			"endsAt": "0001-01-01T00:00:00Z",
+			"generatorURL": "http://prometheus.example.com/graph"
+		}]
+	}`)
+	req, err := http.NewRequest("POST", s.webhookEndpointURL, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return []*http.Request{req}, nil
+}
+
+// RoomTargets returns "all alerts" if the room is notified of alerts.
+func (s *Service) RoomTargets(roomID string) []string {
+	if _, ok := s.Rooms[roomID]; !ok {
+		return nil
+	}
+	return []string{"all alerts"}
+}
+
 // Register makes sure the Config information supplied is valid.
 func (s *Service) Register(oldService types.Service, client *gomatrix.Client) error {
 	s.WebhookURL = s.webhookEndpointURL
@@ -127,14 +182,14 @@ func (s *Service) Register(oldService types.Service, client *gomatrix.Client) er
 			return fmt.Errorf("plain text template missing")
 		} else {
 			// validate the plain text template is valid
-			_, err := text.New("textTemplate").Parse(templates.TextTemplate)
+			_, err := text.New("textTemplate").Funcs(templateFuncs).Parse(templates.TextTemplate)
 			if err != nil {
 				return fmt.Errorf("plain text template is invalid")
 			}
 		}
 		if templates.HTMLTemplate != "" {
 			// validate that the html template is valid
-			_, err := html.New("htmlTemplate").Parse(templates.HTMLTemplate)
+			_, err := html.New("htmlTemplate").Funcs(templateFuncs).Parse(templates.HTMLTemplate)
 			if err != nil {
 				return fmt.Errorf("html template is invalid")
 			}
@@ -0,0 +1,322 @@
+package alertmanager
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+)
+
+const alertmanagerPayload = `{
+	"version": "4",
+	"groupKey": "{}:{alertname=\"DiskFull\"}",
+	"status": "firing",
+	"receiver": "matrix",
+	"groupLabels": {"alertname": "DiskFull"},
+	"commonLabels": {"alertname": "DiskFull", "severity": "critical", "env": "prod"},
+	"commonAnnotations": {"summary": "Disk <full>"},
+	"externalURL": "http://alertmanager.hyrule",
+	"alerts": [{
+		"status": "firing",
+		"labels": {"alertname": "DiskFull", "instance": "castle"},
+		"annotations": {"summary": "Disk <full>"},
+		"startsAt": "2017-01-01T12:00:00.123Z",
+		"endsAt": "0001-01-01T00:00:00Z",
+		"generatorURL": "http://prometheus.hyrule/graph",
+		"fingerprint": "abc123"
+	}, {
+		"status": "resolved",
+		"labels": {"alertname": "DiskFull", "instance": "village"},
+		"annotations": {},
+		"startsAt": "2017-01-01T11:00:00Z",
+		"endsAt": "2017-01-01T11:30:00Z",
+		"generatorURL": "http://prometheus.hyrule/graph"
+	}]
+}`
+
+var templateTests = []struct {
+	textTemplate string
+	htmlTemplate string
+	wantBody     string
+	wantHTML     string
+}{
+	{ // Alertmanager's default title template
+		textTemplate: `[{{ .Status | toUpper }}{{ if eq .Status "firing" }}:{{ .Alerts.Firing | len }}{{ end }}] {{ .GroupLabels.SortedPairs.Values | join " " }} {{ if gt (len .CommonLabels) (len .GroupLabels) }}({{ with .CommonLabels.Remove .GroupLabels.Names }}{{ .Values | join " " }}{{ end }}){{ end }}`,
+		wantBody:     `[FIRING:1] DiskFull (prod critical)`,
+	},
+	{
+		textTemplate: `{{ range .CommonLabels.SortedPairs }}{{ .Name }}={{ .Value }} {{ end }}`,
+		wantBody:     `alertname=DiskFull env=prod severity=critical `,
+	},
+	{
+		textTemplate: `{{ range .Alerts.Resolved }}{{ .Labels.instance }} resolved after {{ .EndsAt.Sub .StartsAt }}{{ end }}`,
+		wantBody:     `village resolved after 30m0s`,
+	},
+	{ // fields from before the Alertmanager data model are still available
+		textTemplate: `{{ .ExternalUrl }} {{ (index .Alerts 0).GeneratorUrl }} {{ .Version }}`,
+		wantBody:     `http://alertmanager.hyrule http://prometheus.hyrule/graph 4`,
+	},
+	{
+		textTemplate: `{{ .CommonAnnotations.summary }}`,
+		htmlTemplate: `{{ .CommonAnnotations.summary }} {{ "<b>bold</b>" | safeHtml }} {{ reReplaceAll "D(isk)" "d$1" .CommonLabels.alertname | toLower }}`,
+		wantBody:     `Disk <full>`,
+		wantHTML:     `Disk &lt;full&gt; <b>bold</b> diskfull`,
+	},
+}
+
+func TestTemplates(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+	for _, test := range templateTests {
+		var sent map[string]interface{}
+		matrixTrans := struct{ testutils.MockTransport }{}
+		matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+			if req.Method == "POST" && strings.HasPrefix(req.URL.Path, "/_matrix/client/r0/join/") {
+				return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(`{}`))}, nil
+			}
+			if !strings.HasPrefix(req.URL.Path, "/_matrix/client/r0/rooms/!alerts:hyrule/send/m.room.message") {
+				return nil, errors.New("Unhandled matrix client test request")
+			}
+			if err := json.NewDecoder(req.Body).Decode(&sent); err != nil {
+				t.Fatal("Failed to decode request JSON: ", err)
+			}
+			return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$1:hyrule"}`))}, nil
+		}
+		matrixClient, _ := gomatrix.NewClient("https://hyrule", "@alertbot:hyrule", "its_a_secret")
+		matrixClient.Client = &http.Client{Transport: matrixTrans}
+
+		config, _ := json.Marshal(map[string]interface{}{
+			"rooms": map[string]interface{}{
+				"!alerts:hyrule": map[string]string{
+					"text_template": test.textTemplate,
+					"html_template": test.htmlTemplate,
+					"msg_type":      "m.notice",
+				},
+			},
+		})
+		srv, err := types.CreateService("id", ServiceType, "@alertbot:hyrule", config)
+		if err != nil {
+			t.Fatal("Failed to create alertmanager service: ", err)
+		}
+		if err := srv.Register(nil, matrixClient); err != nil {
+			t.Fatalf("TestTemplates: Register(%s) failed: %s", test.textTemplate, err)
+		}
+
+		req, _ := http.NewRequest("POST", "https://neb/services/hooks/id", bytes.NewBufferString(alertmanagerPayload))
+		w := httptest.NewRecorder()
+		srv.OnReceiveWebhook(w, req, matrixClient)
+		if w.Code != 200 {
+			t.Fatalf("TestTemplates: want HTTP 200, got %d", w.Code)
+		}
+		if sent["body"] != test.wantBody {
+			t.Errorf("TestTemplates(%s): want body %q, got %q", test.textTemplate, test.wantBody, sent["body"])
+		}
+		if test.wantHTML != "" && sent["formatted_body"] != test.wantHTML {
+			t.Errorf("TestTemplates(%s): want formatted body %q, got %q", test.htmlTemplate, test.wantHTML, sent["formatted_body"])
+		}
+	}
+}
+
+// threadStorage stores notification threads in memory.
+type threadStorage struct {
+	database.NopStorage
+	mu      sync.Mutex
+	threads map[string]string
+}
+
+func (s *threadStorage) StoreNotificationThread(serviceID, roomID, subject, rootEventID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.threads[serviceID+roomID+subject] = rootEventID
+	return nil
+}
+
+func (s *threadStorage) LoadNotificationThread(serviceID, roomID, subject string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.threads[serviceID+roomID+subject], nil
+}
+
+func TestThreadBySubject(t *testing.T) {
+	database.SetServiceDB(&threadStorage{threads: make(map[string]string)})
+	var sent []map[string]interface{}
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		if !strings.HasPrefix(req.URL.Path, "/_matrix/client/r0/rooms/!alerts:hyrule/send/m.room.message") {
+			return nil, errors.New("Unhandled matrix client test request")
+		}
+		var content map[string]interface{}
+		if err := json.NewDecoder(req.Body).Decode(&content); err != nil {
+			t.Fatal("Failed to decode request JSON: ", err)
+		}
+		sent = append(sent, content)
+		eventID := fmt.Sprintf(`{"event_id":"$%d:hyrule"}`, len(sent))
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(eventID))}, nil
+	}
+	matrixClient, _ := gomatrix.NewClient("https://hyrule", "@alertbot:hyrule", "its_a_secret")
+	matrixClient.Client = &http.Client{Transport: matrixTrans}
+
+	srv, err := types.CreateService("id", ServiceType, "@alertbot:hyrule", []byte(`{
+		"thread_by_subject": true,
+		"rooms": {"!alerts:hyrule": {"text_template": "{{ .Status }}", "msg_type": "m.notice"}}
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create alertmanager service: ", err)
+	}
+	for _, payload := range []string{
+		alertmanagerPayload,
+		strings.Replace(alertmanagerPayload, `"status": "firing",
+	"receiver"`, `"status": "resolved",
+	"receiver"`, 1),
+		strings.Replace(alertmanagerPayload, "DiskFull", "CPUHigh", -1),
+	} {
+		req, _ := http.NewRequest("POST", "https://neb/services/hooks/id", bytes.NewBufferString(payload))
+		srv.OnReceiveWebhook(httptest.NewRecorder(), req, matrixClient)
+	}
+
+	if len(sent) != 3 {
+		t.Fatalf("TestThreadBySubject: want 3 notifications, got %d", len(sent))
+	}
+	if sent[0]["m.relates_to"] != nil || sent[2]["m.relates_to"] != nil {
+		t.Errorf("TestThreadBySubject: want the first notification for each alert group to start a thread, got %v", sent)
+	}
+	relation, _ := sent[1]["m.relates_to"].(map[string]interface{})
+	if sent[1]["body"] != "resolved" || relation["rel_type"] != "m.thread" || relation["event_id"] != "$1:hyrule" {
+		t.Errorf("TestThreadBySubject: want the resolved notification in the thread of $1:hyrule, got %v", sent[1])
+	}
+}
+
+func TestThreadsAreSentConcurrently(t *testing.T) {
+	database.SetServiceDB(&threadStorage{threads: make(map[string]string)})
+	var mu sync.Mutex
+	var sent []map[string]interface{}
+	blocked := make(chan struct{})
+	release := make(chan struct{})
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		var content map[string]interface{}
+		if err := json.NewDecoder(req.Body).Decode(&content); err != nil {
+			return nil, err
+		}
+		mu.Lock()
+		sent = append(sent, content)
+		n := len(sent)
+		mu.Unlock()
+		if n == 1 {
+			// hold up the notification which starts the DiskFull thread
+			close(blocked)
+			<-release
+		}
+		eventID := fmt.Sprintf(`{"event_id":"$%d:hyrule"}`, n)
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(eventID))}, nil
+	}
+	matrixClient, _ := gomatrix.NewClient("https://hyrule", "@alertbot:hyrule", "its_a_secret")
+	matrixClient.Client = &http.Client{Transport: matrixTrans}
+
+	srv, err := types.CreateService("id", ServiceType, "@alertbot:hyrule", []byte(`{
+		"thread_by_subject": true,
+		"rooms": {"!alerts:hyrule": {"text_template": "{{ .Status }}", "msg_type": "m.notice"}}
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create alertmanager service: ", err)
+	}
+	notify := func(payload string) chan struct{} {
+		done := make(chan struct{})
+		go func() {
+			req, _ := http.NewRequest("POST", "https://neb/services/hooks/id", bytes.NewBufferString(payload))
+			srv.OnReceiveWebhook(httptest.NewRecorder(), req, matrixClient)
+			close(done)
+		}()
+		return done
+	}
+
+	diskFull := notify(alertmanagerPayload)
+	<-blocked
+	select {
+	case <-notify(strings.Replace(alertmanagerPayload, "DiskFull", "CPUHigh", -1)):
+	case <-time.After(5 * time.Second):
+		t.Fatal("TestThreadsAreSentConcurrently: a notification about another alert group waited for DiskFull")
+	}
+	resolved := notify(strings.Replace(alertmanagerPayload, `"status": "firing",
+	"receiver"`, `"status": "resolved",
+	"receiver"`, 1))
+	close(release)
+	<-diskFull
+	<-resolved
+
+	if len(sent) != 3 {
+		t.Fatalf("TestThreadsAreSentConcurrently: want 3 notifications, got %d", len(sent))
+	}
+	relation, _ := sent[2]["m.relates_to"].(map[string]interface{})
+	if sent[2]["body"] != "resolved" || relation["event_id"] != "$1:hyrule" {
+		t.Errorf("TestThreadsAreSentConcurrently: want the resolved notification in the thread of $1:hyrule, got %v", sent[2])
+	}
+}
+
+// mockAlertmanagerAPI records the silences which are created with the Alertmanager API.
+func mockAlertmanagerAPI(t *testing.T, silences *[]map[string]interface{}) {
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		if req.Method != "POST" || req.URL.String() != "http://alertmanager.hyrule/api/v2/silences" {
+			return nil, fmt.Errorf("Unhandled URL %s", req.URL.String())
+		}
+		var silence map[string]interface{}
+		if err := json.NewDecoder(req.Body).Decode(&silence); err != nil {
+			t.Fatal("Failed to decode silence JSON: ", err)
+		}
+		*silences = append(*silences, silence)
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(`{"silenceID":"quiet"}`))}, nil
+	})}
+}
+
+func TestSilence(t *testing.T) {
+	var silences []map[string]interface{}
+	mockAlertmanagerAPI(t, &silences)
+
+	srv, err := types.CreateService("id", ServiceType, "@alertbot:hyrule", []byte(`{
+		"rooms": {"!alerts:hyrule": {"text_template": "{{ .Status }}", "msg_type": "m.notice"}}
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create alertmanager service: ", err)
+	}
+	if cmds := srv.Commands(nil); len(cmds) != 0 {
+		t.Errorf("TestSilence: want no commands without an API URL, got %d", len(cmds))
+	}
+	srv.(*Service).APIURL = "http://alertmanager.hyrule"
+	cmds := srv.Commands(nil)
+	if len(cmds) != 1 || cmds[0].Approval == nil {
+		t.Fatalf("TestSilence: want one command which needs approval, got %+v", cmds)
+	}
+	if _, err := cmds[0].Command("!other:hyrule", "@link:hyrule", []string{"DiskFull", "2h"}); err == nil {
+		t.Error("TestSilence: want alerts not to be silenced from other rooms")
+	}
+	res, err := cmds[0].Command("!alerts:hyrule", "@link:hyrule", []string{"DiskFull", "2h", "New", "disk"})
+	if err != nil {
+		t.Fatal("TestSilence: failed to silence: ", err)
+	}
+	if body := res.(*gomatrix.TextMessage).Body; body != "Silenced DiskFull for 2h0m0s (silence quiet)" {
+		t.Errorf("TestSilence: want the silence ID in the response, got %q", body)
+	}
+	checkSilenceCreated(t, silences)
+}
+
+// checkSilenceCreated checks that the only silence is of DiskFull, created by @link:hyrule.
+func checkSilenceCreated(t *testing.T, silences []map[string]interface{}) {
+	if len(silences) != 1 || silences[0]["createdBy"] != "@link:hyrule" || silences[0]["comment"] != "New disk" {
+		t.Fatalf("TestSilence: want one silence created by @link:hyrule, got %v", silences)
+	}
+	matcher := silences[0]["matchers"].([]interface{})[0].(map[string]interface{})
+	if matcher["name"] != "alertname" || matcher["value"] != "DiskFull" {
+		t.Errorf("TestSilence: want a silence of DiskFull, got %v", matcher)
+	}
+}
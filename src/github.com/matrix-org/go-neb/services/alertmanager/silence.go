@@ -0,0 +1,87 @@
+package alertmanager
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+)
+
+var httpClient = &http.Client{}
+
+const cmdSilenceUsage = "Usage: !alertmanager silence <alertname> <duration, e.g. 2h> [comment]"
+
+// Commands supported:
+//    !alertmanager silence DiskFull 2h "Replacing the disk"
+// Silences the alert with the given name for the given duration, once another user in the room
+// approves it. There are no commands if the service has no API URL.
+func (s *Service) Commands(cli *gomatrix.Client) []types.Command {
+	if s.APIURL == "" {
+		return nil
+	}
+	return []types.Command{
+		types.Command{
+			Path:      []string{"alertmanager", "silence"},
+			Arguments: []string{"alertname", "duration", "comment"},
+			Help:      "Silence an alert, once another user approves it.",
+			Approval:  &types.ApprovalPolicy{},
+			Command: func(roomID, userID string, args []string) (interface{}, error) {
+				return s.cmdSilence(roomID, userID, args)
+			},
+		},
+	}
+}
+
+func (s *Service) cmdSilence(roomID, userID string, args []string) (interface{}, error) {
+	if len(args) < 2 {
+		return nil, errors.New(cmdSilenceUsage)
+	}
+	if _, ok := s.Rooms[roomID]; !ok {
+		return nil, errors.New("Alerts can't be silenced from this room")
+	}
+	duration, err := time.ParseDuration(args[1])
+	if err != nil || duration <= 0 {
+		return nil, errors.New(cmdSilenceUsage)
+	}
+	comment := strings.Join(args[2:], " ")
+	if comment == "" {
+		comment = "Silenced from Matrix"
+	}
+
+	now := time.Now()
+	silence := map[string]interface{}{
+		"matchers":  []map[string]interface{}{{"name": "alertname", "value": args[0], "isRegex": false}},
+		"startsAt":  now.UTC().Format(time.RFC3339),
+		"endsAt":    now.Add(duration).UTC().Format(time.RFC3339),
+		"createdBy": userID,
+		"comment":   comment,
+	}
+	body, err := json.Marshal(silence)
+	if err != nil {
+		return nil, err
+	}
+	res, err := httpClient.Post(strings.TrimSuffix(s.APIURL, "/")+"/api/v2/silences", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to silence %s: %s", args[0], err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("Failed to silence %s: HTTP %d", args[0], res.StatusCode)
+	}
+	var created struct {
+		SilenceID string `json:"silenceID"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&created); err != nil {
+		return nil, fmt.Errorf("Failed to silence %s: %s", args[0], err)
+	}
+	return &gomatrix.TextMessage{
+		MsgType: "m.notice",
+		Body:    fmt.Sprintf("Silenced %s for %s (silence %s)", args[0], duration, created.SilenceID),
+	}, nil
+}
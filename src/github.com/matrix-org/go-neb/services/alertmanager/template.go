@@ -0,0 +1,196 @@
+package alertmanager
+
+import (
+	html "html/template"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The data model and functions in this file match those which Alertmanager gives to its own notification
+// templates (see https://prometheus.io/docs/alerting/notifications/), so that templates written for
+// Alertmanager's notifiers can be used unchanged.
+
+// Data is the data passed to the text and HTML templates.
+type Data struct {
+	Receiver          string
+	Status            string
+	Alerts            Alerts
+	GroupLabels       KV
+	CommonLabels      KV
+	CommonAnnotations KV
+	ExternalURL       string
+
+	// These are not part of Alertmanager's template data but are kept for existing templates.
+	Version     string
+	GroupKey    string
+	ExternalUrl string
+}
+
+// Alert is a single alert.
+type Alert struct {
+	Status       string
+	Labels       KV
+	Annotations  KV
+	StartsAt     time.Time
+	EndsAt       time.Time
+	GeneratorURL string
+	Fingerprint  string
+
+	// GeneratorUrl is not part of Alertmanager's template data but is kept for existing templates.
+	GeneratorUrl string
+}
+
+// Alerts is a list of alerts.
+type Alerts []Alert
+
+// Firing returns the alerts which are firing.
+func (as Alerts) Firing() []Alert {
+	res := []Alert{}
+	for _, a := range as {
+		if a.Status == "firing" {
+			res = append(res, a)
+		}
+	}
+	return res
+}
+
+// Resolved returns the alerts which have been resolved.
+func (as Alerts) Resolved() []Alert {
+	res := []Alert{}
+	for _, a := range as {
+		if a.Status == "resolved" {
+			res = append(res, a)
+		}
+	}
+	return res
+}
+
+// KV is a set of labels or annotations.
+type KV map[string]string
+
+// Pair is a key/value string pair.
+type Pair struct {
+	Name, Value string
+}
+
+// Pairs is a list of key/value string pairs.
+type Pairs []Pair
+
+// Names returns the names of the pairs.
+func (ps Pairs) Names() []string {
+	ns := make([]string, 0, len(ps))
+	for _, p := range ps {
+		ns = append(ns, p.Name)
+	}
+	return ns
+}
+
+// Values returns the values of the pairs.
+func (ps Pairs) Values() []string {
+	vs := make([]string, 0, len(ps))
+	for _, p := range ps {
+		vs = append(vs, p.Value)
+	}
+	return vs
+}
+
+// SortedPairs returns the pairs sorted by name, except that "alertname" always comes first.
+func (kv KV) SortedPairs() Pairs {
+	keys := make([]string, 0, len(kv))
+	sortStart := 0
+	for k := range kv {
+		if k == "alertname" {
+			keys = append([]string{k}, keys...)
+			sortStart = 1
+		} else {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys[sortStart:])
+
+	pairs := make(Pairs, 0, len(kv))
+	for _, k := range keys {
+		pairs = append(pairs, Pair{k, kv[k]})
+	}
+	return pairs
+}
+
+// Remove returns a copy of the set without the given keys.
+func (kv KV) Remove(keys []string) KV {
+	keySet := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		keySet[k] = true
+	}
+	res := KV{}
+	for k, v := range kv {
+		if !keySet[k] {
+			res[k] = v
+		}
+	}
+	return res
+}
+
+// Names returns the sorted names of the set.
+func (kv KV) Names() []string {
+	return kv.SortedPairs().Names()
+}
+
+// Values returns the values of the set, sorted by name.
+func (kv KV) Values() []string {
+	return kv.SortedPairs().Values()
+}
+
+// templateFuncs are the functions available to templates, in addition to the standard ones.
+var templateFuncs = map[string]interface{}{
+	"toUpper": strings.ToUpper,
+	"toLower": strings.ToLower,
+	"title":   strings.Title,
+	// join is equal to strings.Join but inverts the argument order for easier pipelining in templates.
+	"join": func(sep string, s []string) string {
+		return strings.Join(s, sep)
+	},
+	"match": regexp.MatchString,
+	"safeHtml": func(text string) html.HTML {
+		return html.HTML(text)
+	},
+	"reReplaceAll": func(pattern, repl, text string) string {
+		re := regexp.MustCompile(pattern)
+		return re.ReplaceAllString(text, repl)
+	},
+	"stringSlice": func(s ...string) []string {
+		return s
+	},
+}
+
+// templateData converts the payload from Alertmanager into the data passed to templates.
+func templateData(notif WebhookNotification) *Data {
+	data := &Data{
+		Receiver:          notif.Receiver,
+		Status:            notif.Status,
+		Alerts:            make(Alerts, 0, len(notif.Alerts)),
+		GroupLabels:       KV(notif.GroupLabels),
+		CommonLabels:      KV(notif.CommonLabels),
+		CommonAnnotations: KV(notif.CommonAnnotations),
+		ExternalURL:       notif.ExternalUrl,
+		Version:           notif.Version,
+		GroupKey:          notif.GroupKey,
+		ExternalUrl:       notif.ExternalUrl,
+	}
+	for _, a := range notif.Alerts {
+		alert := Alert{
+			Status:       a.Status,
+			Labels:       KV(a.Labels),
+			Annotations:  KV(a.Annotations),
+			GeneratorURL: a.GeneratorUrl,
+			Fingerprint:  a.Fingerprint,
+			GeneratorUrl: a.GeneratorUrl,
+		}
+		// Unparseable times are left as the zero time, as Alertmanager always sends RFC3339 times.
+		alert.StartsAt, _ = time.Parse(time.RFC3339, a.StartsAt)
+		alert.EndsAt, _ = time.Parse(time.RFC3339, a.EndsAt)
+		data.Alerts = append(data.Alerts, alert)
+	}
+	return data
+}
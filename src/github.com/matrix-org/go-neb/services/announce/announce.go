@@ -0,0 +1,494 @@
+// Package announce implements a Service which posts announcements to many rooms once a second person
+// has approved them.
+package announce
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+)
+
+// ServiceType of the Announce service
+const ServiceType = "announce"
+
+// allRoomsTarget is the target which sends an announcement to every room the service user is joined to.
+const allRoomsTarget = "all"
+
+// How long a draft can wait to be approved.
+const draftExpiry = 24 * time.Hour
+
+// The number of sent announcements whose delivery reports are kept.
+const maxSentDrafts = 20
+
+// Service contains the Config fields for the Announce service.
+//
+// Announcers draft an announcement with "!announce draft "text" to:target", which replies with a
+// preview. A different announcer must then approve it with "!announce approve <id>" within a day,
+// at which point it is posted to every room of the target and the approver is shown which rooms it
+// reached. Targets are named lists of rooms, which can refer to room groups and spaces. The target
+// "all" is every room which the service user is joined to.
+//
+// Example request:
+//   {
+//       announcers: ["@alice:example.com", "@bob:example.com"],
+//       targets: {
+//           "ops": ["group:ops"],
+//           "team": ["space:#team:example.com", "!lobby:example.com"]
+//       }
+//   }
+type Service struct {
+	types.DefaultService
+	types.CommandScope
+	// The users who can draft and approve announcements. There must be at least two, as nobody can
+	// approve their own announcement.
+	Announcers []string `json:"announcers"`
+	// Named lists of rooms which announcements can be sent to. Room group and space references are
+	// expanded in them. The name "all" is reserved.
+	Targets map[string][]string `json:"targets" rooms:"values"`
+	// Optional. The msgtype of announcements, either "m.text" or "m.notice". Defaults to "m.text".
+	MsgType string `json:"msg_type,omitempty"`
+	// The pending drafts and recently sent announcements. This is populated by Go-NEB.
+	Drafts []Draft `json:"drafts"`
+	// The ID of the last draft. This is populated by Go-NEB.
+	LastDraftID int `json:"last_draft_id"`
+}
+
+// Draft is an announcement which is waiting to be approved or has been sent.
+type Draft struct {
+	ID                   int    `json:"id"`
+	Text                 string `json:"text"`
+	Target               string `json:"target"`
+	DraftedBy            string `json:"drafted_by"`
+	DraftedTimestampSecs int64  `json:"drafted_ts_secs"`
+	// The user who approved the announcement. Empty until it is approved.
+	ApprovedBy string `json:"approved_by,omitempty"`
+	// The result of sending the announcement to each room.
+	Deliveries []Delivery `json:"deliveries,omitempty"`
+}
+
+// Delivery is the result of sending an announcement to a room.
+type Delivery struct {
+	RoomID string `json:"room_id"`
+	// The ID of the announcement in the room, if it was sent.
+	EventID string `json:"event_id,omitempty"`
+	// Why the announcement could not be sent, if it wasn't.
+	Error string `json:"error,omitempty"`
+}
+
+// Register makes sure the Config information supplied is valid. Drafts are kept when the service is
+// configured again.
+func (s *Service) Register(oldService types.Service, client *gomatrix.Client) error {
+	if len(s.Announcers) < 2 {
+		return errors.New("At least two announcers must be specified")
+	}
+	if len(s.Targets) == 0 {
+		return errors.New("At least one target must be specified")
+	}
+	if _, ok := s.Targets[allRoomsTarget]; ok {
+		return fmt.Errorf("The target name '%s' is reserved", allRoomsTarget)
+	}
+	if s.MsgType != "" && s.MsgType != "m.text" && s.MsgType != "m.notice" {
+		return errors.New("msg_type is neither 'm.text' nor 'm.notice'")
+	}
+	if old, ok := oldService.(*Service); ok && s.Drafts == nil {
+		s.Drafts = old.Drafts
+		s.LastDraftID = old.LastDraftID
+	}
+	return nil
+}
+
+// Commands supported:
+//    !announce draft "Some text" to:target
+//    !announce preview 3
+//    !announce approve 3
+//    !announce cancel 3
+//    !announce list
+func (s *Service) Commands(cli *gomatrix.Client) []types.Command {
+	return []types.Command{
+		types.Command{
+			Path:      []string{"announce", "draft"},
+			Arguments: []string{"text", "to:target"},
+			Help:      "Draft an announcement, which another announcer must approve.",
+			Command: func(roomID, userID string, args []string) (interface{}, error) {
+				return s.cmdDraft(cli, userID, args)
+			},
+		},
+		types.Command{
+			Path:      []string{"announce", "preview"},
+			Arguments: []string{"id"},
+			Help:      "Show an announcement and, once it has been sent, which rooms it reached.",
+			Command: func(roomID, userID string, args []string) (interface{}, error) {
+				return s.cmdPreview(cli, args)
+			},
+		},
+		types.Command{
+			Path:      []string{"announce", "approve"},
+			Arguments: []string{"id"},
+			Help:      "Approve and send another announcer's draft.",
+			Command: func(roomID, userID string, args []string) (interface{}, error) {
+				return s.cmdApprove(cli, userID, args)
+			},
+		},
+		types.Command{
+			Path:      []string{"announce", "cancel"},
+			Arguments: []string{"id"},
+			Help:      "Discard a draft.",
+			Command: func(roomID, userID string, args []string) (interface{}, error) {
+				return s.cmdCancel(userID, args)
+			},
+		},
+		types.Command{
+			Path: []string{"announce", "list"},
+			Help: "List the drafts which are waiting to be approved.",
+			Command: func(roomID, userID string, args []string) (interface{}, error) {
+				return s.cmdList()
+			},
+		},
+	}
+}
+
+func (s *Service) cmdDraft(cli *gomatrix.Client, userID string, args []string) (interface{}, error) {
+	if !s.isAnnouncer(userID) {
+		return nil, errors.New("You are not allowed to make announcements")
+	}
+	usage := errors.New(`Usage: !announce draft "text" to:target`)
+	if len(args) < 2 || !strings.HasPrefix(args[len(args)-1], "to:") {
+		return nil, usage
+	}
+	text := strings.Join(args[:len(args)-1], " ")
+	target := strings.TrimPrefix(args[len(args)-1], "to:")
+	if text == "" {
+		return nil, usage
+	}
+	rooms, err := s.targetRooms(cli, target)
+	if err != nil {
+		return nil, err
+	}
+
+	var draft Draft
+	now := time.Now()
+	err = s.modify(func(srv *Service) {
+		srv.removeExpiredDrafts(now)
+		srv.LastDraftID++
+		draft = Draft{
+			ID:                   srv.LastDraftID,
+			Text:                 text,
+			Target:               target,
+			DraftedBy:            userID,
+			DraftedTimestampSecs: now.Unix(),
+		}
+		srv.Drafts = append(srv.Drafts, draft)
+	})
+	if err != nil {
+		log.WithError(err).WithField("service_id", s.ServiceID()).Error("Failed to store draft")
+		return nil, errors.New("Failed to store the draft")
+	}
+	return notice(preview(draft, len(rooms))), nil
+}
+
+func (s *Service) cmdPreview(cli *gomatrix.Client, args []string) (interface{}, error) {
+	draft, err := s.findDraft(args, "preview")
+	if err != nil {
+		return nil, err
+	}
+	if draft.ApprovedBy != "" {
+		return notice(deliveryReport(draft)), nil
+	}
+	rooms, err := s.targetRooms(cli, draft.Target)
+	if err != nil {
+		return nil, err
+	}
+	return notice(preview(draft, len(rooms))), nil
+}
+
+func (s *Service) cmdApprove(cli *gomatrix.Client, userID string, args []string) (interface{}, error) {
+	if !s.isAnnouncer(userID) {
+		return nil, errors.New("You are not allowed to approve announcements")
+	}
+	draft, err := s.findDraft(args, "approve")
+	if err != nil {
+		return nil, err
+	}
+	rooms, err := s.targetRooms(cli, draft.Target)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = s.approve(draft.ID, userID); err != nil {
+		return nil, err
+	}
+	draft.ApprovedBy = userID
+	draft.Deliveries = s.deliver(cli, draft.Text, rooms)
+
+	err = s.modify(func(srv *Service) {
+		if d := srv.draft(draft.ID); d != nil {
+			d.Deliveries = draft.Deliveries
+		}
+		srv.removeOldAnnouncements()
+	})
+	if err != nil {
+		log.WithError(err).WithField("service_id", s.ServiceID()).Error("Failed to store delivery report")
+	}
+	return notice(deliveryReport(draft)), nil
+}
+
+// approve marks the draft as approved by the user. The latest version of the draft is approved, so that
+// two announcers approving at once only send it once.
+func (s *Service) approve(draftID int, userID string) error {
+	var approveErr error
+	err := s.modify(func(srv *Service) {
+		d := srv.draft(draftID)
+		switch {
+		case d == nil:
+			approveErr = fmt.Errorf("There is no draft #%d", draftID)
+		case d.ApprovedBy != "":
+			approveErr = fmt.Errorf("Draft #%d has already been approved by %s", d.ID, d.ApprovedBy)
+		case d.DraftedBy == userID:
+			approveErr = errors.New("Another announcer must approve your draft")
+		case isExpired(*d, time.Now()):
+			approveErr = fmt.Errorf("Draft #%d has expired", d.ID)
+		default:
+			d.ApprovedBy = userID
+		}
+	})
+	if err != nil {
+		log.WithError(err).WithField("service_id", s.ServiceID()).Error("Failed to store approval")
+		return errors.New("Failed to approve the draft")
+	}
+	return approveErr
+}
+
+// deliver sends the announcement to each room, and returns the result for each room.
+func (s *Service) deliver(cli *gomatrix.Client, text string, rooms []string) []Delivery {
+	msgType := s.MsgType
+	if msgType == "" {
+		msgType = "m.text"
+	}
+	var deliveries []Delivery
+	for _, roomID := range rooms {
+		delivery := Delivery{RoomID: roomID}
+		res, err := cli.SendMessageEvent(roomID, "m.room.message", gomatrix.TextMessage{MsgType: msgType, Body: text})
+		if err != nil {
+			delivery.Error = err.Error()
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+				"service_id": s.ServiceID(),
+			}).Warn("Failed to send announcement")
+		} else {
+			delivery.EventID = res.EventID
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries
+}
+
+func (s *Service) cmdCancel(userID string, args []string) (interface{}, error) {
+	if !s.isAnnouncer(userID) {
+		return nil, errors.New("You are not allowed to cancel announcements")
+	}
+	draft, err := s.findDraft(args, "cancel")
+	if err != nil {
+		return nil, err
+	}
+	if draft.ApprovedBy != "" {
+		return nil, fmt.Errorf("Draft #%d has already been sent", draft.ID)
+	}
+	err = s.modify(func(srv *Service) {
+		var drafts []Draft
+		for _, d := range srv.Drafts {
+			if d.ID != draft.ID || d.ApprovedBy != "" {
+				drafts = append(drafts, d)
+			}
+		}
+		srv.Drafts = drafts
+	})
+	if err != nil {
+		log.WithError(err).WithField("service_id", s.ServiceID()).Error("Failed to remove draft")
+		return nil, errors.New("Failed to cancel the draft")
+	}
+	return notice(fmt.Sprintf("Cancelled draft #%d", draft.ID)), nil
+}
+
+func (s *Service) cmdList() (interface{}, error) {
+	var lines []string
+	now := time.Now()
+	for _, d := range s.Drafts {
+		if d.ApprovedBy == "" && !isExpired(d, now) {
+			lines = append(lines, fmt.Sprintf("#%d by %s to %s: %s", d.ID, d.DraftedBy, d.Target, d.Text))
+		}
+	}
+	if len(lines) == 0 {
+		return notice("There are no drafts waiting to be approved"), nil
+	}
+	return notice("Drafts waiting to be approved:\n" + strings.Join(lines, "\n")), nil
+}
+
+// findDraft returns the draft with the ID given as the only argument of the command.
+func (s *Service) findDraft(args []string, command string) (Draft, error) {
+	if len(args) != 1 {
+		return Draft{}, fmt.Errorf("Usage: !announce %s <id>", command)
+	}
+	id, err := strconv.Atoi(strings.TrimPrefix(args[0], "#"))
+	if err != nil {
+		return Draft{}, fmt.Errorf("Usage: !announce %s <id>", command)
+	}
+	d := s.draft(id)
+	if d == nil || (d.ApprovedBy == "" && isExpired(*d, time.Now())) {
+		return Draft{}, fmt.Errorf("There is no draft #%d", id)
+	}
+	return *d, nil
+}
+
+// targetRooms returns the sorted room IDs of the target.
+func (s *Service) targetRooms(cli *gomatrix.Client, target string) ([]string, error) {
+	var rooms []string
+	if target == allRoomsTarget {
+		resBody, err := cli.SendJSON("GET", cli.BuildURL("joined_rooms"), nil)
+		if err != nil {
+			return nil, errors.New("Failed to load the rooms I am in")
+		}
+		var res struct {
+			JoinedRooms []string `json:"joined_rooms"`
+		}
+		if err := json.Unmarshal(resBody, &res); err != nil {
+			return nil, errors.New("Failed to load the rooms I am in")
+		}
+		rooms = res.JoinedRooms
+	} else {
+		var ok bool
+		if rooms, ok = s.Targets[target]; !ok {
+			var names []string
+			for name := range s.Targets {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return nil, fmt.Errorf("Unknown target '%s'. Announcements can be sent to: %s, %s", target, strings.Join(names, ", "), allRoomsTarget)
+		}
+	}
+	seen := make(map[string]bool)
+	var unique []string
+	for _, roomID := range rooms {
+		if !seen[roomID] {
+			seen[roomID] = true
+			unique = append(unique, roomID)
+		}
+	}
+	sort.Strings(unique)
+	return unique, nil
+}
+
+func (s *Service) isAnnouncer(userID string) bool {
+	for _, u := range s.Announcers {
+		if u == userID {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Service) draft(id int) *Draft {
+	for i := range s.Drafts {
+		if s.Drafts[i].ID == id {
+			return &s.Drafts[i]
+		}
+	}
+	return nil
+}
+
+func (s *Service) removeExpiredDrafts(now time.Time) {
+	var drafts []Draft
+	for _, d := range s.Drafts {
+		if d.ApprovedBy != "" || !isExpired(d, now) {
+			drafts = append(drafts, d)
+		}
+	}
+	s.Drafts = drafts
+}
+
+// removeOldAnnouncements forgets the delivery reports of all but the most recently sent announcements.
+func (s *Service) removeOldAnnouncements() {
+	sent := 0
+	for _, d := range s.Drafts {
+		if d.ApprovedBy != "" {
+			sent++
+		}
+	}
+	var drafts []Draft
+	for _, d := range s.Drafts {
+		if d.ApprovedBy != "" && sent > maxSentDrafts {
+			sent--
+			continue
+		}
+		drafts = append(drafts, d)
+	}
+	s.Drafts = drafts
+}
+
+// modify applies fn to the stored version of this service and stores it. The drafts of this instance
+// are replaced with the modified drafts. fn is only called once, so it can return results by setting
+// variables.
+func (s *Service) modify(fn func(srv *Service)) error {
+	stored, err := database.GetServiceDB().ModifyService(s.ServiceID(), func(service types.Service) error {
+		srv, ok := service.(*Service)
+		if !ok {
+			return fmt.Errorf("service %s is not an announce service", s.ServiceID())
+		}
+		fn(srv)
+		return nil
+	})
+	if srv, ok := stored.(*Service); ok {
+		s.Drafts = srv.Drafts
+		s.LastDraftID = srv.LastDraftID
+	}
+	return err
+}
+
+func isExpired(d Draft, now time.Time) bool {
+	return now.Sub(time.Unix(d.DraftedTimestampSecs, 0)) > draftExpiry
+}
+
+func preview(d Draft, numRooms int) string {
+	return fmt.Sprintf(
+		"Draft #%d by %s to %s (%d rooms):\n\n%s\n\nAnother announcer can send it with: !announce approve %d",
+		d.ID, d.DraftedBy, d.Target, numRooms, d.Text, d.ID,
+	)
+}
+
+func deliveryReport(d Draft) string {
+	delivered := 0
+	var lines []string
+	for _, delivery := range d.Deliveries {
+		if delivery.Error == "" {
+			delivered++
+			lines = append(lines, "✓ "+delivery.RoomID)
+		} else {
+			lines = append(lines, "✗ "+delivery.RoomID+": "+delivery.Error)
+		}
+	}
+	return fmt.Sprintf(
+		"Announcement #%d by %s, approved by %s, was delivered to %d of %d rooms in %s:\n%s",
+		d.ID, d.DraftedBy, d.ApprovedBy, delivered, len(d.Deliveries), d.Target, strings.Join(lines, "\n"),
+	)
+}
+
+func notice(body string) *gomatrix.TextMessage {
+	return &gomatrix.TextMessage{MsgType: "m.notice", Body: body}
+}
+
+func init() {
+	types.RegisterService(func(serviceID, serviceUserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
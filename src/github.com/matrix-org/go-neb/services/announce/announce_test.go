@@ -0,0 +1,192 @@
+package announce
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+)
+
+// serviceStorage stores a single service in memory.
+type serviceStorage struct {
+	database.NopStorage
+	service types.Service
+}
+
+func (s *serviceStorage) LoadService(serviceID string) (types.Service, error) {
+	if s.service == nil {
+		return nil, errors.New("no service")
+	}
+	// round trip through JSON so that each load is a separate instance, as with a real database
+	b, _ := json.Marshal(s.service)
+	return types.CreateService(s.service.ServiceID(), s.service.ServiceType(), s.service.ServiceUserID(), b)
+}
+
+func (s *serviceStorage) StoreService(service types.Service) (types.Service, error) {
+	old := s.service
+	s.service = service
+	return old, nil
+}
+
+func (s *serviceStorage) ModifyService(serviceID string, fn func(types.Service) error) (types.Service, error) {
+	srv, err := s.LoadService(serviceID)
+	if err != nil {
+		return nil, err
+	}
+	if err = fn(srv); err != nil {
+		return nil, err
+	}
+	s.service = srv
+	return srv, nil
+}
+
+// runCommand runs the announce command with the given path and arguments as the given user.
+func runCommand(t *testing.T, store *serviceStorage, cli *gomatrix.Client, userID string, args ...string) (string, error) {
+	srv, err := store.LoadService("announce")
+	if err != nil {
+		t.Fatal("Failed to load announce service: ", err)
+	}
+	for _, cmd := range srv.Commands(cli) {
+		if cmd.Matches(args) {
+			res, err := cmd.Command("!control:hyrule", userID, args[len(cmd.Path):])
+			if err != nil {
+				return "", err
+			}
+			return res.(*gomatrix.TextMessage).Body, nil
+		}
+	}
+	t.Fatalf("No command matches %v", args)
+	return "", nil
+}
+
+// announceClient returns a client which is joined to !control:hyrule, !a:hyrule and !b:hyrule, and records
+// the rooms it sends messages to in sentTo. Sending to !b:hyrule fails.
+func announceClient(sentTo *[]string) *gomatrix.Client {
+	cli, _ := gomatrix.NewClient("https://hyrule", "@announcer:hyrule", "its_a_secret")
+	cli.Client = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		if req.Method == "GET" && req.URL.Path == "/_matrix/client/r0/joined_rooms" {
+			body := `{"joined_rooms":["!control:hyrule","!a:hyrule","!b:hyrule"]}`
+			return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(body))}, nil
+		}
+		if req.Method != "PUT" || !strings.Contains(req.URL.Path, "/send/m.room.message/") {
+			return nil, errors.New("Unhandled matrix client test request")
+		}
+		roomID := strings.Split(req.URL.Path, "/")[5]
+		*sentTo = append(*sentTo, roomID)
+		if roomID == "!b:hyrule" {
+			body := `{"errcode":"M_FORBIDDEN","error":"You are not in this room"}`
+			return &http.Response{StatusCode: 403, Body: ioutil.NopCloser(bytes.NewBufferString(body))}, nil
+		}
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$1:hyrule"}`))}, nil
+	})}
+	return cli
+}
+
+func TestAnnounce(t *testing.T) {
+	var sentTo []string
+	cli := announceClient(&sentTo)
+	srv, err := types.CreateService("announce", ServiceType, "@announcer:hyrule", []byte(`{
+		"announcers": ["@alice:hyrule", "@bob:hyrule"],
+		"targets": {"ops": ["!a:hyrule", "!b:hyrule", "!a:hyrule"]}
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create announce service: ", err)
+	}
+	if err := srv.Register(nil, cli); err != nil {
+		t.Fatal("Failed to register announce service: ", err)
+	}
+	store := &serviceStorage{service: srv}
+	database.SetServiceDB(store)
+
+	checkDrafting(t, store, cli)
+	if len(sentTo) != 0 {
+		t.Fatalf("TestAnnounce: wanted nothing to be sent before approval, sent to %v", sentTo)
+	}
+
+	res, err := runCommand(t, store, cli, "@bob:hyrule", "announce", "approve", "1")
+	wantReport := "Announcement #1 by @alice:hyrule, approved by @bob:hyrule, was delivered to 1 of 2 rooms in ops:\n✓ !a:hyrule\n✗ !b:hyrule: "
+	if err != nil || !strings.HasPrefix(res, wantReport) {
+		t.Errorf("TestAnnounce: wanted a delivery report, got %q (err=%v)", res, err)
+	}
+	if strings.Join(sentTo, " ") != "!a:hyrule !b:hyrule" {
+		t.Errorf("TestAnnounce: wanted the announcement to be sent to each room once, sent to %v", sentTo)
+	}
+	if _, err = runCommand(t, store, cli, "@bob:hyrule", "announce", "approve", "1"); err == nil {
+		t.Errorf("TestAnnounce: wanted an error approving a sent announcement")
+	}
+	if res, _ = runCommand(t, store, cli, "@alice:hyrule", "announce", "preview", "#1"); !strings.HasPrefix(res, wantReport) {
+		t.Errorf("TestAnnounce: wanted the preview of a sent announcement to be its delivery report, got %q", res)
+	}
+
+	checkUnapprovable(t, store, cli)
+	if len(sentTo) != 2 {
+		t.Errorf("TestAnnounce: wanted nothing else to be sent, sent to %v", sentTo)
+	}
+}
+
+// checkDrafting checks that only announcers can draft announcements to known targets, and drafts #1 to ops.
+func checkDrafting(t *testing.T, store *serviceStorage, cli *gomatrix.Client) {
+	if _, err := runCommand(t, store, cli, "@mallory:hyrule", "announce", "draft", "Free cake", "to:ops"); err == nil {
+		t.Errorf("TestAnnounce: wanted an error drafting as a user who isn't an announcer")
+	}
+	if _, err := runCommand(t, store, cli, "@alice:hyrule", "announce", "draft", "Maintenance", "to:nowhere"); err == nil {
+		t.Errorf("TestAnnounce: wanted an error drafting to an unknown target")
+	}
+	res, err := runCommand(t, store, cli, "@alice:hyrule", "announce", "draft", "Maintenance at noon", "to:ops")
+	if err != nil || !strings.Contains(res, "Draft #1 by @alice:hyrule to ops (2 rooms):\n\nMaintenance at noon") {
+		t.Fatalf("TestAnnounce: wanted a preview of draft #1, got %q (err=%v)", res, err)
+	}
+	if res, _ = runCommand(t, store, cli, "@bob:hyrule", "announce", "list"); !strings.Contains(res, "#1 by @alice:hyrule to ops: Maintenance at noon") {
+		t.Errorf("TestAnnounce: wanted draft #1 to be listed, got %q", res)
+	}
+	if _, err = runCommand(t, store, cli, "@alice:hyrule", "announce", "approve", "1"); err == nil {
+		t.Errorf("TestAnnounce: wanted an error approving your own draft")
+	}
+}
+
+// checkUnapprovable checks that cancelled and expired drafts can't be approved.
+func checkUnapprovable(t *testing.T, store *serviceStorage, cli *gomatrix.Client) {
+	res, err := runCommand(t, store, cli, "@bob:hyrule", "announce", "draft", "Hello", "everyone", "to:all")
+	if err != nil || !strings.Contains(res, "Draft #2 by @bob:hyrule to all (3 rooms):\n\nHello everyone") {
+		t.Errorf("TestAnnounce: wanted a preview of draft #2 to all rooms, got %q (err=%v)", res, err)
+	}
+	if _, err = runCommand(t, store, cli, "@alice:hyrule", "announce", "cancel", "2"); err != nil {
+		t.Errorf("TestAnnounce: failed to cancel draft #2: %s", err)
+	}
+	if _, err = runCommand(t, store, cli, "@alice:hyrule", "announce", "approve", "2"); err == nil {
+		t.Errorf("TestAnnounce: wanted an error approving a cancelled draft")
+	}
+
+	runCommand(t, store, cli, "@alice:hyrule", "announce", "draft", "Old news", "to:ops")
+	announce := store.service.(*Service)
+	announce.Drafts[len(announce.Drafts)-1].DraftedTimestampSecs = time.Now().Add(-draftExpiry - time.Minute).Unix()
+	if _, err = runCommand(t, store, cli, "@bob:hyrule", "announce", "approve", "3"); err == nil {
+		t.Errorf("TestAnnounce: wanted an error approving an expired draft")
+	}
+}
+
+func TestRegister(t *testing.T) {
+	for _, config := range []string{
+		`{"announcers": ["@alice:hyrule"], "targets": {"ops": ["!a:hyrule"]}}`,
+		`{"announcers": ["@alice:hyrule", "@bob:hyrule"], "targets": {}}`,
+		`{"announcers": ["@alice:hyrule", "@bob:hyrule"], "targets": {"all": ["!a:hyrule"]}}`,
+		`{"announcers": ["@alice:hyrule", "@bob:hyrule"], "targets": {"ops": ["!a:hyrule"]}, "msg_type": "m.emote"}`,
+	} {
+		srv, err := types.CreateService("announce", ServiceType, "@announcer:hyrule", []byte(config))
+		if err != nil {
+			t.Fatal("Failed to create announce service: ", err)
+		}
+		if err := srv.Register(nil, nil); err == nil {
+			t.Errorf("TestRegister: wanted an error registering %s", config)
+		}
+	}
+}
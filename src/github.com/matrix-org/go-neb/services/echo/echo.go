@@ -14,6 +14,7 @@ const ServiceType = "echo"
 // Service represents the Echo service. It has no Config fields.
 type Service struct {
 	types.DefaultService
+	types.CommandScope
 }
 
 // Commands supported:
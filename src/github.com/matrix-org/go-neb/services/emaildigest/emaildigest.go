@@ -0,0 +1,797 @@
+// Package emaildigest implements a Service which emails users a periodic digest of the
+// notifications and mentions they missed in Matrix rooms.
+package emaildigest
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+)
+
+// ServiceType of the Email Digest service
+const ServiceType = "email-digest"
+
+// The default time between digests, if none is configured.
+const defaultIntervalMins = 60 * 24
+
+// The smallest allowed time between digests.
+const minIntervalMins = 5
+
+// The maximum number of items which are remembered for a single subscriber between digests.
+// Older items are discarded first.
+const maxPendingItems = 200
+
+// How long a subscription confirmation link can be used for.
+const confirmationValidity = 24 * time.Hour
+
+// sendMail is the function used to deliver emails. It is a variable so tests can replace it.
+var sendMail = smtp.SendMail
+
+// Service contains the Config fields for the Email Digest service.
+//
+// This service watches the configured rooms for notices (e.g. notifications sent by other
+// Go-NEB services) and for messages which mention subscribed users. Every interval_mins,
+// each subscriber with outstanding items is sent a single email with text and HTML parts
+// summarising them. Each email contains an unsubscribe link which is served by Go-NEB. Opening
+// the link shows a confirmation page, and mail clients can unsubscribe in one click with a POST
+// as described in RFC 8058.
+//
+// Users opt in by typing "!digest subscribe alice@example.com" in a room which is listed in
+// Rooms. This emails a confirmation link to the address, and the subscription only starts once
+// the link has been opened and confirmed, so users can't sign up addresses which aren't theirs.
+// The service user must be a syncing client which is joined to those rooms.
+//
+// Items which have not been emailed yet are stored with the service, so they are kept if Go-NEB
+// restarts.
+//
+// Example request:
+//   {
+//       smtp: {
+//           host: "smtp.example.com",
+//           port: 587,
+//           username: "neb",
+//           password: "secret",
+//           from: "Go-NEB <neb@example.com>"
+//       },
+//       rooms: ["!qmElAGdFYCHoCJuaNt:localhost"],
+//       interval_mins: 1440
+//   }
+type Service struct {
+	types.DefaultService
+	types.CommandScope
+	webhookEndpointURL string
+	// The SMTP server to send emails through.
+	SMTP struct {
+		// The hostname of the SMTP server.
+		Host string `json:"host"`
+		// Optional. The port of the SMTP server. Defaults to 25.
+		Port int `json:"port"`
+		// Optional. The username to authenticate with. If empty, no authentication is performed.
+		Username string `json:"username"`
+		// Optional. The password to authenticate with.
+		Password string `json:"password"`
+		// The address to send emails from.
+		From string `json:"from"`
+	} `json:"smtp"`
+	// The list of rooms which subscribers can receive digests for. This cannot be empty.
+	Rooms []string `json:"rooms" rooms:"values"`
+	// Optional. The number of minutes between digests. Defaults to 1 day.
+	IntervalMins int `json:"interval_mins"`
+	// A map of Matrix user ID to subscription information. This is usually populated by users
+	// typing "!digest subscribe", but can be supplied directly.
+	Subscribers map[string]Subscriber `json:"subscribers"`
+	// The secret used to sign unsubscribe and confirmation links. This is populated by Go-NEB and
+	// is not included in admin API responses.
+	UnsubscribeSecret string `json:"unsubscribe_secret"`
+	// The time the last digests were sent. This is populated by Go-NEB.
+	LastDigestTimestampSecs int64 `json:"last_digest_ts_secs"`
+	// A map of Matrix user ID to the items which have not been emailed to them yet. This is
+	// populated by Go-NEB.
+	Pending map[string][]digestItem `json:"pending"`
+}
+
+// Subscriber is a single user who has opted in to email digests.
+type Subscriber struct {
+	// The email address to send digests to.
+	Email string `json:"email"`
+	// The rooms to include in the digest. This must be a subset of the service's rooms.
+	// If empty, all of the service's rooms are included.
+	Rooms []string `json:"rooms" rooms:"values"`
+}
+
+// digestItem is a single notification or mention which will be included in a digest.
+type digestItem struct {
+	RoomID    string
+	Sender    string
+	Body      string
+	Mention   bool
+	Timestamp time.Time
+}
+
+// Register validates the config and generates an unsubscribe secret if there isn't one.
+func (s *Service) Register(oldService types.Service, client *gomatrix.Client) error {
+	if err := s.validate(); err != nil {
+		return err
+	}
+
+	// Keep the existing secret so previously sent unsubscribe links keep working.
+	if old, ok := oldService.(*Service); ok && s.UnsubscribeSecret == "" {
+		s.UnsubscribeSecret = old.UnsubscribeSecret
+	}
+	if s.UnsubscribeSecret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return err
+		}
+		s.UnsubscribeSecret = hex.EncodeToString(secret)
+	}
+
+	// Keep the items which haven't been emailed yet for users who are still subscribed.
+	if old, ok := oldService.(*Service); ok && s.Pending == nil {
+		for userID, items := range old.Pending {
+			if _, ok := s.Subscribers[userID]; ok {
+				s.addPending(userID, items...)
+			}
+		}
+	}
+
+	s.joinRooms(client)
+	return nil
+}
+
+func (s *Service) validate() error {
+	if s.SMTP.Host == "" || s.SMTP.From == "" {
+		return errors.New("An SMTP host and from address must be specified")
+	}
+	if _, err := mail.ParseAddress(s.SMTP.From); err != nil {
+		return fmt.Errorf("Invalid from address: %s", err.Error())
+	}
+	if len(s.Rooms) == 0 {
+		return errors.New("At least one room must be specified")
+	}
+	if s.IntervalMins != 0 && s.IntervalMins < minIntervalMins {
+		return fmt.Errorf("interval_mins must be at least %d", minIntervalMins)
+	}
+	for userID, sub := range s.Subscribers {
+		if _, err := mail.ParseAddress(sub.Email); err != nil {
+			return fmt.Errorf("Subscriber %s has an invalid email address: %s", userID, err.Error())
+		}
+		for _, roomID := range sub.Rooms {
+			if !s.hasRoom(roomID) {
+				return fmt.Errorf("Subscriber %s is subscribed to room %s which is not in rooms", userID, roomID)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Service) joinRooms(client *gomatrix.Client) {
+	for _, roomID := range s.Rooms {
+		if _, err := client.JoinRoom(roomID, "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+				"user_id":    client.UserID,
+			}).Error("Failed to join room")
+		}
+	}
+}
+
+// Commands supported:
+//    !digest subscribe alice@example.com
+// Emails a link which subscribes the user to digests for the current room, sent to the given
+// email address.
+//    !digest unsubscribe
+// Stops including the current room in the user's digests.
+func (s *Service) Commands(cli *gomatrix.Client) []types.Command {
+	return []types.Command{
+		types.Command{
+			Path: []string{"digest", "subscribe"},
+			Command: func(roomID, userID string, args []string) (interface{}, error) {
+				return s.cmdSubscribe(roomID, userID, args)
+			},
+		},
+		types.Command{
+			Path: []string{"digest", "unsubscribe"},
+			Command: func(roomID, userID string, args []string) (interface{}, error) {
+				return s.cmdUnsubscribe(roomID, userID, args)
+			},
+		},
+		types.Command{
+			Path: []string{"digest", "help"},
+			Command: func(roomID, userID string, args []string) (interface{}, error) {
+				return &gomatrix.TextMessage{
+					MsgType: "m.notice",
+					Body:    "Usage: !digest subscribe email@address | !digest unsubscribe",
+				}, nil
+			},
+		},
+	}
+}
+
+func (s *Service) cmdSubscribe(roomID, userID string, args []string) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Usage: !digest subscribe email@address")
+	}
+	addr, err := mail.ParseAddress(args[0])
+	if err != nil {
+		return nil, errors.New("That doesn't look like a valid email address")
+	}
+	if !s.hasRoom(roomID) {
+		return nil, errors.New("Email digests are not enabled for this room")
+	}
+
+	expires := time.Now().Add(confirmationValidity).Unix()
+	if err = s.sendConfirmation(userID, addr.Address, roomID, expires); err != nil {
+		log.WithFields(log.Fields{
+			log.ErrorKey: err,
+			"service_id": s.ServiceID(),
+			"user_id":    userID,
+		}).Error("Failed to send confirmation email")
+		return nil, errors.New("Failed to send the confirmation email")
+	}
+	// Only the user who asked needs to know which address they used.
+	return types.PrivateResponse(&gomatrix.TextMessage{
+		MsgType: "m.notice",
+		Body: fmt.Sprintf(
+			"A confirmation link has been emailed to %s. Open it to start receiving email digests for this room.",
+			addr.Address,
+		),
+	}), nil
+}
+
+func (s *Service) cmdUnsubscribe(roomID, userID string, args []string) (interface{}, error) {
+	if _, ok := s.Subscribers[userID]; !ok {
+		return nil, errors.New("You are not subscribed to email digests")
+	}
+	err := s.modify(func(srv *Service) {
+		sub, ok := srv.Subscribers[userID]
+		if !ok {
+			return
+		}
+		var rooms []string
+		for _, r := range sub.Rooms {
+			if r != roomID {
+				rooms = append(rooms, r)
+			}
+		}
+		if len(rooms) == 0 {
+			delete(srv.Subscribers, userID)
+			delete(srv.Pending, userID)
+			return
+		}
+		sub.Rooms = rooms
+		srv.Subscribers[userID] = sub
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &gomatrix.TextMessage{
+		MsgType: "m.notice",
+		Body:    "This room will no longer be included in your email digests.",
+	}, nil
+}
+
+// OnMessageEvent records notices and mentions in the configured rooms for each subscriber.
+func (s *Service) OnMessageEvent(cli *gomatrix.Client, event *gomatrix.Event) {
+	if !s.hasRoom(event.RoomID) {
+		return
+	}
+	body, ok := event.Body()
+	if !ok || body == "" {
+		return
+	}
+	items := s.digestItems(event, body)
+	if len(items) == 0 {
+		return
+	}
+	err := s.modify(func(srv *Service) {
+		for userID, item := range items {
+			srv.addPending(userID, item)
+		}
+	})
+	if err != nil {
+		log.WithError(err).WithField("service_id", s.ServiceID()).Error("Failed to store digest items")
+	}
+}
+
+// digestItems returns the digest item for the message event for each subscriber who should be told
+// about it: because it is a notice, or because it mentions them.
+func (s *Service) digestItems(event *gomatrix.Event, body string) map[string]digestItem {
+	msgtype, _ := event.MessageType()
+	formattedBody, _ := event.Content["formatted_body"].(string)
+
+	items := make(map[string]digestItem)
+	for userID, sub := range s.Subscribers {
+		if event.Sender == userID {
+			continue
+		}
+		if len(sub.Rooms) > 0 && !containsString(sub.Rooms, event.RoomID) {
+			continue
+		}
+		mention := strings.Contains(body, userID) || strings.Contains(formattedBody, userID)
+		if msgtype != "m.notice" && !mention {
+			continue
+		}
+		items[userID] = digestItem{
+			RoomID:    event.RoomID,
+			Sender:    event.Sender,
+			Body:      body,
+			Mention:   mention,
+			Timestamp: time.Unix(0, int64(event.Timestamp)*int64(time.Millisecond)),
+		}
+	}
+	return items
+}
+
+// OnPoll sends a digest to every subscriber who has outstanding items, if the interval has elapsed.
+func (s *Service) OnPoll(cli *gomatrix.Client) time.Time {
+	logger := log.WithFields(log.Fields{
+		"service_id":   s.ServiceID(),
+		"service_type": s.ServiceType(),
+	})
+	// The poller holds onto the service it was started with, so reload it to pick up
+	// subscriptions which have been made since.
+	srv := s
+	if latest, err := database.GetServiceDB().LoadService(s.ServiceID()); err == nil {
+		if digestSrv, ok := latest.(*Service); ok {
+			srv = digestSrv
+		}
+	}
+
+	now := time.Now()
+	next := time.Unix(srv.LastDigestTimestampSecs, 0).Add(srv.interval())
+	if now.Before(next) {
+		return next
+	}
+
+	srv.sendDigests()
+
+	err := srv.modify(func(stored *Service) {
+		stored.LastDigestTimestampSecs = now.Unix()
+	})
+	if err != nil {
+		logger.WithError(err).Error("Failed to persist last digest time")
+	}
+	return now.Add(srv.interval())
+}
+
+func (s *Service) sendDigests() {
+	var pending map[string][]digestItem
+	err := s.modify(func(srv *Service) {
+		pending = srv.Pending
+		srv.Pending = nil
+	})
+	if err != nil {
+		log.WithError(err).WithField("service_id", s.ServiceID()).Error("Failed to take digest items")
+		return
+	}
+
+	failed := make(map[string][]digestItem)
+	for userID, items := range pending {
+		sub, ok := s.Subscribers[userID]
+		if !ok || len(items) == 0 {
+			continue
+		}
+		logger := log.WithFields(log.Fields{
+			"service_id": s.ServiceID(),
+			"user_id":    userID,
+			"items":      len(items),
+		})
+		if err := s.sendDigest(userID, sub.Email, items); err != nil {
+			logger.WithError(err).Error("Failed to send email digest")
+			failed[userID] = items
+			continue
+		}
+		logger.Info("Sent email digest")
+	}
+	if len(failed) == 0 {
+		return
+	}
+
+	// put them back so they are included next time, before any items which arrived since
+	err = s.modify(func(srv *Service) {
+		for userID, items := range failed {
+			newer := srv.Pending[userID]
+			delete(srv.Pending, userID)
+			srv.addPending(userID, append(items, newer...)...)
+		}
+	})
+	if err != nil {
+		log.WithError(err).WithField("service_id", s.ServiceID()).Error("Failed to store unsent digest items")
+	}
+}
+
+func (s *Service) sendDigest(userID, email string, items []digestItem) error {
+	msg, err := s.buildEmail(userID, email, items)
+	if err != nil {
+		return err
+	}
+	return s.deliver(email, msg)
+}
+
+// sendConfirmation emails a link which subscribes the user to digests of the room when it is confirmed.
+func (s *Service) sendConfirmation(userID, email, roomID string, expires int64) error {
+	var body bytes.Buffer
+	qp := quotedprintable.NewWriter(&body)
+	fmt.Fprintf(
+		qp, "%s asked for email digests of the notifications they miss in %s to be sent to this address.\r\n\r\n",
+		userID, roomID,
+	)
+	fmt.Fprintf(qp, "To confirm, visit: %s\r\n\r\n", s.confirmURL(userID, email, roomID, expires))
+	fmt.Fprintf(
+		qp, "If this wasn't you, ignore this email and nothing more will be sent. The link expires at %s.\r\n",
+		time.Unix(expires, 0).UTC().Format("2006-01-02 15:04 MST"),
+	)
+	if err := qp.Close(); err != nil {
+		return err
+	}
+
+	var msg bytes.Buffer
+	headers := []struct{ key, value string }{
+		{"From", s.SMTP.From},
+		{"To", email},
+		{"Subject", "Confirm your Matrix email digests"},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "text/plain; charset=UTF-8"},
+		{"Content-Transfer-Encoding", "quoted-printable"},
+	}
+	for _, h := range headers {
+		fmt.Fprintf(&msg, "%s: %s\r\n", h.key, h.value)
+	}
+	msg.WriteString("\r\n")
+	msg.Write(body.Bytes())
+	return s.deliver(email, msg.Bytes())
+}
+
+// deliver sends the email through the configured SMTP server.
+func (s *Service) deliver(email string, msg []byte) error {
+	var auth smtp.Auth
+	if s.SMTP.Username != "" {
+		auth = smtp.PlainAuth("", s.SMTP.Username, s.SMTP.Password, s.SMTP.Host)
+	}
+	from, err := mail.ParseAddress(s.SMTP.From)
+	if err != nil {
+		return err
+	}
+	port := s.SMTP.Port
+	if port == 0 {
+		port = 25
+	}
+	addr := s.SMTP.Host + ":" + strconv.Itoa(port)
+	return sendMail(addr, auth, from.Address, []string{email}, msg)
+}
+
+// buildEmail creates a multipart/alternative email containing the digest as text and HTML.
+func (s *Service) buildEmail(userID, email string, items []digestItem) ([]byte, error) {
+	unsubURL := s.unsubscribeURL(userID)
+
+	var textBuf bytes.Buffer
+	var htmlBuf bytes.Buffer
+	fmt.Fprintf(&textBuf, "You have %d new notifications in Matrix.\r\n\r\n", len(items))
+	fmt.Fprintf(&htmlBuf, "<p>You have %d new notifications in Matrix.</p>\r\n", len(items))
+	for _, group := range groupByRoom(items) {
+		fmt.Fprintf(&textBuf, "%s\r\n", group[0].RoomID)
+		fmt.Fprintf(&htmlBuf, "<h3>%s</h3>\r\n<ul>\r\n", html.EscapeString(group[0].RoomID))
+		for _, item := range group {
+			prefix := ""
+			if item.Mention {
+				prefix = "[mention] "
+			}
+			ts := item.Timestamp.UTC().Format("2006-01-02 15:04")
+			fmt.Fprintf(&textBuf, "  %s%s %s: %s\r\n", prefix, ts, item.Sender, item.Body)
+			fmt.Fprintf(
+				&htmlBuf, "<li>%s%s <b>%s</b>: %s</li>\r\n", html.EscapeString(prefix), ts,
+				html.EscapeString(item.Sender), html.EscapeString(item.Body),
+			)
+		}
+		textBuf.WriteString("\r\n")
+		htmlBuf.WriteString("</ul>\r\n")
+	}
+	fmt.Fprintf(&textBuf, "To stop receiving these emails, visit: %s\r\n", unsubURL)
+	fmt.Fprintf(
+		&htmlBuf, "<p><small><a href=\"%s\">Unsubscribe</a> from these emails.</small></p>\r\n",
+		html.EscapeString(unsubURL),
+	)
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, part := range []struct {
+		contentType string
+		content     []byte
+	}{
+		{"text/plain; charset=UTF-8", textBuf.Bytes()},
+		{"text/html; charset=UTF-8", htmlBuf.Bytes()},
+	} {
+		w, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write(part.content); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	var msg bytes.Buffer
+	headers := []struct{ key, value string }{
+		{"From", s.SMTP.From},
+		{"To", email},
+		{"Subject", fmt.Sprintf("Matrix digest for %s: %d new notifications", userID, len(items))},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"MIME-Version", "1.0"},
+		{"List-Unsubscribe", "<" + unsubURL + ">"},
+		{"List-Unsubscribe-Post", "List-Unsubscribe=One-Click"},
+		{"Content-Type", "multipart/alternative; boundary=" + mw.Boundary()},
+	}
+	for _, h := range headers {
+		fmt.Fprintf(&msg, "%s: %s\r\n", h.key, h.value)
+	}
+	msg.WriteString("\r\n")
+	msg.Write(body.Bytes())
+	return msg.Bytes(), nil
+}
+
+// OnReceiveWebhook handles unsubscribe and confirmation links. A GET (from a browser) shows a
+// page asking the user to confirm, and a POST (from that page, or RFC 8058 one-click unsubscribe
+// from a mail client) acts on it. Link scanners and mail previews fetch links with GET, so only
+// POST may change anything.
+func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli *gomatrix.Client) {
+	if req.Method != "GET" && req.Method != "POST" {
+		w.WriteHeader(405)
+		return
+	}
+	q := req.URL.Query()
+	if q.Get("confirm") != "" {
+		s.confirmSubscription(w, req.Method, q)
+		return
+	}
+	s.unsubscribe(w, req.Method, q)
+}
+
+func (s *Service) unsubscribe(w http.ResponseWriter, method string, q url.Values) {
+	userID := q.Get("unsubscribe")
+	token := q.Get("token")
+	if userID == "" || token == "" {
+		w.WriteHeader(400)
+		return
+	}
+	if !hmac.Equal([]byte(token), []byte(s.unsubscribeToken(userID))) {
+		log.WithFields(log.Fields{
+			"service_id": s.ServiceID(),
+			"user_id":    userID,
+		}).Warn("Received unsubscribe request with a bad token")
+		w.WriteHeader(403)
+		return
+	}
+	if method == "GET" {
+		// The form has no action, so it is posted back to this URL including its query.
+		respondHTML(
+			w, 200, "<form method=\"post\"><p>Stop sending email digests to %s?</p><button type=\"submit\">Unsubscribe</button></form>",
+			html.EscapeString(userID),
+		)
+		return
+	}
+	err := s.modify(func(srv *Service) {
+		delete(srv.Subscribers, userID)
+		delete(srv.Pending, userID)
+	})
+	if err != nil {
+		log.WithError(err).WithField("service_id", s.ServiceID()).Error("Failed to unsubscribe user")
+		w.WriteHeader(500)
+		return
+	}
+	log.WithFields(log.Fields{
+		"service_id": s.ServiceID(),
+		"user_id":    userID,
+	}).Info("Unsubscribed user from email digests")
+	respondHTML(w, 200, "<p>%s has been unsubscribed from email digests.</p>", html.EscapeString(userID))
+}
+
+func (s *Service) confirmSubscription(w http.ResponseWriter, method string, q url.Values) {
+	userID, email, roomID, token := q.Get("confirm"), q.Get("email"), q.Get("room"), q.Get("token")
+	expires, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil || email == "" || roomID == "" || token == "" {
+		w.WriteHeader(400)
+		return
+	}
+	if !hmac.Equal([]byte(token), []byte(s.confirmToken(userID, email, roomID, expires))) {
+		log.WithFields(log.Fields{
+			"service_id": s.ServiceID(),
+			"user_id":    userID,
+		}).Warn("Received subscription confirmation with a bad token")
+		w.WriteHeader(403)
+		return
+	}
+	if time.Now().Unix() > expires {
+		respondHTML(w, 410, "<p>This link has expired. Type !digest subscribe in Matrix to get a new one.</p>")
+		return
+	}
+	if !s.hasRoom(roomID) {
+		respondHTML(w, 404, "<p>Email digests are no longer enabled for %s.</p>", html.EscapeString(roomID))
+		return
+	}
+	if method == "GET" {
+		respondHTML(
+			w, 200, "<form method=\"post\"><p>Send email digests of %s for %s to %s?</p><button type=\"submit\">Subscribe</button></form>",
+			html.EscapeString(roomID), html.EscapeString(userID), html.EscapeString(email),
+		)
+		return
+	}
+	err = s.modify(func(srv *Service) {
+		if srv.Subscribers == nil {
+			srv.Subscribers = make(map[string]Subscriber)
+		}
+		sub := srv.Subscribers[userID]
+		sub.Email = email
+		if !containsString(sub.Rooms, roomID) {
+			sub.Rooms = append(sub.Rooms, roomID)
+		}
+		srv.Subscribers[userID] = sub
+	})
+	if err != nil {
+		log.WithError(err).WithField("service_id", s.ServiceID()).Error("Failed to subscribe user")
+		w.WriteHeader(500)
+		return
+	}
+	log.WithFields(log.Fields{
+		"service_id": s.ServiceID(),
+		"user_id":    userID,
+		"room_id":    roomID,
+	}).Info("Subscribed user to email digests")
+	respondHTML(w, 200, "<p>%s has been subscribed to email digests.</p>", html.EscapeString(email))
+}
+
+func respondHTML(w http.ResponseWriter, code int, format string, args ...interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(code)
+	fmt.Fprintf(w, format, args...)
+}
+
+// sign returns an HMAC of the parts using the service's secret, so that links can't be forged.
+func (s *Service) sign(parts ...string) string {
+	mac := hmac.New(sha256.New, []byte(s.UnsubscribeSecret))
+	mac.Write([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *Service) confirmToken(userID, email, roomID string, expires int64) string {
+	return s.sign("confirm", userID, email, roomID, strconv.FormatInt(expires, 10))
+}
+
+func (s *Service) confirmURL(userID, email, roomID string, expires int64) string {
+	q := url.Values{}
+	q.Set("confirm", userID)
+	q.Set("email", email)
+	q.Set("room", roomID)
+	q.Set("expires", strconv.FormatInt(expires, 10))
+	q.Set("token", s.confirmToken(userID, email, roomID, expires))
+	return s.webhookEndpointURL + "?" + q.Encode()
+}
+
+func (s *Service) unsubscribeToken(userID string) string {
+	return s.sign(userID)
+}
+
+func (s *Service) unsubscribeURL(userID string) string {
+	q := url.Values{}
+	q.Set("unsubscribe", userID)
+	q.Set("token", s.unsubscribeToken(userID))
+	return s.webhookEndpointURL + "?" + q.Encode()
+}
+
+// modify applies fn to the stored version of this service and stores it. The subscribers, last
+// digest time and pending items of this instance are replaced with the modified ones.
+func (s *Service) modify(fn func(srv *Service)) error {
+	stored, err := database.GetServiceDB().ModifyService(s.ServiceID(), func(service types.Service) error {
+		srv, ok := service.(*Service)
+		if !ok {
+			return fmt.Errorf("service %s is not an email digest service", s.ServiceID())
+		}
+		fn(srv)
+		return nil
+	})
+	if srv, ok := stored.(*Service); ok {
+		s.Subscribers = srv.Subscribers
+		s.LastDigestTimestampSecs = srv.LastDigestTimestampSecs
+		s.Pending = srv.Pending
+	}
+	return err
+}
+
+// WithoutSecrets returns a copy of the service without its unsubscribe secret, which would let
+// anyone subscribe or unsubscribe any user.
+func (s *Service) WithoutSecrets() types.Service {
+	c := *s
+	c.UnsubscribeSecret = ""
+	return &c
+}
+
+func (s *Service) interval() time.Duration {
+	mins := s.IntervalMins
+	if mins == 0 {
+		mins = defaultIntervalMins
+	}
+	return time.Duration(mins) * time.Minute
+}
+
+func (s *Service) hasRoom(roomID string) bool {
+	return containsString(s.Rooms, roomID)
+}
+
+// addPending remembers items to include in the user's next digest. The oldest items are discarded
+// if there are more than maxPendingItems.
+func (s *Service) addPending(userID string, items ...digestItem) {
+	if s.Pending == nil {
+		s.Pending = make(map[string][]digestItem)
+	}
+	all := append(s.Pending[userID], items...)
+	if len(all) > maxPendingItems {
+		all = all[len(all)-maxPendingItems:]
+	}
+	s.Pending[userID] = all
+}
+
+// groupByRoom groups the items by room ID, preserving the order in which rooms first appear.
+func groupByRoom(items []digestItem) [][]digestItem {
+	var groups [][]digestItem
+	index := make(map[string]int)
+	for _, item := range items {
+		i, ok := index[item.RoomID]
+		if !ok {
+			i = len(groups)
+			index[item.RoomID] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], item)
+	}
+	return groups
+}
+
+func containsString(list []string, str string) bool {
+	for _, s := range list {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
+
+func init() {
+	types.RegisterService(func(serviceID, serviceUserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService:     types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+			webhookEndpointURL: webhookEndpointURL,
+		}
+	})
+}
@@ -0,0 +1,289 @@
+package emaildigest
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+)
+
+type mockStore struct {
+	database.NopStorage
+	service types.Service
+}
+
+func (d *mockStore) LoadService(serviceID string) (types.Service, error) {
+	return d.service, nil
+}
+
+func (d *mockStore) StoreService(service types.Service) (types.Service, error) {
+	old := d.service
+	d.service = service
+	return old, nil
+}
+
+func (d *mockStore) ModifyService(serviceID string, fn func(types.Service) error) (types.Service, error) {
+	if err := fn(d.service); err != nil {
+		return nil, err
+	}
+	return d.service, nil
+}
+
+// smtpStandIn is a minimal SMTP server which accepts a single message and sends its
+// DATA down the returned channel.
+func smtpStandIn(t *testing.T) (string, int, chan string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Failed to listen: ", err)
+	}
+	received := make(chan string, 1)
+	go func() {
+		defer ln.Close()
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		conn.Write([]byte("220 localhost ESMTP\r\n"))
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			cmd := strings.ToUpper(strings.TrimSpace(line))
+			switch {
+			case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+				conn.Write([]byte("250 localhost\r\n"))
+			case cmd == "DATA":
+				conn.Write([]byte("354 go ahead\r\n"))
+				var data []string
+				for {
+					l, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if l == ".\r\n" {
+						break
+					}
+					data = append(data, l)
+				}
+				received <- strings.Join(data, "")
+				conn.Write([]byte("250 OK\r\n"))
+			case cmd == "QUIT":
+				conn.Write([]byte("221 bye\r\n"))
+				return
+			default: // MAIL, RCPT, RSET
+				conn.Write([]byte("250 OK\r\n"))
+			}
+		}
+	}()
+	addr := ln.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port, received
+}
+
+func newService(t *testing.T, host string, port int) *Service {
+	types.BaseURL("https://go.neb")
+	srv, err := types.CreateService("digest", ServiceType, "@neb:hyrule", []byte(`{
+		"smtp": {"host": "`+host+`", "port": `+strconv.Itoa(port)+`, "from": "neb@hyrule"},
+		"rooms": ["!castle:hyrule"],
+		"unsubscribe_secret": "triforce",
+		"subscribers": {
+			"@zelda:hyrule": {"email": "zelda@hyrule"}
+		}
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create service: ", err)
+	}
+	s := srv.(*Service)
+	database.SetServiceDB(&mockStore{service: s})
+	return s
+}
+
+func TestDigestIsEmailed(t *testing.T) {
+	host, port, received := smtpStandIn(t)
+	s := newService(t, host, port)
+	cli, _ := gomatrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+
+	events := []gomatrix.Event{
+		{ // a notice from another bot: included
+			Sender: "@alerts:hyrule", RoomID: "!castle:hyrule", Timestamp: 1000,
+			Content: map[string]interface{}{"msgtype": "m.notice", "body": "Ganon is attacking"},
+		},
+		{ // a mention: included
+			Sender: "@link:hyrule", RoomID: "!castle:hyrule", Timestamp: 2000,
+			Content: map[string]interface{}{"msgtype": "m.text", "body": "@zelda:hyrule where are you?"},
+		},
+		{ // chatter: ignored
+			Sender: "@link:hyrule", RoomID: "!castle:hyrule", Timestamp: 3000,
+			Content: map[string]interface{}{"msgtype": "m.text", "body": "hyaaa"},
+		},
+		{ // a notice in an unconfigured room: ignored
+			Sender: "@alerts:hyrule", RoomID: "!lostwoods:hyrule", Timestamp: 4000,
+			Content: map[string]interface{}{"msgtype": "m.notice", "body": "Skull kid spotted"},
+		},
+	}
+	for i := range events {
+		s.OnMessageEvent(cli, &events[i])
+	}
+	if n := len(s.Pending["@zelda:hyrule"]); n != 2 {
+		t.Fatalf("TestDigestIsEmailed: want 2 stored items, got %d", n)
+	}
+
+	s.OnPoll(cli)
+	data := <-received
+
+	for _, want := range []string{
+		"To: zelda@hyrule",
+		"multipart/alternative",
+		"text/plain",
+		"text/html",
+		"Ganon is attacking",
+		"[mention]",
+		"List-Unsubscribe: <https://go.neb/services/hooks/",
+	} {
+		if !strings.Contains(data, want) {
+			t.Errorf("TestDigestIsEmailed: want '%s' in email, got:\n%s", want, data)
+		}
+	}
+	for _, unwanted := range []string{"hyaaa", "Skull kid"} {
+		if strings.Contains(data, unwanted) {
+			t.Errorf("TestDigestIsEmailed: did not want '%s' in email, got:\n%s", unwanted, data)
+		}
+	}
+	if len(s.Pending["@zelda:hyrule"]) != 0 {
+		t.Errorf("TestDigestIsEmailed: items were not cleared after sending")
+	}
+}
+
+func TestUnsubscribeLink(t *testing.T) {
+	s := newService(t, "localhost", 25)
+
+	badReq, _ := http.NewRequest("GET", s.webhookEndpointURL+"?unsubscribe=%40zelda%3Ahyrule&token=nope", nil)
+	w := httptest.NewRecorder()
+	s.OnReceiveWebhook(w, badReq, nil)
+	if w.Code != 403 {
+		t.Errorf("TestUnsubscribeLink: want HTTP 403 for a bad token, got %d", w.Code)
+	}
+	if _, ok := s.Subscribers["@zelda:hyrule"]; !ok {
+		t.Fatal("TestUnsubscribeLink: subscriber was removed with a bad token")
+	}
+
+	// opening the link must only ask the user to confirm
+	u, _ := url.Parse(s.unsubscribeURL("@zelda:hyrule"))
+	getReq, _ := http.NewRequest("GET", u.String(), nil)
+	w = httptest.NewRecorder()
+	s.OnReceiveWebhook(w, getReq, nil)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `<form method="post">`) {
+		t.Errorf("TestUnsubscribeLink: want a confirmation form, got HTTP %d: %s", w.Code, w.Body.String())
+	}
+	if _, ok := s.Subscribers["@zelda:hyrule"]; !ok {
+		t.Fatal("TestUnsubscribeLink: subscriber was removed by a GET")
+	}
+
+	req, _ := http.NewRequest("POST", u.String(), strings.NewReader("List-Unsubscribe=One-Click"))
+	w = httptest.NewRecorder()
+	s.OnReceiveWebhook(w, req, nil)
+	if w.Code != 200 {
+		t.Errorf("TestUnsubscribeLink: want HTTP 200, got %d", w.Code)
+	}
+	if _, ok := s.Subscribers["@zelda:hyrule"]; ok {
+		t.Errorf("TestUnsubscribeLink: subscriber was not removed")
+	}
+}
+
+// requestConfirmation subscribes @link:hyrule to digests of !castle:hyrule and returns the
+// confirmation link which was emailed to them.
+func requestConfirmation(t *testing.T, s *Service) *url.URL {
+	var sentTo []string
+	var sentMsg []byte
+	sendMail = func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		sentTo, sentMsg = to, msg
+		return nil
+	}
+	defer func() { sendMail = smtp.SendMail }()
+
+	res, err := s.cmdSubscribe("!castle:hyrule", "@link:hyrule", []string{"link@hyrule"})
+	if err != nil {
+		t.Fatal("TestSubscribeIsConfirmed: failed to subscribe: ", err)
+	}
+	if resp, ok := res.(types.Response); !ok || !resp.Private {
+		t.Errorf("TestSubscribeIsConfirmed: want a private response, got %+v", res)
+	}
+	if len(sentTo) != 1 || sentTo[0] != "link@hyrule" {
+		t.Fatalf("TestSubscribeIsConfirmed: want a confirmation sent to link@hyrule, got %v", sentTo)
+	}
+	parts := strings.SplitN(string(sentMsg), "\r\n\r\n", 2)
+	body, err := ioutil.ReadAll(quotedprintable.NewReader(strings.NewReader(parts[1])))
+	if err != nil {
+		t.Fatal("TestSubscribeIsConfirmed: failed to decode email: ", err)
+	}
+	u, err := url.Parse(regexp.MustCompile(`https://go.neb/\S+`).FindString(string(body)))
+	if err != nil || u.Query().Get("confirm") != "@link:hyrule" {
+		t.Fatalf("TestSubscribeIsConfirmed: want a confirmation link in the email, got:\n%s", body)
+	}
+	return u
+}
+
+func TestSubscribeIsConfirmed(t *testing.T) {
+	s := newService(t, "localhost", 25)
+	u := requestConfirmation(t, s)
+
+	// the link can't be changed to subscribe another address
+	q := u.Query()
+	q.Set("email", "ganon@hyrule")
+	forged := *u
+	forged.RawQuery = q.Encode()
+	for _, req := range []struct {
+		method   string
+		u        string
+		wantCode int
+	}{
+		{"POST", forged.String(), 403},
+		{"GET", u.String(), 200}, // only asks the user to confirm
+		{"POST", u.String(), 200},
+	} {
+		if _, ok := s.Subscribers["@link:hyrule"]; ok {
+			t.Fatalf("TestSubscribeIsConfirmed: subscribed before %s %s", req.method, req.u)
+		}
+		r, _ := http.NewRequest(req.method, req.u, nil)
+		w := httptest.NewRecorder()
+		s.OnReceiveWebhook(w, r, nil)
+		if w.Code != req.wantCode {
+			t.Errorf("TestSubscribeIsConfirmed: %s %s: want HTTP %d, got %d", req.method, req.u, req.wantCode, w.Code)
+		}
+	}
+
+	sub := s.Subscribers["@link:hyrule"]
+	if sub.Email != "link@hyrule" || len(sub.Rooms) != 1 || sub.Rooms[0] != "!castle:hyrule" {
+		t.Errorf("TestSubscribeIsConfirmed: want link@hyrule subscribed to !castle:hyrule, got %+v", sub)
+	}
+}
+
+func TestSecretIsHidden(t *testing.T) {
+	s := newService(t, "localhost", 25)
+
+	b, err := json.Marshal(s.WithoutSecrets())
+	if err != nil {
+		t.Fatal("TestSecretIsHidden: failed to marshal service: ", err)
+	}
+	if strings.Contains(string(b), "triforce") {
+		t.Errorf("TestSecretIsHidden: want no unsubscribe secret, got %s", string(b))
+	}
+	if s.UnsubscribeSecret != "triforce" {
+		t.Errorf("TestSecretIsHidden: the service's own secret was changed to '%s'", s.UnsubscribeSecret)
+	}
+}
@@ -46,6 +46,7 @@ type giphySearch struct {
 //   }
 type Service struct {
 	types.DefaultService
+	types.CommandScope
 	// The Giphy API key to use when making HTTP requests to Giphy.
 	// The public beta API key is "dc6zaTOxFJmzC".
 	APIKey string `json:"api_key"`
@@ -58,15 +58,29 @@ var ownerRepoRegex = regexp.MustCompile(`^([A-z0-9-_.]+)/([A-z0-9-_.]+)$`)
 //
 // This will allow the "owner/repo" to be omitted when creating/expanding issues.
 //
+// Saying "!github link owner/repo#12" in a thread links the thread to the issue. Comments on the issue
+// are sent into the thread, provided a Github Webhook Service is tracking the repository. Replies in the
+// thread are posted as comments on the issue by the Github account of their sender, if they have logged
+// into Github. Otherwise they are posted by the Github account of the ClientUserID, saying which Matrix
+// user wrote them, or not at all if there is no ClientUserID. Say "!github unlink" in the thread to stop this.
+//
 // Example request:
 //   {
-//       "RealmID": "github-realm-id"
+//       "RealmID": "github-realm-id",
+//       "ClientUserID": "@neb-github:localhost"
 //   }
 type Service struct {
 	types.DefaultService
+	types.CommandScope
 	// The ID of an existing "github" realm. This realm will be used to obtain
 	// credentials of users when they create issues on Github.
 	RealmID string
+	// Optional. The user whose Github account posts the replies in linked threads as comments, for
+	// senders who haven't logged into Github.
+	ClientUserID string
+	// The Matrix threads which have been linked to Github issues with "!github link".
+	// This is populated by Go-NEB.
+	ThreadLinks []ThreadLink
 }
 
 func (s *Service) requireGithubClientFor(userID string) (cli *gogithub.Client, resp interface{}, err error) {
@@ -77,10 +91,10 @@ func (s *Service) requireGithubClientFor(userID string) (cli *gogithub.Client, r
 			return
 		}
 		if ghRealm, ok := r.(*github.Realm); ok {
-			resp = matrix.StarterLinkMessage{
+			resp = types.PrivateResponse(matrix.StarterLinkMessage{
 				Body: "You need to log into Github before you can create issues.",
 				Link: ghRealm.StarterLink,
-			}
+			})
 		} else {
 			err = fmt.Errorf("Failed to cast realm %s into a GithubRealm", s.RealmID)
 		}
@@ -383,6 +397,39 @@ func (s *Service) cmdGithubReopen(roomID, userID string, args []string) (interfa
 	return s.githubIssueCloseReopen(roomID, userID, args, "open", "open", cmdGithubCloseUsage)
 }
 
+const cmdGithubMergeUsage = `!github merge [owner/repo]#pull`
+
+func (s *Service) cmdGithubMerge(roomID, userID string, args []string) (interface{}, error) {
+	cli, resp, err := s.requireGithubClientFor(userID)
+	if cli == nil {
+		return resp, err
+	}
+	if len(args) == 0 {
+		return &gomatrix.TextMessage{"m.notice", "Usage: " + cmdGithubMergeUsage}, nil
+	}
+
+	// get owner,repo,pull,resp out of args[0]
+	owner, repo, pullNum, resp := s.getIssueDetailsFor(args[0], roomID, cmdGithubMergeUsage)
+	if resp != nil {
+		return resp, nil
+	}
+
+	result, res, err := cli.PullRequests.Merge(owner, repo, pullNum, "", nil)
+	if err != nil {
+		log.WithField("err", err).Print("Failed to merge pull request")
+		if res == nil {
+			return nil, fmt.Errorf("Failed to merge pull request. Failed to connect to Github")
+		}
+		return nil, fmt.Errorf("Failed to merge pull request. HTTP %d", res.StatusCode)
+	}
+
+	merged := fmt.Sprintf("Merged pull request %s/%s#%d", owner, repo, pullNum)
+	if result.SHA != nil {
+		merged += " as " + shortSHA(*result.SHA)
+	}
+	return gomatrix.TextMessage{"m.notice", merged}, nil
+}
+
 func (s *Service) getIssueDetailsFor(input, roomID, usage string) (owner, repo string, issueNum int, resp interface{}) {
 	// We expect the input to look like:
 	// "[owner/repo]#issue"
@@ -504,6 +551,9 @@ func (s *Service) expandCommit(roomID, userID, owner, repo, sha string) interfac
 // Responds with the outcome of the issue comment creation request. This command requires
 // a Github account to be linked to the Matrix user ID issuing the command. If there
 // is no link, it will return a Starter Link instead.
+//    !github merge [owner/repo]#pull
+// Merges the pull request as the Matrix user ID issuing the command, once another user in the
+// room with the default approval power level approves it.
 func (s *Service) Commands(cli *gomatrix.Client) []types.Command {
 	return []types.Command{
 		types.Command{
@@ -548,6 +598,13 @@ func (s *Service) Commands(cli *gomatrix.Client) []types.Command {
 				return s.cmdGithubReopen(roomID, userID, args)
 			},
 		},
+		types.Command{
+			Path:     []string{"github", "merge"},
+			Approval: &types.ApprovalPolicy{},
+			Command: func(roomID, userID string, args []string) (interface{}, error) {
+				return s.cmdGithubMerge(roomID, userID, args)
+			},
+		},
 		types.Command{
 			Path: []string{"github", "help"},
 			Command: func(roomID, userID string, args []string) (interface{}, error) {
@@ -560,6 +617,9 @@ func (s *Service) Commands(cli *gomatrix.Client) []types.Command {
 						cmdGithubAssignUsage,
 						cmdGithubCloseUsage,
 						cmdGithubReopenUsage,
+						cmdGithubMergeUsage,
+						cmdGithubLinkUsage,
+						cmdGithubUnlinkUsage,
 					}, "\n"),
 				}, nil
 			},
@@ -672,11 +732,20 @@ func (s *Service) Register(oldService types.Service, client *gomatrix.Client) er
 	if realm.Type() != "github" {
 		return fmt.Errorf("Realm is of type '%s', not 'github'", realm.Type())
 	}
+	// keep the threads linked when the service is reconfigured
+	if old, ok := oldService.(*Service); ok && s.ThreadLinks == nil {
+		s.ThreadLinks = old.ThreadLinks
+	}
 
 	log.Infof("%+v", s)
 	return nil
 }
 
+// RealmIDs returns the github realm used by this service.
+func (s *Service) RealmIDs() []string {
+	return []string{s.RealmID}
+}
+
 // defaultRepo returns the default repo for the given room, or an empty string.
 func (s *Service) defaultRepo(roomID string) string {
 	logger := log.WithFields(log.Fields{
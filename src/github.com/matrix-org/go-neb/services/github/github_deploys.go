@@ -0,0 +1,573 @@
+package github
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	gogithub "github.com/google/go-github/github"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/services/github/client"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+)
+
+// DeploysServiceType of the Deploys service.
+const DeploysServiceType = "deploys"
+
+// The number of deploys which are kept for each app and environment.
+const maxDeploysPerEnvironment = 20
+
+// The number of deploys listed by "!deploys".
+const maxDeploysListed = 5
+
+// The number of commits listed in a deploy announcement.
+const maxDeployCommits = 10
+
+const cmdDeployRecordUsage = `!deploy record app version environment [sha]`
+
+// DeploysService contains the Config fields for the Deploys Service.
+//
+// This service records deployments of apps and announces them in the rooms of the app. Deploys
+// are recorded by POSTing JSON to the WebhookURL, e.g. from CI:
+//   {
+//       "app": "website",
+//       "version": "v1.2.3",
+//       "environment": "prod",
+//       "sha": "0a1b2c3d",
+//       "deployed_by": "alice"
+//   }
+// or by saying "!deploy record website v1.2.3 prod [sha]" in a room of the app. "!deploys website prod"
+// lists the recent deploys of the app. The environment can be left out to list every environment.
+//
+// If the app has a Github repository, announcements link to the commits between the previous deploy
+// and this one, and list them. The SHA of each deploy is compared if it has one, otherwise its
+// version, which should then be a tag or branch. If a RealmID is given, the Github credentials of the
+// ClientUserID are used, otherwise the repository must be public.
+//
+// Webhook requests must send the Secret as "Authorization: Bearer <secret>". If a Secret isn't given,
+// Go-NEB generates one, which is returned with the rest of the service's config.
+//
+// Example request:
+//   {
+//       ClientUserID: "@alice:localhost",
+//       RealmID: "github-realm-id",
+//       Secret: "its_a_secret",
+//       Apps: {
+//           "website": {
+//               Repo: "matrix-org/website",
+//               Rooms: ["!qmElAGdFYCHoCJuaNt:localhost"]
+//           }
+//       }
+//   }
+type DeploysService struct {
+	types.DefaultService
+	types.CommandScope
+	webhookEndpointURL string
+	// The URL which CI should POST deploys to. This is populated by Go-NEB.
+	WebhookURL string
+	// Optional. The user ID whose Github credentials are used to list commits.
+	ClientUserID string
+	// Optional. The ID of an existing "github" realm. This realm will be used to obtain
+	// the Github credentials of the ClientUserID.
+	RealmID string
+	// Optional. The secret which webhook requests must send. This is generated by Go-NEB if not given.
+	Secret string
+	// A map of app names to config options.
+	Apps map[string]struct {
+		// Optional. The "owner/repo"-style Github repository of the app.
+		Repo string
+		// The rooms to announce deploys of the app in. "!deploy record" can only be used in them.
+		Rooms []string `rooms:"values"`
+	}
+	// The recent deploys of each app and environment, oldest first. This is populated by Go-NEB.
+	Deploys []Deploy
+}
+
+// A Deploy is a deployment of a version of an app to an environment.
+type Deploy struct {
+	App         string `json:"app"`
+	Version     string `json:"version"`
+	Environment string `json:"environment"`
+	// Optional. The commit which was deployed.
+	SHA string `json:"sha,omitempty"`
+	// Who deployed it: a Matrix user ID for deploys recorded by command, or whatever CI sent.
+	DeployedBy    string `json:"deployed_by,omitempty"`
+	TimestampSecs int64  `json:"ts_secs"`
+}
+
+// ref returns the git ref of the deploy.
+func (d *Deploy) ref() string {
+	if d.SHA != "" {
+		return d.SHA
+	}
+	return d.Version
+}
+
+// Register validates the apps, generates a secret if there isn't one and joins the apps' rooms.
+// Deploys are kept when the service is configured again.
+func (s *DeploysService) Register(oldService types.Service, client *gomatrix.Client) error {
+	if err := s.checkRealm(); err != nil {
+		return err
+	}
+	if err := s.checkApps(); err != nil {
+		return err
+	}
+	old, _ := oldService.(*DeploysService)
+	if old != nil && s.Deploys == nil {
+		s.Deploys = old.Deploys
+	}
+	if err := s.ensureSecret(old); err != nil {
+		return err
+	}
+	s.WebhookURL = s.webhookEndpointURL
+	for _, roomID := range s.roomIDs() {
+		if _, err := client.JoinRoom(roomID, "", nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkRealm checks that the realm, if any, is a github realm used with a ClientUserID.
+func (s *DeploysService) checkRealm() error {
+	if s.RealmID == "" {
+		return nil
+	}
+	if s.ClientUserID == "" {
+		return errors.New("ClientUserID is required if RealmID is given")
+	}
+	realm, err := database.GetServiceDB().LoadAuthRealm(s.RealmID)
+	if err != nil {
+		return err
+	}
+	if realm.Type() != "github" {
+		return fmt.Errorf("Realm is of type '%s', not 'github'", realm.Type())
+	}
+	return nil
+}
+
+// checkApps checks that there is at least one app, and that each has a name without whitespace,
+// an owner/repo-style repository if any, and rooms.
+func (s *DeploysService) checkApps() error {
+	if len(s.Apps) == 0 {
+		return errors.New("No apps specified")
+	}
+	for name, app := range s.Apps {
+		if strings.ContainsAny(name, " \t\n") {
+			return fmt.Errorf("App name '%s' contains whitespace", name)
+		}
+		if app.Repo != "" && strings.Count(app.Repo, "/") != 1 {
+			return fmt.Errorf("Bad owner/repo '%s' for app %s", app.Repo, name)
+		}
+		if len(app.Rooms) == 0 {
+			return fmt.Errorf("No rooms specified for app %s", name)
+		}
+	}
+	return nil
+}
+
+// ensureSecret keeps the secret of the old service, if there is one and no secret was given, so CI
+// doesn't need to be configured again. Otherwise a secret is generated if there isn't one.
+func (s *DeploysService) ensureSecret(old *DeploysService) error {
+	if old != nil && s.Secret == "" {
+		s.Secret = old.Secret
+	}
+	if s.Secret != "" {
+		return nil
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	s.Secret = hex.EncodeToString(secret)
+	return nil
+}
+
+// RealmIDs returns the github realm used by this service, if any.
+func (s *DeploysService) RealmIDs() []string {
+	if s.RealmID == "" {
+		return nil
+	}
+	return []string{s.RealmID}
+}
+
+// RoomTargets returns each app whose deploys are announced in the room.
+func (s *DeploysService) RoomTargets(roomID string) []string {
+	var targets []string
+	for name := range s.Apps {
+		if s.appInRoom(name, roomID) {
+			targets = append(targets, name)
+		}
+	}
+	sort.Strings(targets)
+	return targets
+}
+
+// Commands supported:
+//    !deploy record website v1.2.3 prod [sha]
+//    !deploys website [prod]
+// Errors are sent to the user privately, as they can name apps, and so repos, which are configured for
+// other rooms.
+func (s *DeploysService) Commands(cli *gomatrix.Client) []types.Command {
+	return []types.Command{
+		types.Command{
+			Path:      []string{"deploy", "record"},
+			Arguments: []string{"app", "version", "environment", "sha"},
+			Help:      "Record a deploy and announce it in the app's rooms.",
+			Private:   true,
+			Command: func(roomID, userID string, args []string) (interface{}, error) {
+				return publicUnlessFailed(s.cmdRecord(cli, roomID, userID, args))
+			},
+		},
+		types.Command{
+			Path:      []string{"deploys"},
+			Arguments: []string{"app", "environment"},
+			Help:      "List the recent deploys of an app which announces deploys in this room.",
+			Private:   true,
+			Command: func(roomID, userID string, args []string) (interface{}, error) {
+				return publicUnlessFailed(s.cmdDeploys(roomID, args))
+			},
+		},
+	}
+}
+
+// publicUnlessFailed sends the response of a private command to the room if the command succeeded.
+func publicUnlessFailed(content interface{}, err error) (interface{}, error) {
+	if err != nil {
+		return nil, err
+	}
+	return types.PublicResponse(content), nil
+}
+
+func (s *DeploysService) cmdRecord(cli *gomatrix.Client, roomID, userID string, args []string) (interface{}, error) {
+	if len(args) < 3 || len(args) > 4 {
+		return nil, errors.New("Usage: " + cmdDeployRecordUsage)
+	}
+	if _, ok := s.Apps[args[0]]; !ok {
+		return nil, fmt.Errorf("Unknown app '%s'", args[0])
+	}
+	if !s.appInRoom(args[0], roomID) {
+		return nil, fmt.Errorf("Deploys of %s can't be recorded in this room", args[0])
+	}
+	d := Deploy{
+		App:           args[0],
+		Version:       args[1],
+		Environment:   args[2],
+		DeployedBy:    userID,
+		TimestampSecs: time.Now().Unix(),
+	}
+	if len(args) == 4 {
+		d.SHA = args[3]
+	}
+	msg, err := s.recordDeploy(d)
+	if err != nil {
+		return nil, err
+	}
+	s.announce(cli, d.App, msg, roomID)
+	return msg, nil
+}
+
+func (s *DeploysService) cmdDeploys(roomID string, args []string) (interface{}, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return nil, errors.New("Usage: !deploys app [environment]")
+	}
+	if _, ok := s.Apps[args[0]]; !ok {
+		return nil, fmt.Errorf("Unknown app '%s'", args[0])
+	}
+	if !s.appInRoom(args[0], roomID) {
+		return nil, fmt.Errorf("Deploys of %s can't be listed in this room", args[0])
+	}
+	env := ""
+	if len(args) == 2 {
+		env = args[1]
+	}
+	// Reload so that deploys recorded by webhook since the last command are included.
+	srv := s
+	if latest, err := database.GetServiceDB().LoadService(s.ServiceID()); err == nil {
+		if deploysSrv, ok := latest.(*DeploysService); ok {
+			srv = deploysSrv
+		}
+	}
+	lines := deployLines(srv.Deploys, args[0], env)
+	where := args[0]
+	if env != "" {
+		where += " to " + env
+	}
+	if len(lines) == 0 {
+		return &gomatrix.TextMessage{MsgType: "m.notice", Body: "There are no deploys of " + where}, nil
+	}
+	return &gomatrix.TextMessage{
+		MsgType: "m.notice",
+		Body:    fmt.Sprintf("Recent deploys of %s:\n%s", where, strings.Join(lines, "\n")),
+	}, nil
+}
+
+// OnReceiveWebhook records a deploy POSTed by CI and announces it.
+func (s *DeploysService) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli *gomatrix.Client) {
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if s.Secret == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.Secret)) != 1 {
+		log.WithField("service_id", s.ServiceID()).Warn("Received deploy webhook with a bad secret")
+		w.WriteHeader(403)
+		return
+	}
+	var d Deploy
+	if err := json.NewDecoder(req.Body).Decode(&d); err != nil {
+		log.WithError(err).Error("Deploy webhook received an invalid JSON payload")
+		w.WriteHeader(400)
+		return
+	}
+	if _, ok := s.Apps[d.App]; !ok || d.Version == "" || d.Environment == "" {
+		log.WithField("app", d.App).Error("Deploy webhook is missing fields or has an unknown app")
+		w.WriteHeader(400)
+		return
+	}
+	d.TimestampSecs = time.Now().Unix()
+	msg, err := s.recordDeploy(d)
+	if err != nil {
+		w.WriteHeader(500)
+		return
+	}
+	s.announce(cli, d.App, msg, "")
+	w.WriteHeader(200)
+}
+
+// recordDeploy stores the deploy and returns the announcement of it.
+func (s *DeploysService) recordDeploy(d Deploy) (interface{}, error) {
+	var previous *Deploy
+	err := s.modify(func(srv *DeploysService) {
+		for i := len(srv.Deploys) - 1; i >= 0; i-- {
+			if srv.Deploys[i].App == d.App && srv.Deploys[i].Environment == d.Environment {
+				p := srv.Deploys[i]
+				previous = &p
+				break
+			}
+		}
+		srv.Deploys = trimDeploys(append(srv.Deploys, d), d.App, d.Environment)
+	})
+	if err != nil {
+		log.WithError(err).WithField("service_id", s.ServiceID()).Error("Failed to store deploy")
+		return nil, errors.New("Failed to record the deploy")
+	}
+
+	var commits *gogithub.CommitsComparison
+	repo := s.Apps[d.App].Repo
+	if repo != "" && previous != nil && previous.ref() != d.ref() {
+		segs := strings.Split(repo, "/")
+		commits, _, err = s.githubClient().Repositories.CompareCommits(segs[0], segs[1], previous.ref(), d.ref())
+		if err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"repo":       repo,
+				"base":       previous.ref(),
+				"head":       d.ref(),
+			}).Print("Failed to compare deployed commits")
+			commits = nil
+		}
+	}
+	return gomatrix.GetHTMLMessage("m.notice", htmlForDeploy(d, previous, repo, commits)), nil
+}
+
+// announce sends the announcement into each room of the app, except the room it was recorded in.
+// deployLines describes the most recent deploys of the app to the environment, newest first. If the
+// environment is empty, deploys to every environment are described.
+func deployLines(deploys []Deploy, app, env string) []string {
+	var lines []string
+	for i := len(deploys) - 1; i >= 0 && len(lines) < maxDeploysListed; i-- {
+		d := deploys[i]
+		if d.App != app || (env != "" && d.Environment != env) {
+			continue
+		}
+		line := fmt.Sprintf("%s to %s at %s", d.Version, d.Environment, time.Unix(d.TimestampSecs, 0).UTC().Format("2006-01-02 15:04"))
+		if d.DeployedBy != "" {
+			line += " by " + d.DeployedBy
+		}
+		if d.SHA != "" {
+			line += fmt.Sprintf(" (%s)", shortSHA(d.SHA))
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func (s *DeploysService) announce(cli *gomatrix.Client, app string, msg interface{}, exceptRoomID string) {
+	for _, roomID := range s.Apps[app].Rooms {
+		if roomID == exceptRoomID {
+			continue
+		}
+		if _, err := cli.SendMessageEvent(roomID, "m.room.message", msg); err != nil {
+			log.WithError(err).WithField("room_id", roomID).Print("Failed to announce deploy")
+		}
+	}
+}
+
+func htmlForDeploy(d Deploy, previous *Deploy, repo string, commits *gogithub.CommitsComparison) string {
+	who := "Deployed"
+	if d.DeployedBy != "" {
+		who = fmt.Sprintf("<b>%s</b> deployed", html.EscapeString(d.DeployedBy))
+	}
+	text := fmt.Sprintf(
+		"%s <b>%s</b> %s to <b>%s</b>",
+		who, html.EscapeString(d.App), html.EscapeString(d.Version), html.EscapeString(d.Environment),
+	)
+	if previous == nil {
+		return text
+	}
+	text += fmt.Sprintf(" (previously %s)", html.EscapeString(previous.Version))
+	if repo == "" || previous.ref() == d.ref() {
+		return text
+	}
+	compareURL := fmt.Sprintf("https://github.com/%s/compare/%s...%s", repo, previous.ref(), d.ref())
+	if commits == nil {
+		return text + fmt.Sprintf(`: <a href="%s">changes</a>`, html.EscapeString(compareURL))
+	}
+	total := derefInt(commits.TotalCommits)
+	plural := "s"
+	if total == 1 {
+		plural = ""
+	}
+	text += fmt.Sprintf(`: <a href="%s">%d commit%s</a>`, html.EscapeString(compareURL), total, plural)
+	if len(commits.Commits) == 0 {
+		return text
+	}
+	return text + htmlForCommits(commits.Commits, total)
+}
+
+// htmlForCommits lists the newest of the commits, newest first, as an HTML list. The total is the
+// number of commits, which may be more than Github returned.
+func htmlForCommits(commits []gogithub.RepositoryCommit, total int) string {
+	text := "<ul>"
+	// Github lists the oldest commits first, so show the newest ones.
+	list := commits
+	if len(list) > maxDeployCommits {
+		list = list[len(list)-maxDeployCommits:]
+	}
+	for i := len(list) - 1; i >= 0; i-- {
+		text += htmlForCommit(list[i])
+	}
+	if total > len(list) {
+		text += fmt.Sprintf("<li>and %d more</li>", total-len(list))
+	}
+	return text + "</ul>"
+}
+
+// htmlForCommit formats a commit as an HTML list item with its short SHA, first line and author.
+func htmlForCommit(c gogithub.RepositoryCommit) string {
+	message := ""
+	author := ""
+	if c.Commit != nil {
+		message = strings.SplitN(derefString(c.Commit.Message), "\n", 2)[0]
+		if c.Commit.Author != nil {
+			author = derefString(c.Commit.Author.Name)
+		}
+	}
+	if c.Author != nil && c.Author.Login != nil {
+		author = *c.Author.Login
+	}
+	return fmt.Sprintf(
+		"<li>%s %s (%s)</li>",
+		shortSHA(derefString(c.SHA)), html.EscapeString(message), html.EscapeString(author),
+	)
+}
+
+// trimDeploys removes the oldest deploys of the app and environment, so at most
+// maxDeploysPerEnvironment are kept.
+func trimDeploys(deploys []Deploy, app, env string) []Deploy {
+	count := 0
+	for _, d := range deploys {
+		if d.App == app && d.Environment == env {
+			count++
+		}
+	}
+	var kept []Deploy
+	for _, d := range deploys {
+		if d.App == app && d.Environment == env && count > maxDeploysPerEnvironment {
+			count--
+			continue
+		}
+		kept = append(kept, d)
+	}
+	return kept
+}
+
+func (s *DeploysService) appInRoom(app, roomID string) bool {
+	for _, r := range s.Apps[app].Rooms {
+		if r == roomID {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *DeploysService) roomIDs() []string {
+	seen := make(map[string]bool)
+	var roomIDs []string
+	for _, app := range s.Apps {
+		for _, roomID := range app.Rooms {
+			if !seen[roomID] {
+				seen[roomID] = true
+				roomIDs = append(roomIDs, roomID)
+			}
+		}
+	}
+	return roomIDs
+}
+
+// githubClient returns a client with the Github credentials of the ClientUserID, or an
+// unauthenticated client if there is no realm.
+func (s *DeploysService) githubClient() *gogithub.Client {
+	if s.RealmID == "" {
+		return client.New("")
+	}
+	token, err := getTokenForUser(s.RealmID, s.ClientUserID)
+	if err != nil {
+		log.WithFields(log.Fields{
+			log.ErrorKey: err,
+			"user_id":    s.ClientUserID,
+			"realm_id":   s.RealmID,
+		}).Print("Failed to get token for user")
+	}
+	return client.New(token)
+}
+
+// modify applies fn to the stored version of this service and stores it. The deploys of this
+// instance are replaced with the modified deploys.
+func (s *DeploysService) modify(fn func(srv *DeploysService)) error {
+	stored, err := database.GetServiceDB().ModifyService(s.ServiceID(), func(service types.Service) error {
+		srv, ok := service.(*DeploysService)
+		if !ok {
+			return fmt.Errorf("service %s is not a deploys service", s.ServiceID())
+		}
+		fn(srv)
+		return nil
+	})
+	if srv, ok := stored.(*DeploysService); ok {
+		s.Deploys = srv.Deploys
+	}
+	return err
+}
+
+func shortSHA(sha string) string {
+	if len(sha) > 7 {
+		return sha[:7]
+	}
+	return sha
+}
+
+func init() {
+	types.RegisterService(func(serviceID, serviceUserID, webhookEndpointURL string) types.Service {
+		return &DeploysService{
+			DefaultService:     types.NewDefaultService(serviceID, serviceUserID, DeploysServiceType),
+			webhookEndpointURL: webhookEndpointURL,
+		}
+	})
+}
@@ -0,0 +1,169 @@
+package github
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	gogithub "github.com/google/go-github/github"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+)
+
+func TestDeploys(t *testing.T) {
+	srv, err := types.CreateService("deploys", DeploysServiceType, "@deploybot:hyrule", []byte(`{
+		"Secret": "its_a_secret",
+		"Apps": {
+			"website": {"Rooms": ["!ops:hyrule", "!web:hyrule"]}
+		}
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create deploys service: ", err)
+	}
+	store := &threadStorage{service: srv}
+	database.SetServiceDB(store)
+
+	sent := make(map[string][]string) // room ID => bodies
+	matrixCli := deploysTestClient(sent)
+	deploySrv := srv.(*DeploysService)
+	checkDeployWebhook(t, deploySrv, matrixCli)
+	checkRecordDeploy(t, deploySrv, matrixCli, sent)
+	checkListDeploys(t, deploySrv, matrixCli)
+	if len(store.service.(*DeploysService).Deploys) != 2 {
+		t.Errorf("TestDeploys: want 2 stored deploys, got %v", store.service.(*DeploysService).Deploys)
+	}
+}
+
+// deploysTestClient returns a client which appends the HTML of each message it sends to sent.
+func deploysTestClient(sent map[string][]string) *gomatrix.Client {
+	matrixCli, _ := gomatrix.NewClient("https://hyrule", "@deploybot:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		segs := strings.Split(req.URL.Path, "/")
+		if len(segs) < 7 || segs[6] != "send" {
+			return nil, fmt.Errorf("Unhandled URL: %s", req.URL.String())
+		}
+		var content map[string]interface{}
+		if err := json.NewDecoder(req.Body).Decode(&content); err != nil {
+			return nil, fmt.Errorf("Failed to decode request JSON: %s", err)
+		}
+		sent[segs[5]] = append(sent[segs[5]], content["formatted_body"].(string))
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$yup:event"}`)),
+		}, nil
+	})}
+	return matrixCli
+}
+
+// checkDeployWebhook POSTs a deploy of v1.2.2 to prod, which is only recorded once the secret is sent.
+func checkDeployWebhook(t *testing.T, deploySrv *DeploysService, matrixCli *gomatrix.Client) {
+	req, _ := http.NewRequest("POST", "https://neb/services/hooks/deploys", strings.NewReader(
+		`{"app": "website", "version": "v1.2.2", "environment": "prod", "deployed_by": "ci"}`,
+	))
+	w := httptest.NewRecorder()
+	deploySrv.OnReceiveWebhook(w, req, matrixCli)
+	if w.Code != 403 {
+		t.Errorf("TestDeploys: want webhooks without the secret to be refused, got HTTP %d", w.Code)
+	}
+	req.Header.Set("Authorization", "Bearer its_a_secret")
+	w = httptest.NewRecorder()
+	deploySrv.OnReceiveWebhook(w, req, matrixCli)
+	if w.Code != 200 {
+		t.Fatalf("TestDeploys: want HTTP 200, got %d", w.Code)
+	}
+}
+
+// checkRecordDeploy records a deploy of v1.2.3 to prod from !ops:hyrule.
+func checkRecordDeploy(t *testing.T, deploySrv *DeploysService, matrixCli *gomatrix.Client, sent map[string][]string) {
+	res, err := deploySrv.cmdRecord(matrixCli, "!ops:hyrule", "@alice:hyrule", []string{"website", "v1.2.3", "prod"})
+	if err != nil {
+		t.Fatal("TestDeploys: failed to record deploy: ", err)
+	}
+	want := "<b>@alice:hyrule</b> deployed <b>website</b> v1.2.3 to <b>prod</b> (previously v1.2.2)"
+	if got := res.(gomatrix.HTMLMessage).FormattedBody; got != want {
+		t.Errorf("TestDeploys: want response %q, got %q", want, got)
+	}
+	if len(sent["!ops:hyrule"]) != 1 || len(sent["!web:hyrule"]) != 2 || sent["!web:hyrule"][1] != want {
+		t.Errorf("TestDeploys: want each deploy announced once in each room, got %v", sent)
+	}
+	if _, err := deploySrv.cmdRecord(matrixCli, "!other:hyrule", "@alice:hyrule", []string{"website", "v1.2.4", "prod"}); err == nil {
+		t.Error("TestDeploys: want deploys to only be recorded in the app's rooms")
+	}
+}
+
+// checkListDeploys lists the deploys of the website, which can only be done in its rooms.
+func checkListDeploys(t *testing.T, deploySrv *DeploysService, matrixCli *gomatrix.Client) {
+	if _, err := deploySrv.cmdDeploys("!other:hyrule", []string{"website", "prod"}); err == nil {
+		t.Error("TestDeploys: want deploys to only be listed in the app's rooms")
+	}
+	res, err := deploySrv.cmdDeploys("!web:hyrule", []string{"website", "prod"})
+	if err != nil {
+		t.Fatal("TestDeploys: failed to list deploys: ", err)
+	}
+	body := res.(*gomatrix.TextMessage).Body
+	if !strings.HasPrefix(body, "Recent deploys of website to prod:\nv1.2.3 to prod at ") || !strings.Contains(body, "by @alice:hyrule\nv1.2.2 to prod at ") {
+		t.Errorf("TestDeploys: want both deploys listed newest first, got %q", body)
+	}
+	// Errors are private, but the deploys are listed in the room.
+	for _, cmd := range deploySrv.Commands(matrixCli) {
+		if cmd.Path[0] != "deploys" {
+			continue
+		}
+		res, err := cmd.Command("!web:hyrule", "@alice:hyrule", []string{"website"})
+		if r, ok := res.(types.Response); !cmd.Private || err != nil || !ok || r.Private {
+			t.Errorf("TestDeploys: want a private command with a public response, got %v %+v (err=%v)", cmd.Private, res, err)
+		}
+	}
+}
+
+func TestDeploySecret(t *testing.T) {
+	config := []byte(`{"Apps": {"website": {"Rooms": ["!ops:hyrule"]}}}`)
+	var sent []string
+	matrixCli := digestMatrixClient(&sent)
+	old, err := types.CreateService("deploys", DeploysServiceType, "@deploybot:hyrule", config)
+	if err != nil {
+		t.Fatal("Failed to create deploys service: ", err)
+	}
+	if err := old.Register(nil, matrixCli); err != nil {
+		t.Fatal("TestDeploySecret: failed to register: ", err)
+	}
+	secret := old.(*DeploysService).Secret
+	if len(secret) != 64 {
+		t.Fatalf("TestDeploySecret: want a generated secret, got %q", secret)
+	}
+
+	srv, _ := types.CreateService("deploys", DeploysServiceType, "@deploybot:hyrule", config)
+	if err := srv.Register(old, matrixCli); err != nil {
+		t.Fatal("TestDeploySecret: failed to register again: ", err)
+	}
+	if got := srv.(*DeploysService).Secret; got != secret {
+		t.Errorf("TestDeploySecret: want the secret %q to be kept, got %q", secret, got)
+	}
+}
+
+func TestDeployCommits(t *testing.T) {
+	var commits gogithub.CommitsComparison
+	json.Unmarshal([]byte(`{
+		"total_commits": 2,
+		"commits": [
+			{"sha": "1111111111", "commit": {"message": "Fix <bug>\n\nLonger description", "author": {"name": "Bob"}}},
+			{"sha": "2222222222", "commit": {"message": "Add feature"}, "author": {"login": "alice"}}
+		]
+	}`), &commits)
+	previous := Deploy{App: "website", Version: "v1.2.2", Environment: "prod"}
+	d := Deploy{App: "website", Version: "v1.2.3", Environment: "prod", SHA: "2222222222"}
+
+	want := `Deployed <b>website</b> v1.2.3 to <b>prod</b> (previously v1.2.2): ` +
+		`<a href="https://github.com/matrix-org/website/compare/v1.2.2...2222222222">2 commits</a>` +
+		`<ul><li>2222222 Add feature (alice)</li><li>1111111 Fix &lt;bug&gt; (Bob)</li></ul>`
+	if got := htmlForDeploy(d, &previous, "matrix-org/website", &commits); got != want {
+		t.Errorf("TestDeployCommits want:\n%s\ngot:\n%s", want, got)
+	}
+}
@@ -0,0 +1,586 @@
+package github
+
+import (
+	"fmt"
+	"html"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	gogithub "github.com/google/go-github/github"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/polling/cron"
+	"github.com/matrix-org/go-neb/services/github/client"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+)
+
+// DigestServiceType of the Github Digest service.
+const DigestServiceType = "github-digest"
+
+// The schedule used if none is configured: every Monday at 09:00 UTC.
+const defaultDigestSchedule = "0 9 * * 1"
+
+// The number of days without activity after which an open pull request is stale, if none is configured.
+const defaultStaleDays = 7
+
+// The maximum number of contributors and stale pull requests listed in a digest.
+const (
+	maxDigestContributors = 5
+	maxDigestStalePRs     = 10
+)
+
+// DigestService contains the Config fields for the Github Digest Service.
+//
+// Before you can set up a Github Digest Service, you need to set up a Github Realm. The
+// ClientUserID must have authenticated with the realm. This service does not require a
+// syncing client.
+//
+// This service sends a summary of each repository into its rooms on the given cron schedule.
+// The summary covers the time since the previous digest, or since the service was created for the
+// first digest, and includes pull requests opened and
+// merged, issues opened and closed, the top contributors by commits, releases, and open pull
+// requests which have had no activity for StaleDays days. Schedules are evaluated in UTC and
+// use the standard five cron fields e.g "0 9 * * 1" for 09:00 every Monday.
+//
+// Example request:
+//   {
+//       ClientUserID: "@alice:localhost",
+//       RealmID: "github-realm-id",
+//       Schedule: "0 9 * * 1",
+//       StaleDays: 7,
+//       Rooms: {
+//           "!qmElAGdFYCHoCJuaNt:localhost": {
+//               Repos: ["matrix-org/go-neb", "matrix-org/synapse"]
+//           }
+//       }
+//   }
+type DigestService struct {
+	types.DefaultService
+	// The user ID whose Github credentials are used to read the repositories.
+	ClientUserID string
+	// The ID of an existing "github" realm. This realm will be used to obtain
+	// the Github credentials of the ClientUserID.
+	RealmID string
+	// Optional. The cron schedule to send digests on. Defaults to "0 9 * * 1".
+	Schedule string
+	// Optional. The number of days without activity after which an open pull request
+	// is listed as needing review. Defaults to 7.
+	StaleDays int
+	// A map from Matrix room ID to the repositories to send digests for.
+	Rooms map[string]struct {
+		// A list of "owner/repo"-style repositories.
+		Repos []string
+	} `rooms:"keys"`
+	// The time the last digests were sent, or the time the service was created if none have been
+	// sent yet. This is populated by Go-NEB.
+	LastDigestTimestampSecs int64
+}
+
+// repoDigest is the activity in a repository between two times.
+type repoDigest struct {
+	Repo         string
+	Since        time.Time
+	PRsOpened    int
+	PRsMerged    int
+	IssuesOpened int
+	IssuesClosed int
+	Contributors []contributor
+	Releases     []*gogithub.RepositoryRelease
+	StalePRs     []*gogithub.PullRequest
+}
+
+// contributor is the number of commits made by a single author.
+type contributor struct {
+	Name    string
+	Commits int
+}
+
+// Register validates the schedule and repositories and joins the configured rooms.
+func (s *DigestService) Register(oldService types.Service, client *gomatrix.Client) error {
+	if err := s.validate(); err != nil {
+		return err
+	}
+	// Carry on from the last digest rather than repeating it. New services start counting from now,
+	// so that the first digest is sent at the next time the schedule matches.
+	if old, ok := oldService.(*DigestService); ok && s.LastDigestTimestampSecs == 0 {
+		s.LastDigestTimestampSecs = old.LastDigestTimestampSecs
+	}
+	if s.LastDigestTimestampSecs == 0 {
+		s.LastDigestTimestampSecs = time.Now().Unix()
+	}
+	for roomID := range s.Rooms {
+		if _, err := client.JoinRoom(roomID, "", nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validate checks the realm, schedule and repositories of the config.
+func (s *DigestService) validate() error {
+	if s.RealmID == "" || s.ClientUserID == "" {
+		return fmt.Errorf("RealmID and ClientUserID is required")
+	}
+	realm, err := database.GetServiceDB().LoadAuthRealm(s.RealmID)
+	if err != nil {
+		return err
+	}
+	if realm.Type() != "github" {
+		return fmt.Errorf("Realm is of type '%s', not 'github'", realm.Type())
+	}
+	if _, err := cron.Parse(s.schedule()); err != nil {
+		return fmt.Errorf("Invalid Schedule: %s", err)
+	}
+	if s.StaleDays < 0 {
+		return fmt.Errorf("StaleDays cannot be negative")
+	}
+	if len(s.Rooms) == 0 {
+		return fmt.Errorf("No rooms specified")
+	}
+	for roomID, roomConfig := range s.Rooms {
+		for _, ownerRepo := range roomConfig.Repos {
+			if strings.Count(ownerRepo, "/") != 1 {
+				return fmt.Errorf("Bad owner/repo '%s' for room %s", ownerRepo, roomID)
+			}
+		}
+	}
+	return nil
+}
+
+// RealmIDs returns the github realm used by this service.
+func (s *DigestService) RealmIDs() []string {
+	return []string{s.RealmID}
+}
+
+// RoomTargets returns each repository which is summarised in the room.
+func (s *DigestService) RoomTargets(roomID string) []string {
+	targets := append([]string{}, s.Rooms[roomID].Repos...)
+	sort.Strings(targets)
+	return targets
+}
+
+// OnPoll sends the digests if they are due, and returns when they are next due.
+func (s *DigestService) OnPoll(cli *gomatrix.Client) time.Time {
+	return s.poll(cli, time.Now().UTC())
+}
+
+// poll sends the digests if the schedule has matched since the last digest, and returns when they are
+// next due.
+func (s *DigestService) poll(cli *gomatrix.Client, now time.Time) time.Time {
+	logger := log.WithFields(log.Fields{
+		"service_id":   s.ServiceID(),
+		"service_type": s.ServiceType(),
+	})
+	// The poller holds onto the service it was started with, so reload it to pick up
+	// the time of the last digest.
+	srv := s
+	if latest, err := database.GetServiceDB().LoadService(s.ServiceID()); err == nil {
+		if digestSrv, ok := latest.(*DigestService); ok {
+			srv = digestSrv
+		}
+	}
+	schedule, err := cron.Parse(srv.schedule())
+	if err != nil {
+		logger.WithError(err).Error("Invalid schedule, stopping digests")
+		return time.Unix(0, 0)
+	}
+
+	if srv.LastDigestTimestampSecs == 0 {
+		// Register records when the service was created, so this can only be a service stored before it
+		// did. Start counting from now rather than summarising the whole history of the repositories.
+		if err = srv.modify(func(stored *DigestService) { stored.LastDigestTimestampSecs = now.Unix() }); err != nil {
+			logger.WithError(err).Error("Failed to persist last digest time")
+		}
+		return schedule.Next(now)
+	}
+	last := time.Unix(srv.LastDigestTimestampSecs, 0).UTC()
+	due := schedule.Next(last)
+	if due.IsZero() {
+		logger.Error("Schedule never matches, stopping digests")
+		return time.Unix(0, 0)
+	}
+	if now.Before(due) {
+		return due
+	}
+
+	srv.sendDigests(cli, last, now)
+
+	err = srv.modify(func(stored *DigestService) {
+		stored.LastDigestTimestampSecs = now.Unix()
+	})
+	if err != nil {
+		logger.WithError(err).Error("Failed to persist last digest time")
+	}
+	return schedule.Next(now)
+}
+
+func (s *DigestService) sendDigests(cli *gomatrix.Client, since, until time.Time) {
+	ghCli := s.githubClientFor(s.ClientUserID, false)
+	if ghCli == nil {
+		log.WithFields(log.Fields{
+			"service_id": s.ServiceID(),
+			"user_id":    s.ClientUserID,
+		}).Error("Cannot send digests: no authenticated client exists for user ID")
+		return
+	}
+	digests := make(map[string]string) // owner/repo => HTML, so repos in many rooms are only fetched once
+	for roomID, roomConfig := range s.Rooms {
+		for _, ownerRepo := range roomConfig.Repos {
+			logger := log.WithFields(log.Fields{
+				"repo":    ownerRepo,
+				"room_id": roomID,
+			})
+			htmlText, ok := digests[strings.ToLower(ownerRepo)]
+			if !ok {
+				segs := strings.Split(ownerRepo, "/")
+				digest, err := buildRepoDigest(ghCli, segs[0], segs[1], since, until, s.staleDays())
+				if err != nil {
+					logger.WithError(err).Error("Failed to build digest")
+					continue
+				}
+				htmlText = htmlForDigest(digest, until)
+				digests[strings.ToLower(ownerRepo)] = htmlText
+			}
+			if _, err := cli.SendMessageEvent(roomID, "m.room.message", gomatrix.GetHTMLMessage("m.notice", htmlText)); err != nil {
+				logger.WithError(err).Print("Failed to send digest to room")
+			}
+		}
+	}
+}
+
+// digestPeriod is the time covered by a digest.
+type digestPeriod struct {
+	since time.Time
+	until time.Time
+}
+
+// contains returns true if t is within the period.
+func (p digestPeriod) contains(t *time.Time) bool {
+	return t != nil && !t.Before(p.since) && t.Before(p.until)
+}
+
+// buildRepoDigest fetches the activity in the repository between since and until.
+func buildRepoDigest(cli *gogithub.Client, owner, repo string, since, until time.Time, staleDays int) (*repoDigest, error) {
+	digest := &repoDigest{Repo: owner + "/" + repo, Since: since}
+	period := digestPeriod{since, until}
+	var err error
+	if err = countIssues(cli, owner, repo, period, digest); err != nil {
+		return nil, err
+	}
+	if digest.PRsMerged, err = countMergedPRs(cli, owner, repo, period); err != nil {
+		return nil, err
+	}
+	if digest.Contributors, err = topContributors(cli, owner, repo, period); err != nil {
+		return nil, err
+	}
+	if digest.Releases, err = publishedReleases(cli, owner, repo, period); err != nil {
+		return nil, err
+	}
+	if digest.StalePRs, err = stalePRs(cli, owner, repo, until.AddDate(0, 0, -staleDays)); err != nil {
+		return nil, err
+	}
+	return digest, nil
+}
+
+// countIssues counts the issues and pull requests which were opened, and the issues which were closed,
+// in the period.
+func countIssues(cli *gogithub.Client, owner, repo string, period digestPeriod, digest *repoDigest) error {
+	// Issues and pull requests which were opened or closed have been updated since then too.
+	opts := &gogithub.IssueListByRepoOptions{
+		State:       "all",
+		Since:       period.since,
+		ListOptions: gogithub.ListOptions{PerPage: 100},
+	}
+	for {
+		issues, res, err := cli.Issues.ListByRepo(owner, repo, opts)
+		if err != nil {
+			return err
+		}
+		for _, issue := range issues {
+			digest.countIssue(issue, period)
+		}
+		if res.NextPage == 0 {
+			return nil
+		}
+		opts.Page = res.NextPage
+	}
+}
+
+func (d *repoDigest) countIssue(issue *gogithub.Issue, period digestPeriod) {
+	if issue.PullRequestLinks != nil {
+		if period.contains(issue.CreatedAt) {
+			d.PRsOpened++
+		}
+		return
+	}
+	if period.contains(issue.CreatedAt) {
+		d.IssuesOpened++
+	}
+	if period.contains(issue.ClosedAt) {
+		d.IssuesClosed++
+	}
+}
+
+// countMergedPRs counts the pull requests which were merged in the period.
+func countMergedPRs(cli *gogithub.Client, owner, repo string, period digestPeriod) (int, error) {
+	opts := &gogithub.PullRequestListOptions{
+		State:       "closed",
+		Sort:        "updated",
+		Direction:   "desc",
+		ListOptions: gogithub.ListOptions{PerPage: 100},
+	}
+	merged := 0
+	for {
+		prs, res, err := cli.PullRequests.List(owner, repo, opts)
+		if err != nil {
+			return 0, err
+		}
+		for _, pr := range prs {
+			if pr.UpdatedAt != nil && pr.UpdatedAt.Before(period.since) {
+				return merged, nil // sorted by update time, so the rest are older
+			}
+			if period.contains(pr.MergedAt) {
+				merged++
+			}
+		}
+		if res.NextPage == 0 {
+			return merged, nil
+		}
+		opts.Page = res.NextPage
+	}
+}
+
+// topContributors returns the authors of the most commits in the period, most commits first.
+func topContributors(cli *gogithub.Client, owner, repo string, period digestPeriod) ([]contributor, error) {
+	commitCounts := make(map[string]int)
+	opts := &gogithub.CommitsListOptions{
+		Since:       period.since,
+		Until:       period.until,
+		ListOptions: gogithub.ListOptions{PerPage: 100},
+	}
+	for {
+		commits, res, err := cli.Repositories.ListCommits(owner, repo, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, commit := range commits {
+			if name, ok := commitAuthor(commit); ok {
+				commitCounts[name]++
+			}
+		}
+		if res.NextPage == 0 {
+			break
+		}
+		opts.Page = res.NextPage
+	}
+
+	var contributors []contributor
+	for name, commits := range commitCounts {
+		contributors = append(contributors, contributor{name, commits})
+	}
+	sort.Slice(contributors, func(i, j int) bool {
+		a, b := contributors[i], contributors[j]
+		if a.Commits != b.Commits {
+			return a.Commits > b.Commits
+		}
+		return a.Name < b.Name
+	})
+	if len(contributors) > maxDigestContributors {
+		contributors = contributors[:maxDigestContributors]
+	}
+	return contributors, nil
+}
+
+// commitAuthor returns the Github login of the author of the commit, or their name if the commit
+// isn't linked to a Github user.
+func commitAuthor(commit *gogithub.RepositoryCommit) (string, bool) {
+	if commit.Author != nil && commit.Author.Login != nil {
+		return *commit.Author.Login, true
+	}
+	if commit.Commit != nil && commit.Commit.Author != nil && commit.Commit.Author.Name != nil {
+		return *commit.Commit.Author.Name, true
+	}
+	return "", false
+}
+
+// publishedReleases returns the releases which were published in the period.
+func publishedReleases(cli *gogithub.Client, owner, repo string, period digestPeriod) ([]*gogithub.RepositoryRelease, error) {
+	// Releases are listed newest first, so the first page is plenty for a digest.
+	releases, _, err := cli.Repositories.ListReleases(owner, repo, &gogithub.ListOptions{PerPage: 100})
+	if err != nil {
+		return nil, err
+	}
+	var published []*gogithub.RepositoryRelease
+	for _, release := range releases {
+		if release.Draft != nil && *release.Draft {
+			continue
+		}
+		if release.PublishedAt != nil && period.contains(&release.PublishedAt.Time) {
+			published = append(published, release)
+		}
+	}
+	return published, nil
+}
+
+// stalePRs returns the open pull requests which haven't been updated since staleBefore, least
+// recently updated first.
+func stalePRs(cli *gogithub.Client, owner, repo string, staleBefore time.Time) ([]*gogithub.PullRequest, error) {
+	opts := &gogithub.PullRequestListOptions{
+		State:       "open",
+		Sort:        "updated",
+		Direction:   "asc",
+		ListOptions: gogithub.ListOptions{PerPage: 100},
+	}
+	var stale []*gogithub.PullRequest
+	for {
+		prs, res, err := cli.PullRequests.List(owner, repo, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, pr := range prs {
+			if pr.UpdatedAt == nil || !pr.UpdatedAt.Before(staleBefore) {
+				return stale, nil // sorted by update time, so the rest are more recent
+			}
+			stale = append(stale, pr)
+		}
+		if res.NextPage == 0 {
+			return stale, nil
+		}
+		opts.Page = res.NextPage
+	}
+}
+
+// htmlForDigest formats a digest e.g:
+//   Digest for matrix-org/go-neb since 2017-03-06
+//   Pull requests: 4 opened, 3 merged
+//   Issues: 5 opened, 2 closed
+//   Top contributors: alice (12 commits), bob (3 commits)
+//   Releases: v0.2.0
+//   Stale pull requests needing review:
+//    - #12 Add a thing by alice, last updated 20 days ago
+func htmlForDigest(d *repoDigest, now time.Time) string {
+	var lines []string
+	lines = append(lines, fmt.Sprintf(
+		"<b>Digest for %s</b> since %s", html.EscapeString(d.Repo), d.Since.UTC().Format("2006-01-02"),
+	))
+	lines = append(lines, fmt.Sprintf("Pull requests: %d opened, %d merged", d.PRsOpened, d.PRsMerged))
+	lines = append(lines, fmt.Sprintf("Issues: %d opened, %d closed", d.IssuesOpened, d.IssuesClosed))
+	if len(d.Contributors) > 0 {
+		var names []string
+		for _, c := range d.Contributors {
+			noun := "commits"
+			if c.Commits == 1 {
+				noun = "commit"
+			}
+			names = append(names, fmt.Sprintf("%s (%d %s)", html.EscapeString(c.Name), c.Commits, noun))
+		}
+		lines = append(lines, "Top contributors: "+strings.Join(names, ", "))
+	}
+	if len(d.Releases) > 0 {
+		var names []string
+		for _, r := range d.Releases {
+			name := derefString(r.Name)
+			if name == "" {
+				name = derefString(r.TagName)
+			}
+			names = append(names, fmt.Sprintf(
+				`<a href="%s">%s</a>`, html.EscapeString(derefString(r.HTMLURL)), html.EscapeString(name),
+			))
+		}
+		lines = append(lines, "Releases: "+strings.Join(names, ", "))
+	}
+	text := strings.Join(lines, "<br>")
+	if len(d.StalePRs) == 0 {
+		return text
+	}
+	text += "<br>Stale pull requests needing review:<ul>"
+	for i, pr := range d.StalePRs {
+		if i == maxDigestStalePRs {
+			text += fmt.Sprintf("<li>and %d more</li>", len(d.StalePRs)-maxDigestStalePRs)
+			break
+		}
+		author := ""
+		if pr.User != nil && pr.User.Login != nil {
+			author = " by " + html.EscapeString(*pr.User.Login)
+		}
+		days := int(now.Sub(*pr.UpdatedAt).Hours() / 24)
+		text += fmt.Sprintf(
+			`<li><a href="%s">#%d %s</a>%s, last updated %d days ago</li>`,
+			html.EscapeString(derefString(pr.HTMLURL)), derefInt(pr.Number), html.EscapeString(derefString(pr.Title)),
+			author, days,
+		)
+	}
+	return text + "</ul>"
+}
+
+func (s *DigestService) schedule() string {
+	if s.Schedule == "" {
+		return defaultDigestSchedule
+	}
+	return s.Schedule
+}
+
+func (s *DigestService) staleDays() int {
+	if s.StaleDays == 0 {
+		return defaultStaleDays
+	}
+	return s.StaleDays
+}
+
+func (s *DigestService) githubClientFor(userID string, allowUnauth bool) *gogithub.Client {
+	token, err := getTokenForUser(s.RealmID, userID)
+	if err != nil {
+		log.WithFields(log.Fields{
+			log.ErrorKey: err,
+			"user_id":    userID,
+			"realm_id":   s.RealmID,
+		}).Print("Failed to get token for user")
+	}
+	if token != "" {
+		return client.New(token)
+	} else if allowUnauth {
+		return client.New("")
+	}
+	return nil
+}
+
+// modify applies fn to the stored version of this service and stores it. The last digest time of
+// this instance is replaced with the modified one.
+func (s *DigestService) modify(fn func(srv *DigestService)) error {
+	stored, err := database.GetServiceDB().ModifyService(s.ServiceID(), func(service types.Service) error {
+		srv, ok := service.(*DigestService)
+		if !ok {
+			return fmt.Errorf("service %s is not a github-digest service", s.ServiceID())
+		}
+		fn(srv)
+		return nil
+	})
+	if srv, ok := stored.(*DigestService); ok {
+		s.LastDigestTimestampSecs = srv.LastDigestTimestampSecs
+	}
+	return err
+}
+
+func derefString(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func derefInt(i *int) int {
+	if i == nil {
+		return 0
+	}
+	return *i
+}
+
+func init() {
+	types.RegisterService(func(serviceID, serviceUserID, webhookEndpointURL string) types.Service {
+		return &DigestService{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, DigestServiceType),
+		}
+	})
+}
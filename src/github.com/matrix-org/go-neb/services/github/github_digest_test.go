@@ -0,0 +1,180 @@
+package github
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	gogithub "github.com/google/go-github/github"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/realms/github"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+)
+
+// digestAPI returns a transport which serves the Github API requests made for a digest of owner/repo.
+func digestAPI() http.RoundTripper {
+	responses := map[string]string{
+		"/repos/owner/repo/issues": `[
+			{"number": 1, "created_at": "2017-03-07T10:00:00Z", "closed_at": "2017-03-08T10:00:00Z"},
+			{"number": 2, "created_at": "2017-03-01T10:00:00Z", "closed_at": "2017-03-09T10:00:00Z"},
+			{"number": 3, "created_at": "2017-03-10T10:00:00Z"},
+			{"number": 4, "created_at": "2017-03-10T10:00:00Z", "pull_request": {}}
+		]`,
+		"/repos/owner/repo/pulls?closed": `[
+			{"number": 5, "updated_at": "2017-03-12T10:00:00Z", "merged_at": "2017-03-12T10:00:00Z"},
+			{"number": 6, "updated_at": "2017-03-11T10:00:00Z"},
+			{"number": 7, "updated_at": "2017-03-01T10:00:00Z", "merged_at": "2017-03-01T10:00:00Z"}
+		]`,
+		"/repos/owner/repo/pulls?open": `[
+			{"number": 8, "title": "Old <thing>", "html_url": "https://github.com/owner/repo/pull/8",
+			 "updated_at": "2017-02-21T09:00:00Z", "user": {"login": "carol"}},
+			{"number": 9, "updated_at": "2017-03-12T10:00:00Z"}
+		]`,
+		"/repos/owner/repo/commits": `[
+			{"author": {"login": "alice"}},
+			{"author": {"login": "bob"}},
+			{"author": {"login": "alice"}},
+			{"commit": {"author": {"name": "Dave"}}}
+		]`,
+		"/repos/owner/repo/releases": `[
+			{"tag_name": "v0.2.0", "html_url": "https://github.com/owner/repo/releases/v0.2.0", "published_at": "2017-03-10T10:00:00Z"},
+			{"tag_name": "v0.3.0-rc1", "draft": true, "published_at": "2017-03-11T10:00:00Z"},
+			{"tag_name": "v0.1.0", "published_at": "2017-01-10T10:00:00Z"}
+		]`,
+	}
+	return testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		key := req.URL.Path
+		if state := req.URL.Query().Get("state"); key == "/repos/owner/repo/pulls" {
+			key += "?" + state
+		}
+		body, ok := responses[key]
+		if !ok {
+			return nil, fmt.Errorf("Unhandled URL: %s", req.URL.String())
+		}
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(body))}, nil
+	})
+}
+
+func TestGithubDigest(t *testing.T) {
+	since := time.Date(2017, 3, 6, 9, 0, 0, 0, time.UTC)
+	now := time.Date(2017, 3, 13, 9, 0, 0, 0, time.UTC)
+	httpCli := &http.Client{Transport: digestAPI()}
+
+	digest, err := buildRepoDigest(gogithub.NewClient(httpCli), "owner", "repo", since, now, 7)
+	if err != nil {
+		t.Fatal("TestGithubDigest failed to build digest: ", err)
+	}
+	want := "<b>Digest for owner/repo</b> since 2017-03-06<br>" +
+		"Pull requests: 1 opened, 1 merged<br>" +
+		"Issues: 2 opened, 2 closed<br>" +
+		"Top contributors: alice (2 commits), Dave (1 commit), bob (1 commit)<br>" +
+		`Releases: <a href="https://github.com/owner/repo/releases/v0.2.0">v0.2.0</a><br>` +
+		"Stale pull requests needing review:<ul>" +
+		`<li><a href="https://github.com/owner/repo/pull/8">#8 Old &lt;thing&gt;</a> by carol, last updated 20 days ago</li>` +
+		"</ul>"
+	if got := htmlForDigest(digest, now); got != want {
+		t.Errorf("TestGithubDigest want:\n%s\ngot:\n%s", want, got)
+	}
+}
+
+// digestStorage stores a single github-digest service along with the realm and session it uses.
+type digestStorage struct {
+	threadStorage
+	realm types.AuthRealm
+}
+
+func (s *digestStorage) LoadAuthRealm(realmID string) (types.AuthRealm, error) {
+	return s.realm, nil
+}
+
+func (s *digestStorage) LoadAuthSessionByUser(realmID, userID string) (types.AuthSession, error) {
+	return &github.Session{AccessToken: "its_a_secret"}, nil
+}
+
+// digestMatrixClient returns a client which can join !castle:hyrule and appends the HTML of the
+// messages sent there to sent.
+func digestMatrixClient(sent *[]string) *gomatrix.Client {
+	matrixCli, _ := gomatrix.NewClient("https://hyrule", "@ghbot:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.Path, "/join/") {
+			return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(`{"room_id":"!castle:hyrule"}`))}, nil
+		}
+		if !strings.Contains(req.URL.Path, "/rooms/!castle:hyrule/send/m.room.message") {
+			return nil, fmt.Errorf("Unhandled URL: %s", req.URL.String())
+		}
+		var content map[string]interface{}
+		if err := json.NewDecoder(req.Body).Decode(&content); err != nil {
+			return nil, err
+		}
+		*sent = append(*sent, content["formatted_body"].(string))
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$digest:hyrule"}`))}, nil
+	})}
+	return matrixCli
+}
+
+// checkPoll polls the service at now and checks that the next poll is at wantNext and that wantSent
+// digests have been sent in total.
+func checkPoll(t *testing.T, s *DigestService, cli *gomatrix.Client, now, wantNext time.Time, sent *[]string, wantSent int) {
+	if next := s.poll(cli, now); !next.Equal(wantNext) || len(*sent) != wantSent {
+		t.Fatalf("TestGithubDigestSchedule: polling at %s: want %d digests and next poll %s, got %d digests and next poll %s",
+			now, wantSent, wantNext, len(*sent), next)
+	}
+}
+
+func TestGithubDigestSchedule(t *testing.T) {
+	realm, err := types.CreateAuthRealm("ghrealm", "github", []byte(`{"ClientSecret":"secret","ClientID":"id"}`))
+	if err != nil {
+		t.Fatal("Failed to create realm: ", err)
+	}
+	srv, err := types.CreateService("digest", DigestServiceType, "@ghbot:hyrule", []byte(`{
+		"ClientUserID": "@alice:hyrule",
+		"RealmID": "ghrealm",
+		"Schedule": "0 9 * * 1",
+		"Rooms": {"!castle:hyrule": {"Repos": ["owner/repo"]}}
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create github-digest service: ", err)
+	}
+	store := &digestStorage{threadStorage: threadStorage{service: srv}, realm: realm}
+	database.SetServiceDB(store)
+
+	// the Github client of the realm session uses the default transport
+	defaultTransport := http.DefaultTransport
+	http.DefaultTransport = digestAPI()
+	defer func() { http.DefaultTransport = defaultTransport }()
+
+	var sent []string
+	matrixCli := digestMatrixClient(&sent)
+
+	s := srv.(*DigestService)
+	if err := s.Register(nil, matrixCli); err != nil {
+		t.Fatal("TestGithubDigestSchedule: failed to register: ", err)
+	}
+	if s.LastDigestTimestampSecs == 0 {
+		t.Fatal("TestGithubDigestSchedule: want the creation time to be recorded")
+	}
+
+	// created on a Monday after the schedule matched, so the first digest is a week later
+	s.LastDigestTimestampSecs = time.Date(2017, 3, 6, 10, 0, 0, 0, time.UTC).Unix()
+	store.StoreService(s)
+	firstDigest := time.Date(2017, 3, 13, 9, 0, 0, 0, time.UTC)
+	checkPoll(t, s, matrixCli, time.Date(2017, 3, 8, 12, 0, 0, 0, time.UTC), firstDigest, &sent, 0)
+
+	now := firstDigest.Add(30 * time.Second)
+	secondDigest := time.Date(2017, 3, 20, 9, 0, 0, 0, time.UTC)
+	checkPoll(t, s, matrixCli, now, secondDigest, &sent, 1)
+	if !strings.Contains(sent[0], "<b>Digest for owner/repo</b> since 2017-03-06") || !strings.Contains(sent[0], "Pull requests: 1 opened, 1 merged") {
+		t.Errorf("TestGithubDigestSchedule: want a digest of owner/repo since creation, got %s", sent[0])
+	}
+	if stored := store.service.(*DigestService); stored.LastDigestTimestampSecs != now.Unix() {
+		t.Errorf("TestGithubDigestSchedule: want the digest time to be stored, got %d", stored.LastDigestTimestampSecs)
+	}
+	checkPoll(t, s, matrixCli, now.Add(time.Hour), secondDigest, &sent, 1)
+}
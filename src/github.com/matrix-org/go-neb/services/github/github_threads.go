@@ -0,0 +1,314 @@
+package github
+
+import (
+	"fmt"
+	"html"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	gogithub "github.com/google/go-github/github"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+)
+
+const cmdGithubLinkUsage = `!github link [owner/repo]#issue (in a thread)`
+const cmdGithubUnlinkUsage = `!github unlink (in a linked thread)`
+
+// threadCommentMarker is added to issue comments which were posted from a Matrix thread, so that
+// they aren't mirrored back into the thread when Github sends them to the webhook.
+const threadCommentMarker = "<!-- sent from a Matrix thread by Go-NEB -->"
+
+// A ThreadLink links a Matrix thread to a Github issue. New comments on the issue are sent
+// into the thread, and replies in the thread are posted as comments on the issue.
+type ThreadLink struct {
+	// The room the thread is in.
+	RoomID string `rooms:"values"`
+	// The event ID of the thread's root event.
+	ThreadID string
+	// The "owner/repo"-style repository of the issue.
+	Repo string
+	// The issue or pull request number.
+	Issue int
+	// The user who linked the thread.
+	LinkedBy string
+}
+
+// OnMessageEvent handles "!github link" and "!github unlink" in threads, and posts replies in
+// linked threads to their issue.
+func (s *Service) OnMessageEvent(cli *gomatrix.Client, event *gomatrix.Event) {
+	body, ok := threadMessageBody(cli, event)
+	if !ok {
+		return
+	}
+	threadID := threadRootID(event)
+	response := s.threadResponse(event, threadID, body)
+	if response == "" {
+		return
+	}
+	content := matrix.ThreadMessage(threadID, gomatrix.TextMessage{MsgType: "m.notice", Body: response})
+	if _, err := cli.SendMessageEvent(event.RoomID, "m.room.message", content); err != nil {
+		log.WithError(err).WithField("room_id", event.RoomID).Print("Failed to send thread link response")
+	}
+}
+
+// threadMessageBody returns the body of the message event, or false if it is empty or was
+// sent by this client or as a notice.
+func threadMessageBody(cli *gomatrix.Client, event *gomatrix.Event) (string, bool) {
+	if event.Sender == cli.UserID {
+		return "", false
+	}
+	if msgtype, ok := event.MessageType(); !ok || msgtype == "m.notice" {
+		return "", false
+	}
+	body, ok := event.Body()
+	return body, ok && body != ""
+}
+
+// threadResponse handles the message in the thread, returning the response to send into the
+// thread or "" if there is nothing to say.
+func (s *Service) threadResponse(event *gomatrix.Event, threadID, body string) string {
+	args := strings.Fields(body)
+	if len(args) < 2 || args[0] != "!github" || (args[1] != "link" && args[1] != "unlink") {
+		if link := s.threadLink(event.RoomID, threadID); link != nil && body[0] != '!' {
+			return s.postThreadReply(link, event.Sender, body)
+		}
+		return ""
+	}
+	if threadID == "" {
+		return fmt.Sprintf("!github %s must be used in a thread", args[1])
+	}
+	if args[1] == "link" {
+		return s.linkThread(event.RoomID, threadID, event.Sender, args[2:])
+	}
+	return s.unlinkThread(event.RoomID, threadID)
+}
+
+func (s *Service) linkThread(roomID, threadID, userID string, args []string) string {
+	if len(args) != 1 {
+		return "Usage: " + cmdGithubLinkUsage
+	}
+	owner, repo, issueNum, resp := s.getIssueDetailsFor(args[0], roomID, cmdGithubLinkUsage)
+	if resp != nil {
+		return resp.(*gomatrix.TextMessage).Body
+	}
+	cli := s.githubClientFor(userID, false)
+	if cli == nil {
+		return "You need to log into Github before you can link threads to issues."
+	}
+	issue, res, err := cli.Issues.Get(owner, repo, issueNum)
+	if err != nil {
+		log.WithError(err).WithField("repo", owner+"/"+repo).Print("Failed to get issue to link")
+		if res == nil {
+			return "Failed to link issue. Failed to connect to Github"
+		}
+		return fmt.Sprintf("Failed to link issue. HTTP %d", res.StatusCode)
+	}
+
+	link := ThreadLink{
+		RoomID:   roomID,
+		ThreadID: threadID,
+		Repo:     owner + "/" + repo,
+		Issue:    issueNum,
+		LinkedBy: userID,
+	}
+	err = s.modifyThreadLinks(func(links []ThreadLink) []ThreadLink {
+		return append(removeThreadLink(links, roomID, threadID), link)
+	})
+	if err != nil {
+		log.WithError(err).WithField("service_id", s.ServiceID()).Error("Failed to store thread link")
+		return "Failed to link issue"
+	}
+	return fmt.Sprintf(
+		"Linked this thread to %s#%d. New comments on the issue will appear here, and replies here will be posted to it: %s",
+		link.Repo, link.Issue, *issue.HTMLURL,
+	)
+}
+
+func (s *Service) unlinkThread(roomID, threadID string) string {
+	link := s.threadLink(roomID, threadID)
+	if link == nil {
+		return "This thread is not linked to an issue"
+	}
+	err := s.modifyThreadLinks(func(links []ThreadLink) []ThreadLink {
+		return removeThreadLink(links, roomID, threadID)
+	})
+	if err != nil {
+		log.WithError(err).WithField("service_id", s.ServiceID()).Error("Failed to remove thread link")
+		return "Failed to unlink issue"
+	}
+	return fmt.Sprintf("Unlinked this thread from %s#%d", link.Repo, link.Issue)
+}
+
+// postThreadReply posts the reply as a comment on the linked issue. The comment is posted with the
+// sender's own Github session if they have one. Otherwise it is posted with the Github session of the
+// ClientUserID and says who wrote it. Returns a message to send to the thread if it failed.
+func (s *Service) postThreadReply(link *ThreadLink, sender, body string) string {
+	comment := body + "\n\n" + threadCommentMarker
+	cli := s.githubClientFor(sender, false)
+	if cli == nil && s.ClientUserID == "" {
+		return fmt.Sprintf("Failed to post to %s#%d: you need to log into Github first", link.Repo, link.Issue)
+	}
+	if cli == nil {
+		comment = fmt.Sprintf("**%s** wrote in Matrix:\n\n%s", sender, comment)
+		if cli = s.githubClientFor(s.ClientUserID, false); cli == nil {
+			return fmt.Sprintf("Failed to post to %s#%d: %s is not logged into Github", link.Repo, link.Issue, s.ClientUserID)
+		}
+	}
+	segs := strings.Split(link.Repo, "/")
+	_, res, err := cli.Issues.CreateComment(segs[0], segs[1], link.Issue, &gogithub.IssueComment{
+		Body: &comment,
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			log.ErrorKey: err,
+			"repo":       link.Repo,
+			"issue":      link.Issue,
+			"user_id":    sender,
+		}).Print("Failed to post thread reply to issue")
+		if res == nil {
+			return fmt.Sprintf("Failed to post to %s#%d. Failed to connect to Github", link.Repo, link.Issue)
+		}
+		return fmt.Sprintf("Failed to post to %s#%d. HTTP %d", link.Repo, link.Issue, res.StatusCode)
+	}
+	return ""
+}
+
+// threadLink returns the link for the thread, or nil if it isn't linked.
+func (s *Service) threadLink(roomID, threadID string) *ThreadLink {
+	if threadID == "" {
+		return nil
+	}
+	for i, link := range s.ThreadLinks {
+		if link.RoomID == roomID && link.ThreadID == threadID {
+			return &s.ThreadLinks[i]
+		}
+	}
+	return nil
+}
+
+// modifyThreadLinks replaces the thread links of the stored version of this service with those
+// returned by fn and stores it. The thread links of this instance are replaced with the modified ones.
+func (s *Service) modifyThreadLinks(fn func(links []ThreadLink) []ThreadLink) error {
+	stored, err := database.GetServiceDB().ModifyService(s.ServiceID(), func(service types.Service) error {
+		srv, ok := service.(*Service)
+		if !ok {
+			return fmt.Errorf("service %s is not a github service", s.ServiceID())
+		}
+		srv.ThreadLinks = fn(srv.ThreadLinks)
+		return nil
+	})
+	if srv, ok := stored.(*Service); ok {
+		s.ThreadLinks = srv.ThreadLinks
+	}
+	return err
+}
+
+func removeThreadLink(links []ThreadLink, roomID, threadID string) []ThreadLink {
+	var kept []ThreadLink
+	for _, link := range links {
+		if link.RoomID != roomID || link.ThreadID != threadID {
+			kept = append(kept, link)
+		}
+	}
+	return kept
+}
+
+// mirrorIssueComment sends a new issue comment into every thread which is linked to the issue by
+// a github service of the same tenant as the webhook service. Comments which were posted from a
+// thread are skipped.
+func (s *WebhookService) mirrorIssueComment(ev *gogithub.IssueCommentEvent) {
+	if ev.Action == nil || *ev.Action != "created" || ev.Comment == nil || ev.Issue == nil || ev.Repo == nil {
+		return
+	}
+	body := derefString(ev.Comment.Body)
+	if strings.Contains(body, threadCommentMarker) {
+		return
+	}
+	srvs, err := s.tenantGithubServices()
+	if err != nil {
+		log.WithError(err).WithField("service_id", s.ServiceID()).Error("Failed to load github services to mirror issue comment")
+		return
+	}
+	repo := derefString(ev.Repo.FullName)
+	issueNum := derefInt(ev.Issue.Number)
+	htmlText := htmlForIssueComment(ev, repo, issueNum, body)
+	for _, ghSrv := range srvs {
+		for _, link := range ghSrv.ThreadLinks {
+			if link.Issue == issueNum && strings.EqualFold(link.Repo, repo) {
+				sendToThread(ghSrv, link, htmlText)
+			}
+		}
+	}
+}
+
+// tenantGithubServices returns the github services with thread links which belong to the same
+// tenant as the webhook service.
+func (s *WebhookService) tenantGithubServices() ([]*Service, error) {
+	db := database.GetServiceDB()
+	tenantID, err := db.LoadResourceOwner(database.ResourceService, s.ServiceID())
+	if err != nil {
+		return nil, err
+	}
+	srvs, err := db.LoadServicesByType(ServiceType)
+	if err != nil {
+		return nil, err
+	}
+	var ghSrvs []*Service
+	for _, srv := range srvs {
+		ghSrv, ok := srv.(*Service)
+		if !ok || len(ghSrv.ThreadLinks) == 0 {
+			continue
+		}
+		if owner, err := db.LoadResourceOwner(database.ResourceService, ghSrv.ServiceID()); err != nil || owner != tenantID {
+			continue
+		}
+		ghSrvs = append(ghSrvs, ghSrv)
+	}
+	return ghSrvs, nil
+}
+
+// htmlForIssueComment formats a new issue comment for mirroring into threads.
+func htmlForIssueComment(ev *gogithub.IssueCommentEvent, repo string, issueNum int, body string) string {
+	author := "Someone"
+	if ev.Comment.User != nil && ev.Comment.User.Login != nil {
+		author = *ev.Comment.User.Login
+	}
+	return fmt.Sprintf(
+		`<b>%s</b> commented on <a href="%s">%s#%d</a>:<br>%s`,
+		html.EscapeString(author), html.EscapeString(derefString(ev.Comment.HTMLURL)),
+		html.EscapeString(repo), issueNum,
+		strings.Replace(html.EscapeString(body), "\n", "<br>", -1),
+	)
+}
+
+// sendToThread sends the HTML notice into the linked thread as the github service's user.
+func sendToThread(ghSrv *Service, link ThreadLink, htmlText string) {
+	logger := log.WithFields(log.Fields{
+		"room_id":   link.RoomID,
+		"thread_id": link.ThreadID,
+		"repo":      link.Repo,
+		"issue":     link.Issue,
+	})
+	cli, err := types.ServiceClient(ghSrv.ServiceUserID())
+	if err != nil {
+		logger.WithError(err).Print("Failed to get client to mirror issue comment")
+		return
+	}
+	content := matrix.ThreadMessage(link.ThreadID, gomatrix.GetHTMLMessage("m.notice", htmlText))
+	if _, err := cli.SendMessageEvent(link.RoomID, "m.room.message", content); err != nil {
+		logger.WithError(err).Print("Failed to mirror issue comment into thread")
+	}
+}
+
+// threadRootID returns the ID of the root event of the thread which the event is in, or an
+// empty string if it isn't in a thread.
+func threadRootID(event *gomatrix.Event) string {
+	relation, ok := event.Content["m.relates_to"].(map[string]interface{})
+	if !ok || relation["rel_type"] != "m.thread" {
+		return ""
+	}
+	eventID, _ := relation["event_id"].(string)
+	return eventID
+}
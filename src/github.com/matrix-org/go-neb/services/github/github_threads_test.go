@@ -0,0 +1,289 @@
+package github
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	gogithub "github.com/google/go-github/github"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/realms/github"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+)
+
+// threadStorage stores a single github service in memory.
+type threadStorage struct {
+	database.NopStorage
+	service types.Service
+	owners  map[string]string // service ID => tenant ID
+}
+
+func (s *threadStorage) LoadResourceOwner(resourceType, resourceID string) (string, error) {
+	return s.owners[resourceID], nil
+}
+
+func (s *threadStorage) LoadService(serviceID string) (types.Service, error) {
+	// round trip through JSON so that each load is a separate instance, as with a real database
+	b, _ := json.Marshal(s.service)
+	return types.CreateService(s.service.ServiceID(), s.service.ServiceType(), s.service.ServiceUserID(), b)
+}
+
+func (s *threadStorage) LoadServicesByType(serviceType string) ([]types.Service, error) {
+	srv, err := s.LoadService(s.service.ServiceID())
+	return []types.Service{srv}, err
+}
+
+func (s *threadStorage) StoreService(service types.Service) (types.Service, error) {
+	old := s.service
+	s.service = service
+	return old, nil
+}
+
+func (s *threadStorage) ModifyService(serviceID string, fn func(types.Service) error) (types.Service, error) {
+	srv, err := s.LoadService(serviceID)
+	if err != nil {
+		return nil, err
+	}
+	if err = fn(srv); err != nil {
+		return nil, err
+	}
+	s.service = srv
+	return srv, nil
+}
+
+func TestThreadLinks(t *testing.T) {
+	srv, err := types.CreateService("gh", ServiceType, "@ghbot:hyrule", []byte(`{
+		"RealmID": "ghrealm",
+		"ThreadLinks": [{
+			"RoomID": "`+roomID+`",
+			"ThreadID": "$root:hyrule",
+			"Repo": "DummyAccount/reponame",
+			"Issue": 15,
+			"LinkedBy": "@alice:hyrule"
+		}, {
+			"RoomID": "`+roomID+`",
+			"ThreadID": "$sample:hyrule",
+			"Repo": "DummyAccount/reponame",
+			"Issue": 1,
+			"LinkedBy": "@alice:hyrule"
+		}]
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create github service: ", err)
+	}
+	store := &threadStorage{service: srv}
+	database.SetServiceDB(store)
+
+	var sent []map[string]interface{}
+	matrixCli := threadTestClient(&sent)
+	types.SetClientLookup(func(userID string) (*gomatrix.Client, error) {
+		if userID != "@ghbot:hyrule" {
+			return nil, fmt.Errorf("no client for %s", userID)
+		}
+		return matrixCli, nil
+	})
+	defer types.SetClientLookup(nil)
+
+	hook := &WebhookService{DefaultService: types.NewDefaultService("ghhook", "@ghbot:hyrule", WebhookServiceType)}
+	hook.mirrorIssueComment(issueCommentEvent(15, "Looks <good>\nto me"))
+	hook.mirrorIssueComment(issueCommentEvent(16, "Another issue"))
+	hook.mirrorIssueComment(issueCommentEvent(15, "From Matrix\n\n"+threadCommentMarker))
+
+	// Comments received by other tenants' webhook services, and test deliveries, are not mirrored.
+	store.owners = map[string]string{"otherhook": "acme"}
+	otherHook := &WebhookService{DefaultService: types.NewDefaultService("otherhook", "@ghbot:hyrule", WebhookServiceType)}
+	otherHook.mirrorIssueComment(issueCommentEvent(15, "Not for you"))
+	hook.Rooms = map[string]struct {
+		Repos map[string]struct {
+			Events []string
+		}
+	}{"!other:hyrule": {Repos: map[string]struct{ Events []string }{
+		"DummyAccount/reponame": {Events: []string{"issue_comment"}},
+	}}}
+	testReqs, err := hook.TestWebhookRequests()
+	if err != nil || len(testReqs) != 1 {
+		t.Fatalf("TestThreadLinks want 1 test request, got %d (err=%v)", len(testReqs), err)
+	}
+	w := httptest.NewRecorder()
+	hook.OnReceiveWebhook(w, types.AsTestRequest(testReqs[0]), matrixCli)
+	if w.Code != 200 {
+		t.Errorf("TestThreadLinks want test delivery to succeed, got HTTP %d", w.Code)
+	}
+	// The test delivery is about issue 1, but is only sent into the room which listens for issue comments.
+	sent = threadedMessages(sent)
+	checkMirroredComment(t, sent)
+
+	checkThreadCommands(t, srv.(*Service), matrixCli, &sent)
+	if links := store.service.(*Service).ThreadLinks; len(links) != 1 || links[0].ThreadID != "$sample:hyrule" {
+		t.Errorf("TestThreadLinks want only the other link stored, got %v", links)
+	}
+	hook.mirrorIssueComment(issueCommentEvent(15, "Too late"))
+	if len(sent) != 3 {
+		t.Errorf("TestThreadLinks want comments not to be mirrored once unlinked, got %v", sent[3:])
+	}
+}
+
+// threadTestClient returns a client which appends the content of each message it sends to sent.
+func threadTestClient(sent *[]map[string]interface{}) *gomatrix.Client {
+	matrixCli, _ := gomatrix.NewClient("https://hyrule", "@ghbot:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		if !strings.Contains(req.URL.String(), "/send/m.room.message") {
+			return nil, fmt.Errorf("Unhandled URL: %s", req.URL.String())
+		}
+		var content map[string]interface{}
+		if err := json.NewDecoder(req.Body).Decode(&content); err != nil {
+			return nil, fmt.Errorf("Failed to decode request JSON: %s", err)
+		}
+		*sent = append(*sent, content)
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$yup:event"}`)),
+		}, nil
+	})}
+	return matrixCli
+}
+
+// issueCommentEvent returns an event for a new comment by bob on the issue.
+func issueCommentEvent(issue int, body string) *gogithub.IssueCommentEvent {
+	var ev gogithub.IssueCommentEvent
+	json.Unmarshal([]byte(fmt.Sprintf(`{
+		"action": "created",
+		"issue": {"number": %d},
+		"comment": {
+			"body": %q,
+			"html_url": "https://github.com/DummyAccount/reponame/issues/15#issuecomment-1",
+			"user": {"login": "bob"}
+		},
+		"repository": {"full_name": "DummyAccount/reponame"}
+	}`, issue, body)), &ev)
+	return &ev
+}
+
+// threadedMessages returns the messages which were sent into threads.
+func threadedMessages(sent []map[string]interface{}) []map[string]interface{} {
+	var threaded []map[string]interface{}
+	for _, content := range sent {
+		if content["m.relates_to"] != nil {
+			threaded = append(threaded, content)
+		}
+	}
+	return threaded
+}
+
+func checkMirroredComment(t *testing.T, sent []map[string]interface{}) {
+	if len(sent) != 1 {
+		t.Fatalf("TestThreadLinks want 1 comment mirrored, got %d: %v", len(sent), sent)
+	}
+	wantHTML := `<b>bob</b> commented on <a href="https://github.com/DummyAccount/reponame/issues/15#issuecomment-1">` +
+		`DummyAccount/reponame#15</a>:<br>Looks &lt;good&gt;<br>to me`
+	if sent[0]["formatted_body"] != wantHTML {
+		t.Errorf("TestThreadLinks want %q, got %q", wantHTML, sent[0]["formatted_body"])
+	}
+	relation, _ := sent[0]["m.relates_to"].(map[string]interface{})
+	if relation["rel_type"] != "m.thread" || relation["event_id"] != "$root:hyrule" {
+		t.Errorf("TestThreadLinks want the comment to be sent into the thread, got relation %v", relation)
+	}
+}
+
+// checkThreadCommands links outside a thread, which must fail, and unlinks the $root:hyrule thread.
+func checkThreadCommands(t *testing.T, ghSrv *Service, matrixCli *gomatrix.Client, sent *[]map[string]interface{}) {
+	ghSrv.OnMessageEvent(matrixCli, &gomatrix.Event{
+		Sender:  "@alice:hyrule",
+		RoomID:  roomID,
+		Content: map[string]interface{}{"msgtype": "m.text", "body": "!github link DummyAccount/reponame#16"},
+	})
+	if len(*sent) != 2 || (*sent)[1]["body"] != "!github link must be used in a thread" {
+		t.Errorf("TestThreadLinks want linking outside a thread to fail, got %v", (*sent)[1:])
+	}
+
+	ghSrv.OnMessageEvent(matrixCli, &gomatrix.Event{
+		Sender: "@alice:hyrule",
+		RoomID: roomID,
+		Content: map[string]interface{}{
+			"msgtype":      "m.text",
+			"body":         "!github unlink",
+			"m.relates_to": map[string]interface{}{"rel_type": "m.thread", "event_id": "$root:hyrule"},
+		},
+	})
+	if len(*sent) != 3 || (*sent)[2]["body"] != "Unlinked this thread from DummyAccount/reponame#15" {
+		t.Errorf("TestThreadLinks want the thread to be unlinked, got %v", (*sent)[2:])
+	}
+}
+
+// replyStorage stores a single github service along with its realm, in which only some users have
+// logged into Github.
+type replyStorage struct {
+	threadStorage
+	realm  types.AuthRealm
+	tokens map[string]string // user ID => Github access token
+}
+
+func (s *replyStorage) LoadAuthRealm(realmID string) (types.AuthRealm, error) {
+	return s.realm, nil
+}
+
+func (s *replyStorage) LoadAuthSessionByUser(realmID, userID string) (types.AuthSession, error) {
+	token, ok := s.tokens[userID]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return &github.Session{AccessToken: token}, nil
+}
+
+func TestThreadReplyAuthor(t *testing.T) {
+	realm, err := types.CreateAuthRealm("ghrealm", "github", []byte(`{"ClientSecret":"secret","ClientID":"id"}`))
+	if err != nil {
+		t.Fatal("Failed to create realm: ", err)
+	}
+	srv, err := types.CreateService("gh", ServiceType, "@ghbot:hyrule", []byte(`{
+		"RealmID": "ghrealm",
+		"ClientUserID": "@neb:hyrule"
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create github service: ", err)
+	}
+	database.SetServiceDB(&replyStorage{
+		threadStorage: threadStorage{service: srv},
+		realm:         realm,
+		tokens:        map[string]string{"@alice:hyrule": "alice_token", "@neb:hyrule": "neb_token"},
+	})
+
+	// the Github clients of realm sessions use the default transport
+	var posted []string // "Authorization header: comment"
+	defaultTransport := http.DefaultTransport
+	http.DefaultTransport = testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path != "/repos/DummyAccount/reponame/issues/15/comments" {
+			return nil, fmt.Errorf("Unhandled URL: %s", req.URL.String())
+		}
+		var comment gogithub.IssueComment
+		if err := json.NewDecoder(req.Body).Decode(&comment); err != nil {
+			return nil, err
+		}
+		posted = append(posted, req.Header.Get("Authorization")+": "+derefString(comment.Body))
+		return &http.Response{StatusCode: 201, Body: ioutil.NopCloser(bytes.NewBufferString(`{}`))}, nil
+	})
+	defer func() { http.DefaultTransport = defaultTransport }()
+
+	link := &ThreadLink{RoomID: roomID, ThreadID: "$root:hyrule", Repo: "DummyAccount/reponame", Issue: 15}
+	for _, sender := range []string{"@alice:hyrule", "@bob:hyrule"} {
+		if msg := srv.(*Service).postThreadReply(link, sender, "Hey"); msg != "" {
+			t.Errorf("TestThreadReplyAuthor: failed to post reply from %s: %s", sender, msg)
+		}
+	}
+	want := []string{
+		"Bearer alice_token: Hey\n\n" + threadCommentMarker,
+		"Bearer neb_token: **@bob:hyrule** wrote in Matrix:\n\nHey\n\n" + threadCommentMarker,
+	}
+	if !reflect.DeepEqual(posted, want) {
+		t.Errorf("TestThreadReplyAuthor: want comments %q, got %q", want, posted)
+	}
+}
@@ -1,7 +1,10 @@
 package github
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"sort"
 	"strings"
@@ -9,6 +12,7 @@ import (
 	log "github.com/Sirupsen/logrus"
 	gogithub "github.com/google/go-github/github"
 	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/matrix"
 	"github.com/matrix-org/go-neb/services/github/client"
 	"github.com/matrix-org/go-neb/services/github/webhook"
 	"github.com/matrix-org/go-neb/types"
@@ -65,10 +69,14 @@ type WebhookService struct {
 			// Most of these events are directly from: https://developer.github.com/webhooks/#events
 			Events []string
 		}
-	}
+	} `rooms:"keys"`
 	// Optional. The secret token to supply when creating the webhook. If supplied,
 	// Go-NEB will perform security checks on incoming webhook requests using this token.
 	SecretToken string
+	// Optional. If true, notifications about the same issue or pull request are grouped into
+	// a thread which is rooted at the first notification. Push notifications are always sent
+	// into the room.
+	ThreadBySubject bool
 }
 
 // OnReceiveWebhook receives requests from Github and possibly sends requests to Matrix as a result.
@@ -79,42 +87,41 @@ type WebhookService struct {
 //
 // If the "owner/repo" string doesn't exist in this Service config, then the webhook will be deleted from
 // Github.
+//
+// New issue comments are also sent into any Matrix threads which have been linked to the issue
+// with "!github link" by a github service of the same tenant, whether or not the room listens for
+// issue_comment events. Test requests are never sent into linked threads.
+//
+// If ThreadBySubject is set, notifications about an issue or pull request are sent into a thread
+// for it, which is started by the first notification about it.
 func (s *WebhookService) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli *gomatrix.Client) {
+	// keep the body so issue comments can be parsed once the request has been verified
+	payload, readErr := ioutil.ReadAll(req.Body)
+	if readErr != nil {
+		w.WriteHeader(400)
+		return
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(payload))
 	evType, repo, msg, err := webhook.OnReceiveRequest(req, s.SecretToken)
 	if err != nil {
 		w.WriteHeader(err.Code)
 		return
 	}
+	if evType == "issue_comment" && !types.IsTestRequest(req) {
+		var ev gogithub.IssueCommentEvent
+		if jsonErr := json.Unmarshal(payload, &ev); jsonErr == nil {
+			s.mirrorIssueComment(&ev)
+		}
+	}
+	var subject string
+	if s.ThreadBySubject && !types.IsTestRequest(req) {
+		subject = notificationSubject(*repo.FullName, payload)
+	}
 	logger := log.WithFields(log.Fields{
 		"event": evType,
 		"repo":  *repo.FullName,
 	})
-	repoExistsInConfig := false
-	for roomID, roomConfig := range s.Rooms {
-		for ownerRepo, repoConfig := range roomConfig.Repos {
-			if !strings.EqualFold(*repo.FullName, ownerRepo) {
-				continue
-			}
-			repoExistsInConfig = true // even if we don't notify for it.
-			notifyRoom := false
-			for _, notifyType := range repoConfig.Events {
-				if evType == notifyType {
-					notifyRoom = true
-					break
-				}
-			}
-			if notifyRoom {
-				logger.WithFields(log.Fields{
-					"message": msg,
-					"room_id": roomID,
-				}).Print("Sending notification to room")
-				if _, e := cli.SendMessageEvent(roomID, "m.room.message", msg); e != nil {
-					logger.WithError(e).WithField("room_id", roomID).Print(
-						"Failed to send notification to room.")
-				}
-			}
-		}
-	}
+	repoExistsInConfig := s.notifyRooms(cli, logger, *repo.FullName, evType, subject, msg)
 
 	if !repoExistsInConfig {
 		segs := strings.Split(*repo.FullName, "/")
@@ -133,6 +140,86 @@ func (s *WebhookService) OnReceiveWebhook(w http.ResponseWriter, req *http.Reque
 	w.WriteHeader(200)
 }
 
+// notifyRooms sends the notification into each room configured to listen for the event type on the
+// repository. Returns false if no room is configured with the repository at all.
+func (s *WebhookService) notifyRooms(cli *gomatrix.Client, logger *log.Entry, repoName, evType, subject string, msg *gomatrix.HTMLMessage) bool {
+	repoExistsInConfig := false
+	for roomID, roomConfig := range s.Rooms {
+		for ownerRepo, repoConfig := range roomConfig.Repos {
+			if !strings.EqualFold(repoName, ownerRepo) {
+				continue
+			}
+			repoExistsInConfig = true // even if we don't notify for it.
+			if !containsString(repoConfig.Events, evType) {
+				continue
+			}
+			logger.WithFields(log.Fields{
+				"message": msg,
+				"room_id": roomID,
+			}).Print("Sending notification to room")
+			if _, e := matrix.SendNotification(cli, s.ServiceID(), roomID, subject, msg); e != nil {
+				logger.WithError(e).WithField("room_id", roomID).Print(
+					"Failed to send notification to room.")
+			}
+		}
+	}
+	return repoExistsInConfig
+}
+
+// TestWebhookRequests returns a sample Github webhook request for each event type configured for each
+// repository. The requests are signed with the SecretToken, if there is one.
+func (s *WebhookService) TestWebhookRequests() ([]*http.Request, error) {
+	repoEvents := make(map[string]map[string]bool) // owner/repo => event type => true
+	for _, roomConfig := range s.Rooms {
+		for ownerRepo, repoConfig := range roomConfig.Repos {
+			ownerRepo = strings.ToLower(ownerRepo)
+			if repoEvents[ownerRepo] == nil {
+				repoEvents[ownerRepo] = make(map[string]bool)
+			}
+			for _, ev := range repoConfig.Events {
+				repoEvents[ownerRepo][ev] = true
+			}
+		}
+	}
+	var reqs []*http.Request
+	for ownerRepo, events := range repoEvents {
+		for ev := range events {
+			githubEvent, payload, err := webhook.SamplePayload(ev, ownerRepo)
+			if err != nil {
+				// Github will never send this event either, so there's nothing to test.
+				log.WithError(err).WithField("repo", ownerRepo).Warn("Cannot create sample webhook request")
+				continue
+			}
+			req, err := http.NewRequest("POST", s.webhookEndpointURL, bytes.NewReader(payload))
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-GitHub-Event", githubEvent)
+			if s.SecretToken != "" {
+				req.Header.Set("X-Hub-Signature", webhook.Signature(payload, s.SecretToken))
+			}
+			reqs = append(reqs, req)
+		}
+	}
+	return reqs, nil
+}
+
+// RealmIDs returns the github realm used by this service.
+func (s *WebhookService) RealmIDs() []string {
+	return []string{s.RealmID}
+}
+
+// RoomTargets returns each repository which notifies the room, along with its events.
+func (s *WebhookService) RoomTargets(roomID string) []string {
+	var targets []string
+	for ownerRepo, repo := range s.Rooms[roomID].Repos {
+		targets = append(targets, fmt.Sprintf("%s (%s)", ownerRepo, strings.Join(repo.Events, ", ")))
+	}
+	sort.Strings(targets)
+	return targets
+}
+
 // Register will create webhooks for the repos specified in Rooms
 //
 // The hooks made are a delta between the old service and the current configuration. If all webhooks are made,
@@ -427,6 +514,15 @@ func difference(a, b []string) (onlyA, onlyB []string) {
 	}
 }
 
+func containsString(list []string, str string) bool {
+	for _, s := range list {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *WebhookService) githubClientFor(userID string, allowUnauth bool) *gogithub.Client {
 	token, err := getTokenForUser(s.RealmID, userID)
 	if err != nil {
@@ -469,3 +565,26 @@ func init() {
 		}
 	})
 }
+
+// notificationSubject returns the "owner/repo#N" issue or pull request which the webhook payload is
+// about, or an empty string if it isn't about one.
+func notificationSubject(repo string, payload []byte) string {
+	var ev struct {
+		Issue *struct {
+			Number int `json:"number"`
+		} `json:"issue"`
+		PullRequest *struct {
+			Number int `json:"number"`
+		} `json:"pull_request"`
+	}
+	if err := json.Unmarshal(payload, &ev); err != nil {
+		return ""
+	}
+	if ev.Issue != nil && ev.Issue.Number != 0 {
+		return fmt.Sprintf("%s#%d", repo, ev.Issue.Number)
+	}
+	if ev.PullRequest != nil && ev.PullRequest.Number != 0 {
+		return fmt.Sprintf("%s#%d", repo, ev.PullRequest.Number)
+	}
+	return ""
+}
@@ -0,0 +1,127 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+const sampleSender = "go-neb"
+
+// SamplePayload returns a representative Github webhook payload for the given event type, as used
+// in the "Events" list of a Github webhook service, for the given "owner/repo". It returns the
+// value of the X-GitHub-Event header to send with the payload, which may differ from the event type
+// (e.g. "labels" events are "issues" events with a "labeled" action).
+func SamplePayload(eventType, ownerRepo string) (githubEvent string, payload []byte, err error) {
+	segs := strings.Split(ownerRepo, "/")
+	if len(segs) != 2 {
+		return "", nil, fmt.Errorf("Malformed owner/repo: %s", ownerRepo)
+	}
+	repoURL := "https://github.com/" + ownerRepo
+	repo := map[string]interface{}{
+		"name":      segs[1],
+		"full_name": ownerRepo,
+		"owner":     map[string]interface{}{"login": segs[0]},
+	}
+	sender := map[string]interface{}{"login": sampleSender}
+	issue := map[string]interface{}{
+		"number":   1,
+		"title":    "Test issue from Go-NEB",
+		"state":    "open",
+		"html_url": repoURL + "/issues/1",
+		"user":     sender,
+	}
+	pullRequest := map[string]interface{}{
+		"number":   2,
+		"title":    "Test pull request from Go-NEB",
+		"state":    "open",
+		"html_url": repoURL + "/pull/2",
+		"user":     sender,
+	}
+	issuesEvent := func(action string) map[string]interface{} {
+		return map[string]interface{}{
+			"action":     action,
+			"issue":      issue,
+			"repository": repo,
+			"sender":     sender,
+		}
+	}
+
+	var ev map[string]interface{}
+	switch eventType {
+	case "push":
+		githubEvent = "push"
+		commit := map[string]interface{}{
+			"id":        "0000000000000000000000000000000000000000",
+			"message":   "Test commit from Go-NEB",
+			"url":       repoURL + "/commit/0000000000000000000000000000000000000000",
+			"author":    map[string]interface{}{"name": sampleSender},
+			"committer": map[string]interface{}{"name": sampleSender},
+		}
+		ev = map[string]interface{}{
+			"ref":         "refs/heads/master",
+			"head_commit": commit,
+			"commits":     []interface{}{commit},
+			"pusher":      map[string]interface{}{"name": sampleSender},
+			"repository": map[string]interface{}{
+				"name":      segs[1],
+				"full_name": ownerRepo,
+				"owner":     map[string]interface{}{"name": segs[0]},
+			},
+		}
+	case "issues":
+		githubEvent = "issues"
+		ev = issuesEvent("opened")
+	case "labels":
+		githubEvent = "issues"
+		ev = issuesEvent("labeled")
+		ev["label"] = map[string]interface{}{"name": "test"}
+	case "milestones":
+		githubEvent = "issues"
+		ev = issuesEvent("milestoned")
+	case "assignments":
+		githubEvent = "issues"
+		ev = issuesEvent("assigned")
+	case "pull_request":
+		githubEvent = "pull_request"
+		ev = map[string]interface{}{
+			"action":       "opened",
+			"number":       2,
+			"pull_request": pullRequest,
+			"repository":   repo,
+			"sender":       sender,
+		}
+	case "issue_comment":
+		githubEvent = "issue_comment"
+		ev = map[string]interface{}{
+			"action":     "created",
+			"issue":      issue,
+			"comment":    map[string]interface{}{"user": sender, "html_url": repoURL + "/issues/1#issuecomment-1"},
+			"repository": repo,
+			"sender":     sender,
+		}
+	case "pull_request_review_comment":
+		githubEvent = "pull_request_review_comment"
+		ev = map[string]interface{}{
+			"action":       "created",
+			"pull_request": pullRequest,
+			"comment":      map[string]interface{}{"user": sender, "html_url": repoURL + "/pull/2#discussion_r1"},
+			"repository":   repo,
+			"sender":       sender,
+		}
+	default:
+		return "", nil, fmt.Errorf("No sample payload for event type %s", eventType)
+	}
+	payload, err = json.Marshal(ev)
+	return
+}
+
+// Signature returns the X-Hub-Signature header value for the payload signed with the secret token.
+func Signature(payload []byte, secretToken string) string {
+	mac := hmac.New(sha1.New, []byte(secretToken))
+	mac.Write(payload)
+	return "sha1=" + hex.EncodeToString(mac.Sum(nil))
+}
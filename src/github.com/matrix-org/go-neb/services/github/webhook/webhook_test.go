@@ -1,6 +1,8 @@
 package webhook
 
 import (
+	"bytes"
+	"net/http"
 	"strings"
 	"testing"
 )
@@ -1526,3 +1528,34 @@ func TestParseGithubEvent(t *testing.T) {
 		}
 	}
 }
+
+func TestSamplePayload(t *testing.T) {
+	for _, eventType := range []string{
+		"push", "issues", "labels", "milestones", "assignments", "pull_request", "issue_comment",
+		"pull_request_review_comment",
+	} {
+		githubEvent, payload, err := SamplePayload(eventType, "matrix-org/go-neb")
+		if err != nil {
+			t.Fatalf("SamplePayload(%s) => %s", eventType, err)
+		}
+		req, _ := http.NewRequest("POST", "https://neb/services/hooks/abc", bytes.NewReader(payload))
+		req.Header.Set("X-GitHub-Event", githubEvent)
+		req.Header.Set("X-Hub-Signature", Signature(payload, "secret"))
+		outType, outRepo, outMsg, resErr := OnReceiveRequest(req, "secret")
+		if resErr != nil {
+			t.Fatalf("SamplePayload(%s) => OnReceiveRequest failed: %v", eventType, resErr.JSON)
+		}
+		if outType != eventType {
+			t.Errorf("SamplePayload(%s) => Event type: Want %s got %s", eventType, eventType, outType)
+		}
+		if *outRepo.FullName != "matrix-org/go-neb" {
+			t.Errorf("SamplePayload(%s) => Repo: Want matrix-org/go-neb got %s", eventType, *outRepo.FullName)
+		}
+		if !strings.Contains(outMsg.Body, "Go-NEB") && !strings.Contains(outMsg.Body, "go-neb") {
+			t.Errorf("SamplePayload(%s) => Body does not look like a test: %s", eventType, outMsg.Body)
+		}
+	}
+	if _, _, err := SamplePayload("watch", "matrix-org/go-neb"); err == nil {
+		t.Errorf("SamplePayload(watch) => wanted an error for an unsupported event type")
+	}
+}
@@ -59,6 +59,7 @@ type googleImage struct {
 //   }
 type Service struct {
 	types.DefaultService
+	types.CommandScope
 	// The Google API key to use when making HTTP requests to Google.
 	APIKey string `json:"api_key"`
 	// The Google custom search engine ID
@@ -42,6 +42,7 @@ type guggyGifResult struct {
 //   }
 type Service struct {
 	types.DefaultService
+	types.CommandScope
 	// The Guggy API key to use when making HTTP requests to Guggy.
 	APIKey string `json:"api_key"`
 }
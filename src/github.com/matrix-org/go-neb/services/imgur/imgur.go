@@ -105,6 +105,7 @@ type imgurSearchResponse struct {
 //   }
 type Service struct {
 	types.DefaultService
+	types.CommandScope
 	// The Imgur client ID
 	ClientID string `json:"client_id"`
 	// The API key to use when making HTTP requests to Imgur.
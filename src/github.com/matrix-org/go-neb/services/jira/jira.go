@@ -10,6 +10,7 @@ import (
 	"html"
 	"net/http"
 	"regexp"
+	"sort"
 	"strings"
 
 	log "github.com/Sirupsen/logrus"
@@ -43,6 +44,9 @@ var projectKeyRegex = regexp.MustCompile("^[A-z]+$")
 //                       Projects: {
 //                           "SYN": { Expand: true },
 //                           "BOTS": { Expand: true, Track: true }
+//                       },
+//                       Boards: {
+//                           "12": { SprintReport: true }
 //                       }
 //                   }
 //               }
@@ -51,6 +55,7 @@ var projectKeyRegex = regexp.MustCompile("^[A-z]+$")
 //   }
 type Service struct {
 	types.DefaultService
+	types.CommandScope
 	webhookEndpointURL string
 	// The user ID to create issues as, or to create/delete webhooks as. This user
 	// is also used to look up issues for expansions.
@@ -66,14 +71,52 @@ type Service struct {
 				Expand bool
 				// True to add a webhook to this project and send updates into the room.
 				Track bool
+				// True to send expanded issues from this project to the user who mentioned
+				// them in a direct message instead of to the room, e.g. for restricted projects.
+				Private bool
 			}
+			// A map of board IDs e.g. "12" to config options. "!jira sprint" only reports on
+			// these boards, and if only one board is configured for the room, on it by default.
+			Boards map[string]struct {
+				// True to send a report into the room when a sprint on this board ends.
+				SprintReport bool
+			}
+		}
+	} `rooms:"keys"`
+	// The ID of the last sprint which was reported for each board, keyed by realm ID and
+	// board ID e.g. "jira-realm-id/12". This is populated by Go-NEB.
+	ReportedSprints map[string]int
+	// Optional. If true, updates about the same issue are grouped into a thread which is
+	// rooted at the first update about it.
+	ThreadBySubject bool
+}
+
+// RoomTargets returns each project which notifies the room or is expanded in it.
+func (s *Service) RoomTargets(roomID string) []string {
+	var targets []string
+	for realmID, realmConfig := range s.Rooms[roomID].Realms {
+		for projectKey, project := range realmConfig.Projects {
+			var what []string
+			if project.Track {
+				what = append(what, "tracked")
+			}
+			if project.Expand {
+				what = append(what, "expanded")
+			}
+			targets = append(targets, fmt.Sprintf("%s on %s (%s)", projectKey, realmID, strings.Join(what, ", ")))
 		}
 	}
+	sort.Strings(targets)
+	return targets
 }
 
 // Register ensures that the given realm IDs are valid JIRA realms and registers webhooks
 // with those JIRA endpoints.
 func (s *Service) Register(oldService types.Service, client *gomatrix.Client) error {
+	// Keep track of which sprints have been reported, so they aren't reported again.
+	if old, ok := oldService.(*Service); ok && s.ReportedSprints == nil {
+		s.ReportedSprints = old.ReportedSprints
+	}
 	// We only ever make 1 JIRA webhook which listens for all projects and then filter
 	// on receive. So we simply need to know if we need to make a webhook or not. We
 	// need to do this for each unique realm.
@@ -140,13 +183,13 @@ func (s *Service) cmdJiraCreate(roomID, userID string, args []string) (interface
 	cli, err := r.JIRAClient(userID, false)
 	if err != nil {
 		if err == sql.ErrNoRows { // no client found
-			return matrix.StarterLinkMessage{
+			return types.PrivateResponse(matrix.StarterLinkMessage{
 				Body: fmt.Sprintf(
 					"You need to OAuth with JIRA on %s before you can create issues.",
 					r.JIRAEndpoint,
 				),
 				Link: r.StarterLink,
-			}, nil
+			}), nil
 		}
 		return nil, err
 	}
@@ -221,17 +264,23 @@ func (s *Service) expandIssue(roomID, userID string, issueKeyGroups []string) in
 		logger.WithError(err).Print("Failed to GET issue")
 		return err
 	}
-	return gomatrix.GetHTMLMessage(
+	msg := gomatrix.GetHTMLMessage(
 		"m.notice",
 		fmt.Sprintf(
 			"%sbrowse/%s : %s",
 			jrealm.JIRAEndpoint, issueKey, htmlSummaryForIssue(issue),
 		),
 	)
+	if s.Rooms[roomID].Realms[realmID].Projects[projectKey].Private {
+		return types.PrivateResponse(msg)
+	}
+	return msg
 }
 
 // Commands supported:
 //    !jira create KEY "issue title" "optional issue description"
+//    !jira sprint [board ID or name]
+//    !jira board [KEY]
 // Responds with the outcome of the issue creation request. This command requires
 // a JIRA account to be linked to the Matrix user ID issuing the command. It also
 // requires there to be a project with the given project key (e.g. "KEY") to exist
@@ -239,6 +288,12 @@ func (s *Service) expandIssue(roomID, userID string, issueKeyGroups []string) in
 // same project key, which project is chosen is undefined. If there
 // is no JIRA account linked to the Matrix user ID, it will return a Starter Link
 // if there is a known public project with that project key.
+//
+// "!jira sprint" shows the goal, days remaining and issue counts by status of the active sprint on
+// the board. The board can be omitted if the room has exactly one board configured. "!jira board"
+// lists the boards of the room's projects, or of the given project, with their active sprints.
+// These commands use the JIRA account of the Matrix user issuing the command if there is one,
+// otherwise that of ClientUserID.
 func (s *Service) Commands(cli *gomatrix.Client) []types.Command {
 	return []types.Command{
 		types.Command{
@@ -247,6 +302,22 @@ func (s *Service) Commands(cli *gomatrix.Client) []types.Command {
 				return s.cmdJiraCreate(roomID, userID, args)
 			},
 		},
+		types.Command{
+			Path:      []string{"jira", "sprint"},
+			Arguments: []string{"board"},
+			Help:      "Show the active sprint on one of the room's boards.",
+			Command: func(roomID, userID string, args []string) (interface{}, error) {
+				return s.cmdJiraSprint(roomID, userID, args)
+			},
+		},
+		types.Command{
+			Path:      []string{"jira", "board"},
+			Arguments: []string{"project"},
+			Help:      "List the boards of the room's projects.",
+			Command: func(roomID, userID string, args []string) (interface{}, error) {
+				return s.cmdJiraBoard(roomID, userID, args)
+			},
+		},
 	}
 }
 
@@ -268,6 +339,7 @@ func (s *Service) Expansions(cli *gomatrix.Client) []types.Expansion {
 }
 
 // OnReceiveWebhook receives requests from JIRA and possibly sends requests to Matrix as a result.
+// If ThreadBySubject is set, updates about an issue are sent into a thread for it.
 func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli *gomatrix.Client) {
 	eventProjectKey, event, httpErr := webhook.OnReceiveRequest(req)
 	if httpErr != nil {
@@ -289,6 +361,10 @@ func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli
 		w.WriteHeader(200)
 		return
 	}
+	var subject string
+	if s.ThreadBySubject && !types.IsTestRequest(req) {
+		subject = event.Issue.Key
+	}
 	// send message into each configured room
 	for roomID, roomConfig := range s.Rooms {
 		for _, realmConfig := range roomConfig.Realms {
@@ -296,8 +372,8 @@ func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli
 				if pkey != eventProjectKey || !projectConfig.Track {
 					continue
 				}
-				_, msgErr := cli.SendMessageEvent(
-					roomID, "m.room.message", gomatrix.GetHTMLMessage("m.notice", htmlText),
+				_, msgErr := matrix.SendNotification(
+					cli, s.ServiceID(), roomID, subject, gomatrix.GetHTMLMessage("m.notice", htmlText),
 				)
 				if msgErr != nil {
 					log.WithFields(log.Fields{
@@ -386,6 +462,21 @@ func (s *Service) projectToRealm(userID, pkey string) (*jira.Realm, error) {
 	return nil, nil
 }
 
+// RealmIDs returns every JIRA realm referred to by this service.
+func (s *Service) RealmIDs() []string {
+	seen := make(map[string]bool)
+	var realmIDs []string
+	for _, roomConfig := range s.Rooms {
+		for realmID := range roomConfig.Realms {
+			if !seen[realmID] {
+				seen[realmID] = true
+				realmIDs = append(realmIDs, realmID)
+			}
+		}
+	}
+	return realmIDs
+}
+
 // Returns realm_id => [PROJ, ECT, KEYS]
 func projectsAndRealmsToTrack(s *Service) map[string][]string {
 	ridsToProjects := make(map[string][]string)
@@ -0,0 +1,590 @@
+package jira
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	gojira "github.com/andygrunwald/go-jira"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/realms/jira"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+)
+
+// How often boards are checked for sprints which have ended.
+const sprintReportPollInterval = 30 * time.Minute
+
+// agileSprint is a sprint returned by the JIRA Agile REST API. gojira.Sprint omits the goal.
+type agileSprint struct {
+	gojira.Sprint
+	Goal string `json:"goal"`
+}
+
+// agileBoard is a board and the client which can load its sprints.
+type agileBoard struct {
+	gojira.Board
+	cli *gojira.Client
+}
+
+// statusCount is the number of issues in a sprint with a given status.
+type statusCount struct {
+	Status string
+	Count  int
+}
+
+// sprintSummary is the state of the issues in a sprint.
+type sprintSummary struct {
+	Sprint   agileSprint
+	Statuses []statusCount
+	Total    int
+	Done     int
+}
+
+func (s *Service) cmdJiraSprint(roomID, userID string, args []string) (interface{}, error) {
+	board, err := s.resolveBoard(roomID, userID, strings.Join(args, " "))
+	if err != nil {
+		return nil, err
+	}
+	sprints, err := boardSprints(board.cli, board.ID, "active")
+	if err != nil {
+		log.WithError(err).WithField("board_id", board.ID).Print("Failed to load active sprints")
+		return nil, fmt.Errorf("Failed to load sprints for board %s", board.Name)
+	}
+	if len(sprints) == 0 {
+		return &gomatrix.TextMessage{
+			MsgType: "m.notice",
+			Body:    fmt.Sprintf("There is no active sprint on board %s", board.Name),
+		}, nil
+	}
+	var parts []string
+	for _, sprint := range sprints {
+		summary, err := summariseSprint(board.cli, sprint)
+		if err != nil {
+			log.WithError(err).WithField("sprint_id", sprint.ID).Print("Failed to load sprint issues")
+			return nil, fmt.Errorf("Failed to load issues for sprint %s", sprint.Name)
+		}
+		parts = append(parts, htmlForSprint(*board, summary, time.Now()))
+	}
+	return gomatrix.GetHTMLMessage("m.notice", strings.Join(parts, "<br>")), nil
+}
+
+func (s *Service) cmdJiraBoard(roomID, userID string, args []string) (interface{}, error) {
+	realms, err := s.roomRealms(roomID)
+	if err != nil {
+		return nil, err
+	}
+	var projectKey string
+	if len(args) > 0 {
+		if !projectKeyRegex.MatchString(args[0]) {
+			return nil, errors.New("Project key must only contain A-Z.")
+		}
+		projectKey = strings.ToUpper(args[0])
+	}
+
+	// Only the boards of the projects configured for the room are listed, as the client may be that
+	// of the user who provisioned the service.
+	var lines []string
+	found := false
+	for _, realm := range realms {
+		keys := s.roomProjectKeys(roomID, realm.ID(), projectKey)
+		if len(keys) == 0 {
+			continue
+		}
+		found = true
+		cli, err := s.agileClient(realm, userID)
+		if err != nil {
+			log.WithError(err).WithField("realm_id", realm.ID()).Print("Failed to retrieve client")
+			continue
+		}
+		lines = append(lines, projectBoardLines(cli, keys)...)
+	}
+	if !found && projectKey != "" {
+		return nil, fmt.Errorf("Project %s is not configured for this room.", projectKey)
+	}
+	if len(lines) == 0 {
+		return &gomatrix.TextMessage{MsgType: "m.notice", Body: "No boards found"}, nil
+	}
+	return gomatrix.GetHTMLMessage("m.notice", strings.Join(lines, "<br>")), nil
+}
+
+// roomProjectKeys returns the sorted keys of the projects in the realm which are configured for the room.
+// If projectKey isn't empty, only the project with that key is returned.
+func (s *Service) roomProjectKeys(roomID, realmID, projectKey string) []string {
+	var keys []string
+	for pkey := range s.Rooms[roomID].Realms[realmID].Projects {
+		if projectKey == "" || strings.ToUpper(pkey) == projectKey {
+			keys = append(keys, pkey)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// projectBoardLines returns a line formatted by htmlForBoard for each board of the projects.
+func projectBoardLines(cli *gojira.Client, projectKeys []string) []string {
+	var lines []string
+	for _, pkey := range projectKeys {
+		boards, _, err := cli.Board.GetAllBoards(&gojira.BoardListOptions{ProjectKeyOrID: pkey})
+		if err != nil {
+			log.WithError(err).WithField("project", pkey).Print("Failed to list boards")
+			continue
+		}
+		for _, b := range boards.Values {
+			lines = append(lines, htmlForBoard(agileBoard{b, cli}, time.Now()))
+		}
+	}
+	return lines
+}
+
+// htmlForBoard formats a single board e.g:
+//   "Bots (#12, scrum): Sprint 4, 3 days remaining"
+func htmlForBoard(board agileBoard, now time.Time) string {
+	line := fmt.Sprintf("<b>%s</b> (#%d, %s)", html.EscapeString(board.Name), board.ID, html.EscapeString(board.Type))
+	if board.Type != "scrum" {
+		return line
+	}
+	sprints, err := boardSprints(board.cli, board.ID, "active")
+	if err != nil {
+		log.WithError(err).WithField("board_id", board.ID).Print("Failed to load active sprints")
+		return line
+	}
+	if len(sprints) == 0 {
+		return line + ": no active sprint"
+	}
+	var names []string
+	for _, sprint := range sprints {
+		names = append(names, fmt.Sprintf("%s, %s", html.EscapeString(sprint.Name), timeRemaining(sprint.EndDate, now)))
+	}
+	return line + ": " + strings.Join(names, "; ")
+}
+
+// htmlForSprint formats a summary of a sprint e.g:
+//   "Sprint 4 on Bots: 3 days remaining
+//    Goal: Ship it
+//    To Do: 2, In Progress: 1, Done: 3 (3 of 6 issues done)"
+func htmlForSprint(board agileBoard, summary sprintSummary, now time.Time) string {
+	sprint := summary.Sprint
+	text := fmt.Sprintf(
+		"<b>%s</b> on %s: %s",
+		html.EscapeString(sprint.Name), html.EscapeString(board.Name), timeRemaining(sprint.EndDate, now),
+	)
+	if sprint.Goal != "" {
+		text += "<br>Goal: " + html.EscapeString(sprint.Goal)
+	}
+	return text + "<br>" + htmlForStatuses(summary)
+}
+
+// htmlForSprintReport formats the end-of-sprint report for a sprint which has been completed.
+func htmlForSprintReport(board agileBoard, summary sprintSummary) string {
+	sprint := summary.Sprint
+	text := fmt.Sprintf(
+		"<b>%s</b> on %s has ended.",
+		html.EscapeString(sprint.Name), html.EscapeString(board.Name),
+	)
+	if sprint.Goal != "" {
+		text += "<br>Goal: " + html.EscapeString(sprint.Goal)
+	}
+	return text + "<br>" + htmlForStatuses(summary)
+}
+
+func htmlForStatuses(summary sprintSummary) string {
+	if summary.Total == 0 {
+		return "No issues"
+	}
+	var counts []string
+	for _, sc := range summary.Statuses {
+		counts = append(counts, fmt.Sprintf("%s: %d", html.EscapeString(sc.Status), sc.Count))
+	}
+	return fmt.Sprintf("%s (%d of %d issues done)", strings.Join(counts, ", "), summary.Done, summary.Total)
+}
+
+// timeRemaining describes how long is left until the end date e.g "3 days remaining".
+func timeRemaining(end *time.Time, now time.Time) string {
+	if end == nil {
+		return "no end date"
+	}
+	days := int(math.Ceil(end.Sub(now).Hours() / 24))
+	switch {
+	case days > 1:
+		return fmt.Sprintf("%d days remaining", days)
+	case days == 1:
+		return "1 day remaining"
+	case days == 0:
+		return "ends today"
+	case days == -1:
+		return "ended 1 day ago"
+	default:
+		return fmt.Sprintf("ended %d days ago", -days)
+	}
+}
+
+// summariseSprint counts the issues in the sprint by status. Statuses are ordered by category
+// (to do, in progress, done) then by name.
+func summariseSprint(cli *gojira.Client, sprint agileSprint) (sprintSummary, error) {
+	issues, err := sprintIssues(cli, sprint.ID)
+	if err != nil {
+		return sprintSummary{}, err
+	}
+	return countIssuesByStatus(sprint, issues), nil
+}
+
+func countIssuesByStatus(sprint agileSprint, issues []gojira.Issue) sprintSummary {
+	summary := sprintSummary{Sprint: sprint, Total: len(issues)}
+	counts := make(map[string]int)
+	categories := make(map[string]int)
+	for _, issue := range issues {
+		name := "Unknown"
+		category := 0
+		if issue.Fields != nil && issue.Fields.Status != nil {
+			name = issue.Fields.Status.Name
+			switch issue.Fields.Status.StatusCategory.Key {
+			case "indeterminate":
+				category = 1
+			case "done":
+				category = 2
+				summary.Done++
+			}
+		}
+		counts[name]++
+		categories[name] = category
+	}
+	for name, count := range counts {
+		summary.Statuses = append(summary.Statuses, statusCount{name, count})
+	}
+	sort.Slice(summary.Statuses, func(i, j int) bool {
+		a, b := summary.Statuses[i].Status, summary.Statuses[j].Status
+		if categories[a] != categories[b] {
+			return categories[a] < categories[b]
+		}
+		return a < b
+	})
+	return summary
+}
+
+// boardSprints returns the sprints on the board in the given state ("future", "active" or "closed").
+func boardSprints(cli *gojira.Client, boardID int, state string) ([]agileSprint, error) {
+	var sprints []agileSprint
+	for {
+		req, err := cli.NewRequest("GET", fmt.Sprintf(
+			"rest/agile/1.0/board/%d/sprint?state=%s&startAt=%d", boardID, state, len(sprints),
+		), nil)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			IsLast bool          `json:"isLast"`
+			Values []agileSprint `json:"values"`
+		}
+		if _, err = cli.Do(req, &page); err != nil {
+			return nil, err
+		}
+		sprints = append(sprints, page.Values...)
+		if page.IsLast || len(page.Values) == 0 {
+			return sprints, nil
+		}
+	}
+}
+
+// sprintIssues returns every issue in the sprint, with only the status field populated.
+func sprintIssues(cli *gojira.Client, sprintID int) ([]gojira.Issue, error) {
+	var issues []gojira.Issue
+	for {
+		req, err := cli.NewRequest("GET", fmt.Sprintf(
+			"rest/agile/1.0/sprint/%d/issue?fields=status&startAt=%d", sprintID, len(issues),
+		), nil)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Total  int            `json:"total"`
+			Issues []gojira.Issue `json:"issues"`
+		}
+		if _, err = cli.Do(req, &page); err != nil {
+			return nil, err
+		}
+		issues = append(issues, page.Issues...)
+		if len(issues) >= page.Total || len(page.Issues) == 0 {
+			return issues, nil
+		}
+	}
+}
+
+// roomRealms returns the JIRA realms configured for the room.
+func (s *Service) roomRealms(roomID string) ([]*jira.Realm, error) {
+	var realmIDs []string
+	for realmID := range s.Rooms[roomID].Realms {
+		realmIDs = append(realmIDs, realmID)
+	}
+	if len(realmIDs) == 0 {
+		return nil, errors.New("No JIRA realms are configured for this room.")
+	}
+	sort.Strings(realmIDs)
+	var realms []*jira.Realm
+	for _, realmID := range realmIDs {
+		r, err := database.GetServiceDB().LoadAuthRealm(realmID)
+		if err != nil {
+			log.WithError(err).WithField("realm_id", realmID).Print("Failed to load realm")
+			continue
+		}
+		jrealm, ok := r.(*jira.Realm)
+		if !ok {
+			log.WithField("realm_id", realmID).Print("Realm cannot be typecast to jira.Realm")
+			continue
+		}
+		realms = append(realms, jrealm)
+	}
+	if len(realms) == 0 {
+		return nil, errors.New("Failed to load the JIRA realms for this room.")
+	}
+	return realms, nil
+}
+
+// agileClient returns a client for the user's session on the realm. If they have not
+// authenticated with it, the session of the user who provisioned the service is used, so callers
+// must only look up the boards and projects which are configured for the room.
+func (s *Service) agileClient(realm *jira.Realm, userID string) (*gojira.Client, error) {
+	if cli, err := realm.JIRAClient(userID, false); err == nil {
+		return cli, nil
+	}
+	return realm.JIRAClient(s.ClientUserID, true)
+}
+
+// resolveBoard finds the board to report on in the room. The board may be the ID or name of one of the
+// boards configured for the room. If it is empty, the room must have exactly one board configured.
+func (s *Service) resolveBoard(roomID, userID, board string) (*agileBoard, error) {
+	realms, err := s.roomRealms(roomID)
+	if err != nil {
+		return nil, err
+	}
+	configured := s.numRoomBoards(roomID, realms)
+	if configured == 0 {
+		return nil, errors.New("No JIRA boards are configured for this room.")
+	}
+	if board == "" && configured != 1 {
+		return nil, errors.New("Usage: !jira sprint <board ID or name>")
+	}
+
+	board = strings.TrimPrefix(board, "#")
+	_, idErr := strconv.Atoi(board)
+	byName := board != "" && idErr != nil
+	for _, realm := range realms {
+		boardIDs := s.roomBoardIDs(roomID, realm.ID(), board, byName)
+		if len(boardIDs) == 0 {
+			continue
+		}
+		cli, err := s.agileClient(realm, userID)
+		if err != nil {
+			log.WithError(err).WithField("realm_id", realm.ID()).Print("Failed to retrieve client")
+			continue
+		}
+		if b := findBoard(cli, boardIDs, board, byName); b != nil {
+			return b, nil
+		}
+	}
+	return nil, fmt.Errorf("No board %q is configured for this room", board)
+}
+
+// numRoomBoards returns the number of boards configured for the room in the realms.
+func (s *Service) numRoomBoards(roomID string, realms []*jira.Realm) int {
+	configured := 0
+	for _, realm := range realms {
+		configured += len(s.Rooms[roomID].Realms[realm.ID()].Boards)
+	}
+	return configured
+}
+
+// roomBoardIDs returns the IDs of the boards in the realm configured for the room which may be the given
+// board. All of them may be if the board is given by name or not at all.
+func (s *Service) roomBoardIDs(roomID, realmID, board string, byName bool) []string {
+	var boardIDs []string
+	for boardID := range s.Rooms[roomID].Realms[realmID].Boards {
+		if board == "" || board == boardID || byName {
+			boardIDs = append(boardIDs, boardID)
+		}
+	}
+	return boardIDs
+}
+
+// findBoard returns the first of the boards with the given IDs which has the given name, or the first
+// which can be loaded if byName is false. Returns nil if there is no such board.
+func findBoard(cli *gojira.Client, boardIDs []string, name string, byName bool) *agileBoard {
+	sort.Strings(boardIDs)
+	for _, boardID := range boardIDs {
+		id, err := strconv.Atoi(boardID)
+		if err != nil {
+			continue
+		}
+		b, _, err := cli.Board.GetBoard(id)
+		if err != nil {
+			log.WithError(err).WithField("board_id", id).Print("Failed to load board")
+			continue
+		}
+		if !byName || strings.EqualFold(b.Name, name) {
+			return &agileBoard{*b, cli}
+		}
+	}
+	return nil
+}
+
+// OnPoll posts a report into each room which wants one for every sprint which has ended on its
+// boards since the last poll.
+func (s *Service) OnPoll(cli *gomatrix.Client) time.Time {
+	// The poller holds onto the service it was started with, so reload it to pick up
+	// the sprints which have been reported since.
+	srv := s
+	if latest, err := database.GetServiceDB().LoadService(s.ServiceID()); err == nil {
+		if jiraSrv, ok := latest.(*Service); ok {
+			srv = jiraSrv
+		}
+	}
+	reportRooms := srv.sprintReportRooms()
+	if len(reportRooms) == 0 {
+		return time.Unix(0, 0) // nothing to report on, so stop polling
+	}
+
+	reported := make(map[string]int)
+	for key, rooms := range reportRooms {
+		sprintID, err := srv.reportEndedSprint(cli, key, rooms)
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"service_id": srv.ServiceID(),
+				"board":      key,
+			}).Print("Failed to check for ended sprints")
+			continue
+		}
+		if sprintID != 0 && sprintID != srv.ReportedSprints[key] {
+			reported[key] = sprintID
+		}
+	}
+	if len(reported) > 0 {
+		err := srv.modify(func(stored *Service) {
+			if stored.ReportedSprints == nil {
+				stored.ReportedSprints = make(map[string]int)
+			}
+			for key, sprintID := range reported {
+				stored.ReportedSprints[key] = sprintID
+			}
+		})
+		if err != nil {
+			log.WithError(err).WithField("service_id", srv.ServiceID()).Error("Failed to persist reported sprints")
+		}
+	}
+	return time.Now().Add(sprintReportPollInterval)
+}
+
+// sprintReportRooms returns the rooms which want sprint reports, keyed by "realm ID/board ID".
+func (s *Service) sprintReportRooms() map[string][]string {
+	reportRooms := make(map[string][]string)
+	for roomID, roomConfig := range s.Rooms {
+		for realmID, realmConfig := range roomConfig.Realms {
+			for boardID, boardConfig := range realmConfig.Boards {
+				if boardConfig.SprintReport {
+					key := realmID + "/" + boardID
+					reportRooms[key] = append(reportRooms[key], roomID)
+				}
+			}
+		}
+	}
+	return reportRooms
+}
+
+// reportEndedSprint sends a report into the rooms if the most recently completed sprint on the
+// board has not been reported yet. The first time a board is checked, its latest sprint is
+// recorded without being reported. Returns the ID of the latest completed sprint.
+func (s *Service) reportEndedSprint(cli *gomatrix.Client, key string, roomIDs []string) (int, error) {
+	realmID := key[:strings.LastIndex(key, "/")]
+	boardID, err := strconv.Atoi(key[len(realmID)+1:])
+	if err != nil {
+		return 0, fmt.Errorf("Bad board ID %q", key[len(realmID)+1:])
+	}
+	r, err := database.GetServiceDB().LoadAuthRealm(realmID)
+	if err != nil {
+		return 0, err
+	}
+	jrealm, ok := r.(*jira.Realm)
+	if !ok {
+		return 0, errors.New("Realm ID doesn't map to a JIRA realm")
+	}
+	jcli, err := jrealm.JIRAClient(s.ClientUserID, true)
+	if err != nil {
+		return 0, err
+	}
+	sprints, err := boardSprints(jcli, boardID, "closed")
+	if err != nil {
+		return 0, err
+	}
+	latest := latestCompletedSprint(sprints)
+	if latest == nil {
+		return 0, nil
+	}
+	lastReported, seen := s.ReportedSprints[key]
+	if !seen || lastReported == latest.ID {
+		return latest.ID, nil
+	}
+	if err := sendSprintReport(cli, jcli, boardID, *latest, roomIDs); err != nil {
+		return 0, err
+	}
+	return latest.ID, nil
+}
+
+// latestCompletedSprint returns the sprint which was completed most recently, or nil if none have been.
+func latestCompletedSprint(sprints []agileSprint) *agileSprint {
+	var latest *agileSprint
+	for i, sprint := range sprints {
+		if sprint.CompleteDate == nil {
+			continue
+		}
+		if latest == nil || sprint.CompleteDate.After(*latest.CompleteDate) {
+			latest = &sprints[i]
+		}
+	}
+	return latest
+}
+
+// sendSprintReport sends a report of the sprint on the board into the rooms.
+func sendSprintReport(cli *gomatrix.Client, jcli *gojira.Client, boardID int, sprint agileSprint, roomIDs []string) error {
+	board, _, err := jcli.Board.GetBoard(boardID)
+	if err != nil {
+		return err
+	}
+	summary, err := summariseSprint(jcli, sprint)
+	if err != nil {
+		return err
+	}
+	htmlText := htmlForSprintReport(agileBoard{*board, jcli}, summary)
+	for _, roomID := range roomIDs {
+		_, err := cli.SendMessageEvent(roomID, "m.room.message", gomatrix.GetHTMLMessage("m.notice", htmlText))
+		if err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+				"sprint_id":  sprint.ID,
+			}).Print("Failed to send sprint report into room")
+		}
+	}
+	return nil
+}
+
+// modify applies fn to the stored version of this service and stores it. The reported sprints of this
+// instance are replaced with the modified ones.
+func (s *Service) modify(fn func(srv *Service)) error {
+	stored, err := database.GetServiceDB().ModifyService(s.ServiceID(), func(service types.Service) error {
+		srv, ok := service.(*Service)
+		if !ok {
+			return fmt.Errorf("service %s is not a JIRA service", s.ServiceID())
+		}
+		fn(srv)
+		return nil
+	})
+	if srv, ok := stored.(*Service); ok {
+		s.ReportedSprints = srv.ReportedSprints
+	}
+	return err
+}
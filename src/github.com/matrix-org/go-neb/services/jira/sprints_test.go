@@ -0,0 +1,151 @@
+package jira
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	gojira "github.com/andygrunwald/go-jira"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/realms/jira"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+)
+
+// realmStorage stores a single auth realm in memory.
+type realmStorage struct {
+	database.NopStorage
+	realm types.AuthRealm
+}
+
+func (s *realmStorage) LoadAuthRealm(realmID string) (types.AuthRealm, error) {
+	return s.realm, nil
+}
+
+func TestBoardLookupsAreScoped(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal("Failed to generate key: ", err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	realmJSON, _ := json.Marshal(map[string]string{
+		"JIRAEndpoint":  "jira.example.com",
+		"PrivateKeyPEM": string(keyPEM),
+	})
+	realm, err := types.CreateAuthRealm("jirarealm", jira.RealmType, realmJSON)
+	if err != nil {
+		t.Fatal("Failed to create realm: ", err)
+	}
+	database.SetServiceDB(&realmStorage{realm: realm})
+
+	srv, err := types.CreateService("jira", ServiceType, "@jira:hyrule", []byte(`{
+		"ClientUserID": "@provisioner:hyrule",
+		"Rooms": {
+			"!castle:hyrule": {
+				"Realms": {
+					"jirarealm": {
+						"Projects": {"BOTS": {"Expand": true}},
+						"Boards": {"12": {}}
+					}
+				}
+			}
+		}
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create service: ", err)
+	}
+	s := srv.(*Service)
+
+	// Boards and projects which aren't configured for the room are never looked up, as the client
+	// might be that of the provisioner.
+	for _, board := range []string{"99", "#99", "Secret board"} {
+		_, err := s.cmdJiraSprint("!castle:hyrule", "@mallory:hyrule", strings.Fields(board))
+		if err == nil || !strings.Contains(err.Error(), "is configured for this room") {
+			t.Errorf("TestBoardLookupsAreScoped: sprint %q want not configured error, got %v", board, err)
+		}
+	}
+	if _, err := s.cmdJiraBoard("!castle:hyrule", "@mallory:hyrule", []string{"SECRET"}); err == nil {
+		t.Errorf("TestBoardLookupsAreScoped: board SECRET want not configured error, got nil")
+	}
+	if _, err := s.cmdJiraSprint("!dungeon:hyrule", "@mallory:hyrule", nil); err == nil {
+		t.Errorf("TestBoardLookupsAreScoped: sprint in unconfigured room want error, got nil")
+	}
+}
+
+func TestSprintSummary(t *testing.T) {
+	issuesPages := []string{
+		`{"startAt":0,"total":5,"issues":[
+			{"fields":{"status":{"name":"Done","statusCategory":{"key":"done"}}}},
+			{"fields":{"status":{"name":"In Progress","statusCategory":{"key":"indeterminate"}}}},
+			{"fields":{"status":{"name":"To Do","statusCategory":{"key":"new"}}}}
+		]}`,
+		`{"startAt":3,"total":5,"issues":[
+			{"fields":{"status":{"name":"Done","statusCategory":{"key":"done"}}}},
+			{"fields":{"status":{"name":"Blocked","statusCategory":{"key":"new"}}}}
+		]}`,
+	}
+	var requested []string
+	httpCli := &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		requested = append(requested, req.URL.RequestURI())
+		body := issuesPages[len(requested)-1]
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(body))}, nil
+	})}
+	cli, err := gojira.NewClient(httpCli, "https://jira.example.com/")
+	if err != nil {
+		t.Fatal("Failed to create JIRA client: ", err)
+	}
+
+	end := time.Date(2017, 3, 10, 17, 0, 0, 0, time.UTC)
+	sprint := agileSprint{Goal: "Ship <it>"}
+	sprint.ID = 7
+	sprint.Name = "Sprint 7"
+	sprint.EndDate = &end
+	summary, err := summariseSprint(cli, sprint)
+	if err != nil {
+		t.Fatal("Failed to summarise sprint: ", err)
+	}
+	wantRequests := []string{
+		"/rest/agile/1.0/sprint/7/issue?fields=status&startAt=0",
+		"/rest/agile/1.0/sprint/7/issue?fields=status&startAt=3",
+	}
+	if len(requested) != len(wantRequests) || requested[0] != wantRequests[0] || requested[1] != wantRequests[1] {
+		t.Errorf("TestSprintSummary want requests %v, got %v", wantRequests, requested)
+	}
+
+	now := time.Date(2017, 3, 7, 9, 0, 0, 0, time.UTC)
+	got := htmlForSprint(agileBoard{Board: gojira.Board{Name: "Bots"}}, summary, now)
+	want := "<b>Sprint 7</b> on Bots: 4 days remaining<br>Goal: Ship &lt;it&gt;<br>" +
+		"Blocked: 1, To Do: 1, In Progress: 1, Done: 2 (2 of 5 issues done)"
+	if got != want {
+		t.Errorf("TestSprintSummary want %q, got %q", want, got)
+	}
+}
+
+func TestTimeRemaining(t *testing.T) {
+	now := time.Date(2017, 3, 7, 9, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		End  time.Time
+		Want string
+	}{
+		{now.Add(25 * time.Hour), "2 days remaining"},
+		{now.Add(3 * time.Hour), "1 day remaining"},
+		{now.Add(-3 * time.Hour), "ends today"},
+		{now.Add(-50 * time.Hour), "ended 2 days ago"},
+	} {
+		end := test.End
+		if got := timeRemaining(&end, now); got != test.Want {
+			t.Errorf("TestTimeRemaining %v: want %q, got %q", test.End, test.Want, got)
+		}
+	}
+	if got := timeRemaining(nil, now); got != "no end date" {
+		t.Errorf("TestTimeRemaining nil: want %q, got %q", "no end date", got)
+	}
+}
@@ -0,0 +1,382 @@
+// Package relay implements a Service which mirrors messages between rooms, which can be on different homeservers.
+package relay
+
+import (
+	"fmt"
+	"html"
+	"path"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+)
+
+// ServiceType of the Relay service
+const ServiceType = "relay"
+
+// relayKey is the key in the content of relayed messages which says where they were relayed from.
+// Messages with this key are never relayed again, even by other relay services, to prevent loops.
+const relayKey = "org.matrix.neb.relay"
+
+// How long relayed messages are remembered for. Edits and redactions of older messages are not relayed.
+const relayedEventsRetention = 30 * 24 * time.Hour
+
+// How often relayed messages older than relayedEventsRetention are forgotten.
+const relayedEventsPruneInterval = time.Hour
+
+// Service contains the Config fields for the Relay service.
+//
+// This service mirrors rooms: every message sent in one of the configured rooms is sent to all the
+// others, prefixed with the user ID of its sender. Edits and redactions of relayed messages are relayed
+// too, for up to 30 days. Each room is read and posted in by its own client, so the rooms can be on
+// different homeservers. Each client must be a syncing client which is joined to its room, and the
+// service user must be one of them.
+//
+// Messages sent by the clients of the service and messages which were relayed by any Go-NEB are never
+// relayed, so that rooms which are mirrored in both directions don't loop.
+//
+// Example request:
+//   {
+//       rooms: [
+//           { user_id: "@neb:corp.example.com", room_id: "!private:corp.example.com" },
+//           { user_id: "@neb:matrix.org", room_id: "!public:matrix.org" }
+//       ],
+//       senders: ["@*:corp.example.com"],
+//       msg_types: ["m.text", "m.notice"]
+//   }
+type Service struct {
+	types.DefaultService
+	// The rooms to mirror. There must be at least two.
+	Rooms []Room `json:"rooms"`
+	// Optional. Only relay messages from these senders. Entries may contain "*" wildcards, e.g.
+	// "@*:corp.example.com". If empty, messages from every sender are relayed.
+	Senders []string `json:"senders,omitempty"`
+	// Optional. Never relay messages from these senders. Entries may contain "*" wildcards.
+	IgnoreSenders []string `json:"ignore_senders,omitempty"`
+	// Optional. Only relay messages with these msgtypes, e.g. "m.text". If empty, every msgtype is relayed.
+	MsgTypes []string `json:"msg_types,omitempty"`
+}
+
+// Room is a room which is mirrored, along with the client which reads and posts messages in it.
+type Room struct {
+	// The user ID of the client which reads and posts messages in the room.
+	UserID string `json:"user_id"`
+	// The room ID.
+	RoomID string `json:"room_id" rooms:"values"`
+}
+
+// ClientUserIDs returns the user ID of the client for each room.
+func (s *Service) ClientUserIDs() []string {
+	var userIDs []string
+	seen := make(map[string]bool)
+	for _, r := range s.Rooms {
+		if !seen[r.UserID] {
+			seen[r.UserID] = true
+			userIDs = append(userIDs, r.UserID)
+		}
+	}
+	return userIDs
+}
+
+// RoomTargets returns the rooms which the room is mirrored with.
+func (s *Service) RoomTargets(roomID string) []string {
+	if _, ok := s.room(roomID); !ok {
+		return nil
+	}
+	var targets []string
+	for _, r := range s.Rooms {
+		if r.RoomID != roomID {
+			targets = append(targets, "messages mirrored with "+r.RoomID)
+		}
+	}
+	return targets
+}
+
+// Register makes sure the Config information supplied is valid and joins each client to its room.
+func (s *Service) Register(oldService types.Service, client *gomatrix.Client) error {
+	if err := s.validate(); err != nil {
+		return err
+	}
+	for _, r := range s.Rooms {
+		cli, err := s.client(r.UserID, client)
+		if err != nil {
+			return fmt.Errorf("unknown client %s", r.UserID)
+		}
+		if _, err := cli.JoinRoom(r.RoomID, "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    r.RoomID,
+				"user_id":    r.UserID,
+			}).Error("Failed to join room")
+		}
+	}
+	return nil
+}
+
+func (s *Service) validate() error {
+	if len(s.Rooms) < 2 {
+		return fmt.Errorf("at least two rooms are required")
+	}
+	seen := make(map[string]bool)
+	usesServiceUser := false
+	for _, r := range s.Rooms {
+		if r.UserID == "" || r.RoomID == "" {
+			return fmt.Errorf("each room needs a user_id and a room_id")
+		}
+		if seen[r.RoomID] {
+			return fmt.Errorf("room %s is listed more than once", r.RoomID)
+		}
+		seen[r.RoomID] = true
+		usesServiceUser = usesServiceUser || r.UserID == s.ServiceUserID()
+	}
+	if !usesServiceUser {
+		return fmt.Errorf("one of the rooms must use the service user %s", s.ServiceUserID())
+	}
+	for _, pattern := range append(s.Senders, s.IgnoreSenders...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid sender pattern %s", pattern)
+		}
+	}
+	return nil
+}
+
+// OnMessageEvent relays messages, and edits of relayed messages, to the other rooms.
+func (s *Service) OnMessageEvent(cli *gomatrix.Client, event *gomatrix.Event) {
+	if !s.shouldRelay(cli, event) {
+		return
+	}
+	if relation, ok := event.Content["m.relates_to"].(map[string]interface{}); ok && relation["rel_type"] == "m.replace" {
+		s.relayEdit(event, relation)
+		return
+	}
+
+	relayed := map[string]string{event.RoomID: event.ID}
+	for _, r := range s.Rooms {
+		if r.RoomID == event.RoomID {
+			continue
+		}
+		content := s.attributed(event, event.Content)
+		if eventID := s.send(r, content); eventID != "" {
+			relayed[r.RoomID] = eventID
+		}
+	}
+	if len(relayed) == 1 {
+		return
+	}
+	db := database.GetServiceDB()
+	if err := db.StoreRelayedEvents(s.ServiceID(), event.ID, relayed); err != nil {
+		log.WithError(err).WithField("service_id", s.ServiceID()).Error("Failed to store relayed events")
+	}
+}
+
+// OnPoll forgets the messages which were relayed longer ago than the retention period.
+func (s *Service) OnPoll(cli *gomatrix.Client) time.Time {
+	before := time.Now().Add(-relayedEventsRetention)
+	if err := database.GetServiceDB().DeleteRelayedEventsBefore(s.ServiceID(), before); err != nil {
+		log.WithError(err).WithField("service_id", s.ServiceID()).Error("Failed to delete old relayed events")
+	}
+	return time.Now().Add(relayedEventsPruneInterval)
+}
+
+// OnRedactionEvent redacts the copies of a redacted message in the other rooms. Redacting a copy redacts
+// the original message too.
+func (s *Service) OnRedactionEvent(cli *gomatrix.Client, event *gomatrix.Event) {
+	if !s.shouldRelay(cli, event) {
+		return
+	}
+	redacts, err := matrix.RedactedEventID(cli, event)
+	if err != nil || redacts == "" {
+		log.WithError(err).WithField("event_id", event.ID).Error("Failed to find the redacted event")
+		return
+	}
+	relayed := s.relayedEvents(event.RoomID, redacts)
+	for _, r := range s.Rooms {
+		eventID, ok := relayed[r.RoomID]
+		if !ok || r.RoomID == event.RoomID {
+			continue
+		}
+		client, err := s.client(r.UserID, cli)
+		if err == nil {
+			txnID := "nebrelay" + strconv.FormatInt(time.Now().UnixNano(), 10)
+			_, err = client.SendJSON("PUT", client.BuildURL("rooms", r.RoomID, "redact", eventID, txnID), map[string]string{
+				"reason": "Redacted in " + event.RoomID,
+			})
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    r.RoomID,
+				"event_id":   eventID,
+			}).Error("Failed to relay redaction")
+		}
+	}
+}
+
+// shouldRelay returns true if the event was received by the client of one of the rooms and passes the
+// filters.
+func (s *Service) shouldRelay(cli *gomatrix.Client, event *gomatrix.Event) bool {
+	room, ok := s.room(event.RoomID)
+	if !ok || room.UserID != cli.UserID {
+		return false
+	}
+	for _, r := range s.Rooms {
+		if event.Sender == r.UserID {
+			return false
+		}
+	}
+	if _, ok := event.Content[relayKey]; ok {
+		return false
+	}
+	if len(s.Senders) > 0 && !matchesAny(s.Senders, event.Sender) {
+		return false
+	}
+	if matchesAny(s.IgnoreSenders, event.Sender) {
+		return false
+	}
+	return event.Type != "m.room.message" || s.relaysMsgType(event)
+}
+
+// relaysMsgType returns true if the msgtype of the message event, or of the new content of an edit,
+// is one of the msgtypes to relay.
+func (s *Service) relaysMsgType(event *gomatrix.Event) bool {
+	if len(s.MsgTypes) == 0 {
+		return true
+	}
+	msgtype, _ := event.MessageType()
+	if newContent, ok := event.Content["m.new_content"].(map[string]interface{}); ok {
+		msgtype, _ = newContent["msgtype"].(string)
+	}
+	for _, t := range s.MsgTypes {
+		if t == msgtype {
+			return true
+		}
+	}
+	return false
+}
+
+// relayEdit sends the edit of a relayed message as an edit of its copy in each of the other rooms.
+func (s *Service) relayEdit(event *gomatrix.Event, relation map[string]interface{}) {
+	originalID, _ := relation["event_id"].(string)
+	newContent, ok := event.Content["m.new_content"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	relayed := s.relayedEvents(event.RoomID, originalID)
+	for _, r := range s.Rooms {
+		eventID, ok := relayed[r.RoomID]
+		if !ok || r.RoomID == event.RoomID {
+			continue
+		}
+		attributed := s.attributed(event, newContent)
+		content := map[string]interface{}{
+			"msgtype":       attributed["msgtype"],
+			"body":          fmt.Sprintf("* %v", attributed["body"]),
+			"m.new_content": attributed,
+			"m.relates_to": map[string]interface{}{
+				"rel_type": "m.replace",
+				"event_id": eventID,
+			},
+			relayKey: attributed[relayKey],
+		}
+		delete(attributed, relayKey)
+		if formatted, ok := attributed["formatted_body"].(string); ok {
+			content["format"] = attributed["format"]
+			content["formatted_body"] = "* " + formatted
+		}
+		s.send(r, content)
+	}
+}
+
+// attributed returns a copy of the message content with the sender of the event prepended to its body,
+// marked as relayed from the event. Relations to other events are removed, as they are in another room.
+func (s *Service) attributed(event *gomatrix.Event, content map[string]interface{}) map[string]interface{} {
+	c := make(map[string]interface{}, len(content)+1)
+	for k, v := range content {
+		c[k] = v
+	}
+	delete(c, "m.relates_to")
+	delete(c, "m.new_content")
+
+	separator := ": "
+	if c["msgtype"] == "m.emote" {
+		separator = " "
+	}
+	body, _ := c["body"].(string)
+	c["body"] = event.Sender + separator + body
+	if formatted, ok := c["formatted_body"].(string); ok && c["format"] == "org.matrix.custom.html" {
+		c["formatted_body"] = "<b>" + html.EscapeString(event.Sender) + "</b>" + separator + formatted
+	}
+	c[relayKey] = map[string]string{
+		"room_id":  event.RoomID,
+		"event_id": event.ID,
+		"sender":   event.Sender,
+	}
+	return c
+}
+
+// send sends the message content to the room. Returns the ID of the sent event, or "" if it failed.
+func (s *Service) send(r Room, content map[string]interface{}) string {
+	client, err := s.client(r.UserID, nil)
+	if err == nil {
+		var res *gomatrix.RespSendEvent
+		if res, err = client.SendMessageEvent(r.RoomID, "m.room.message", content); err == nil {
+			return res.EventID
+		}
+	}
+	log.WithFields(log.Fields{
+		log.ErrorKey: err,
+		"room_id":    r.RoomID,
+		"user_id":    r.UserID,
+	}).Error("Failed to relay message")
+	return ""
+}
+
+// relayedEvents returns the events which were relayed along with the given event, by room ID.
+func (s *Service) relayedEvents(roomID, eventID string) map[string]string {
+	if eventID == "" {
+		return nil
+	}
+	relayed, err := database.GetServiceDB().LoadRelayedEvents(s.ServiceID(), roomID, eventID)
+	if err != nil {
+		log.WithError(err).WithField("service_id", s.ServiceID()).Error("Failed to load relayed events")
+	}
+	return relayed
+}
+
+// client returns the client for the given user ID. The given client is returned if it is for that user.
+func (s *Service) client(userID string, cli *gomatrix.Client) (*gomatrix.Client, error) {
+	if cli != nil && cli.UserID == userID {
+		return cli, nil
+	}
+	return types.ServiceClient(userID)
+}
+
+func (s *Service) room(roomID string) (Room, bool) {
+	for _, r := range s.Rooms {
+		if r.RoomID == roomID {
+			return r, true
+		}
+	}
+	return Room{}, false
+}
+
+func matchesAny(patterns []string, userID string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, userID); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func init() {
+	types.RegisterService(func(serviceID, serviceUserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
@@ -0,0 +1,225 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+)
+
+// relayStorage remembers relayed events in memory.
+type relayStorage struct {
+	database.NopStorage
+	origins map[string]string            // room_id/event_id => origin event ID
+	groups  map[string]map[string]string // origin event ID => room_id => event_id
+}
+
+func (s *relayStorage) StoreRelayedEvents(serviceID, originEventID string, eventIDs map[string]string) error {
+	s.groups[originEventID] = eventIDs
+	for roomID, eventID := range eventIDs {
+		s.origins[roomID+"/"+eventID] = originEventID
+	}
+	return nil
+}
+
+func (s *relayStorage) LoadRelayedEvents(serviceID, roomID, eventID string) (map[string]string, error) {
+	return s.groups[s.origins[roomID+"/"+eventID]], nil
+}
+
+// sentRequest is a request which a client sent to its homeserver.
+type sentRequest struct {
+	userID  string
+	method  string
+	path    string
+	content map[string]interface{}
+}
+
+// relayClients returns clients for @neb:corp and @neb:public which record the requests they send in sent.
+func relayClients(t *testing.T, sent *[]sentRequest) map[string]*gomatrix.Client {
+	clients := make(map[string]*gomatrix.Client)
+	for _, userID := range []string{"@neb:corp", "@neb:public"} {
+		cli, _ := gomatrix.NewClient("https://"+strings.Split(userID, ":")[1], userID, "its_a_secret")
+		cli.Client = &http.Client{Transport: relayTransport(t, userID, sent)}
+		clients[userID] = cli
+	}
+	return clients
+}
+
+func relayTransport(t *testing.T, userID string, sent *[]sentRequest) http.RoundTripper {
+	trans := struct{ testutils.MockTransport }{}
+	trans.RT = func(req *http.Request) (*http.Response, error) {
+		if req.Method == "POST" && strings.HasPrefix(req.URL.Path, "/_matrix/client/r0/join/") {
+			return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(`{}`))}, nil
+		}
+		if req.Method == "GET" && req.URL.Path == "/_matrix/client/r0/rooms/!private:corp/event/$redaction" {
+			body := `{"event_id":"$redaction","type":"m.room.redaction","redacts":"$hello","content":{}}`
+			return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(body))}, nil
+		}
+		if req.Method != "PUT" {
+			return nil, errors.New("Unhandled matrix client test request")
+		}
+		var content map[string]interface{}
+		if err := json.NewDecoder(req.Body).Decode(&content); err != nil {
+			t.Fatal("Failed to decode request JSON: ", err)
+		}
+		*sent = append(*sent, sentRequest{userID, req.Method, req.URL.Path, content})
+		body := fmt.Sprintf(`{"event_id":"$copy%d"}`, len(*sent))
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(body))}, nil
+	}
+	return trans
+}
+
+// relayMessage returns a message event in !private:corp.
+func relayMessage(id, sender, msgtype, body string) *gomatrix.Event {
+	return &gomatrix.Event{
+		ID:      id,
+		Type:    "m.room.message",
+		RoomID:  "!private:corp",
+		Sender:  sender,
+		Content: map[string]interface{}{"msgtype": msgtype, "body": body},
+	}
+}
+
+func TestRelay(t *testing.T) {
+	database.SetServiceDB(&relayStorage{
+		origins: make(map[string]string),
+		groups:  make(map[string]map[string]string),
+	})
+	var sent []sentRequest
+	clients := relayClients(t, &sent)
+	types.SetClientLookup(func(userID string) (*gomatrix.Client, error) {
+		if cli, ok := clients[userID]; ok {
+			return cli, nil
+		}
+		return nil, errors.New("unknown client")
+	})
+	defer types.SetClientLookup(nil)
+
+	config := `{
+		"rooms": [
+			{"user_id": "@neb:corp", "room_id": "!private:corp"},
+			{"user_id": "@neb:public", "room_id": "!public:public"}
+		],
+		"senders": ["@*:corp"],
+		"ignore_senders": ["@spam:corp"],
+		"msg_types": ["m.text", "m.emote"]
+	}`
+	srv, err := types.CreateService("relay", ServiceType, "@neb:corp", []byte(config))
+	if err != nil {
+		t.Fatal("Failed to create relay service: ", err)
+	}
+	if err := srv.Register(nil, clients["@neb:corp"]); err != nil {
+		t.Fatal("Failed to register relay service: ", err)
+	}
+	relay := srv.(*Service)
+
+	checkIgnoredMessages(t, relay, clients, &sent)
+
+	relay.OnMessageEvent(clients["@neb:corp"], relayMessage("$hello", "@alice:corp", "m.text", "hello"))
+	if len(sent) != 1 || sent[0].userID != "@neb:public" || !strings.HasPrefix(sent[0].path, "/_matrix/client/r0/rooms/!public:public/send/m.room.message/") {
+		t.Fatalf("TestRelay: wanted the message to be sent to !public:public by @neb:public, got %v", sent)
+	}
+	if sent[0].content["body"] != "@alice:corp: hello" {
+		t.Errorf("TestRelay: wanted an attributed body, got %v", sent[0].content["body"])
+	}
+	if _, ok := sent[0].content[relayKey]; !ok {
+		t.Errorf("TestRelay: wanted the message to be marked as relayed, got %v", sent[0].content)
+	}
+
+	checkRelayedEditAndRedaction(t, relay, clients, &sent)
+	if got := relay.RoomTargets("!private:corp"); len(got) != 1 || got[0] != "messages mirrored with !public:public" {
+		t.Errorf("TestRelay: RoomTargets want the other room, got %v", got)
+	}
+}
+
+// checkIgnoredMessages checks that messages which shouldn't be relayed aren't.
+func checkIgnoredMessages(t *testing.T, relay *Service, clients map[string]*gomatrix.Client, sent *[]sentRequest) {
+	relayedEvent := relayMessage("$relayed", "@alice:corp", "m.text", "hi")
+	relayedEvent.Content[relayKey] = map[string]interface{}{}
+	ignored := []*gomatrix.Event{
+		relayMessage("$bot", "@neb:public", "m.text", "from a client of the service"),
+		relayMessage("$other", "@mallory:elsewhere", "m.text", "not a listed sender"),
+		relayMessage("$spam", "@spam:corp", "m.text", "an ignored sender"),
+		relayMessage("$notice", "@alice:corp", "m.notice", "not a listed msgtype"),
+		relayedEvent,
+	}
+	for _, event := range ignored {
+		relay.OnMessageEvent(clients["@neb:corp"], event)
+	}
+	// received by a client which doesn't read the room
+	relay.OnMessageEvent(clients["@neb:public"], relayMessage("$wrong_client", "@alice:corp", "m.text", "hello"))
+	if len(*sent) != 0 {
+		t.Fatalf("TestRelay: wanted no messages to be relayed, got %v", *sent)
+	}
+}
+
+// checkRelayedEditAndRedaction checks that an edit and a redaction of the relayed message $hello are
+// relayed to its copy, $copy1.
+func checkRelayedEditAndRedaction(t *testing.T, relay *Service, clients map[string]*gomatrix.Client, sent *[]sentRequest) {
+	edit := relayMessage("$edit", "@alice:corp", "m.text", "* hello world")
+	edit.Content["m.new_content"] = map[string]interface{}{"msgtype": "m.text", "body": "hello world"}
+	edit.Content["m.relates_to"] = map[string]interface{}{"rel_type": "m.replace", "event_id": "$hello"}
+	relay.OnMessageEvent(clients["@neb:corp"], edit)
+	if len(*sent) != 2 {
+		t.Fatalf("TestRelay: wanted the edit to be relayed, got %v", *sent)
+	}
+	relation, _ := (*sent)[1].content["m.relates_to"].(map[string]interface{})
+	newContent, _ := (*sent)[1].content["m.new_content"].(map[string]interface{})
+	if relation["event_id"] != "$copy1" || newContent["body"] != "@alice:corp: hello world" {
+		t.Errorf("TestRelay: wanted an edit of $copy1, got %v", (*sent)[1].content)
+	}
+
+	relay.OnRedactionEvent(clients["@neb:corp"], &gomatrix.Event{
+		ID:      "$redaction",
+		Type:    "m.room.redaction",
+		RoomID:  "!private:corp",
+		Sender:  "@alice:corp",
+		Content: map[string]interface{}{},
+	})
+	if len(*sent) != 3 || !strings.HasPrefix((*sent)[2].path, "/_matrix/client/r0/rooms/!public:public/redact/$copy1/") {
+		t.Fatalf("TestRelay: wanted $copy1 to be redacted, got %v", *sent)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	types.SetClientLookup(func(userID string) (*gomatrix.Client, error) {
+		return nil, errors.New("unknown client")
+	})
+	defer types.SetClientLookup(nil)
+	cli, _ := gomatrix.NewClient("https://corp", "@neb:corp", "its_a_secret")
+	cli.Client = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(`{}`))}, nil
+	})}
+
+	for _, config := range []string{
+		`{"rooms": [{"user_id": "@neb:corp", "room_id": "!private:corp"}]}`,
+		`{"rooms": [{"user_id": "@neb:corp", "room_id": "!a:corp"}, {"user_id": "@neb:corp", "room_id": "!a:corp"}]}`,
+		`{"rooms": [{"user_id": "@other:corp", "room_id": "!a:corp"}, {"user_id": "@other:corp", "room_id": "!b:corp"}]}`,
+		`{"rooms": [{"user_id": "@neb:corp", "room_id": "!a:corp"}, {"user_id": "@neb:public", "room_id": "!b:public"}]}`,
+		`{"rooms": [{"user_id": "@neb:corp", "room_id": "!a:corp"}, {"user_id": "@neb:corp", "room_id": "!b:corp"}], "senders": ["["]}`,
+	} {
+		srv, err := types.CreateService("relay", ServiceType, "@neb:corp", []byte(config))
+		if err != nil {
+			t.Fatal("Failed to create relay service: ", err)
+		}
+		if err := srv.Register(nil, cli); err == nil {
+			t.Errorf("TestRegister: wanted an error registering %s", config)
+		}
+	}
+
+	srv, _ := types.CreateService("relay", ServiceType, "@neb:corp", []byte(`{
+		"rooms": [{"user_id": "@neb:corp", "room_id": "!a:corp"}, {"user_id": "@neb:corp", "room_id": "!b:corp"}]
+	}`))
+	if err := srv.Register(nil, cli); err != nil {
+		t.Errorf("TestRegister: wanted rooms sharing the service user's client to register, got %s", err)
+	}
+}
@@ -0,0 +1,165 @@
+package rssbot
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/gomatrix"
+	"github.com/mmcdole/gofeed"
+)
+
+// The ways in which enclosures can be posted. See Service.Feeds.
+const (
+	enclosuresIgnore = ""
+	enclosuresLink   = "link"
+	enclosuresUpload = "upload"
+)
+
+const defaultMaxEnclosureBytes = 10 * 1024 * 1024 // 10 MB
+
+// hardMaxEnclosureBytes is the largest enclosure which is ever uploaded, whatever the feed config says, as
+// enclosures are held in memory while they are uploaded. It matches the default upload limit of Synapse.
+const hardMaxEnclosureBytes = 50 * 1024 * 1024 // 50 MB
+
+// enclosureClient downloads enclosures. It doesn't share the feed cache as enclosures are large and are
+// only downloaded once.
+var enclosureClient = &http.Client{
+	Transport: userAgentRoundTripper{http.DefaultTransport},
+	Timeout:   5 * time.Minute,
+}
+
+// fileMessage is an m.audio, m.video, m.image or m.file message.
+type fileMessage struct {
+	MsgType string   `json:"msgtype"`
+	Body    string   `json:"body"`
+	URL     string   `json:"url"`
+	Info    fileInfo `json:"info"`
+}
+
+type fileInfo struct {
+	MimeType string `json:"mimetype,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+}
+
+// enclosureMessages returns the messages to send for the enclosures of an item, according to how the
+// feed is configured to post enclosures. Each enclosure is only uploaded once, however many rooms the
+// messages are sent to.
+func enclosureMessages(cli *gomatrix.Client, mode string, maxBytes int64, item gofeed.Item) []interface{} {
+	if mode == enclosuresIgnore {
+		return nil
+	}
+	if maxBytes <= 0 {
+		maxBytes = defaultMaxEnclosureBytes
+	} else if maxBytes > hardMaxEnclosureBytes {
+		maxBytes = hardMaxEnclosureBytes
+	}
+	var msgs []interface{}
+	for _, enc := range item.Enclosures {
+		if enc == nil || enc.URL == "" {
+			continue
+		}
+		if mode == enclosuresUpload {
+			msg, err := uploadEnclosure(cli, enc, maxBytes)
+			if err == nil {
+				msgs = append(msgs, msg)
+				continue
+			}
+			log.WithError(err).WithField("enclosure_url", enc.URL).Info("Linking enclosure instead of uploading it")
+		}
+		msgs = append(msgs, enclosureLink(enc))
+	}
+	return msgs
+}
+
+// uploadEnclosure downloads the enclosure and uploads it to the homeserver. Returns an error if the
+// enclosure is larger than maxBytes.
+func uploadEnclosure(cli *gomatrix.Client, enc *gofeed.Enclosure, maxBytes int64) (*fileMessage, error) {
+	if length, err := strconv.ParseInt(enc.Length, 10, 64); err == nil && length > maxBytes {
+		return nil, fmt.Errorf("enclosure is %d bytes, which is larger than %d", length, maxBytes)
+	}
+	res, err := enclosureClient.Get(enc.URL)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return nil, fmt.Errorf("failed to download enclosure: HTTP %d", res.StatusCode)
+	}
+	// The advertised length can't be trusted, so read one byte more than allowed to find out if it is too big.
+	data, err := ioutil.ReadAll(io.LimitReader(res.Body, maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxBytes {
+		return nil, fmt.Errorf("enclosure is larger than %d bytes", maxBytes)
+	}
+
+	mimeType := enc.Type
+	if mimeType == "" {
+		mimeType = res.Header.Get("Content-Type")
+	}
+	upload, err := cli.UploadToContentRepo(bytes.NewReader(data), mimeType, int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	return &fileMessage{
+		MsgType: enclosureMsgType(mimeType),
+		Body:    enclosureName(enc),
+		URL:     upload.ContentURI,
+		Info:    fileInfo{MimeType: mimeType, Size: int64(len(data))},
+	}, nil
+}
+
+// enclosureLink returns a notice which links to the enclosure.
+func enclosureLink(enc *gofeed.Enclosure) gomatrix.HTMLMessage {
+	var details []string
+	if enc.Type != "" {
+		details = append(details, enc.Type)
+	}
+	if length, err := strconv.ParseInt(enc.Length, 10, 64); err == nil && length > 0 {
+		details = append(details, fmt.Sprintf("%.1f MB", float64(length)/(1024*1024)))
+	}
+	text := fmt.Sprintf(`Attachment: <a href="%s">%s</a>`, html.EscapeString(enc.URL), html.EscapeString(enclosureName(enc)))
+	if len(details) > 0 {
+		text += " (" + html.EscapeString(strings.Join(details, ", ")) + ")"
+	}
+	return gomatrix.GetHTMLMessage("m.notice", text)
+}
+
+// enclosureMsgType returns the msgtype to use for a file with the given MIME type.
+func enclosureMsgType(mimeType string) string {
+	switch {
+	case strings.HasPrefix(mimeType, "audio/"):
+		return "m.audio"
+	case strings.HasPrefix(mimeType, "video/"):
+		return "m.video"
+	case strings.HasPrefix(mimeType, "image/"):
+		return "m.image"
+	}
+	return "m.file"
+}
+
+// enclosureName returns the file name of the enclosure, or its URL if it has no file name.
+func enclosureName(enc *gofeed.Enclosure) string {
+	u, err := url.Parse(enc.URL)
+	if err != nil {
+		return enc.URL
+	}
+	name := path.Base(u.Path)
+	if name == "." || name == "/" {
+		return enc.URL
+	}
+	return name
+}
@@ -0,0 +1,107 @@
+package rssbot
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+)
+
+// jsonFeed is a JSON Feed, as described at https://jsonfeed.org/version/1.1
+// Only the fields which rssbot uses are listed.
+type jsonFeed struct {
+	Version     string `json:"version"`
+	Title       string `json:"title"`
+	HomePageURL string `json:"home_page_url"`
+	FeedURL     string `json:"feed_url"`
+	Description string `json:"description"`
+	Items       []struct {
+		ID            string       `json:"id"`
+		URL           string       `json:"url"`
+		ExternalURL   string       `json:"external_url"`
+		Title         string       `json:"title"`
+		ContentHTML   string       `json:"content_html"`
+		ContentText   string       `json:"content_text"`
+		Summary       string       `json:"summary"`
+		DatePublished string       `json:"date_published"`
+		DateModified  string       `json:"date_modified"`
+		Author        *jsonAuthor  `json:"author"`  // version 1
+		Authors       []jsonAuthor `json:"authors"` // version 1.1
+		Attachments   []struct {
+			URL         string `json:"url"`
+			MimeType    string `json:"mime_type"`
+			SizeInBytes int64  `json:"size_in_bytes"`
+		} `json:"attachments"`
+	} `json:"items"`
+}
+
+type jsonAuthor struct {
+	Name string `json:"name"`
+}
+
+// isJSONFeed returns true if the body of a feed looks like JSON rather than XML.
+func isJSONFeed(body []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(body), []byte("{"))
+}
+
+// parseJSONFeed parses a JSON Feed into the same form as gofeed uses for RSS and Atom feeds, so the rest
+// of rssbot doesn't need to care which kind of feed it is reading. Attachments become enclosures.
+func parseJSONFeed(body []byte) (*gofeed.Feed, error) {
+	var jf jsonFeed
+	if err := json.Unmarshal(body, &jf); err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(jf.Version, "https://jsonfeed.org/version/") {
+		return nil, errors.New("Failed to detect feed type")
+	}
+
+	feed := &gofeed.Feed{
+		Title:       jf.Title,
+		Description: jf.Description,
+		Link:        jf.HomePageURL,
+		FeedLink:    jf.FeedURL,
+		FeedType:    "json",
+		FeedVersion: strings.TrimPrefix(jf.Version, "https://jsonfeed.org/version/"),
+	}
+	for _, ji := range jf.Items {
+		item := &gofeed.Item{
+			GUID:        ji.ID,
+			Title:       ji.Title,
+			Link:        ji.URL,
+			Description: ji.Summary,
+			Content:     ji.ContentHTML,
+			Published:   ji.DatePublished,
+			Updated:     ji.DateModified,
+		}
+		if item.Link == "" {
+			item.Link = ji.ExternalURL
+		}
+		if item.Content == "" {
+			item.Content = ji.ContentText
+		}
+		if t, err := time.Parse(time.RFC3339, ji.DatePublished); err == nil {
+			item.PublishedParsed = &t
+		}
+		if t, err := time.Parse(time.RFC3339, ji.DateModified); err == nil {
+			item.UpdatedParsed = &t
+		}
+		if ji.Author != nil {
+			item.Author = &gofeed.Person{Name: ji.Author.Name}
+		} else if len(ji.Authors) > 0 {
+			item.Author = &gofeed.Person{Name: ji.Authors[0].Name}
+		}
+		for _, a := range ji.Attachments {
+			enc := &gofeed.Enclosure{URL: a.URL, Type: a.MimeType}
+			if a.SizeInBytes > 0 {
+				enc.Length = strconv.FormatInt(a.SizeInBytes, 10)
+			}
+			item.Enclosures = append(item.Enclosures, enc)
+		}
+		feed.Items = append(feed.Items, item)
+	}
+	return feed, nil
+}
@@ -1,11 +1,14 @@
-// Package rssbot implements a Service capable of reading Atom/RSS feeds.
+// Package rssbot implements a Service capable of reading Atom/RSS feeds and JSON Feeds.
 package rssbot
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"html"
+	"io/ioutil"
 	"net/http"
+	"sort"
 	"strconv"
 	"time"
 
@@ -45,6 +48,11 @@ const minPollingIntervalSeconds = 60 * 5 // 5 min (News feeds can be genuinely s
 //           },
 //           "https://www.wired.com/feed/": {
 //                rooms: ["!qmElAGdFYCHoCJuaNt:localhost"]
+//           },
+//           "https://podcast.example.com/feed.json": {
+//                rooms: ["!qmElAGdFYCHoCJuaNt:localhost"],
+//                enclosures: "upload",
+//                max_enclosure_bytes: 52428800
 //           }
 //       }
 //   }
@@ -55,7 +63,14 @@ type Service struct {
 		// Optional. The time to wait between polls. If this is less than minPollingIntervalSeconds, it is ignored.
 		PollIntervalMins int `json:"poll_interval_mins"`
 		// The list of rooms to send feed updates into. This cannot be empty.
-		Rooms []string `json:"rooms"`
+		Rooms []string `json:"rooms" rooms:"values"`
+		// Optional. How to post enclosures, such as podcast audio, which are attached to feed items.
+		// "upload" uploads them to the homeserver and posts them as m.audio, m.video or m.image events
+		// (or m.file for other types) after the item, linking to them instead if they are larger than
+		// max_enclosure_bytes. "link" always links to them. If empty, enclosures are ignored.
+		Enclosures string `json:"enclosures"`
+		// Optional. The largest enclosure to upload, in bytes. Defaults to 10 MB, and cannot be more than 50 MB.
+		MaxEnclosureBytes int64 `json:"max_enclosure_bytes"`
 		// True if rss bot is unable to poll this feed. This is populated by Go-NEB. Use /getService to
 		// retrieve this value.
 		IsFailing bool `json:"is_failing"`
@@ -69,6 +84,35 @@ type Service struct {
 	} `json:"feeds"`
 }
 
+// RoomTargets returns each feed which notifies the room.
+func (s *Service) RoomTargets(roomID string) []string {
+	var targets []string
+	for feedURL, feedInfo := range s.Feeds {
+		for _, r := range feedInfo.Rooms {
+			if r != roomID {
+				continue
+			}
+			if feedInfo.IsFailing {
+				feedURL += " (failing)"
+			}
+			targets = append(targets, feedURL)
+			break
+		}
+	}
+	sort.Strings(targets)
+	return targets
+}
+
+// FeedURLs returns the URL of each feed.
+func (s *Service) FeedURLs() []string {
+	var urls []string
+	for feedURL := range s.Feeds {
+		urls = append(urls, feedURL)
+	}
+	sort.Strings(urls)
+	return urls
+}
+
 // Register will check the liveness of each RSS feed given. If all feeds check out okay, no error is returned.
 func (s *Service) Register(oldService types.Service, client *gomatrix.Client) error {
 	if len(s.Feeds) == 0 {
@@ -93,6 +137,11 @@ func (s *Service) Register(oldService types.Service, client *gomatrix.Client) er
 		if len(feedInfo.Rooms) == 0 {
 			return fmt.Errorf("Feed %s has no rooms to send updates to", feedURL)
 		}
+		switch feedInfo.Enclosures {
+		case enclosuresIgnore, enclosuresLink, enclosuresUpload:
+		default:
+			return fmt.Errorf("Feed %s has unknown enclosures option '%s': must be 'upload', 'link' or empty", feedURL, feedInfo.Enclosures)
+		}
 	}
 
 	s.joinRooms(client)
@@ -340,9 +389,14 @@ func (s *Service) sendToRooms(cli *gomatrix.Client, feedURL string, feed *gofeed
 		"guid":     item.GUID,
 	})
 	logger.Info("Sending new feed item")
-	for _, roomID := range s.Feeds[feedURL].Rooms {
-		if _, err := cli.SendMessageEvent(roomID, "m.room.message", itemToHTML(feed, item)); err != nil {
-			logger.WithError(err).WithField("room_id", roomID).Error("Failed to send to room")
+	feedInfo := s.Feeds[feedURL]
+	msgs := []interface{}{itemToHTML(feed, item)}
+	msgs = append(msgs, enclosureMessages(cli, feedInfo.Enclosures, feedInfo.MaxEnclosureBytes, item)...)
+	for _, roomID := range feedInfo.Rooms {
+		for _, msg := range msgs {
+			if _, err := cli.SendMessageEvent(roomID, "m.room.message", msg); err != nil {
+				logger.WithError(err).WithField("room_id", roomID).Error("Failed to send to room")
+			}
 		}
 	}
 	return nil
@@ -426,7 +480,15 @@ func readFeed(feedURL string) (*gofeed.Feed, error) {
 			Status:     resp.Status,
 		}
 	}
-	return fp.Parse(resp.Body)
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	// gofeed only understands XML feeds, so JSON Feeds are parsed separately.
+	if isJSONFeed(body) {
+		return parseJSONFeed(body)
+	}
+	return fp.Parse(bytes.NewReader(body))
 }
 
 func init() {
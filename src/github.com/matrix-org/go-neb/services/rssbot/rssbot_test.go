@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"strings"
@@ -103,3 +104,106 @@ func TestHTMLEntities(t *testing.T) {
 	// Check that the Matrix client sent a message
 	wg.Wait()
 }
+
+const podcastJSONFeed = `{
+	"version": "https://jsonfeed.org/version/1.1",
+	"title": "Ballad of the Windfish",
+	"items": [{
+		"id": "episode-1",
+		"url": "http://go.neb/podcast/episode-1",
+		"title": "Episode 1",
+		"attachments": [
+			{"url": "http://go.neb/podcast/episode-1.mp3", "mime_type": "audio/mpeg", "size_in_bytes": 4},
+			{"url": "http://go.neb/podcast/episode-1.mp4", "mime_type": "video/mp4", "size_in_bytes": 104857600}
+		]
+	}]
+}`
+
+// mockPodcastFeed serves podcastJSONFeed at feedURL, and records the enclosures which are downloaded.
+func mockPodcastFeed(feedURL string, downloaded *[]string) {
+	cachingClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		if req.URL.String() != feedURL {
+			return nil, errors.New("Unknown test URL")
+		}
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(podcastJSONFeed))}, nil
+	})}
+	enclosureClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		*downloaded = append(*downloaded, req.URL.String())
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString("ID3!"))}, nil
+	})}
+}
+
+// uploadingMatrixClient returns a client which accepts uploads and records the messages sent to !beach:koholint.
+func uploadingMatrixClient(t *testing.T, sent *[]map[string]interface{}) *gomatrix.Client {
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path == "/_matrix/media/r0/upload" {
+			return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(`{"content_uri":"mxc://koholint/episode1"}`))}, nil
+		}
+		if strings.HasPrefix(req.URL.Path, "/_matrix/client/r0/rooms/!beach:koholint/send/m.room.message") {
+			var content map[string]interface{}
+			if err := json.NewDecoder(req.Body).Decode(&content); err != nil {
+				t.Fatal("Failed to decode request JSON: ", err)
+			}
+			*sent = append(*sent, content)
+			return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$1:koholint"}`))}, nil
+		}
+		return nil, errors.New("Unhandled matrix client test request")
+	}
+	matrixClient, _ := gomatrix.NewClient("https://koholint", "@marin:koholint", "its_a_secret")
+	matrixClient.Client = &http.Client{Transport: matrixTrans}
+	return matrixClient
+}
+
+// pollPodcastFeed polls podcastJSONFeed with the given max_enclosure_bytes, and returns the messages
+// which were sent and the enclosures which were downloaded.
+func pollPodcastFeed(t *testing.T, maxEnclosureBytes int64) (sent []map[string]interface{}, downloaded []string) {
+	database.SetServiceDB(&database.NopStorage{})
+	feedURL := "https://windfish.koholint/feed.json"
+	mockPodcastFeed(feedURL, &downloaded)
+
+	srv, err := types.CreateService("id", "rssbot", "@marin:koholint", []byte(fmt.Sprintf(
+		`{"feeds": {"%s":{"rooms":["!beach:koholint"],"enclosures":"upload","max_enclosure_bytes":%d}}}`,
+		feedURL, maxEnclosureBytes,
+	)))
+	if err != nil {
+		t.Fatal("Failed to create RSS bot: ", err)
+	}
+	rssbot := srv.(*Service)
+	f := rssbot.Feeds[feedURL]
+	f.NextPollTimestampSecs = time.Now().Unix()
+	rssbot.Feeds[feedURL] = f
+
+	rssbot.OnPoll(uploadingMatrixClient(t, &sent))
+	return
+}
+
+func TestJSONFeedEnclosures(t *testing.T) {
+	sent, downloaded := pollPodcastFeed(t, 1024)
+	if len(sent) != 3 {
+		t.Fatalf("TestJSONFeedEnclosures: want 3 messages (item, audio, video link), got %d: %v", len(sent), sent)
+	}
+	if body, _ := sent[0]["body"].(string); !strings.Contains(body, "Episode 1") {
+		t.Errorf("TestJSONFeedEnclosures: want item title in first message, got %v", sent[0])
+	}
+	if sent[1]["msgtype"] != "m.audio" || sent[1]["url"] != "mxc://koholint/episode1" || sent[1]["body"] != "episode-1.mp3" {
+		t.Errorf("TestJSONFeedEnclosures: want uploaded m.audio message, got %v", sent[1])
+	}
+	if body, _ := sent[2]["formatted_body"].(string); sent[2]["msgtype"] != "m.notice" || !strings.Contains(body, `href="http://go.neb/podcast/episode-1.mp4"`) {
+		t.Errorf("TestJSONFeedEnclosures: want too large video to be linked, got %v", sent[2])
+	}
+	if len(downloaded) != 1 || downloaded[0] != "http://go.neb/podcast/episode-1.mp3" {
+		t.Errorf("TestJSONFeedEnclosures: want only the audio to be downloaded, got %v", downloaded)
+	}
+}
+
+// Enclosures over the hard limit are linked, even if the feed allows larger ones.
+func TestMaxEnclosureBytesIsCapped(t *testing.T) {
+	sent, downloaded := pollPodcastFeed(t, 1<<40)
+	if len(sent) != 3 || sent[2]["msgtype"] != "m.notice" {
+		t.Errorf("TestMaxEnclosureBytesIsCapped: want the 100 MB video to be linked, got %v", sent)
+	}
+	if len(downloaded) != 1 || downloaded[0] != "http://go.neb/podcast/episode-1.mp3" {
+		t.Errorf("TestMaxEnclosureBytesIsCapped: want only the audio to be downloaded, got %v", downloaded)
+	}
+}
@@ -1,6 +1,7 @@
 package slackapi
 
 import (
+	"bytes"
 	"net/http"
 	"strings"
 
@@ -27,7 +28,7 @@ type Service struct {
 	webhookEndpointURL string
 	// The URL which should be given to an outgoing slack webhook - Populated by Go-NEB after Service registration.
 	WebhookURL  string `json:"webhook_url"`
-	RoomID      string `json:"room_id"`
+	RoomID      string `json:"room_id" rooms:"values"`
 	MessageType string `json:"message_type"`
 }
 
@@ -69,6 +70,35 @@ func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli
 	w.WriteHeader(200)
 }
 
+// TestWebhookRequests returns a sample Slack webhook request with some Markdown and an attachment.
+func (s *Service) TestWebhookRequests() ([]*http.Request, error) {
+	payload := []byte(`{
+		"text": "Test message from *Go-NEB*",
+		"username": "go-neb",
+		"channel": "test",
+		"attachments": [{
+			"fallback": "Test attachment",
+			"color": "good",
+			"title": "Test attachment",
+			"text": "Sent by Go-NEB to check which room this service notifies"
+		}]
+	}`)
+	req, err := http.NewRequest("POST", s.webhookEndpointURL, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return []*http.Request{req}, nil
+}
+
+// RoomTargets returns "Slack-compatible webhook messages" if the room is the one messages are sent to.
+func (s *Service) RoomTargets(roomID string) []string {
+	if s.RoomID != roomID {
+		return nil
+	}
+	return []string{"Slack-compatible webhook messages"}
+}
+
 // Register joins the configured room and sets the public WebhookURL
 func (s *Service) Register(oldService types.Service, client *gomatrix.Client) error {
 	s.WebhookURL = s.webhookEndpointURL
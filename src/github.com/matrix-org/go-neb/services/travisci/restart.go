@@ -0,0 +1,95 @@
+package travisci
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+)
+
+// defaultAPIURL is the Travis-CI API which builds are restarted with if the service has no API URL.
+const defaultAPIURL = "https://api.travis-ci.com"
+
+const cmdRestartUsage = "Usage: !travis restart <build ID>"
+
+// Commands supported:
+//    !travis restart 123456
+// Restarts the build with the given ID if it is a build of a repo configured for the room, once
+// another user in the room approves it. There are no commands if the service has no API token.
+func (s *Service) Commands(cli *gomatrix.Client) []types.Command {
+	if s.APIToken == "" {
+		return nil
+	}
+	return []types.Command{
+		types.Command{
+			Path:      []string{"travis", "restart"},
+			Arguments: []string{"build ID"},
+			Help:      "Restart a build of one of the room's repos, once another user approves it.",
+			Approval:  &types.ApprovalPolicy{},
+			Command: func(roomID, userID string, args []string) (interface{}, error) {
+				return s.cmdRestart(roomID, args)
+			},
+		},
+	}
+}
+
+func (s *Service) cmdRestart(roomID string, args []string) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, errors.New(cmdRestartUsage)
+	}
+	buildID, err := strconv.Atoi(args[0])
+	if err != nil {
+		return nil, errors.New(cmdRestartUsage)
+	}
+	var build struct {
+		Number     string `json:"number"`
+		Repository struct {
+			Slug string `json:"slug"`
+		} `json:"repository"`
+	}
+	if err := s.callAPI("GET", fmt.Sprintf("/build/%d", buildID), &build); err != nil {
+		return nil, fmt.Errorf("Failed to load build %d: %s", buildID, err)
+	}
+	if _, ok := s.Rooms[roomID].Repos[build.Repository.Slug]; !ok {
+		return nil, fmt.Errorf("Build %d is not a build of a repository configured for this room", buildID)
+	}
+	if err := s.callAPI("POST", fmt.Sprintf("/build/%d/restart", buildID), nil); err != nil {
+		return nil, fmt.Errorf("Failed to restart build %d: %s", buildID, err)
+	}
+	return &gomatrix.TextMessage{
+		MsgType: "m.notice",
+		Body:    fmt.Sprintf("Restarted %s#%s", build.Repository.Slug, build.Number),
+	}, nil
+}
+
+// callAPI sends a request to the Travis-CI API with the API token of the service, and decodes the
+// JSON response into v unless it is nil.
+func (s *Service) callAPI(method, path string, v interface{}) error {
+	apiURL := s.APIURL
+	if apiURL == "" {
+		apiURL = defaultAPIURL
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(apiURL, "/")+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Travis-API-Version", "3")
+	req.Header.Set("Authorization", "token "+s.APIToken)
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("HTTP %d", res.StatusCode)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
@@ -5,13 +5,16 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/matrix"
 	"github.com/matrix-org/go-neb/types"
 	"github.com/matrix-org/gomatrix"
 )
@@ -50,6 +53,7 @@ var httpClient = &http.Client{}
 //   }
 type Service struct {
 	types.DefaultService
+	types.CommandScope
 	webhookEndpointURL string
 	// The URL which should be added to .travis.yml - Populated by Go-NEB after Service registration.
 	WebhookURL string `json:"webhook_url"`
@@ -80,7 +84,15 @@ type Service struct {
 			//   build_url: URL of the build detail
 			Template string `json:"template"`
 		} `json:"repos"`
-	} `json:"rooms"`
+	} `json:"rooms" rooms:"keys"`
+	// Optional. If true, notifications about the same build are grouped into a thread which
+	// is rooted at the first notification about it.
+	ThreadBySubject bool `json:"thread_by_subject"`
+	// Optional. A Travis-CI API token. If set, "!travis restart" restarts builds of the repos
+	// configured for a room, once another user in the room approves it.
+	APIToken string `json:"api_token"`
+	// Optional. The Travis-CI API to restart builds with. Defaults to "https://api.travis-ci.com".
+	APIURL string `json:"api_url"`
 }
 
 // The payload from Travis-CI
@@ -190,7 +202,10 @@ func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli
 		w.WriteHeader(400)
 		return
 	}
-	if err := verifyOrigin([]byte(payload), req.Header.Get("Signature")); err != nil {
+	// Test requests can't be signed with Travis-CI's private key, so aren't verified.
+	if types.IsTestRequest(req) {
+		log.Info("Received Travis-CI test request")
+	} else if err := verifyOrigin([]byte(payload), req.Header.Get("Signature")); err != nil {
 		log.WithFields(log.Fields{
 			"Signature":  req.Header.Get("Signature"),
 			log.ErrorKey: err,
@@ -213,6 +228,16 @@ func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli
 	whForRepo := notif.Repository.OwnerName + "/" + notif.Repository.Name
 	tmplData := notifToTemplate(notif)
 
+	var subject string
+	if s.ThreadBySubject && !types.IsTestRequest(req) {
+		subject = fmt.Sprintf("%s#%d", whForRepo, notif.ID)
+	}
+	s.notifyRooms(cli, whForRepo, subject, tmplData)
+	w.WriteHeader(200)
+}
+
+// notifyRooms sends a notice formed from each room's template for the repository into the room.
+func (s *Service) notifyRooms(cli *gomatrix.Client, whForRepo, subject string, tmplData map[string]string) {
 	logger := log.WithFields(log.Fields{
 		"repo": whForRepo,
 	})
@@ -231,13 +256,74 @@ func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli
 				"message": msg,
 				"room_id": roomID,
 			}).Print("Sending Travis-CI notification to room")
-			if _, e := cli.SendMessageEvent(roomID, "m.room.message", msg); e != nil {
+			if _, e := matrix.SendNotification(cli, s.ServiceID(), roomID, subject, msg); e != nil {
 				logger.WithError(e).WithField("room_id", roomID).Print(
 					"Failed to send Travis-CI notification to room.")
 			}
 		}
 	}
-	w.WriteHeader(200)
+}
+
+// TestWebhookRequests returns a sample Travis-CI webhook request for each configured repository.
+func (s *Service) TestWebhookRequests() ([]*http.Request, error) {
+	repos := make(map[string]bool)
+	for _, roomData := range s.Rooms {
+		for ownerRepo := range roomData.Repos {
+			repos[ownerRepo] = true
+		}
+	}
+	var reqs []*http.Request
+	for ownerRepo := range repos {
+		segs := strings.Split(ownerRepo, "/")
+		if len(segs) != 2 {
+			continue // Register rejects these, so they can't receive notifications
+		}
+		status := 0
+		startedAt := "2017-01-01T12:00:00Z"
+		finishedAt := "2017-01-01T12:01:30Z"
+		notif := webhookNotification{
+			ID:            1,
+			Number:        "1",
+			Status:        &status,
+			StartedAt:     &startedAt,
+			FinishedAt:    &finishedAt,
+			StatusMessage: "Passed",
+			Commit:        "0000000000000000000000000000000000000000",
+			Branch:        "master",
+			Message:       "Test build from Go-NEB",
+			CompareURL:    "https://github.com/" + ownerRepo + "/compare/0000000000...0000000000",
+			CommitterName: "go-neb",
+			AuthorName:    "go-neb",
+			Type:          "push",
+			BuildURL:      "https://travis-ci.org/" + ownerRepo + "/builds/1",
+		}
+		notif.Repository.OwnerName = segs[0]
+		notif.Repository.Name = segs[1]
+		notif.Repository.URL = "https://github.com/" + ownerRepo
+		payload, err := json.Marshal(notif)
+		if err != nil {
+			return nil, err
+		}
+		form := url.Values{}
+		form.Set("payload", string(payload))
+		req, err := http.NewRequest("POST", s.webhookEndpointURL, strings.NewReader(form.Encode()))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		reqs = append(reqs, req)
+	}
+	return reqs, nil
+}
+
+// RoomTargets returns each repository which notifies the room.
+func (s *Service) RoomTargets(roomID string) []string {
+	var targets []string
+	for ownerRepo := range s.Rooms[roomID].Repos {
+		targets = append(targets, ownerRepo)
+	}
+	sort.Strings(targets)
+	return targets
 }
 
 // Register makes sure the Config information supplied is valid.
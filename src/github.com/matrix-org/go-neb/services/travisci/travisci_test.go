@@ -184,6 +184,58 @@ func assertResponse(t *testing.T, w *httptest.ResponseRecorder, msgs []gomatrix.
 	return true
 }
 
+// mockTravisAPI serves builds 7 of Kegsay/flow-jsdoc and 8 of ganon/secrets, and records the builds which
+// are restarted.
+func mockTravisAPI(restarted *[]string) {
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		if req.Header.Get("Authorization") != "token travis_token" || req.Header.Get("Travis-API-Version") != "3" {
+			return nil, fmt.Errorf("Missing API headers: %v", req.Header)
+		}
+		switch req.Method + " " + req.URL.String() {
+		case "GET https://travis.hyrule/build/7":
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"number":"31","repository":{"slug":"Kegsay/flow-jsdoc"}}`)),
+			}, nil
+		case "GET https://travis.hyrule/build/8":
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"number":"4","repository":{"slug":"ganon/secrets"}}`)),
+			}, nil
+		case "POST https://travis.hyrule/build/7/restart":
+			*restarted = append(*restarted, "7")
+			return &http.Response{StatusCode: 202, Body: ioutil.NopCloser(bytes.NewBufferString(`{}`))}, nil
+		}
+		return nil, fmt.Errorf("Unhandled URL %s", req.URL.String())
+	})}
+}
+
+func TestRestart(t *testing.T) {
+	var restarted []string
+	mockTravisAPI(&restarted)
+
+	srv := makeService(t, "")
+	if cmds := srv.Commands(nil); len(cmds) != 0 {
+		t.Errorf("TestRestart want no commands without an API token, got %d", len(cmds))
+	}
+	srv.APIToken = "travis_token"
+	srv.APIURL = "https://travis.hyrule/"
+	cmds := srv.Commands(nil)
+	if len(cmds) != 1 || cmds[0].Approval == nil {
+		t.Fatalf("TestRestart want one command which needs approval, got %+v", cmds)
+	}
+	if _, err := cmds[0].Command("!ewfug483gsfe:localhost", "@link:hyrule", []string{"8"}); err == nil {
+		t.Error("TestRestart want builds of other repositories not to be restarted")
+	}
+	res, err := cmds[0].Command("!ewfug483gsfe:localhost", "@link:hyrule", []string{"7"})
+	if err != nil {
+		t.Fatal("TestRestart failed to restart build: ", err)
+	}
+	if body := res.(*gomatrix.TextMessage).Body; body != "Restarted Kegsay/flow-jsdoc#31" || len(restarted) != 1 {
+		t.Errorf("TestRestart want build 7 restarted once, got %q and restarted %v", body, restarted)
+	}
+}
+
 func makeService(t *testing.T, template string) *Service {
 	srv, err := types.CreateService("id", ServiceType, "@travisci:hyrule", []byte(
 		`{
@@ -0,0 +1,428 @@
+// Package widgets implements a Service which adds, lists and removes the widgets of Matrix rooms.
+package widgets
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+)
+
+// ServiceType of the Widgets service
+const ServiceType = "widgets"
+
+// The type of the state events which hold a room's widgets, keyed by widget ID.
+const widgetEventType = "im.vector.modular.widgets"
+
+const cmdWidgetAddUsage = `!widget add <preset> [args...] or !widget add grafana|jitsi|custom <url> [name...]`
+
+// The widget types which can be added with a URL, and the type they are given in the widget event.
+var widgetTypes = map[string]string{
+	"grafana": "m.grafana",
+	"jitsi":   "jitsi",
+	"custom":  "m.custom",
+}
+
+// Matches the variables of URL templates e.g. "{room_id}" or "{1}".
+var templateVarRegex = regexp.MustCompile(`\{([a-z_]+|[0-9]+)\}`)
+
+// Service contains the Config fields for the Widgets service.
+//
+// Users can add a widget to a room with "!widget add grafana|jitsi|custom <url> [name]", list the
+// room's widgets with "!widget list" and remove one with "!widget remove <id>". Adding and removing
+// widgets needs the power level to send widget state events in the room, or power_level if that is
+// higher. The service user also needs to be able to send them.
+//
+// Admins can configure presets, which users add with "!widget add <preset> [args...]". Preset URLs are
+// templates: "{room_id}", "{user_id}" and "{widget_id}" are replaced by the room, the user adding the
+// widget and the new widget's ID, and "{1}", "{2}", etc by the arguments of the command. Values are URL
+// escaped for where they are in the URL, so "castle town" becomes "castle%20town" in the path and
+// "castle+town" in the query. Variables which Matrix clients expand themselves, e.g. "$matrix_user_id", are left as they
+// are. Presets under "presets" can be used in every room, and presets under "rooms" can only be used in
+// that room, overriding a preset of the same name under "presets".
+//
+// Example request:
+//   {
+//       power_level: 50,
+//       presets: {
+//           "call": {
+//               type: "jitsi",
+//               name: "Call",
+//               url: "https://meet.example.com/{room_id}"
+//           }
+//       },
+//       rooms: {
+//           "!ops:example.com": {
+//               presets: {
+//                   "cpu": {
+//                       type: "grafana",
+//                       name: "CPU on {1}",
+//                       url: "https://grafana.example.com/d-solo/cpu?var-host={1}&panelId=2"
+//                   }
+//               }
+//           }
+//       }
+//   }
+type Service struct {
+	types.DefaultService
+	types.CommandScope
+	// Optional. The power level users need to add and remove widgets. If this is lower than the power
+	// level needed to send widget state events in the room, that is used instead.
+	PowerLevel int `json:"power_level,omitempty"`
+	// Optional. Presets which can be added in every room, keyed by name.
+	Presets map[string]Preset `json:"presets,omitempty"`
+	// Optional. Presets which can only be added in a room, keyed by room ID.
+	Rooms map[string]struct {
+		// The presets, keyed by name.
+		Presets map[string]Preset `json:"presets"`
+	} `json:"rooms,omitempty" rooms:"keys"`
+}
+
+// A Preset is a widget which admins have configured, so that users can add it by name.
+type Preset struct {
+	// The type of widget: "grafana", "jitsi" or "custom".
+	Type string `json:"type"`
+	// The name shown for the widget. This can use the same variables as the URL.
+	Name string `json:"name"`
+	// The URL template of the widget.
+	URL string `json:"url"`
+	// Optional. Extra data to include in the widget event.
+	Data map[string]interface{} `json:"data,omitempty"`
+}
+
+// Widget is the content of an im.vector.modular.widgets state event.
+type Widget struct {
+	ID            string                 `json:"id"`
+	Type          string                 `json:"type"`
+	URL           string                 `json:"url"`
+	Name          string                 `json:"name,omitempty"`
+	Data          map[string]interface{} `json:"data,omitempty"`
+	CreatorUserID string                 `json:"creatorUserId,omitempty"`
+}
+
+// Register makes sure that the presets are valid.
+func (s *Service) Register(oldService types.Service, client *gomatrix.Client) error {
+	if err := checkPresets(s.Presets); err != nil {
+		return err
+	}
+	for roomID, room := range s.Rooms {
+		if err := checkPresets(room.Presets); err != nil {
+			return fmt.Errorf("Room %s: %s", roomID, err)
+		}
+	}
+	return nil
+}
+
+func checkPresets(presets map[string]Preset) error {
+	for name, preset := range presets {
+		if _, isType := widgetTypes[name]; isType || strings.ContainsAny(name, " \t\n") {
+			return fmt.Errorf("Preset name '%s' is reserved or contains whitespace", name)
+		}
+		if _, ok := widgetTypes[preset.Type]; !ok {
+			return fmt.Errorf("Preset '%s' has an unknown type '%s'", name, preset.Type)
+		}
+		u, err := url.Parse(preset.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("Preset '%s' must have an http or https URL", name)
+		}
+	}
+	return nil
+}
+
+// RoomTargets returns the presets which can be added in the room.
+func (s *Service) RoomTargets(roomID string) []string {
+	var targets []string
+	for name := range s.presets(roomID) {
+		targets = append(targets, "preset "+name)
+	}
+	sort.Strings(targets)
+	return targets
+}
+
+// Commands supported:
+//    !widget add grafana|jitsi|custom https://example.com/dashboard Some name
+//    !widget add preset-name some args
+//    !widget list
+//    !widget remove widget-id
+func (s *Service) Commands(cli *gomatrix.Client) []types.Command {
+	return []types.Command{
+		types.Command{
+			Path:      []string{"widget", "add"},
+			Arguments: []string{"preset or type", "args or url"},
+			Help:      "Add a widget to the room.",
+			Command: func(roomID, userID string, args []string) (interface{}, error) {
+				return s.cmdAdd(cli, roomID, userID, args)
+			},
+		},
+		types.Command{
+			Path: []string{"widget", "list"},
+			Help: "List the room's widgets and the presets which can be added.",
+			Command: func(roomID, userID string, args []string) (interface{}, error) {
+				return s.cmdList(cli, roomID)
+			},
+		},
+		types.Command{
+			Path:      []string{"widget", "remove"},
+			Arguments: []string{"id"},
+			Help:      "Remove a widget from the room.",
+			Command: func(roomID, userID string, args []string) (interface{}, error) {
+				return s.cmdRemove(cli, roomID, userID, args)
+			},
+		},
+	}
+}
+
+func (s *Service) cmdAdd(cli *gomatrix.Client, roomID, userID string, args []string) (interface{}, error) {
+	if len(args) == 0 {
+		return nil, errors.New("Usage: " + cmdWidgetAddUsage)
+	}
+	widgetID := fmt.Sprintf("goneb_%s_%s", args[0], strconv.FormatInt(time.Now().UnixNano(), 36))
+
+	var preset Preset
+	var widgetURL, name string
+	var err error
+	if _, isType := widgetTypes[args[0]]; isType {
+		preset, widgetURL, name, err = typedWidget(args)
+	} else {
+		preset, widgetURL, name, err = s.presetWidget(roomID, userID, widgetID, args)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		name = args[0]
+	}
+	if err = s.checkPowerLevel(cli, roomID, userID); err != nil {
+		return nil, err
+	}
+	widget := Widget{
+		ID:            widgetID,
+		Type:          widgetTypes[preset.Type],
+		URL:           widgetURL,
+		Name:          name,
+		Data:          preset.Data,
+		CreatorUserID: userID,
+	}
+	if _, err := cli.SendJSON("PUT", cli.BuildURL("rooms", roomID, "state", widgetEventType, widgetID), widget); err != nil {
+		log.WithError(err).WithField("room_id", roomID).Print("Failed to add widget")
+		return nil, errors.New("Failed to add the widget. Does the bot have permission to change the room's widgets?")
+	}
+	return notice(fmt.Sprintf("Added widget '%s' (%s)", name, widgetID)), nil
+}
+
+// typedWidget returns the preset, URL and name of a widget added with "!widget add <type> <url> [name]".
+func typedWidget(args []string) (Preset, string, string, error) {
+	if len(args) < 2 {
+		return Preset{}, "", "", errors.New("Usage: " + cmdWidgetAddUsage)
+	}
+	u, err := url.Parse(args[1])
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return Preset{}, "", "", errors.New("The widget URL must be an http or https URL")
+	}
+	return Preset{Type: args[0]}, args[1], strings.Join(args[2:], " "), nil
+}
+
+// presetWidget returns the preset, URL and name of a widget added with "!widget add <preset> [args...]".
+func (s *Service) presetWidget(roomID, userID, widgetID string, args []string) (Preset, string, string, error) {
+	preset, ok := s.presets(roomID)[args[0]]
+	if !ok {
+		return Preset{}, "", "", fmt.Errorf("There is no preset called '%s'. Usage: %s", args[0], cmdWidgetAddUsage)
+	}
+	vars := map[string]string{
+		"room_id":   roomID,
+		"user_id":   userID,
+		"widget_id": widgetID,
+	}
+	for i, arg := range args[1:] {
+		vars[strconv.Itoa(i+1)] = arg
+	}
+	widgetURL, err := expandTemplate(preset.URL, vars, true)
+	if err != nil {
+		return Preset{}, "", "", err
+	}
+	name, err := expandTemplate(preset.Name, vars, false)
+	if err != nil {
+		return Preset{}, "", "", err
+	}
+	return preset, widgetURL, name, nil
+}
+
+func (s *Service) cmdList(cli *gomatrix.Client, roomID string) (interface{}, error) {
+	widgets, err := roomWidgets(cli, roomID)
+	if err != nil {
+		log.WithError(err).WithField("room_id", roomID).Print("Failed to load room widgets")
+		return nil, errors.New("Failed to load the room's widgets")
+	}
+	var lines []string
+	if len(widgets) == 0 {
+		lines = append(lines, "There are no widgets in this room.")
+	} else {
+		lines = append(lines, "Widgets:")
+	}
+	for _, w := range widgets {
+		lines = append(lines, fmt.Sprintf(" - %s: %s (%s) %s", w.ID, w.Name, w.Type, w.URL))
+	}
+	var names []string
+	for name := range s.presets(roomID) {
+		names = append(names, name)
+	}
+	if len(names) > 0 {
+		sort.Strings(names)
+		lines = append(lines, "Presets: "+strings.Join(names, ", "))
+	}
+	return notice(strings.Join(lines, "\n")), nil
+}
+
+func (s *Service) cmdRemove(cli *gomatrix.Client, roomID, userID string, args []string) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Usage: !widget remove <id>")
+	}
+	widgets, err := roomWidgets(cli, roomID)
+	if err != nil {
+		log.WithError(err).WithField("room_id", roomID).Print("Failed to load room widgets")
+		return nil, errors.New("Failed to load the room's widgets")
+	}
+	var widget *Widget
+	for i := range widgets {
+		if widgets[i].ID == args[0] {
+			widget = &widgets[i]
+		}
+	}
+	if widget == nil {
+		return nil, fmt.Errorf("There is no widget '%s' in this room", args[0])
+	}
+	if err := s.checkPowerLevel(cli, roomID, userID); err != nil {
+		return nil, err
+	}
+	// Widgets are removed by emptying their state event.
+	if _, err := cli.SendJSON("PUT", cli.BuildURL("rooms", roomID, "state", widgetEventType, widget.ID), struct{}{}); err != nil {
+		log.WithError(err).WithField("room_id", roomID).Print("Failed to remove widget")
+		return nil, errors.New("Failed to remove the widget. Does the bot have permission to change the room's widgets?")
+	}
+	return notice(fmt.Sprintf("Removed widget '%s' (%s)", widget.Name, widget.ID)), nil
+}
+
+// checkPowerLevel returns an error if the user can't add or remove widgets in the room.
+func (s *Service) checkPowerLevel(cli *gomatrix.Client, roomID, userID string) error {
+	pl, err := matrix.LoadPowerLevels(cli, roomID)
+	if err != nil {
+		log.WithError(err).WithField("room_id", roomID).Print("Failed to load power levels")
+		return errors.New("Failed to check your power level")
+	}
+	required := pl.StateEventLevel(widgetEventType)
+	if s.PowerLevel > required {
+		required = s.PowerLevel
+	}
+	if pl.UserLevel(userID) < required {
+		return fmt.Errorf("You need power level %d to change the room's widgets", required)
+	}
+	return nil
+}
+
+// presets returns the presets which can be used in the room, keyed by name.
+func (s *Service) presets(roomID string) map[string]Preset {
+	presets := make(map[string]Preset)
+	for name, preset := range s.Presets {
+		presets[name] = preset
+	}
+	for name, preset := range s.Rooms[roomID].Presets {
+		presets[name] = preset
+	}
+	return presets
+}
+
+// roomWidgets returns the widgets in the room, sorted by ID.
+func roomWidgets(cli *gomatrix.Client, roomID string) ([]Widget, error) {
+	resBody, err := cli.SendJSON("GET", cli.BuildURL("rooms", roomID, "state"), nil)
+	if err != nil {
+		return nil, err
+	}
+	var events []gomatrix.Event
+	if err := json.Unmarshal(resBody, &events); err != nil {
+		return nil, err
+	}
+	var widgets []Widget
+	for _, ev := range events {
+		if ev.Type != widgetEventType || len(ev.Content) == 0 {
+			continue // removed widgets have empty content
+		}
+		b, _ := json.Marshal(ev.Content)
+		var w Widget
+		if err := json.Unmarshal(b, &w); err != nil || w.URL == "" {
+			continue
+		}
+		if w.ID == "" {
+			w.ID = ev.StateKey
+		}
+		widgets = append(widgets, w)
+	}
+	sort.Slice(widgets, func(i, j int) bool {
+		return widgets[i].ID < widgets[j].ID
+	})
+	return widgets, nil
+}
+
+// expandTemplate replaces the variables in the template with their values, optionally URL escaping
+// them. Values in the query of the URL are query escaped, and values elsewhere are path escaped so
+// that e.g. spaces don't become "+". Returns an error if a variable has no value, e.g. an argument
+// which wasn't given.
+func expandTemplate(template string, vars map[string]string, escape bool) (string, error) {
+	queryStart, queryEnd := len(template), len(template)
+	if i := strings.Index(template, "?"); i >= 0 {
+		queryStart = i
+	}
+	if i := strings.Index(template, "#"); i >= 0 {
+		queryEnd = i
+	}
+
+	var missing string
+	var expanded bytes.Buffer
+	last := 0
+	for _, loc := range templateVarRegex.FindAllStringIndex(template, -1) {
+		expanded.WriteString(template[last:loc[0]])
+		last = loc[1]
+		name := template[loc[0]+1 : loc[1]-1]
+		value, ok := vars[name]
+		switch {
+		case !ok:
+			missing = name
+			value = template[loc[0]:loc[1]]
+		case escape && loc[0] > queryStart && loc[0] < queryEnd:
+			value = url.QueryEscape(value)
+		case escape:
+			value = url.PathEscape(value)
+		}
+		expanded.WriteString(value)
+	}
+	expanded.WriteString(template[last:])
+	if missing != "" {
+		if _, err := strconv.Atoi(missing); err == nil {
+			return "", fmt.Errorf("This preset needs argument %s", missing)
+		}
+		return "", fmt.Errorf("Unknown template variable {%s}", missing)
+	}
+	return expanded.String(), nil
+}
+
+func notice(body string) *gomatrix.TextMessage {
+	return &gomatrix.TextMessage{MsgType: "m.notice", Body: body}
+}
+
+func init() {
+	types.RegisterService(func(serviceID, serviceUserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
@@ -0,0 +1,192 @@
+package widgets
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+)
+
+const roomID = "!ops:hyrule"
+
+func TestWidgets(t *testing.T) {
+	srv, err := types.CreateService("widgets", ServiceType, "@widgetbot:hyrule", []byte(`{
+		"presets": {
+			"call": {"type": "jitsi", "name": "Call", "url": "https://meet.hyrule/{room_id}"}
+		},
+		"rooms": {
+			"`+roomID+`": {
+				"presets": {
+					"cpu": {"type": "grafana", "name": "CPU on {1}", "url": "https://grafana.hyrule/d/cpu?host={1}&user=$matrix_user_id"}
+				}
+			}
+		}
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create widgets service: ", err)
+	}
+	if err := srv.Register(nil, nil); err != nil {
+		t.Fatal("Failed to register widgets service: ", err)
+	}
+
+	state := make(map[string]map[string]interface{}) // widget ID => content
+	matrixCli := widgetTestClient(state)
+
+	cmds := srv.Commands(matrixCli)
+	run := func(path, userID string, args ...string) (string, error) {
+		return runWidgetCommand(t, cmds, path, userID, args)
+	}
+
+	if _, err := run("widget add", "@bob:hyrule", "call"); err == nil || err.Error() != "You need power level 50 to change the room's widgets" {
+		t.Errorf("TestWidgets: want users without power to be refused, got %v", err)
+	}
+	if _, err := run("widget add", "@alice:hyrule", "cpu"); err == nil || err.Error() != "This preset needs argument 1" {
+		t.Errorf("TestWidgets: want missing preset arguments to be refused, got %v", err)
+	}
+	if _, err := run("widget add", "@alice:hyrule", "cpu", "castle town"); err != nil {
+		t.Fatal("TestWidgets: failed to add preset: ", err)
+	}
+	widgetID := checkAddedWidget(t, state)
+
+	list, err := run("widget list", "@bob:hyrule")
+	if err != nil {
+		t.Fatal("TestWidgets: failed to list widgets: ", err)
+	}
+	wantList := "Widgets:\n - " + widgetID + ": CPU on castle town (m.grafana) " +
+		"https://grafana.hyrule/d/cpu?host=castle+town&user=$matrix_user_id\nPresets: call, cpu"
+	if list != wantList {
+		t.Errorf("TestWidgets: want list %q, got %q", wantList, list)
+	}
+
+	checkRemoveWidget(t, cmds, state, widgetID)
+}
+
+// widgetTestClient returns a client for a room whose widgets are stored in state.
+func widgetTestClient(state map[string]map[string]interface{}) *gomatrix.Client {
+	matrixCli, _ := gomatrix.NewClient("https://hyrule", "@widgetbot:hyrule", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		roomPath := "/_matrix/client/r0/rooms/" + roomID + "/state"
+		var body string
+		switch {
+		case req.Method == "GET" && req.URL.Path == roomPath+"/m.room.power_levels":
+			body = `{"users": {"@alice:hyrule": 50}, "events": {"im.vector.modular.widgets": 50}}`
+		case req.Method == "GET" && req.URL.Path == roomPath:
+			body = widgetStateJSON(state)
+		case req.Method == "PUT" && strings.HasPrefix(req.URL.Path, roomPath+"/"+widgetEventType+"/"):
+			var content map[string]interface{}
+			if err := json.NewDecoder(req.Body).Decode(&content); err != nil {
+				return nil, fmt.Errorf("Failed to decode request JSON: %s", err)
+			}
+			state[strings.TrimPrefix(req.URL.Path, roomPath+"/"+widgetEventType+"/")] = content
+			body = `{"event_id":"$yup:event"}`
+		default:
+			return nil, fmt.Errorf("Unhandled URL: %s %s", req.Method, req.URL.String())
+		}
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(body))}, nil
+	})}
+	return matrixCli
+}
+
+// widgetStateJSON returns the room state events for the widgets.
+func widgetStateJSON(state map[string]map[string]interface{}) string {
+	var events []gomatrix.Event
+	for id, content := range state {
+		events = append(events, gomatrix.Event{Type: widgetEventType, StateKey: id, Content: content})
+	}
+	b, _ := json.Marshal(events)
+	return string(b)
+}
+
+// runWidgetCommand runs the command with the path, returning the body of its response.
+func runWidgetCommand(t *testing.T, cmds []types.Command, path, userID string, args []string) (string, error) {
+	for _, cmd := range cmds {
+		if strings.Join(cmd.Path, " ") == path {
+			res, err := cmd.Command(roomID, userID, args)
+			if err != nil {
+				return "", err
+			}
+			return res.(*gomatrix.TextMessage).Body, nil
+		}
+	}
+	t.Fatalf("TestWidgets: no command %q", path)
+	return "", nil
+}
+
+// checkAddedWidget checks that the "cpu" preset was added for castle town, returning the widget's ID.
+func checkAddedWidget(t *testing.T, state map[string]map[string]interface{}) string {
+	if len(state) != 1 {
+		t.Fatalf("TestWidgets: want 1 widget, got %v", state)
+	}
+	var widgetID string
+	for id, content := range state {
+		widgetID = id
+		want := map[string]interface{}{
+			"id":            id,
+			"type":          "m.grafana",
+			"name":          "CPU on castle town",
+			"url":           "https://grafana.hyrule/d/cpu?host=castle+town&user=$matrix_user_id",
+			"creatorUserId": "@alice:hyrule",
+		}
+		if fmt.Sprint(content) != fmt.Sprint(want) {
+			t.Errorf("TestWidgets: want widget %v, got %v", want, content)
+		}
+	}
+	return widgetID
+}
+
+// checkRemoveWidget removes the widget, which must leave no widgets in the room.
+func checkRemoveWidget(t *testing.T, cmds []types.Command, state map[string]map[string]interface{}, widgetID string) {
+	if _, err := runWidgetCommand(t, cmds, "widget remove", "@alice:hyrule", []string{widgetID}); err != nil {
+		t.Fatal("TestWidgets: failed to remove widget: ", err)
+	}
+	if len(state[widgetID]) != 0 {
+		t.Errorf("TestWidgets: want the widget's state to be emptied, got %v", state[widgetID])
+	}
+	if list, _ := runWidgetCommand(t, cmds, "widget list", "@bob:hyrule", nil); !strings.HasPrefix(list, "There are no widgets in this room.") {
+		t.Errorf("TestWidgets: want no widgets once removed, got %q", list)
+	}
+}
+
+func TestRegisterPresets(t *testing.T) {
+	for _, config := range []string{
+		`{"presets": {"custom": {"type": "custom", "url": "https://hyrule"}}}`,
+		`{"presets": {"dash": {"type": "dashboard", "url": "https://hyrule"}}}`,
+		`{"rooms": {"!a:hyrule": {"presets": {"dash": {"type": "custom", "url": "javascript:alert(1)"}}}}}`,
+	} {
+		srv, err := types.CreateService("widgets", ServiceType, "@widgetbot:hyrule", []byte(config))
+		if err != nil {
+			t.Fatal("Failed to create widgets service: ", err)
+		}
+		if err := srv.Register(nil, nil); err == nil {
+			t.Errorf("TestRegisterPresets: want %s to be rejected", config)
+		}
+	}
+}
+
+func TestExpandTemplate(t *testing.T) {
+	vars := map[string]string{"1": "castle town/?&", "room_id": "!castle:hyrule"}
+	for _, test := range []struct {
+		template string
+		escape   bool
+		want     string
+	}{
+		{"https://meet.hyrule/{room_id}", true, "https://meet.hyrule/%21castle:hyrule"},
+		{"https://grafana.hyrule/d/{1}?host={1}#{1}", true,
+			"https://grafana.hyrule/d/castle%20town%2F%3F&?host=castle+town%2F%3F%26#castle%20town%2F%3F&"},
+		{"CPU on {1}", false, "CPU on castle town/?&"},
+	} {
+		got, err := expandTemplate(test.template, vars, test.escape)
+		if err != nil {
+			t.Errorf("TestExpandTemplate(%s): failed: %s", test.template, err)
+		} else if got != test.want {
+			t.Errorf("TestExpandTemplate(%s): want %q, got %q", test.template, test.want, got)
+		}
+	}
+}
@@ -44,6 +44,7 @@ type wikipediaPage struct {
 // Service contains the Config fields for the Wikipedia service.
 type Service struct {
 	types.DefaultService
+	types.CommandScope
 }
 
 // Commands supported:
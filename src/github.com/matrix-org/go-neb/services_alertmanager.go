@@ -0,0 +1,6 @@
+//go:build !no_alertmanager
+// +build !no_alertmanager
+
+package main
+
+import _ "github.com/matrix-org/go-neb/services/alertmanager"
@@ -0,0 +1,6 @@
+//go:build !no_announce
+// +build !no_announce
+
+package main
+
+import _ "github.com/matrix-org/go-neb/services/announce"
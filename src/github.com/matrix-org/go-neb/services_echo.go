@@ -0,0 +1,6 @@
+//go:build !no_echo
+// +build !no_echo
+
+package main
+
+import _ "github.com/matrix-org/go-neb/services/echo"
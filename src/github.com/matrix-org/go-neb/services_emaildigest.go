@@ -0,0 +1,6 @@
+//go:build !no_emaildigest
+// +build !no_emaildigest
+
+package main
+
+import _ "github.com/matrix-org/go-neb/services/emaildigest"
@@ -0,0 +1,6 @@
+//go:build !no_giphy
+// +build !no_giphy
+
+package main
+
+import _ "github.com/matrix-org/go-neb/services/giphy"
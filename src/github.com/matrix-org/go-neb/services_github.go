@@ -0,0 +1,6 @@
+//go:build !no_github
+// +build !no_github
+
+package main
+
+import _ "github.com/matrix-org/go-neb/services/github"
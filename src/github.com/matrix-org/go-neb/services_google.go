@@ -0,0 +1,6 @@
+//go:build !no_google
+// +build !no_google
+
+package main
+
+import _ "github.com/matrix-org/go-neb/services/google"
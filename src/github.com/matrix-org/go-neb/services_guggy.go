@@ -0,0 +1,6 @@
+//go:build !no_guggy
+// +build !no_guggy
+
+package main
+
+import _ "github.com/matrix-org/go-neb/services/guggy"
@@ -0,0 +1,6 @@
+//go:build !no_imgur
+// +build !no_imgur
+
+package main
+
+import _ "github.com/matrix-org/go-neb/services/imgur"
@@ -0,0 +1,6 @@
+//go:build !no_jira
+// +build !no_jira
+
+package main
+
+import _ "github.com/matrix-org/go-neb/services/jira"
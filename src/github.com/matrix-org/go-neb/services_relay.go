@@ -0,0 +1,6 @@
+//go:build !no_relay
+// +build !no_relay
+
+package main
+
+import _ "github.com/matrix-org/go-neb/services/relay"
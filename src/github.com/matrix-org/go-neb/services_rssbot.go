@@ -0,0 +1,6 @@
+//go:build !no_rssbot
+// +build !no_rssbot
+
+package main
+
+import _ "github.com/matrix-org/go-neb/services/rssbot"
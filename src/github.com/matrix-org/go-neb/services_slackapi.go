@@ -0,0 +1,6 @@
+//go:build !no_slackapi
+// +build !no_slackapi
+
+package main
+
+import _ "github.com/matrix-org/go-neb/services/slackapi"
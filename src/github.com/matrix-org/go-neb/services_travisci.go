@@ -0,0 +1,6 @@
+//go:build !no_travisci
+// +build !no_travisci
+
+package main
+
+import _ "github.com/matrix-org/go-neb/services/travisci"
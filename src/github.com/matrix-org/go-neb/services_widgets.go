@@ -0,0 +1,6 @@
+//go:build !no_widgets
+// +build !no_widgets
+
+package main
+
+import _ "github.com/matrix-org/go-neb/services/widgets"
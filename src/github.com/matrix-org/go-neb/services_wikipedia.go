@@ -0,0 +1,6 @@
+//go:build !no_wikipedia
+// +build !no_wikipedia
+
+package main
+
+import _ "github.com/matrix-org/go-neb/services/wikipedia"
@@ -3,6 +3,7 @@ package types
 import (
 	"regexp"
 	"strings"
+	"time"
 )
 
 // A Command is something that a user invokes by sending a message starting with '!'
@@ -13,7 +14,63 @@ type Command struct {
 	Path      []string
 	Arguments []string
 	Help      string
-	Command   func(roomID, userID string, arguments []string) (content interface{}, err error)
+	// Optional. If set, the command is not run until a second user approves it.
+	Approval *ApprovalPolicy
+	// Optional. If true, the responses of the command, including errors, are private unless the command
+	// returns a public Response.
+	Private bool
+	Command func(roomID, userID string, arguments []string) (content interface{}, err error)
+}
+
+// An ApprovalPolicy is the approval which a Command requires before it runs. When the command is
+// invoked, Go-NEB asks for approval in the room instead of running it. Another user in the room can
+// approve it with "!neb approve <id>" or by reacting to the request with 👍. The command is then run
+// as the user who invoked it, and who approved it is logged and announced in the room. Requests which
+// are not approved in time are discarded, as are all requests when Go-NEB restarts.
+type ApprovalPolicy struct {
+	// The power level which the approver needs in the room. Defaults to DefaultApprovalPowerLevel.
+	// A negative power level lets any other user approve.
+	PowerLevel int
+	// How long the command waits to be approved. Defaults to DefaultApprovalTimeout.
+	Timeout time.Duration
+}
+
+// DefaultApprovalTimeout is how long a command waits to be approved if its ApprovalPolicy has no timeout.
+const DefaultApprovalTimeout = 10 * time.Minute
+
+// DefaultApprovalPowerLevel is the power level which the approver needs if the ApprovalPolicy has no power
+// level. This is the power level of a moderator.
+const DefaultApprovalPowerLevel = 50
+
+// RequiredPowerLevel returns the power level which the approver needs in the room, or 0 if any other user
+// can approve.
+func (p *ApprovalPolicy) RequiredPowerLevel() int {
+	if p.PowerLevel == 0 {
+		return DefaultApprovalPowerLevel
+	} else if p.PowerLevel < 0 {
+		return 0
+	}
+	return p.PowerLevel
+}
+
+// A Response is the content of a command or expansion response along with whether it is private. Commands
+// and expansions can return a Response instead of the content to choose who sees each response. Private
+// responses are sent to the user who invoked the command in a direct message, with a short acknowledgement
+// in the room. Use them for output which not everyone in the room should see, such as auth links or issues
+// from restricted projects.
+type Response struct {
+	Content interface{}
+	Private bool
+}
+
+// PrivateResponse returns a Response which is only sent to the user who invoked the command.
+func PrivateResponse(content interface{}) Response {
+	return Response{Content: content, Private: true}
+}
+
+// PublicResponse returns a Response which is sent to the room, even if the command is private.
+func PublicResponse(content interface{}) Response {
+	return Response{Content: content}
 }
 
 // An Expansion is something that actives when the user sends any message
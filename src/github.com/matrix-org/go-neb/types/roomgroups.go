@@ -0,0 +1,494 @@
+package types
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// RoomGroupPrefix is the prefix of a reference to a named room group in a service config,
+// e.g. "group:ops". References can be used in place of rooms in the fields of a service which are
+// tagged as holding rooms. Each is replaced with the room IDs of the group when the config is expanded.
+const RoomGroupPrefix = "group:"
+
+// SpacePrefix is the prefix of a reference to a Matrix space in a service config, by room ID or
+// alias, e.g. "space:#team:localhost". References can be used wherever room group references can.
+// Each is replaced with the room IDs of the rooms in the space, including those in subspaces, when
+// the config is expanded.
+const SpacePrefix = "space:"
+
+// RoomsTag is the struct tag which marks the fields of a service config which hold rooms. Room group
+// and space references are only expanded in these fields, and only rooms in these fields are joined
+// on behalf of the service. A field tagged `rooms:"keys"` is an object keyed by room, e.g.
+//   Rooms map[string]RoomConfig `json:"rooms" rooms:"keys"`
+// and every string in a field tagged `rooms:"values"` is a room, e.g.
+//   RoomID string `json:"room_id" rooms:"values"`
+//   Targets map[string][]string `json:"targets" rooms:"values"`
+// Other strings, such as message templates, are left alone even if they look like references.
+const RoomsTag = "rooms"
+
+// ExpandRoomGroups replaces every room group reference in the JSON config of a service of the given
+// type with the room IDs of the group. When a reference is used as an object key, each room ID is given
+// a copy of its value, except for room IDs which are also listed explicitly in the same object. Returns
+// the names of the room groups which were referenced, or an error if a referenced group does not exist.
+func ExpandRoomGroups(serviceType string, config []byte, groups map[string][]string) ([]byte, []string, error) {
+	names := RoomGroupReferences(serviceType, config)
+	for _, name := range names {
+		if _, ok := groups[name]; !ok {
+			return nil, nil, fmt.Errorf("Unknown room group: %s", name)
+		}
+	}
+	expanded, err := expandReferences(serviceType, config, RoomGroupPrefix, groups)
+	if err != nil {
+		return nil, nil, err
+	}
+	return expanded, names, nil
+}
+
+// RoomGroupReferences returns the sorted names of the room groups referenced by the JSON config of a
+// service of the given type.
+func RoomGroupReferences(serviceType string, config []byte) []string {
+	return references(serviceType, config, RoomGroupPrefix)
+}
+
+// ExpandSpaces replaces every space reference in the JSON config with the rooms of the space, in the
+// same way as ExpandRoomGroups. The spaces map is keyed by the room ID or alias used in the reference.
+// Returns an error if the rooms of a referenced space are not in the map.
+func ExpandSpaces(serviceType string, config []byte, spaces map[string][]string) ([]byte, error) {
+	for _, space := range SpaceReferences(serviceType, config) {
+		if _, ok := spaces[space]; !ok {
+			return nil, fmt.Errorf("Unknown space: %s", space)
+		}
+	}
+	return expandReferences(serviceType, config, SpacePrefix, spaces)
+}
+
+// SpaceReferences returns the sorted room IDs and aliases of the spaces referenced by the JSON config
+// of a service of the given type.
+func SpaceReferences(serviceType string, config []byte) []string {
+	return references(serviceType, config, SpacePrefix)
+}
+
+// MergeExpanded returns the JSON of a stored service with each value which contains room group or
+// space references in config, the config which the service was created from, replaced by its value in
+// expanded, which is config with the references expanded again. Everything else in the stored service,
+// such as state which the service keeps about itself, is left as it is.
+func MergeExpanded(serviceType string, service, config, expanded []byte) ([]byte, error) {
+	s, err := decodeConfig(service)
+	if err != nil {
+		return nil, err
+	}
+	c, err := decodeConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	e, err := decodeConfig(expanded)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(merge(s, c, e, serviceConfigType(serviceType)))
+}
+
+// RoomIDs returns the sorted room IDs in the fields of the JSON config which hold rooms. Room IDs in
+// config which has not been expanded do not include those of any room groups or spaces it refers to.
+func RoomIDs(serviceType string, config []byte) []string {
+	v, err := decodeConfig(config)
+	if err != nil {
+		return nil
+	}
+	seen := make(map[string]bool)
+	visitRooms(v, serviceConfigType(serviceType), func(room string) {
+		if strings.HasPrefix(room, "!") && strings.Contains(room, ":") {
+			seen[room] = true
+		}
+	})
+	return sortedKeys(seen)
+}
+
+func references(serviceType string, config []byte, prefix string) []string {
+	v, err := decodeConfig(config)
+	if err != nil {
+		return nil
+	}
+	seen := make(map[string]bool)
+	visitRooms(v, serviceConfigType(serviceType), func(room string) {
+		if strings.HasPrefix(room, prefix) {
+			seen[strings.TrimPrefix(room, prefix)] = true
+		}
+	})
+	return sortedKeys(seen)
+}
+
+func sortedKeys(set map[string]bool) []string {
+	var keys []string
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func expandReferences(serviceType string, config []byte, prefix string, rooms map[string][]string) ([]byte, error) {
+	if len(references(serviceType, config, prefix)) == 0 {
+		return config, nil
+	}
+	v, err := decodeConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	expanded, err := expand(v, serviceConfigType(serviceType), prefix, rooms)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(expanded)
+}
+
+func decodeConfig(config []byte) (interface{}, error) {
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(config))
+	dec.UseNumber() // don't turn large numbers into floats
+	err := dec.Decode(&v)
+	return v, err
+}
+
+// configType is the Go type which a value in a service config is decoded into, and whether it holds rooms.
+type configType struct {
+	t reflect.Type // nil if the value isn't decoded into a known type, in which case it holds no rooms
+	// The keys of the object are rooms.
+	roomKeys bool
+	// Every string in the value is a room.
+	roomValues bool
+}
+
+// serviceConfigType returns the type of the config of services of the given type.
+func serviceConfigType(serviceType string) configType {
+	factory := servicesByType[serviceType]
+	if factory == nil {
+		return configType{}
+	}
+	return typeOf(reflect.TypeOf(factory("", "", "")), false)
+}
+
+func typeOf(t reflect.Type, roomValues bool) configType {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return configType{t: t, roomValues: roomValues}
+}
+
+// field returns the type of the value with the given key in an object of this type.
+func (c configType) field(key string) configType {
+	if c.t == nil {
+		return configType{}
+	}
+	switch c.t.Kind() {
+	case reflect.Map:
+		return typeOf(c.t.Elem(), c.roomValues)
+	case reflect.Struct:
+		f, ok := structField(c.t, key)
+		if !ok {
+			return configType{}
+		}
+		ct := typeOf(f.Type, c.roomValues)
+		switch f.Tag.Get(RoomsTag) {
+		case "keys":
+			ct.roomKeys = true
+		case "values":
+			ct.roomValues = true
+		}
+		return ct
+	}
+	return configType{}
+}
+
+// elem returns the type of the elements of an array of this type.
+func (c configType) elem() configType {
+	if c.t == nil || (c.t.Kind() != reflect.Slice && c.t.Kind() != reflect.Array) {
+		return configType{}
+	}
+	return typeOf(c.t.Elem(), c.roomValues)
+}
+
+// hasRoomKeys returns true if the keys of an object of this type are rooms.
+func (c configType) hasRoomKeys() bool {
+	return c.roomKeys && c.t != nil && c.t.Kind() == reflect.Map
+}
+
+// isRoom returns true if a string of this type is a room.
+func (c configType) isRoom() bool {
+	return c.roomValues && c.t != nil && c.t.Kind() == reflect.String
+}
+
+// structField returns the field of the struct which is set by the object key, matching names as
+// encoding/json does: exactly if possible, otherwise case-insensitively. The fields of embedded
+// structs are included.
+func structField(t reflect.Type, key string) (reflect.StructField, bool) {
+	var folded reflect.StructField
+	foundFolded := false
+	for _, f := range jsonFields(t) {
+		if f.name == key {
+			return f.field, true
+		}
+		if !foundFolded && strings.EqualFold(f.name, key) {
+			folded, foundFolded = f.field, true
+		}
+	}
+	return folded, foundFolded
+}
+
+type jsonField struct {
+	name  string
+	field reflect.StructField
+}
+
+// jsonFields returns the fields of the struct which are encoded as JSON, with their names.
+func jsonFields(t reflect.Type) []jsonField {
+	var fields []jsonField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if ft := typeOf(f.Type, false).t; f.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+			fields = append(fields, jsonFields(ft)...)
+			continue
+		}
+		if f.PkgPath != "" {
+			continue // unexported
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields = append(fields, jsonField{name, f})
+	}
+	return fields
+}
+
+// visitRooms calls fn with each object key and string in v which is in place of a room.
+func visitRooms(v interface{}, c configType, fn func(room string)) {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, child := range val {
+			if c.hasRoomKeys() {
+				fn(k)
+			}
+			visitRooms(child, c.field(k), fn)
+		}
+	case []interface{}:
+		for _, child := range val {
+			visitRooms(child, c.elem(), fn)
+		}
+	case string:
+		if c.isRoom() {
+			fn(val)
+		}
+	}
+}
+
+func expand(v interface{}, c configType, prefix string, rooms map[string][]string) (interface{}, error) {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		return expandObject(val, c, prefix, rooms)
+	case []interface{}:
+		return expandArray(val, c.elem(), prefix, rooms)
+	case string:
+		if isRoomReference(val, c, prefix) {
+			return expandRoom(val, prefix, rooms)
+		}
+	}
+	return v, nil
+}
+
+func expandObject(obj map[string]interface{}, c configType, prefix string, rooms map[string][]string) (interface{}, error) {
+	out := make(map[string]interface{})
+	var refKeys []string
+	for k, child := range obj {
+		if c.hasRoomKeys() && strings.HasPrefix(k, prefix) {
+			refKeys = append(refKeys, k)
+			continue
+		}
+		expanded, err := expand(child, c.field(k), prefix, rooms)
+		if err != nil {
+			return nil, err
+		}
+		out[k] = expanded
+	}
+	// Expand reference keys in a stable order so that the same config always expands the same way.
+	sort.Strings(refKeys)
+	for _, k := range refKeys {
+		for _, roomID := range rooms[strings.TrimPrefix(k, prefix)] {
+			if _, exists := out[roomID]; exists {
+				continue
+			}
+			// Give each room its own copy so services can't accidentally share state.
+			expanded, err := expand(obj[k], c.field(k), prefix, rooms)
+			if err != nil {
+				return nil, err
+			}
+			out[roomID] = expanded
+		}
+	}
+	return out, nil
+}
+
+// expandArray expands the elements of an array, whose elements have type elem.
+func expandArray(arr []interface{}, elem configType, prefix string, rooms map[string][]string) (interface{}, error) {
+	out := []interface{}{}
+	// Rooms listed both explicitly and in a reference are only listed once.
+	seen := make(map[string]bool)
+	addRoom := func(roomID string) {
+		if !seen[roomID] {
+			seen[roomID] = true
+			out = append(out, roomID)
+		}
+	}
+	hasRefs := false
+	for _, child := range arr {
+		hasRefs = hasRefs || isRoomReference(child, elem, prefix)
+	}
+	for _, child := range arr {
+		if isRoomReference(child, elem, prefix) {
+			for _, roomID := range rooms[strings.TrimPrefix(child.(string), prefix)] {
+				addRoom(roomID)
+			}
+			continue
+		}
+		expanded, err := expand(child, elem, prefix, rooms)
+		if err != nil {
+			return nil, err
+		}
+		if s, ok := expanded.(string); ok && hasRefs {
+			addRoom(s)
+			continue
+		}
+		out = append(out, expanded)
+	}
+	return out, nil
+}
+
+// expandRoom expands a reference which is used in place of a single room.
+func expandRoom(ref, prefix string, rooms map[string][]string) (interface{}, error) {
+	refRooms := rooms[strings.TrimPrefix(ref, prefix)]
+	if len(refRooms) != 1 {
+		return nil, fmt.Errorf("%s has %d rooms: it can only be used in place of a single room ID if it has exactly 1 room", ref, len(refRooms))
+	}
+	return refRooms[0], nil
+}
+
+// isRoomReference returns true if v is a string of type c which holds a room, and is a reference with the prefix.
+func isRoomReference(v interface{}, c configType, prefix string) bool {
+	s, ok := v.(string)
+	return ok && c.isRoom() && strings.HasPrefix(s, prefix)
+}
+
+func merge(stored, config, expanded interface{}, c configType) interface{} {
+	if stored == nil {
+		return expanded
+	}
+	if !hasReferences(config, c) {
+		return stored
+	}
+	switch cfg := config.(type) {
+	case map[string]interface{}:
+		st, sok := stored.(map[string]interface{})
+		ex, eok := expanded.(map[string]interface{})
+		if !sok || !eok {
+			return expanded
+		}
+		return mergeObject(st, cfg, ex, c)
+	case []interface{}:
+		st, sok := stored.([]interface{})
+		ex, eok := expanded.([]interface{})
+		if !sok || !eok || len(st) != len(cfg) || len(ex) != len(cfg) {
+			return expanded
+		}
+		return mergeArray(st, cfg, ex, c.elem())
+	}
+	return expanded
+}
+
+func mergeObject(stored, config, expanded map[string]interface{}, c configType) interface{} {
+	out := make(map[string]interface{})
+	refKeys := referenceKeys(config, c)
+	if len(refKeys) == 0 {
+		// The keys are fields, or rooms listed explicitly, so keep those which aren't in the config.
+		for k, v := range stored {
+			out[k] = v
+		}
+		for k, child := range config {
+			if hasReferences(child, c.field(k)) {
+				key := storedKey(stored, k)
+				out[key] = merge(stored[key], child, expanded[k], c.field(k))
+			}
+		}
+		return out
+	}
+	// The keys are rooms, so only keep the rooms which are still referenced.
+	for k, child := range expanded {
+		configChild, ok := config[k]
+		if !ok {
+			configChild = config[refKeys[0]]
+		}
+		out[k] = merge(stored[k], configChild, child, c.field(k))
+	}
+	return out
+}
+
+// mergeArray merges the elements of an array, whose elements have type elem.
+func mergeArray(stored, config, expanded []interface{}, elem configType) interface{} {
+	out := make([]interface{}, len(config))
+	for i := range config {
+		if s, ok := config[i].(string); ok && elem.isRoom() && isReference(s) {
+			return expanded
+		}
+		out[i] = merge(stored[i], config[i], expanded[i], elem)
+	}
+	return out
+}
+
+// referenceKeys returns the sorted keys of the object which are room group or space references.
+func referenceKeys(obj map[string]interface{}, c configType) []string {
+	if !c.hasRoomKeys() {
+		return nil
+	}
+	var refKeys []string
+	for k := range obj {
+		if isReference(k) {
+			refKeys = append(refKeys, k)
+		}
+	}
+	sort.Strings(refKeys)
+	return refKeys
+}
+
+// storedKey returns the key of the stored object which the config key sets. Field names in config
+// are matched case-insensitively, as encoding/json does.
+func storedKey(stored map[string]interface{}, key string) string {
+	if _, ok := stored[key]; ok {
+		return key
+	}
+	for k := range stored {
+		if strings.EqualFold(k, key) {
+			return k
+		}
+	}
+	return key
+}
+
+// hasReferences returns true if v, which has type c, contains room group or space references in place of rooms.
+func hasReferences(v interface{}, c configType) bool {
+	found := false
+	visitRooms(v, c, func(room string) {
+		found = found || isReference(room)
+	})
+	return found
+}
+
+func isReference(s string) bool {
+	return strings.HasPrefix(s, RoomGroupPrefix) || strings.HasPrefix(s, SpacePrefix)
+}
@@ -0,0 +1,141 @@
+package types
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const roomsTestType = "rooms-test"
+
+type roomsTestService struct {
+	DefaultService
+	CommandScope
+	Rooms map[string]struct {
+		X     int      `json:"x"`
+		Repos []string `json:"repos"`
+	} `json:"rooms" rooms:"keys"`
+	Feeds map[string]struct {
+		Rooms []string `json:"rooms" rooms:"values"`
+		Poll  []int    `json:"poll"`
+	} `json:"feeds"`
+	RoomID string `json:"room_id" rooms:"values"`
+	Topic  string `json:"topic"`
+}
+
+func (s *roomsTestService) ServiceType() string { return roomsTestType }
+
+func init() {
+	RegisterService(func(serviceID, serviceUserID, webhookEndpointURL string) Service {
+		return &roomsTestService{}
+	})
+}
+
+var roomGroups = map[string][]string{
+	"ops": {"!ops:hyrule", "!dev:hyrule"},
+	"one": {"!one:hyrule"},
+}
+
+var expandRoomGroupsTests = []struct {
+	config     string
+	wantConfig string
+	wantNames  []string
+}{
+	{ // no references
+		`{"rooms":{"!a:hyrule":{"x":1}}}`,
+		`{"rooms":{"!a:hyrule":{"x":1}}}`,
+		nil,
+	},
+	{ // map keys, with explicit rooms taking precedence
+		`{"rooms":{"group:ops":{"x":1},"!ops:hyrule":{"x":2}}}`,
+		`{"rooms":{"!ops:hyrule":{"x":2},"!dev:hyrule":{"x":1}}}`,
+		[]string{"ops"},
+	},
+	{ // lists, without duplicates
+		`{"feeds":{"http://a":{"rooms":["!ops:hyrule","group:ops","group:one"],"poll":[1,1]}}}`,
+		`{"feeds":{"http://a":{"rooms":["!ops:hyrule","!dev:hyrule","!one:hyrule"],"poll":[1,1]}}}`,
+		[]string{"one", "ops"},
+	},
+	{ // single room
+		`{"room_id":"group:one"}`,
+		`{"room_id":"!one:hyrule"}`,
+		[]string{"one"},
+	},
+	{ // only fields which hold rooms
+		`{"topic":"group:ops","rooms":{"!a:hyrule":{"repos":["group:ops"]}},"feeds":{"group:ops":{}}}`,
+		`{"topic":"group:ops","rooms":{"!a:hyrule":{"repos":["group:ops"]}},"feeds":{"group:ops":{}}}`,
+		nil,
+	},
+}
+
+func TestExpandRoomGroups(t *testing.T) {
+	for _, test := range expandRoomGroupsTests {
+		config, names, err := ExpandRoomGroups(roomsTestType, []byte(test.config), roomGroups)
+		if err != nil {
+			t.Errorf("TestExpandRoomGroups(%s) failed: %s", test.config, err)
+			continue
+		}
+		var got, want interface{}
+		json.Unmarshal(config, &got)
+		json.Unmarshal([]byte(test.wantConfig), &want)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("TestExpandRoomGroups(%s) want %s, got %s", test.config, test.wantConfig, config)
+		}
+		if !reflect.DeepEqual(names, test.wantNames) {
+			t.Errorf("TestExpandRoomGroups(%s) want names %v, got %v", test.config, test.wantNames, names)
+		}
+	}
+
+	for _, bad := range []string{`{"command_rooms":["group:missing"]}`, `{"room_id":"group:ops"}`} {
+		if _, _, err := ExpandRoomGroups(roomsTestType, []byte(bad), roomGroups); err == nil {
+			t.Errorf("TestExpandRoomGroups(%s) wanted an error", bad)
+		}
+	}
+}
+
+func TestExpandSpaces(t *testing.T) {
+	spaces := map[string][]string{"#team:hyrule": {"!ops:hyrule", "!dev:hyrule"}}
+	config, err := ExpandSpaces(roomsTestType, []byte(`{"rooms":{"space:#team:hyrule":{"x":1}},"command_rooms":["space:#team:hyrule"]}`), spaces)
+	if err != nil {
+		t.Fatalf("TestExpandSpaces failed: %s", err)
+	}
+	want := `{"command_rooms":["!ops:hyrule","!dev:hyrule"],"rooms":{"!dev:hyrule":{"x":1},"!ops:hyrule":{"x":1}}}`
+	if string(config) != want {
+		t.Errorf("TestExpandSpaces want %s, got %s", want, config)
+	}
+	if _, err := ExpandSpaces(roomsTestType, []byte(`{"command_rooms":["space:!unknown:hyrule"]}`), spaces); err == nil {
+		t.Errorf("TestExpandSpaces wanted an error for an unknown space")
+	}
+}
+
+func TestMergeExpanded(t *testing.T) {
+	config := `{"feeds":{"http://a":{"rooms":["group:ops"]}},"rooms":{"group:ops":{"x":1}},"room_id":"!one:hyrule"}`
+	service := `{"Feeds":{"http://a":{"Rooms":["!old:hyrule"],"RecentGUIDs":["1"]}},"Rooms":{"!old:hyrule":{"x":1},` +
+		`"!dev:hyrule":{"x":1,"seen":2}},"RoomID":"!one:hyrule","LastPoll":5}`
+	expanded, _, err := ExpandRoomGroups(roomsTestType, []byte(config), roomGroups)
+	if err != nil {
+		t.Fatalf("TestMergeExpanded failed to expand: %s", err)
+	}
+	merged, err := MergeExpanded(roomsTestType, []byte(service), []byte(config), expanded)
+	if err != nil {
+		t.Fatalf("TestMergeExpanded failed: %s", err)
+	}
+	want := `{"Feeds":{"http://a":{"RecentGUIDs":["1"],"Rooms":["!ops:hyrule","!dev:hyrule"]}},"LastPoll":5,` +
+		`"RoomID":"!one:hyrule","Rooms":{"!dev:hyrule":{"seen":2,"x":1},"!ops:hyrule":{"x":1}}}`
+	if string(merged) != want {
+		t.Errorf("TestMergeExpanded want %s, got %s", want, merged)
+	}
+}
+
+func TestRoomIDs(t *testing.T) {
+	config := `{"rooms":{"!ops:hyrule":{"repos":["!not:a_room"]}},"command_rooms":["!dev:hyrule","!ops:hyrule"],` +
+		`"topic":"!not:a_room","n":1}`
+	want := "!dev:hyrule,!ops:hyrule"
+	if got := strings.Join(RoomIDs(roomsTestType, []byte(config)), ","); got != want {
+		t.Errorf("TestRoomIDs want %s, got %s", want, got)
+	}
+	if got := RoomIDs("not-a-type", []byte(config)); len(got) != 0 {
+		t.Errorf("TestRoomIDs want no rooms for an unknown service type, got %v", got)
+	}
+}
@@ -1,10 +1,13 @@
 package types
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
+	"sort"
 	"strings"
 	"time"
 
@@ -26,6 +29,181 @@ type Poller interface {
 	OnPoll(client *gomatrix.Client) time.Time
 }
 
+// MessageObserver represents a thing which wants to see room messages. Services should implement this method
+// signature to be told about every m.room.message event received by their service user, including notices
+// and messages which are not commands.
+type MessageObserver interface {
+	// OnMessageEvent is called for each m.room.message event in a room the service user is joined to.
+	OnMessageEvent(client *gomatrix.Client, event *gomatrix.Event)
+}
+
+// RedactionObserver represents a thing which wants to see redactions. Services should implement this method
+// signature to be told about every m.room.redaction event received by their service user.
+type RedactionObserver interface {
+	// OnRedactionEvent is called for each m.room.redaction event in a room the service user is joined to.
+	OnRedactionEvent(client *gomatrix.Client, event *gomatrix.Event)
+}
+
+// ClientDependent represents a thing which uses the clients of other users as well as the client of its
+// service user. Services should implement this method signature if they read or send messages as other
+// users, so that they are told about the events received by those clients and those clients are not
+// removed whilst they are still in use. Use ServiceClient to get the clients.
+type ClientDependent interface {
+	// ClientUserIDs returns the user IDs of every client which this service uses.
+	ClientUserIDs() []string
+}
+
+// UsesClient returns true if the service uses the client of the given user as well as that of its
+// service user, according to ClientDependent.
+func UsesClient(service Service, userID string) bool {
+	dependent, ok := service.(ClientDependent)
+	if !ok {
+		return false
+	}
+	for _, id := range dependent.ClientUserIDs() {
+		if id == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// RealmDependent represents a thing which depends on auth realms. Services should implement this method signature
+// if their config refers to auth realms, so that those realms are not removed whilst they are still in use.
+type RealmDependent interface {
+	// RealmIDs returns the IDs of every auth realm which this service refers to.
+	RealmIDs() []string
+}
+
+// WebhookTester represents a thing which can generate sample webhook requests. Services which receive
+// notifications via webhooks should implement this method signature so that admins can check which rooms
+// their notifications reach without having to trigger a real event upstream.
+type WebhookTester interface {
+	// TestWebhookRequests returns representative requests which, when passed to OnReceiveWebhook, will
+	// notify the configured rooms. Return one request for each distinct thing that rooms can be configured
+	// to listen for (e.g. one per repository) so that every configured room can be reached.
+	TestWebhookRequests() ([]*http.Request, error)
+}
+
+// A RouteAuth says who can request a WebhookRoute.
+type RouteAuth int
+
+const (
+	// RouteAuthNone lets anyone request the route, as with OnReceiveWebhook. The handler must check
+	// any signature or secret itself.
+	RouteAuthNone RouteAuth = iota
+	// RouteAuthAdmin only lets requests with the admin token, or with the access token of the tenant
+	// which owns the service, request the route. The token is sent as "Authorization: Bearer <token>".
+	RouteAuthAdmin
+)
+
+// A WebhookRoute is an HTTP route which a service serves below its webhook endpoint URL.
+type WebhookRoute struct {
+	// The path of the route below the webhook endpoint URL, e.g. "oauth/callback" is served at
+	// "<webhook endpoint URL>/oauth/callback". It must not start or end with "/".
+	Path string
+	// The HTTP method of the route, e.g. "GET". A service can declare routes with the same path and
+	// different methods. Requests with other methods get HTTP 405.
+	Method string
+	// Who can request the route.
+	Auth RouteAuth
+	// The function which handles requests to the route, with a Client instance for ServiceUserID().
+	Handler func(w http.ResponseWriter, req *http.Request, cli *gomatrix.Client)
+}
+
+// WebhookRouter represents a thing which serves HTTP routes below its webhook endpoint URL. Services
+// which need more than OnReceiveWebhook, e.g. for OAuth callbacks or feed exports, should implement
+// this method signature instead of parsing the request path themselves. Requests to the webhook
+// endpoint URL itself are still passed to OnReceiveWebhook.
+type WebhookRouter interface {
+	WebhookRoutes() []WebhookRoute
+}
+
+// RoomReporter represents a thing which can describe what it sends to a room. Services which send
+// notifications should implement this method signature so that "!neb status" can tell room members what
+// is routed to their room.
+type RoomReporter interface {
+	// RoomTargets returns a short description of each thing which is routed to the room, e.g. one
+	// "owner/repo (push, issues)" per repository. Return nil if nothing is routed to the room.
+	RoomTargets(roomID string) []string
+}
+
+// FeedReader represents a thing which reads feeds on behalf of rooms. Services which poll feeds should
+// implement this method signature so that tenants can be limited in how many feeds they read.
+type FeedReader interface {
+	// FeedURLs returns the URLs of the feeds which are read.
+	FeedURLs() []string
+}
+
+// SecretHider represents a thing whose config holds secrets which Go-NEB generates, such as keys used to
+// sign links. Services should implement this method signature so that those secrets are stored with the
+// service but are not included in admin API responses.
+type SecretHider interface {
+	// WithoutSecrets returns a copy of the service with its secrets removed. The service itself must not
+	// be modified.
+	WithoutSecrets() Service
+}
+
+// CommandScoper represents a thing whose commands and expansions can only be used in some rooms.
+// CommandScope implements this using the "command_rooms" of the service config.
+type CommandScoper interface {
+	// InCommandScope returns true if commands and expansions can be used in the given room.
+	InCommandScope(roomID string) bool
+	// HasCommandScope returns true if commands and expansions are limited to some rooms, rather than
+	// being usable in every room.
+	HasCommandScope() bool
+}
+
+// CommandScope implements CommandScoper. Services with commands or expansions should embed it alongside
+// DefaultService so that admins can choose the rooms they are used in.
+type CommandScope struct {
+	// The rooms in which the commands and expansions of the service can be used. Room group and space
+	// references are expanded in it, so "space:#team:localhost" scopes them to any room in that space. If empty, they can be used in any room.
+	CommandRooms []string `json:"command_rooms,omitempty" rooms:"values"`
+}
+
+// InCommandScope returns true if the commands and expansions of the service can be used in the room,
+// according to the "command_rooms" of the service config.
+func (s *CommandScope) InCommandScope(roomID string) bool {
+	if len(s.CommandRooms) == 0 {
+		return true
+	}
+	for _, r := range s.CommandRooms {
+		if r == roomID {
+			return true
+		}
+	}
+	return false
+}
+
+// HasCommandScope returns true if the service config has "command_rooms".
+func (s *CommandScope) HasCommandScope() bool {
+	return len(s.CommandRooms) > 0
+}
+
+// FailoverSender represents a thing which can send as other users when its service user can't send to a room.
+// DefaultService implements this using the "failover_user_ids" of the service config.
+type FailoverSender interface {
+	// FailoverUsers returns the user IDs of the clients to send as, in order of preference, when the
+	// service user can't send to a room.
+	FailoverUsers() []string
+}
+
+type testRequestKey struct{}
+
+// AsTestRequest returns a copy of req which is marked as a synthetic test request. Such requests are
+// generated by Go-NEB itself rather than received from an upstream service.
+func AsTestRequest(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), testRequestKey{}, true))
+}
+
+// IsTestRequest returns true if req is a synthetic test request. Services may skip checks which only
+// the real upstream service can satisfy, such as verifying a signature made with a private key.
+func IsTestRequest(req *http.Request) bool {
+	isTest, _ := req.Context().Value(testRequestKey{}).(bool)
+	return isTest
+}
+
 // A Service is the configuration for a bot service.
 type Service interface {
 	// Return the user ID of this service.
@@ -54,11 +232,15 @@ type DefaultService struct {
 	id            string
 	serviceUserID string
 	serviceType   string
+	// The user IDs of the clients to send as, in order of preference, when the service user is
+	// rate-limited, has been kicked from a room or has had its access token revoked. Each is tried
+	// per room, so the service keeps sending as its service user wherever it can.
+	FailoverUserIDs []string `json:"failover_user_ids,omitempty"`
 }
 
 // NewDefaultService creates a new service with implementations for ServiceID(), ServiceType() and ServiceUserID()
 func NewDefaultService(serviceID, serviceUserID, serviceType string) DefaultService {
-	return DefaultService{serviceID, serviceUserID, serviceType}
+	return DefaultService{id: serviceID, serviceUserID: serviceUserID, serviceType: serviceType}
 }
 
 // ServiceID returns the service's ID. In order for this to return the ID, DefaultService MUST have been
@@ -81,6 +263,11 @@ func (s *DefaultService) ServiceType() string {
 	return s.serviceType
 }
 
+// FailoverUsers returns the "failover_user_ids" of the service config.
+func (s *DefaultService) FailoverUsers() []string {
+	return s.FailoverUserIDs
+}
+
 // Commands returns no commands.
 func (s *DefaultService) Commands(cli *gomatrix.Client) []Command {
 	return []Command{}
@@ -102,6 +289,22 @@ func (s *DefaultService) OnReceiveWebhook(w http.ResponseWriter, req *http.Reque
 	w.WriteHeader(200) // Do nothing
 }
 
+var clientLookup func(userID string) (*gomatrix.Client, error)
+
+// SetClientLookup sets the function which ServiceClient uses to get clients.
+func SetClientLookup(lookup func(userID string) (*gomatrix.Client, error)) {
+	clientLookup = lookup
+}
+
+// ServiceClient returns the client for the given user ID. Services which implement ClientDependent
+// use this to get the clients of users other than their service user.
+func ServiceClient(userID string) (*gomatrix.Client, error) {
+	if clientLookup == nil {
+		return nil, errors.New("no clients are available")
+	}
+	return clientLookup(userID)
+}
+
 var baseURL = ""
 
 // BaseURL sets the base URL of NEB to the url given. This URL must be accessible from the
@@ -122,6 +325,7 @@ func BaseURL(u string) error {
 
 var servicesByType = map[string]func(string, string, string) Service{}
 var serviceTypesWhichPoll = map[string]bool{}
+var serviceTypesWithClients = map[string]bool{}
 
 // RegisterService registers a factory for creating Service instances.
 func RegisterService(factory func(string, string, string) Service) {
@@ -131,23 +335,79 @@ func RegisterService(factory func(string, string, string) Service) {
 	if _, ok := s.(Poller); ok {
 		serviceTypesWhichPoll[s.ServiceType()] = true
 	}
+	if _, ok := s.(ClientDependent); ok {
+		serviceTypesWithClients[s.ServiceType()] = true
+	}
 }
 
-// PollingServiceTypes returns a list of service types which meet the Poller interface
+// PollingServiceTypes returns a list of enabled service types which meet the Poller interface
 func PollingServiceTypes() (types []string) {
 	for t := range serviceTypesWhichPoll {
+		if ServiceTypeEnabled(t) {
+			types = append(types, t)
+		}
+	}
+	return
+}
+
+// ClientDependentServiceTypes returns a list of enabled service types which meet the ClientDependent interface
+func ClientDependentServiceTypes() (types []string) {
+	for t := range serviceTypesWithClients {
+		if ServiceTypeEnabled(t) {
+			types = append(types, t)
+		}
+	}
+	return
+}
+
+// enabledServiceTypes is the set of service types which can be created. If nil, every registered
+// type can be created.
+var enabledServiceTypes map[string]bool
+
+// EnableServiceTypes restricts the service types which can be created to the given types. By default
+// every registered type can be created. Returns an error if a type is not registered, e.g. because its
+// package was excluded at build time.
+func EnableServiceTypes(serviceTypes []string) error {
+	enabled := make(map[string]bool)
+	for _, t := range serviceTypes {
+		if servicesByType[t] == nil {
+			return fmt.Errorf("Unknown service type: %s", t)
+		}
+		enabled[t] = true
+	}
+	enabledServiceTypes = enabled
+	return nil
+}
+
+// ServiceTypeRegistered returns true if the service type was built into this binary.
+func ServiceTypeRegistered(serviceType string) bool {
+	return servicesByType[serviceType] != nil
+}
+
+// ServiceTypeEnabled returns true if services of the given type can be created.
+func ServiceTypeEnabled(serviceType string) bool {
+	return ServiceTypeRegistered(serviceType) && (enabledServiceTypes == nil || enabledServiceTypes[serviceType])
+}
+
+// ServiceTypes returns the sorted list of service types which were built into this binary.
+func ServiceTypes() (types []string) {
+	for t := range servicesByType {
 		types = append(types, t)
 	}
+	sort.Strings(types)
 	return
 }
 
 // CreateService creates a Service of the given type and serviceID.
-// Returns an error if the Service couldn't be created.
+// Returns an error if the Service couldn't be created, including if its type is disabled.
 func CreateService(serviceID, serviceType, serviceUserID string, serviceJSON []byte) (Service, error) {
 	f := servicesByType[serviceType]
 	if f == nil {
 		return nil, errors.New("Unknown service type: " + serviceType)
 	}
+	if !ServiceTypeEnabled(serviceType) {
+		return nil, errors.New("Disabled service type: " + serviceType)
+	}
 
 	base64ServiceID := base64.RawURLEncoding.EncodeToString([]byte(serviceID))
 	webhookEndpointURL := baseURL + "services/hooks/" + base64ServiceID
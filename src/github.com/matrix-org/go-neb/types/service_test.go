@@ -0,0 +1,46 @@
+package types
+
+import (
+	"testing"
+)
+
+type enabledTestService struct {
+	DefaultService
+}
+
+func (s *enabledTestService) ServiceType() string { return "enabled-test" }
+
+type disabledTestService struct {
+	DefaultService
+}
+
+func (s *disabledTestService) ServiceType() string { return "disabled-test" }
+
+func TestEnableServiceTypes(t *testing.T) {
+	RegisterService(func(serviceID, serviceUserID, webhookEndpointURL string) Service {
+		return &enabledTestService{}
+	})
+	RegisterService(func(serviceID, serviceUserID, webhookEndpointURL string) Service {
+		return &disabledTestService{}
+	})
+	defer func() { enabledServiceTypes = nil }()
+
+	if err := EnableServiceTypes([]string{"enabled-test", "not-built"}); err == nil {
+		t.Errorf("TestEnableServiceTypes: wanted an error for an unregistered type")
+	}
+	if err := EnableServiceTypes([]string{"enabled-test"}); err != nil {
+		t.Fatalf("TestEnableServiceTypes: EnableServiceTypes failed: %s", err)
+	}
+	if !ServiceTypeEnabled("enabled-test") || ServiceTypeEnabled("disabled-test") || ServiceTypeEnabled("not-built") {
+		t.Errorf("TestEnableServiceTypes: wanted only enabled-test to be enabled")
+	}
+	if !ServiceTypeRegistered("disabled-test") {
+		t.Errorf("TestEnableServiceTypes: wanted disabled-test to still be registered")
+	}
+	if _, err := CreateService("id", "enabled-test", "@neb:hyrule", []byte(`{}`)); err != nil {
+		t.Errorf("TestEnableServiceTypes: CreateService of an enabled type failed: %s", err)
+	}
+	if _, err := CreateService("id", "disabled-test", "@neb:hyrule", []byte(`{}`)); err == nil {
+		t.Errorf("TestEnableServiceTypes: wanted CreateService of a disabled type to fail")
+	}
+}